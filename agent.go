@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxPendingResults bounds the results kept for retry while the controller is unreachable.
+const maxPendingResults = 10000
+
+type agentConfig struct {
+	ID            string `yaml:"id"`
+	ControllerURL string `yaml:"controller-url"`
+	Key           string `yaml:"key"`
+	CACert        string `yaml:"ca-cert"`
+}
+
+// controllerClient pulls the agent's endpoint assignments from the controller and pushes the results back.
+type controllerClient struct {
+	config     agentConfig
+	hostname   string
+	client     *http.Client
+	registered bool
+	servers    []perfServer
+	mu         sync.Mutex
+	pending    []measurement
+}
+
+var controller *controllerClient
+
+// mergeAgentFlags fills any agent settings missing from the configuration file with the CLI values.
+func mergeAgentFlags(ac *agentConfig) {
+	if ac.ID == "" {
+		ac.ID = cliFlags.agentID
+	}
+	if ac.ControllerURL == "" {
+		ac.ControllerURL = cliFlags.controllerURL
+	}
+	if ac.Key == "" {
+		ac.Key = cliFlags.agentKey
+	}
+	if ac.CACert == "" {
+		ac.CACert = cliFlags.controllerCA
+	}
+}
+
+// initAgent sets up the controller client if a controller URL was configured, the agent ID defaults to the hostname.
+func initAgent(ac agentConfig, hostname string) error {
+	if ac.ControllerURL == "" {
+		return nil
+	}
+	if ac.Key == "" {
+		return fmt.Errorf("an agent key is required to connect to the controller")
+	}
+	if ac.ID == "" {
+		ac.ID = hostname
+	}
+	tlsConfig := &tls.Config{}
+	if ac.CACert != "" {
+		pem, err := os.ReadFile(ac.CACert)
+		if err != nil {
+			return fmt.Errorf("could not read the controller CA certificate: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", ac.CACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	controller = &controllerClient{
+		config:   ac,
+		hostname: hostname,
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: tlsConfig,
+			},
+		},
+	}
+	log.Debugf("[Config] Controller = %s as agent %s", ac.ControllerURL, ac.ID)
+	if err := controller.register(); err != nil {
+		log.Errorf("Error registering with the controller, retrying next cycle: %v", err)
+	}
+	return nil
+}
+
+// register announces the agent to the controller.
+func (c *controllerClient) register() error {
+	err := c.do("POST", "/v1/register", agentRecord{Hostname: c.hostname, Version: version}, nil)
+	if err == nil {
+		c.registered = true
+		log.Infof("Registered with the controller at %s as agent %s", c.config.ControllerURL, c.config.ID)
+	}
+	return err
+}
+
+// assignments returns the endpoints assigned to this agent, the previous assignment is kept if the controller
+// can't be reached and the local endpoints are used until the first assignment arrives.
+func (c *controllerClient) assignments(local []perfServer) []perfServer {
+	if !c.registered {
+		if err := c.register(); err != nil {
+			log.Errorf("Error registering with the controller: %v", err)
+		}
+	}
+	var servers []perfServer
+	if err := c.do("GET", "/v1/assignments", nil, &servers); err != nil {
+		log.Errorf("Error pulling the endpoint assignments from the controller: %v", err)
+		if c.servers == nil {
+			return local
+		}
+		return c.servers
+	}
+	c.servers = servers
+	log.Debugf("Assigned %d endpoints by the controller", len(servers))
+	return servers
+}
+
+// add queues a result to push to the controller.
+func (c *controllerClient) add(m measurement) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending = append(c.pending, m)
+	if len(c.pending) > maxPendingResults {
+		c.pending = c.pending[len(c.pending)-maxPendingResults:]
+	}
+}
+
+// flush pushes the queued results, they are kept for the next cycle if the push fails.
+func (c *controllerClient) flush() {
+	c.mu.Lock()
+	batch := c.pending
+	c.pending = nil
+	c.mu.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+	if err := c.do("POST", "/v1/results", batch, nil); err != nil {
+		log.Errorf("Error pushing %d results to the controller, retrying next cycle: %v", len(batch), err)
+		c.mu.Lock()
+		c.pending = append(batch, c.pending...)
+		c.mu.Unlock()
+		return
+	}
+	log.Debugf("Pushed %d results to the controller", len(batch))
+}
+
+// do sends an authenticated JSON request to the controller and decodes the JSON response.
+func (c *controllerClient) do(method string, path string, body interface{}, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, strings.TrimRight(c.config.ControllerURL, "/")+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.config.Key)
+	req.Header.Set(agentIDHeader, c.config.ID)
+
+	resp, err := auditedDo(c.client, "controller", req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(respBody))
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(respBody, result)
+}
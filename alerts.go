@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	alertThreshold = "threshold"
+	alertAnomaly   = "anomaly"
+	alertSLA       = "sla"
+)
+
+// alertsConfig emits an SNMP trap or a syslog event when an alert fires, for the NOCs whose incident workflow keys
+// off traps and syslog rather than webhooks. The alerts are a result below the threshold, the anomalies and the SLA
+// breaches.
+type alertsConfig struct {
+	// Threshold is the bandwidth a full rate result below fires a threshold alert, with an optional K/M/G suffix.
+	Threshold string       `yaml:"threshold"`
+	SNMP      snmpConfig   `yaml:"snmp"`
+	Syslog    syslogConfig `yaml:"syslog"`
+}
+
+// alertEvent is a fired alert. Value is the result in bps and Limit the threshold or the anomaly baseline it broke.
+type alertEvent struct {
+	Name        string
+	Timestamp   time.Time
+	Source      string
+	Destination string
+	Address     string
+	Direction   string
+	Engine      string
+	Value       int64
+	Limit       float64
+	Message     string
+}
+
+// alertSink sends the alerts to the configured trap receiver and syslog server.
+type alertSink struct {
+	threshold float64
+	snmp      *snmpSender
+	syslog    *syslogSender
+}
+
+var alerts *alertSink
+
+// mergeAlertsFlags fills any alert settings missing from the configuration file with the CLI values.
+func mergeAlertsFlags(ac *alertsConfig) {
+	if ac.Threshold == "" {
+		ac.Threshold = cliFlags.alertThreshold
+	}
+	if ac.SNMP.Target == "" {
+		ac.SNMP.Target = cliFlags.snmpTarget
+	}
+	if ac.SNMP.Community == "" {
+		ac.SNMP.Community = cliFlags.snmpCommunity
+	}
+	if ac.Syslog.Address == "" {
+		ac.Syslog.Address = cliFlags.syslogAddress
+	}
+	if ac.SNMP.Version == "" {
+		ac.SNMP.Version = snmpVersion2c
+	}
+	if ac.SNMP.Community == "" {
+		ac.SNMP.Community = defaultSNMPCommunity
+	}
+	if ac.SNMP.OID == "" {
+		ac.SNMP.OID = defaultSNMPOID
+	}
+	if ac.SNMP.AuthProtocol == "" {
+		ac.SNMP.AuthProtocol = snmpAuthSHA
+	}
+	if ac.SNMP.PrivProtocol == "" {
+		ac.SNMP.PrivProtocol = snmpPrivAES
+	}
+	if ac.Syslog.Protocol == "" {
+		ac.Syslog.Protocol = syslogUDP
+	}
+	if ac.Syslog.Facility == "" {
+		ac.Syslog.Facility = "daemon"
+	}
+	if ac.Syslog.AppName == "" {
+		ac.Syslog.AppName = defaultSyslogApp
+	}
+}
+
+// validateAlerts checks the threshold and the trap and syslog destinations.
+func validateAlerts(ac alertsConfig) []error {
+	var errs []error
+	if ac.Threshold != "" {
+		if _, err := parseBandwidth(ac.Threshold); err != nil {
+			errs = append(errs, fmt.Errorf("alerts threshold: %v", err))
+		}
+	}
+	errs = append(errs, validateSNMP(ac.SNMP)...)
+	errs = append(errs, validateSyslog(ac.Syslog)...)
+	return errs
+}
+
+// initAlerts sets up the alert destinations if a trap receiver or a syslog server was configured.
+func initAlerts(ac alertsConfig, hostname string) error {
+	if ac.SNMP.Target == "" && ac.Syslog.Address == "" {
+		return nil
+	}
+	sink := &alertSink{}
+	if ac.Threshold != "" {
+		threshold, err := parseBandwidth(ac.Threshold)
+		if err != nil {
+			return fmt.Errorf("alerts threshold: %v", err)
+		}
+		sink.threshold = threshold
+	}
+	if ac.SNMP.Target != "" {
+		sender, err := newSNMPSender(ac.SNMP, hostname)
+		if err != nil {
+			return err
+		}
+		sink.snmp = sender
+	}
+	if ac.Syslog.Address != "" {
+		sink.syslog = newSyslogSender(ac.Syslog, hostname)
+		log.Debugf("[Config] Alert Syslog = %s over %s", sink.syslog.address, sink.syslog.config.Protocol)
+	}
+	alerts = sink
+	return nil
+}
+
+// testResult fires a threshold alert for a full rate result below the threshold.
+func (a *alertSink) testResult(config configuration, eng engine, server perfServer, direction string, bps int64, bandwidth string) {
+	if a.threshold <= 0 || bandwidth != "" || float64(bps) >= a.threshold {
+		return
+	}
+	a.fire(alertEvent{
+		Name:        alertThreshold,
+		Timestamp:   measurementTime(),
+		Source:      config.Hostname,
+		Destination: server.displayName(),
+		Address:     server.Address,
+		Direction:   direction,
+		Engine:      eng.name,
+		Value:       bps,
+		Limit:       a.threshold,
+		Message:     fmt.Sprintf("%s throughput to %s [%s] of %d bps is below the threshold of %.0f bps", direction, server.Address, server.displayName(), bps, a.threshold),
+	})
+}
+
+// fire sends an alert to every destination, a failed send is logged and doesn't stop the others.
+func (a *alertSink) fire(event alertEvent) {
+	if a.snmp != nil {
+		if err := a.snmp.send(event); err != nil {
+			log.Errorf("Error sending the %s trap of %s to %s: %v", event.Name, event.Destination, a.snmp.address, err)
+		}
+	}
+	if a.syslog != nil {
+		if err := a.syslog.send(event); err != nil {
+			log.Errorf("Error sending the %s syslog event of %s to %s: %v", event.Name, event.Destination, a.syslog.address, err)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// annotation is a grafana region annotation covering the failed or degraded tests to one endpoint in a cycle.
+type annotation struct {
+	start time.Time
+	end   time.Time
+	tags  []string
+	texts []string
+}
+
+// annotationSink batches annotations per endpoint and writes them to grafana at the end of every cycle.
+type annotationSink struct {
+	config    grafanaConfig
+	threshold float64
+	mu        sync.Mutex
+	pending   map[string]*annotation
+	order     []string
+}
+
+var annotations *annotationSink
+
+// initAnnotations sets up the grafana annotation sink if annotations were enabled.
+func initAnnotations(gc grafanaConfig) error {
+	if !gc.Annotations {
+		return nil
+	}
+	if gc.URL == "" || gc.Token == "" {
+		return fmt.Errorf("grafana annotations require a grafana url and token")
+	}
+	var threshold float64
+	if gc.AnnotationThreshold != "" {
+		var err error
+		if threshold, err = parseBandwidth(gc.AnnotationThreshold); err != nil {
+			return fmt.Errorf("invalid grafana annotation-threshold: %v", err)
+		}
+	}
+	annotations = &annotationSink{config: gc, threshold: threshold, pending: make(map[string]*annotation)}
+	log.Debugf("[Config] Grafana Annotations = %s", gc.URL)
+	return nil
+}
+
+// testFailed annotates a failed test to an endpoint.
+func (a *annotationSink) testFailed(server perfServer, direction string, start time.Time, reason string) {
+	a.add(server, start, "error:failed", fmt.Sprintf("%s test failed: %s", direction, reason))
+}
+
+// testResult annotates a full rate test result below the annotation threshold.
+func (a *annotationSink) testResult(server perfServer, direction string, start time.Time, bps int64, bandwidth string) {
+	if a.threshold <= 0 || bandwidth != "" || float64(bps) >= a.threshold {
+		return
+	}
+	a.add(server, start, "error:threshold", fmt.Sprintf("%s %d bps is below the threshold of %s", direction, bps, a.config.AnnotationThreshold))
+}
+
+// add merges an event into the pending annotation of the endpoint, widening its region to the end of this test.
+func (a *annotationSink) add(server perfServer, start time.Time, tag string, text string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	pending, ok := a.pending[server.Address]
+	if !ok {
+		pending = &annotation{start: start, tags: []string{"cloud-bandwidth", "endpoint:" + server.displayName()}}
+		a.pending[server.Address] = pending
+		a.order = append(a.order, server.Address)
+	}
+	pending.end = time.Now()
+	if !containsString(pending.tags, tag) {
+		pending.tags = append(pending.tags, tag)
+	}
+	pending.texts = append(pending.texts, text)
+}
+
+// flush writes the pending annotations, grafana has no bulk API so each endpoint's annotation is one request.
+func (a *annotationSink) flush() {
+	a.mu.Lock()
+	pending, order := a.pending, a.order
+	a.pending = make(map[string]*annotation)
+	a.order = nil
+	a.mu.Unlock()
+
+	for _, address := range order {
+		ann := pending[address]
+		body, err := json.Marshal(map[string]interface{}{
+			"time":    ann.start.UnixNano() / 1e6,
+			"timeEnd": ann.end.UnixNano() / 1e6,
+			"tags":    ann.tags,
+			"text":    strings.Join(ann.texts, "\n"),
+		})
+		if err != nil {
+			log.Errorf("Error encoding the grafana annotation: %v", err)
+			continue
+		}
+		if err := grafanaRequest(a.config, "POST", "/api/annotations", body, nil); err != nil {
+			log.Errorf("Error writing the grafana annotation for %s: %v", address, err)
+		}
+	}
+}
+
+// parseBandwidth converts a bandwidth such as 500K, 50M or 1.5G to bits per second.
+func parseBandwidth(value string) (float64, error) {
+	if !bandwidthPattern.MatchString(value) {
+		return 0, fmt.Errorf("%q must be a number with an optional K, M or G suffix", value)
+	}
+	multiplier := 1.0
+	switch strings.ToUpper(value[len(value)-1:]) {
+	case "K":
+		multiplier = 1e3
+	case "M":
+		multiplier = 1e6
+	case "G":
+		multiplier = 1e9
+	}
+	number, err := strconv.ParseFloat(strings.TrimRight(value, "KMGkmg"), 64)
+	if err != nil {
+		return 0, err
+	}
+	return number * multiplier, nil
+}
+
+// containsString reports whether the slice contains the value.
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
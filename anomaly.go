@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	anomalyMedian = "median"
+	anomalyEWMA   = "ewma"
+	// anomalyMinHistory is the number of results needed before a baseline is trusted.
+	anomalyMinHistory = 3
+)
+
+type anomalyConfig struct {
+	Drop    string `yaml:"drop"`
+	Window  string `yaml:"window"`
+	Method  string `yaml:"method"`
+	Webhook string `yaml:"webhook"`
+}
+
+// anomalyEvent is the webhook payload sent when a result drops below its baseline.
+type anomalyEvent struct {
+	Timestamp   time.Time `json:"timestamp"`
+	Source      string    `json:"source"`
+	Destination string    `json:"destination"`
+	Address     string    `json:"address"`
+	Direction   string    `json:"direction"`
+	Engine      string    `json:"engine"`
+	Bps         int64     `json:"bps"`
+	Baseline    float64   `json:"baseline"`
+	DropPercent float64   `json:"drop-percent"`
+	// ChangePercent is the change from the endpoint's previous result, a sudden drop rather than a slow slide.
+	ChangePercent *float64 `json:"change-percent,omitempty"`
+}
+
+// anomalyBaselines holds the recent full rate results and the EWMA per endpoint, direction and engine.
+var anomalyBaselines = struct {
+	sync.Mutex
+	history map[string][]float64
+	ewma    map[string]float64
+}{history: make(map[string][]float64), ewma: make(map[string]float64)}
+
+// validateAnomaly checks the anomaly detection settings when an --anomaly-drop is set. A drop that isn't a
+// percentage, NaN included, would otherwise flag every result or none.
+func validateAnomaly() []error {
+	if cliFlags.anomalyDrop == "" {
+		return nil
+	}
+	var errs []error
+	if drop, err := strconv.ParseFloat(cliFlags.anomalyDrop, 64); err != nil || !(drop > 0 && drop < 100) {
+		errs = append(errs, fmt.Errorf("anomaly drop must be a percentage between 0 and 100, got %q", cliFlags.anomalyDrop))
+	}
+	if window, err := strconv.Atoi(cliFlags.anomalyWindow); err != nil || window < anomalyMinHistory {
+		errs = append(errs, fmt.Errorf("anomaly window must be a number of at least %d, got %q", anomalyMinHistory, cliFlags.anomalyWindow))
+	}
+	if cliFlags.anomalyMethod != anomalyMedian && cliFlags.anomalyMethod != anomalyEWMA {
+		errs = append(errs, fmt.Errorf("anomaly method must be median or ewma, got %q", cliFlags.anomalyMethod))
+	}
+	return errs
+}
+
+// checkAnomaly compares a full rate result against the rolling baseline of the endpoint and records an
+// anomaly metric that is 1 if throughput dropped more than --anomaly-drop percent below it.
+func checkAnomaly(config configuration, settings runSettings, eng engine, server perfServer, direction string, prefix string, bps int64) {
+	drop, window := settings.anomalyDrop, settings.anomalyWindow
+	key := server.resultKey() + "|" + direction + "|" + eng.name
+
+	anomalyBaselines.Lock()
+	history := anomalyBaselines.history[key]
+	baseline := anomalyBaselines.ewma[key]
+	if settings.anomalyMethod != anomalyEWMA && len(history) > 0 {
+		baseline = percentile(history, 50)
+	}
+	ready := len(history) >= anomalyMinHistory
+	// the result joins the baseline either way so a lasting change becomes the new normal
+	history = append(history, float64(bps))
+	if len(history) > window {
+		history = history[len(history)-window:]
+	}
+	anomalyBaselines.history[key] = history
+	alpha := 2 / (float64(window) + 1)
+	if _, ok := anomalyBaselines.ewma[key]; !ok {
+		anomalyBaselines.ewma[key] = float64(bps)
+	} else {
+		anomalyBaselines.ewma[key] = alpha*float64(bps) + (1-alpha)*anomalyBaselines.ewma[key]
+	}
+	anomalyBaselines.Unlock()
+
+	if !ready || baseline <= 0 {
+		return
+	}
+	dropPercent := (baseline - float64(bps)) / baseline * 100
+	value := 0.0
+	if dropPercent > drop {
+		value = 1
+		// the result was already cached, the delta is against the one before it
+		var change *float64
+		changed := ""
+		if delta, ok := latestDelta(server, direction, eng.name); ok {
+			change = &delta
+			changed = fmt.Sprintf(", %+.1f%% from the previous result", delta)
+		}
+		log.Warnf("Anomaly: %s throughput to %s [%s] of %d bps is %.1f%% below the baseline of %.0f bps%s",
+			direction, server.Address, server.displayName(), bps, dropPercent, baseline, changed)
+		if settings.anomalyWebhook != "" {
+			sendAnomalyWebhook(settings.anomalyWebhook, anomalyEvent{
+				Timestamp:     measurementTime(),
+				Source:        config.Hostname,
+				Destination:   server.displayName(),
+				Address:       server.Address,
+				Direction:     direction,
+				Engine:        eng.name,
+				Bps:           bps,
+				Baseline:      baseline,
+				DropPercent:   dropPercent,
+				ChangePercent: change,
+			})
+		}
+		if alerts != nil {
+			alerts.fire(alertEvent{
+				Name:        alertAnomaly,
+				Timestamp:   measurementTime(),
+				Source:      config.Hostname,
+				Destination: server.displayName(),
+				Address:     server.Address,
+				Direction:   direction,
+				Engine:      eng.name,
+				Value:       bps,
+				Limit:       baseline,
+				Message: fmt.Sprintf("%s throughput to %s [%s] of %d bps is %.1f%% below the baseline of %.0f bps",
+					direction, server.Address, server.displayName(), bps, dropPercent, baseline),
+			})
+		}
+	}
+	recordTestMetric(config, settings, eng, server, direction, prefix, "anomaly", value)
+}
+
+// sendAnomalyWebhook posts an anomaly event as JSON to the --anomaly-webhook URL.
+func sendAnomalyWebhook(url string, event anomalyEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Errorf("Error encoding the anomaly event: %v", err)
+		return
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		log.Errorf("Error sending the anomaly webhook: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := auditedDo(&http.Client{Timeout: 10 * time.Second}, "anomaly-webhook", req)
+	if err != nil {
+		log.Errorf("Error sending the anomaly webhook: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Errorf("Error sending the anomaly webhook: unexpected status %s", resp.Status)
+	}
+}
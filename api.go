@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// startAPI serves the agent API in the background.
+func startAPI(listenAddr string, hostname string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/paths", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, currentPaths())
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, currentStatus(hostname))
+	})
+	mux.HandleFunc("/latest", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, currentLatest())
+	})
+	mux.HandleFunc("/ports", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, currentFlows())
+	})
+	mux.HandleFunc("/baselines", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, exportBaselines(hostname, r.URL.Query().Get("address")))
+	})
+	// the API is read-only unless tests can be triggered with --event-triggers=api
+	if eventTriggers[triggerAPI] {
+		mux.HandleFunc("/trigger", triggerHandler)
+	}
+
+	log.Infof("Serving the agent API on %s", listenAddr)
+	go func() {
+		if err := http.ListenAndServe(listenAddr, mux); err != nil {
+			log.Errorf("Error serving the agent API on %s: %v", listenAddr, err)
+		}
+	}()
+}
+
+// writeJSON encodes a response body as JSON.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("Error encoding the API response: %v", err)
+	}
+}
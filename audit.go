@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+const (
+	auditTypeCommand = "command"
+	auditTypeWrite   = "sink_write"
+)
+
+// auditLog is the rotating audit log while --audit-log is set.
+var auditLog *auditWriter
+
+// auditWriter appends audit records as JSON lines. Rotated files are kept uncompressed so they can be checked
+// without the agent's help.
+type auditWriter struct {
+	mu   sync.Mutex
+	file *lumberjack.Logger
+}
+
+// auditRecord is a line of the audit log, a command the agent spawned or a write to a sink.
+type auditRecord struct {
+	Time       time.Time `json:"time"`
+	Type       string    `json:"type"`
+	Argv       []string  `json:"argv,omitempty"`
+	ExitCode   *int      `json:"exit_code,omitempty"`
+	Sink       string    `json:"sink,omitempty"`
+	Method     string    `json:"method,omitempty"`
+	Target     string    `json:"target,omitempty"`
+	Bytes      int64     `json:"bytes,omitempty"`
+	Status     string    `json:"status,omitempty"`
+	DurationMS float64   `json:"duration_ms"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// initAudit opens the audit log if one was passed. It's opened once, reloads of the configuration keep the file.
+func initAudit() error {
+	if cliFlags.auditLog == "" || auditLog != nil {
+		return nil
+	}
+	maxSize, maxBackups, err := auditRotation()
+	if err != nil {
+		return err
+	}
+	auditLog = &auditWriter{file: &lumberjack.Logger{
+		Filename:   cliFlags.auditLog,
+		MaxSize:    maxSize,
+		MaxBackups: maxBackups,
+	}}
+	log.Debugf("[Config] Audit Log = %s", cliFlags.auditLog)
+	return nil
+}
+
+// auditRotation parses the size the audit log is rotated at and the number of rotated files kept.
+func auditRotation() (int, int, error) {
+	maxSize, err := strconv.Atoi(cliFlags.auditMaxSize)
+	if err != nil || maxSize <= 0 {
+		return 0, 0, fmt.Errorf("audit-max-size must be a positive number of megabytes, got %q", cliFlags.auditMaxSize)
+	}
+	maxBackups, err := strconv.Atoi(cliFlags.auditMaxBackups)
+	if err != nil || maxBackups < 0 {
+		return 0, 0, fmt.Errorf("audit-max-backups must be zero or a positive number, got %q", cliFlags.auditMaxBackups)
+	}
+	return maxSize, maxBackups, nil
+}
+
+// write appends a record, an audit log that can't be written is logged on every failure rather than stopping the
+// agent.
+func (a *auditWriter) write(record auditRecord) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Errorf("Error encoding the audit record: %v", err)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		log.Errorf("Error writing the audit log %s: %v", a.file.Filename, err)
+	}
+}
+
+// auditCommand records a command the agent ran with its exit code and duration. A command that couldn't be
+// started has no exit code.
+func auditCommand(argv []string, start time.Time, err error) {
+	if auditLog == nil {
+		return
+	}
+	record := auditRecord{Time: start, Type: auditTypeCommand, Argv: argv, DurationMS: msSince(start)}
+	exitCode := 0
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		exitCode = exitErr.ExitCode()
+		record.ExitCode = &exitCode
+	} else if err == nil {
+		record.ExitCode = &exitCode
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	auditLog.write(record)
+}
+
+// auditedOutput runs a command and records it, returning its combined output.
+func auditedOutput(name string, args ...string) ([]byte, error) {
+	start := time.Now()
+	output, err := exec.Command(name, args...).CombinedOutput()
+	auditCommand(append([]string{name}, args...), start, err)
+	return output, err
+}
+
+// auditWrite records a write to a sink that isn't HTTP, the status is ok if it succeeded.
+func auditWrite(sink string, target string, size int, start time.Time, err error) {
+	if auditLog == nil {
+		return
+	}
+	record := auditRecord{Time: start, Type: auditTypeWrite, Sink: sink, Target: target, Bytes: int64(size), Status: "ok", DurationMS: msSince(start)}
+	if err != nil {
+		record.Status, record.Error = "error", err.Error()
+	}
+	auditLog.write(record)
+}
+
+// auditedDo sends a sink's HTTP request and records it with the response status. Credentials in the URL are
+// redacted.
+func auditedDo(client *http.Client, sink string, req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := client.Do(req)
+	auditRequest(sink, req, resp, start, err)
+	return resp, err
+}
+
+// auditedTransport records the requests of clients the agent doesn't send itself, such as the AWS SDK's.
+type auditedTransport struct {
+	sink string
+	base http.RoundTripper
+}
+
+func (t auditedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	auditRequest(t.sink, req, resp, start, err)
+	return resp, err
+}
+
+// auditRequest records an HTTP request with the response status.
+func auditRequest(sink string, req *http.Request, resp *http.Response, start time.Time, err error) {
+	if auditLog == nil {
+		return
+	}
+	record := auditRecord{
+		Time:       start,
+		Type:       auditTypeWrite,
+		Sink:       sink,
+		Method:     req.Method,
+		Target:     redactURL(req.URL),
+		Bytes:      req.ContentLength,
+		DurationMS: msSince(start),
+	}
+	if err != nil {
+		record.Status, record.Error = "error", err.Error()
+	} else {
+		record.Status = strconv.Itoa(resp.StatusCode)
+	}
+	auditLog.write(record)
+}
+
+// redactURL hides the password of a URL and drops its query, which can carry tokens.
+func redactURL(u *url.URL) string {
+	redacted := *u
+	redacted.RawQuery = ""
+	if redacted.User != nil {
+		if _, ok := redacted.User.Password(); ok {
+			redacted.User = url.UserPassword(redacted.User.Username(), "xxxxx")
+		}
+	}
+	return redacted.String()
+}
+
+// msSince returns the milliseconds elapsed since a time.
+func msSince(start time.Time) float64 {
+	return float64(time.Since(start)) / float64(time.Millisecond)
+}
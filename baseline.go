@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// baselineVersion is the format version of the exported baselines.
+const baselineVersion = 1
+
+// baselineExport is the state an agent learned about its endpoints, the rolling results the anomaly detection
+// compares against and the tuned parallel streams. It is kept in the --baseline-file across restarts and moved to a
+// replacement agent, so a hardware swap doesn't start the learning over.
+type baselineExport struct {
+	Version  int                `json:"version"`
+	Source   string             `json:"source"`
+	Exported time.Time          `json:"exported"`
+	Anomaly  []anomalyBaseline  `json:"anomaly"`
+	Parallel []parallelBaseline `json:"parallel"`
+}
+
+// anomalyBaseline is the rolling history and EWMA of an endpoint's results in a direction with an engine.
+type anomalyBaseline struct {
+	Key     string    `json:"key"`
+	Address string    `json:"address"`
+	History []float64 `json:"history"`
+	EWMA    *float64  `json:"ewma,omitempty"`
+}
+
+// parallelBaseline is the tuned parallel streams of an endpoint in a direction with an engine.
+type parallelBaseline struct {
+	Key     string    `json:"key"`
+	Address string    `json:"address"`
+	Streams int       `json:"streams"`
+	Bps     int64     `json:"bps"`
+	Tuned   time.Time `json:"tuned"`
+}
+
+// baselineAddress is the endpoint address a baseline key starts with.
+func baselineAddress(key string) string {
+	return strings.SplitN(key, "|", 2)[0]
+}
+
+// exportBaselines returns a copy of the learned baselines, only those of an endpoint address if one is given.
+func exportBaselines(source string, address string) baselineExport {
+	export := baselineExport{Version: baselineVersion, Source: source, Exported: time.Now().UTC()}
+	anomalyBaselines.Lock()
+	for key, history := range anomalyBaselines.history {
+		if address != "" && baselineAddress(key) != address {
+			continue
+		}
+		baseline := anomalyBaseline{Key: key, Address: baselineAddress(key), History: append([]float64{}, history...)}
+		if ewma, ok := anomalyBaselines.ewma[key]; ok {
+			baseline.EWMA = &ewma
+		}
+		export.Anomaly = append(export.Anomaly, baseline)
+	}
+	anomalyBaselines.Unlock()
+	parallelTunings.Lock()
+	for key, tuned := range parallelTunings.tuned {
+		if address != "" && baselineAddress(key) != address {
+			continue
+		}
+		export.Parallel = append(export.Parallel, parallelBaseline{Key: key, Address: baselineAddress(key), Streams: tuned.streams, Bps: tuned.bps, Tuned: tuned.tuned})
+	}
+	parallelTunings.Unlock()
+	sort.Slice(export.Anomaly, func(i, j int) bool { return export.Anomaly[i].Key < export.Anomaly[j].Key })
+	sort.Slice(export.Parallel, func(i, j int) bool { return export.Parallel[i].Key < export.Parallel[j].Key })
+	return export
+}
+
+// importBaselines merges exported baselines into the learned ones and returns how many were added. What the agent
+// already learned about an endpoint is kept over the import.
+func importBaselines(export baselineExport) int {
+	added := 0
+	anomalyBaselines.Lock()
+	for _, baseline := range export.Anomaly {
+		if _, ok := anomalyBaselines.history[baseline.Key]; ok || len(baseline.History) == 0 {
+			continue
+		}
+		anomalyBaselines.history[baseline.Key] = append([]float64{}, baseline.History...)
+		if baseline.EWMA != nil {
+			anomalyBaselines.ewma[baseline.Key] = *baseline.EWMA
+		}
+		added++
+	}
+	anomalyBaselines.Unlock()
+	parallelTunings.Lock()
+	for _, baseline := range export.Parallel {
+		if _, ok := parallelTunings.tuned[baseline.Key]; ok || baseline.Streams < 1 {
+			continue
+		}
+		parallelTunings.tuned[baseline.Key] = tunedParallel{streams: baseline.Streams, bps: baseline.Bps, tuned: baseline.Tuned}
+		added++
+	}
+	parallelTunings.Unlock()
+	return added
+}
+
+// readBaselines reads exported baselines from a file.
+func readBaselines(path string) (baselineExport, error) {
+	var export baselineExport
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return export, err
+	}
+	if err := json.Unmarshal(data, &export); err != nil {
+		return export, fmt.Errorf("%s is not a baseline export: %v", path, err)
+	}
+	if export.Version != baselineVersion {
+		return export, fmt.Errorf("%s has baselines of version %d, this agent reads version %d", path, export.Version, baselineVersion)
+	}
+	return export, nil
+}
+
+// writeBaselines writes exported baselines to a file, through a temporary file so a crash leaves the previous one.
+func writeBaselines(path string, export baselineExport) error {
+	data, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// loadBaselines restores the baselines kept in the --baseline-file and merges a --baseline-import from another
+// agent, at startup.
+func loadBaselines() error {
+	if cliFlags.baselineFile != "" {
+		export, err := readBaselines(cliFlags.baselineFile)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("could not read the baselines: %v", err)
+		}
+		if err == nil {
+			log.Infof("Restored %d baselines from %s", importBaselines(export), cliFlags.baselineFile)
+		}
+	}
+	if cliFlags.baselineImport != "" {
+		export, err := readBaselines(cliFlags.baselineImport)
+		if err != nil {
+			return fmt.Errorf("could not import the baselines: %v", err)
+		}
+		log.Infof("Imported %d baselines learned by %s from %s", importBaselines(export), export.Source, cliFlags.baselineImport)
+	}
+	return nil
+}
+
+// saveBaselines keeps the learned baselines in the --baseline-file, at the end of every cycle.
+func saveBaselines(hostname string) {
+	if cliFlags.baselineFile == "" {
+		return
+	}
+	if err := writeBaselines(cliFlags.baselineFile, exportBaselines(hostname, "")); err != nil {
+		log.Errorf("Error saving the baselines to %s: %v", cliFlags.baselineFile, err)
+	}
+}
+
+// baselineExportAction exports the baselines of a running agent from its API to a file or stdout.
+func baselineExportAction() error {
+	agent := strings.TrimSuffix(cliFlags.baselineAgent, "/")
+	if !strings.Contains(agent, "://") {
+		agent = "http://" + agent
+	}
+	target := agent + "/baselines"
+	if cliFlags.baselineAddress != "" {
+		target += "?address=" + url.QueryEscape(cliFlags.baselineAddress)
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(target)
+	if err != nil {
+		return fmt.Errorf("could not read the baselines at %s, is the agent running with --api-listen? %v", agent, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("could not read the baselines at %s: unexpected status %s", agent, resp.Status)
+	}
+	var export baselineExport
+	if err := json.NewDecoder(resp.Body).Decode(&export); err != nil {
+		return fmt.Errorf("could not read the baselines at %s: %v", agent, err)
+	}
+	if cliFlags.baselineOutput == "" {
+		data, _ := json.MarshalIndent(export, "", "  ")
+		fmt.Println(string(data))
+		return nil
+	}
+	if err := writeBaselines(cliFlags.baselineOutput, export); err != nil {
+		return err
+	}
+	log.Infof("Exported %d anomaly baselines and %d parallel tunings of %s to %s", len(export.Anomaly), len(export.Parallel), export.Source, cliFlags.baselineOutput)
+	return nil
+}
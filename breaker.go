@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBreakerPrefix      = "bandwidth.breaker"
+	defaultBreakerCooldown    = "1800"
+	defaultBreakerProbeLength = "2"
+	// breakerProbePrefix is appended to the prefixes of the probe test of an endpoint whose breaker is half open.
+	breakerProbePrefix = ".probe"
+)
+
+// The states of an endpoint's circuit breaker.
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// breakerConfig stops testing an endpoint for a cool-down after it failed a number of cycles in a row, so a dead
+// endpoint doesn't take up a test slot every cycle. After the cool-down a short probe test decides whether the
+// full tests resume.
+type breakerConfig struct {
+	// Failures is the number of cycles in a row an endpoint fails before its breaker opens, 0 disables it.
+	Failures string `yaml:"failures"`
+	// Cooldown is how long an open breaker skips the endpoint, in seconds.
+	Cooldown string `yaml:"cooldown"`
+	// ProbeLength is the length of the probe test in seconds.
+	ProbeLength string `yaml:"probe-length"`
+	Prefix      string `yaml:"prefix"`
+}
+
+// endpointBreaker is the breaker state of an endpoint. succeeded and failed record the outcome of its tests in
+// the current cycle.
+type endpointBreaker struct {
+	state     int
+	failures  int
+	openedAt  time.Time
+	succeeded bool
+	failed    bool
+}
+
+// circuitBreaker tracks the breakers of every endpoint.
+type circuitBreaker struct {
+	config    breakerConfig
+	failures  int
+	cooldown  time.Duration
+	mu        sync.Mutex
+	endpoints map[string]*endpointBreaker
+}
+
+var breaker *circuitBreaker
+
+// mergeBreakerFlags fills any breaker settings missing from the configuration file with the CLI values.
+func mergeBreakerFlags(bc *breakerConfig) {
+	if bc.Failures == "" {
+		bc.Failures = cliFlags.breakerFailures
+	}
+	if bc.Cooldown == "" {
+		bc.Cooldown = cliFlags.breakerCooldown
+	}
+	if bc.ProbeLength == "" {
+		bc.ProbeLength = cliFlags.breakerProbeLength
+	}
+	if bc.Prefix == "" {
+		bc.Prefix = defaultBreakerPrefix
+	}
+}
+
+// validateBreaker checks the breaker settings.
+func validateBreaker(bc breakerConfig) []error {
+	var errs []error
+	if failures, err := strconv.Atoi(bc.Failures); bc.Failures != "" && (err != nil || failures < 0) {
+		errs = append(errs, fmt.Errorf("circuit-breaker failures must be zero or a positive number, got %q", bc.Failures))
+	}
+	if cooldown, err := strconv.Atoi(bc.Cooldown); err != nil || cooldown <= 0 {
+		errs = append(errs, fmt.Errorf("circuit-breaker cooldown must be a positive number of seconds, got %q", bc.Cooldown))
+	}
+	if length, err := strconv.Atoi(bc.ProbeLength); err != nil || length <= 0 {
+		errs = append(errs, fmt.Errorf("circuit-breaker probe-length must be a positive number of seconds, got %q", bc.ProbeLength))
+	}
+	return errs
+}
+
+// initBreaker sets up the circuit breakers if a number of failures was configured. The breaker state is kept
+// across configuration reloads.
+func initBreaker(bc breakerConfig) error {
+	failures, _ := strconv.Atoi(bc.Failures)
+	if failures <= 0 {
+		breaker = nil
+		return nil
+	}
+	if errs := validateBreaker(bc); len(errs) > 0 {
+		return errs[0]
+	}
+	endpoints := make(map[string]*endpointBreaker)
+	if breaker != nil {
+		endpoints = breaker.endpoints
+	}
+	breaker = &circuitBreaker{config: bc, failures: failures, cooldown: seconds(bc.Cooldown), endpoints: endpoints}
+	log.Debugf("[Config] Circuit Breaker = open after %d failed cycles for %s", failures, breaker.cooldown)
+	return nil
+}
+
+// breakerKey identifies an endpoint, its profiles share its breaker.
+func breakerKey(server perfServer) string {
+	return server.Address + "|" + server.Name
+}
+
+// begin starts the cycle of an endpoint and returns its breaker state. An open breaker whose cool-down is over
+// turns half open.
+func (c *circuitBreaker) begin(server perfServer, now time.Time) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, ok := c.endpoints[breakerKey(server)]
+	if !ok {
+		b = &endpointBreaker{}
+		c.endpoints[breakerKey(server)] = b
+	}
+	b.succeeded, b.failed = false, false
+	if b.state == breakerOpen && now.Sub(b.openedAt) >= c.cooldown {
+		b.state = breakerHalfOpen
+		log.Infof("The circuit breaker of %s [%s] is half open, probing it", server.Address, server.displayName())
+	}
+	return b.state
+}
+
+// testResult records the outcome of a test to an endpoint in the current cycle.
+func (c *circuitBreaker) testResult(server perfServer, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if b, found := c.endpoints[breakerKey(server)]; found {
+		if ok {
+			b.succeeded = true
+		} else {
+			b.failed = true
+		}
+	}
+}
+
+// probed reports whether the tests to an endpoint succeeded so far in the cycle.
+func (c *circuitBreaker) probed(server perfServer) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, ok := c.endpoints[breakerKey(server)]
+	return ok && b.succeeded
+}
+
+// end closes the cycle of an endpoint. A cycle with a successful test closes the breaker, one that failed counts
+// towards opening it, and a failed probe opens it again for another cool-down.
+func (c *circuitBreaker) end(config configuration, settings runSettings, server perfServer, now time.Time) {
+	c.mu.Lock()
+	b, ok := c.endpoints[breakerKey(server)]
+	if !ok {
+		c.mu.Unlock()
+		return
+	}
+	switch {
+	case b.succeeded:
+		if b.state != breakerClosed {
+			log.Infof("The circuit breaker of %s [%s] is closed, resuming the full tests", server.Address, server.displayName())
+		}
+		b.state, b.failures = breakerClosed, 0
+	case b.failed && b.state == breakerHalfOpen:
+		b.state, b.openedAt = breakerOpen, now
+		log.Warnf("The probe of %s [%s] failed, skipping its tests for another %s", server.Address, server.displayName(), c.cooldown)
+	case b.failed:
+		b.failures++
+		if b.failures >= c.failures && b.state == breakerClosed {
+			b.state, b.openedAt = breakerOpen, now
+			log.Warnf("The circuit breaker of %s [%s] is open after %d failed cycles, skipping its tests for %s", server.Address, server.displayName(), b.failures, c.cooldown)
+		}
+	}
+	state := b.state
+	c.mu.Unlock()
+	c.record(config, settings, server, state)
+}
+
+// skip records the state of an endpoint skipped while its breaker is open.
+func (c *circuitBreaker) skip(config configuration, settings runSettings, server perfServer) {
+	log.Debugf("Skipping the tests to %s [%s], its circuit breaker is open", server.Address, server.displayName())
+	c.record(config, settings, server, breakerOpen)
+}
+
+// record records the breaker state of an endpoint under <prefix>.state, 0 closed and 1 open. A half open breaker
+// is recorded once its probe decided the state.
+func (c *circuitBreaker) record(config configuration, settings runSettings, server perfServer, state int) {
+	recordMeasurement(config, settings, measurement{
+		Timestamp:   measurementTime(),
+		Source:      config.Hostname,
+		Destination: server.displayName(),
+		Address:     server.Address,
+		Prefix:      c.config.Prefix + ".state",
+		Metric:      "breaker_state",
+		Value:       float64(state),
+		Tags:        server.Tags,
+	})
+}
+
+// probeSettings are the settings of the short test probing an endpoint whose breaker is half open, a single
+// download run kept apart from the results and the anomaly baselines.
+func (c *circuitBreaker) probeSettings(settings runSettings) runSettings {
+	probe := settings
+	probe.length = c.config.ProbeLength
+	probe.samples = 1
+	probe.warmup = "0"
+	probe.omit = "0"
+	probe.anomalyDrop = 0
+	probe.downloadPrefix += breakerProbePrefix
+	probe.uploadPrefix += breakerProbePrefix
+	return probe
+}
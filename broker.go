@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	brokerMQTT         = "mqtt"
+	brokerNATS         = "nats"
+	defaultMQTTTopic   = "cloud-bandwidth/{{.Source}}/{{.Dest}}/{{.Direction}}"
+	defaultNATSSubject = "cloud-bandwidth.{{.Source}}.{{.Dest}}.{{.Direction}}"
+	brokerPublishWait  = 10 * time.Second
+)
+
+type brokerConfig struct {
+	// URL selects the protocol by its scheme, mqtt://, mqtts://, ssl:// and ws:// connect to an MQTT broker,
+	// nats:// and tls:// to a NATS server.
+	URL string `yaml:"url"`
+	// Topic is a text/template for the MQTT topic or NATS subject, with the same fields as the graphite template.
+	Topic         string `yaml:"topic"`
+	QoS           int    `yaml:"qos"`
+	ClientID      string `yaml:"client-id"`
+	Username      string `yaml:"username"`
+	Password      string `yaml:"password"`
+	TLSCAFile     string `yaml:"tls-ca-file"`
+	TLSCertFile   string `yaml:"tls-cert-file"`
+	TLSKeyFile    string `yaml:"tls-key-file"`
+	TLSSkipVerify bool   `yaml:"tls-skip-verify"`
+}
+
+// brokerSink publishes each measurement as JSON to an MQTT topic or NATS subject rendered from the topic template.
+type brokerSink struct {
+	protocol string
+	qos      byte
+	topic    *template.Template
+	mqtt     mqtt.Client
+	nats     *nats.Conn
+}
+
+var broker *brokerSink
+
+// mergeBrokerFlags fills any broker settings missing from the configuration file with the CLI values.
+func mergeBrokerFlags(bc *brokerConfig) {
+	if bc.URL == "" {
+		bc.URL = cliFlags.brokerURL
+	}
+	if bc.Topic == "" {
+		bc.Topic = cliFlags.brokerTopic
+	}
+	if bc.QoS == 0 {
+		bc.QoS = cliFlags.brokerQoS
+	}
+	if bc.Username == "" {
+		bc.Username = cliFlags.brokerUsername
+	}
+	if bc.Password == "" {
+		bc.Password = cliFlags.brokerPassword
+	}
+}
+
+// brokerProtocol returns the protocol selected by the URL scheme.
+func brokerProtocol(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("broker-url must be a URL such as mqtt://broker:1883 or nats://broker:4222, got %q", rawURL)
+	}
+	switch u.Scheme {
+	case "mqtt", "mqtts", "tcp", "ssl", "ws", "wss":
+		return brokerMQTT, nil
+	case "nats", "tls":
+		return brokerNATS, nil
+	default:
+		return "", fmt.Errorf("unsupported broker scheme %q, use mqtt, mqtts, ssl, ws, wss, nats or tls", u.Scheme)
+	}
+}
+
+// initBroker connects to the MQTT broker or NATS server if a broker URL was configured.
+func initBroker(bc brokerConfig, hostname string) error {
+	if bc.URL == "" {
+		return nil
+	}
+	protocol, err := brokerProtocol(bc.URL)
+	if err != nil {
+		return err
+	}
+	if bc.QoS < 0 || bc.QoS > 2 {
+		return fmt.Errorf("broker qos must be 0, 1 or 2, got %d", bc.QoS)
+	}
+	if bc.Topic == "" {
+		bc.Topic = defaultMQTTTopic
+		if protocol == brokerNATS {
+			bc.Topic = defaultNATSSubject
+		}
+	}
+	topic, err := template.New("broker").Option("missingkey=zero").Parse(bc.Topic)
+	if err != nil {
+		return fmt.Errorf("invalid broker topic template: %v", err)
+	}
+	if bc.ClientID == "" {
+		bc.ClientID = "cloud-bandwidth-" + hostname
+	}
+	tlsConfig, err := tlsClientConfig(bc.TLSCAFile, bc.TLSCertFile, bc.TLSKeyFile, bc.TLSSkipVerify)
+	if err != nil {
+		return err
+	}
+
+	sink := &brokerSink{protocol: protocol, qos: byte(bc.QoS), topic: topic}
+	switch protocol {
+	case brokerMQTT:
+		opts := mqtt.NewClientOptions().
+			AddBroker(bc.URL).
+			SetClientID(bc.ClientID).
+			SetUsername(bc.Username).
+			SetPassword(bc.Password).
+			SetTLSConfig(tlsConfig).
+			SetAutoReconnect(true).
+			SetConnectRetry(true).
+			SetConnectTimeout(brokerPublishWait).
+			SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+				log.Errorf("Lost the connection to the MQTT broker %s, reconnecting: %v", bc.URL, err)
+			})
+		sink.mqtt = mqtt.NewClient(opts)
+		// with connect retry the token only completes once connected, publishes are queued until then
+		token := sink.mqtt.Connect()
+		if token.WaitTimeout(brokerPublishWait) && token.Error() != nil {
+			return fmt.Errorf("could not connect to the MQTT broker %s: %v", bc.URL, token.Error())
+		}
+	case brokerNATS:
+		opts := []nats.Option{
+			nats.Name(bc.ClientID),
+			nats.MaxReconnects(-1),
+			nats.RetryOnFailedConnect(true),
+			nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+				if err != nil {
+					log.Errorf("Lost the connection to the NATS server %s, reconnecting: %v", bc.URL, err)
+				}
+			}),
+		}
+		if bc.Username != "" {
+			opts = append(opts, nats.UserInfo(bc.Username, bc.Password))
+		} else if bc.Password != "" {
+			// a password without a username is used as the NATS auth token
+			opts = append(opts, nats.Token(bc.Password))
+		}
+		if strings.HasPrefix(bc.URL, "tls://") || bc.TLSCAFile != "" || bc.TLSCertFile != "" || bc.TLSSkipVerify {
+			opts = append(opts, nats.Secure(tlsConfig))
+		}
+		sink.nats, err = nats.Connect(bc.URL, opts...)
+		if err != nil {
+			return fmt.Errorf("could not connect to the NATS server %s: %v", bc.URL, err)
+		}
+	}
+	broker = sink
+	log.Debugf("[Config] Broker = %s (%s)", bc.URL, protocol)
+	log.Debugf("[Config] Broker Topic = %s", bc.Topic)
+
+	return nil
+}
+
+// publish sends a measurement as JSON to the topic rendered for it.
+func (b *brokerSink) publish(m measurement) {
+	topic, err := b.renderTopic(m)
+	if err != nil {
+		log.Errorf("Error rendering the broker topic: %v", err)
+		return
+	}
+	payload, err := json.Marshal(m)
+	if err != nil {
+		log.Errorf("Error encoding the measurement for the broker: %v", err)
+		return
+	}
+	if cliFlags.debug {
+		log.Infof("Publishing the following msg to %s %s: %s", b.protocol, topic, payload)
+	}
+	start := time.Now()
+	if b.nats != nil {
+		err := b.nats.Publish(topic, payload)
+		auditWrite("nats", topic, len(payload), start, err)
+		if err != nil {
+			log.Errorf("Error publishing to the NATS subject %s: %v", topic, err)
+		}
+		return
+	}
+	token := b.mqtt.Publish(topic, b.qos, false, payload)
+	if b.qos > 0 && !token.WaitTimeout(brokerPublishWait) {
+		auditWrite("mqtt", topic, len(payload), start, fmt.Errorf("timed out"))
+		log.Errorf("Timed out publishing to the MQTT topic %s", topic)
+		return
+	}
+	auditWrite("mqtt", topic, len(payload), start, token.Error())
+	if token.Error() != nil {
+		log.Errorf("Error publishing to the MQTT topic %s: %v", topic, token.Error())
+	}
+}
+
+// renderTopic executes the topic template, escaping the separators and wildcards of the protocol in each field.
+func (b *brokerSink) renderTopic(m measurement) (string, error) {
+	segment := strings.NewReplacer("/", "_", "+", "_", "#", "_", " ", "_").Replace
+	if b.protocol == brokerNATS {
+		segment = strings.NewReplacer(".", "_", "*", "_", ">", "_", " ", "_").Replace
+	}
+	data := graphitePathData{
+		Prefix:    m.Prefix,
+		Source:    segment(m.Source),
+		Dest:      segment(m.Destination),
+		Address:   segment(m.Address),
+		Direction: m.Direction,
+		Engine:    m.Engine,
+		Metric:    m.Metric,
+		Tags:      make(map[string]string, len(m.Tags)),
+	}
+	for k, v := range m.Tags {
+		data.Tags[k] = segment(v)
+	}
+	var buf bytes.Buffer
+	if err := b.topic.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	topic := strings.TrimSpace(buf.String())
+	if topic == "" {
+		return "", fmt.Errorf("template rendered an empty topic")
+	}
+	return topic, nil
+}
+
+// flush waits for the NATS messages published this cycle to reach the server.
+func (b *brokerSink) flush() {
+	if b.nats == nil {
+		return
+	}
+	if err := b.nats.FlushTimeout(brokerPublishWait); err != nil {
+		log.Errorf("Error flushing the NATS connection: %v", err)
+	}
+}
+
+// close drains any pending messages and disconnects from the broker.
+func (b *brokerSink) close() {
+	if b.nats != nil {
+		if err := b.nats.Drain(); err != nil {
+			log.Errorf("Error draining the NATS connection: %v", err)
+		}
+		return
+	}
+	b.mqtt.Disconnect(uint(brokerPublishWait / time.Millisecond))
+}
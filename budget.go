@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	budgetSkip          = "skip"
+	budgetCapped        = "capped"
+	defaultBudgetRate   = "1M"
+	defaultBudgetPrefix = "bandwidth.budget"
+)
+
+// budgetConfig caps the data the tests transfer to an endpoint per day and per calendar month, for agents on
+// metered links such as LTE sites. Once a cap is used up the tests are skipped or downgraded to capped probes.
+type budgetConfig struct {
+	// Daily and Monthly are sizes such as 2GB or 50GB, empty for no cap.
+	Daily   string `yaml:"daily"`
+	Monthly string `yaml:"monthly"`
+	// Action is skip or capped, what happens once a budget is used up.
+	Action string `yaml:"action"`
+	// CappedRate is the target bandwidth of the downgraded tests.
+	CappedRate string `yaml:"capped-rate"`
+	// StateFile keeps the usage across restarts, it is only kept in memory without one.
+	StateFile string `yaml:"state-file"`
+	Prefix    string `yaml:"prefix"`
+}
+
+// budgetUsage is the data transferred to an endpoint in the current day and month, in bytes.
+type budgetUsage struct {
+	Day        string `json:"day"`
+	DayBytes   int64  `json:"day-bytes"`
+	Month      string `json:"month"`
+	MonthBytes int64  `json:"month-bytes"`
+}
+
+// budgetTracker tracks the data transferred to every endpoint against the budget.
+type budgetTracker struct {
+	config  budgetConfig
+	daily   int64
+	monthly int64
+	mu      sync.Mutex
+	usage   map[string]*budgetUsage
+}
+
+var budget *budgetTracker
+
+// mergeBudgetFlags fills any budget settings missing from the configuration file with the CLI values.
+func mergeBudgetFlags(bc *budgetConfig) {
+	if bc.Daily == "" {
+		bc.Daily = cliFlags.budgetDaily
+	}
+	if bc.Monthly == "" {
+		bc.Monthly = cliFlags.budgetMonthly
+	}
+	if bc.Action == "" {
+		bc.Action = cliFlags.budgetAction
+	}
+	if bc.CappedRate == "" {
+		bc.CappedRate = cliFlags.budgetCappedRate
+	}
+	if bc.StateFile == "" {
+		bc.StateFile = cliFlags.budgetStateFile
+	}
+	if bc.Action == "" {
+		bc.Action = budgetSkip
+	}
+	if bc.CappedRate == "" {
+		bc.CappedRate = defaultBudgetRate
+	}
+	if bc.Prefix == "" {
+		bc.Prefix = defaultBudgetPrefix
+	}
+}
+
+// validateBudget checks the budget sizes and action.
+func validateBudget(bc budgetConfig) []error {
+	var errs []error
+	for _, setting := range []struct{ name, value string }{
+		{"budget daily", bc.Daily},
+		{"budget monthly", bc.Monthly},
+	} {
+		if setting.value == "" {
+			continue
+		}
+		if size, err := parseByteSize(setting.value); err != nil || size <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be a size such as 500MB or 50GB, got %q", setting.name, setting.value))
+		}
+	}
+	if bc.Action != budgetSkip && bc.Action != budgetCapped {
+		errs = append(errs, fmt.Errorf("budget action must be skip or capped, got %q", bc.Action))
+	}
+	if bc.Action == budgetCapped && !bandwidthPattern.MatchString(bc.CappedRate) {
+		errs = append(errs, fmt.Errorf("budget capped-rate must be a bandwidth such as 500K or 1M, got %q", bc.CappedRate))
+	}
+	return errs
+}
+
+// initBudget sets up the budget tracking if a daily or monthly cap was configured and loads the usage kept in
+// the state file.
+func initBudget(bc budgetConfig) error {
+	if bc.Daily == "" && bc.Monthly == "" {
+		return nil
+	}
+	if errs := validateBudget(bc); len(errs) > 0 {
+		return errs[0]
+	}
+	b := &budgetTracker{config: bc, usage: make(map[string]*budgetUsage)}
+	b.daily, _ = parseByteSize(bc.Daily)
+	b.monthly, _ = parseByteSize(bc.Monthly)
+	if bc.StateFile != "" {
+		data, err := os.ReadFile(bc.StateFile)
+		if err == nil {
+			if err := json.Unmarshal(data, &b.usage); err != nil {
+				return fmt.Errorf("could not read the budget state %s: %v", bc.StateFile, err)
+			}
+		} else if !os.IsNotExist(err) {
+			return fmt.Errorf("could not read the budget state %s: %v", bc.StateFile, err)
+		}
+	}
+	log.Debugf("[Config] Budget = daily %s, monthly %s, then %s", bc.Daily, bc.Monthly, bc.Action)
+	budget = b
+	return nil
+}
+
+// current returns the usage of an endpoint, reset when a new day or month started. The caller holds the lock.
+func (b *budgetTracker) current(address string, now time.Time) *budgetUsage {
+	usage, ok := b.usage[address]
+	if !ok {
+		usage = &budgetUsage{}
+		b.usage[address] = usage
+	}
+	if day := now.Format("2006-01-02"); usage.Day != day {
+		usage.Day, usage.DayBytes = day, 0
+	}
+	if month := now.Format("2006-01"); usage.Month != month {
+		usage.Month, usage.MonthBytes = month, 0
+	}
+	return usage
+}
+
+// exhausted reports whether the daily or monthly budget of an endpoint is used up.
+func (b *budgetTracker) exhausted(server perfServer) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	usage := b.current(server.Address, time.Now())
+	return (b.daily > 0 && usage.DayBytes >= b.daily) || (b.monthly > 0 && usage.MonthBytes >= b.monthly)
+}
+
+// use adds the bytes transferred by a test to an endpoint's usage and saves the state.
+func (b *budgetTracker) use(server perfServer, bytes int64) {
+	if bytes <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	usage := b.current(server.Address, time.Now())
+	usage.DayBytes += bytes
+	usage.MonthBytes += bytes
+	if b.config.StateFile == "" {
+		return
+	}
+	data, _ := json.MarshalIndent(b.usage, "", "  ")
+	tmp := b.config.StateFile + ".tmp"
+	if err := os.MkdirAll(filepath.Dir(b.config.StateFile), 0755); err != nil {
+		log.Errorf("Error saving the budget state %s: %v", b.config.StateFile, err)
+		return
+	}
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		log.Errorf("Error saving the budget state %s: %v", b.config.StateFile, err)
+		return
+	}
+	if err := os.Rename(tmp, b.config.StateFile); err != nil {
+		log.Errorf("Error saving the budget state %s: %v", b.config.StateFile, err)
+	}
+}
+
+// record records the bytes left in an endpoint's daily and monthly budgets under <prefix>.daily and
+// <prefix>.monthly.
+func (b *budgetTracker) record(config configuration, settings runSettings, server perfServer) {
+	b.mu.Lock()
+	usage := *b.current(server.Address, time.Now())
+	b.mu.Unlock()
+
+	remaining := func(name string, limit int64, used int64) {
+		if limit <= 0 {
+			return
+		}
+		left := limit - used
+		if left < 0 {
+			left = 0
+		}
+		recordMeasurement(config, settings, measurement{
+			Timestamp:   measurementTime(),
+			Source:      config.Hostname,
+			Destination: server.displayName(),
+			Address:     server.Address,
+			Prefix:      b.config.Prefix + "." + name,
+			Metric:      "remaining_bytes",
+			Value:       float64(left),
+			Tags:        server.Tags,
+		})
+	}
+	remaining("daily", b.daily, usage.DayBytes)
+	remaining("monthly", b.monthly, usage.MonthBytes)
+}
+
+// parseByteSize parses a size with an optional decimal or binary unit such as 500MB, 50GB or 2GiB, a bare number
+// is in bytes.
+func parseByteSize(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	multiplier := 1.0
+	for _, unit := range []struct {
+		suffix     string
+		multiplier float64
+	}{
+		{"KIB", 1 << 10}, {"MIB", 1 << 20}, {"GIB", 1 << 30}, {"TIB", 1 << 40},
+		{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12}, {"B", 1},
+	} {
+		if strings.HasSuffix(value, unit.suffix) {
+			value, multiplier = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix)), unit.multiplier
+			break
+		}
+	}
+	size, err := strconv.ParseFloat(value, 64)
+	if err != nil || size < 0 || math.IsInf(size, 0) {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return int64(size * multiplier), nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	defaultCallPrefix     = "bandwidth.call"
+	defaultCallBitrate    = "2.5M"
+	defaultCallPacketSize = "200"
+	defaultCallLength     = "10"
+)
+
+// callReport is the part of an iperf3 bidirectional UDP JSON report the call quality is scored from, sum is the
+// stream sent by the agent and sum_bidir_reverse the stream sent back by the endpoint.
+type callReport struct {
+	End struct {
+		Sum        callStream `json:"sum"`
+		SumReverse callStream `json:"sum_bidir_reverse"`
+	} `json:"end"`
+	Error string `json:"error"`
+}
+
+// callStream is the receiver's view of one direction of the simulated call.
+type callStream struct {
+	BitsPerSecond float64 `json:"bits_per_second"`
+	JitterMs      float64 `json:"jitter_ms"`
+	LostPercent   float64 `json:"lost_percent"`
+}
+
+// simulateCall sends a video call's worth of small UDP packets to an endpoint and back at the same time and
+// scores each direction by the share of the target bitrate achieved, the jitter and the loss, into a MOS from 1
+// to 4.5. It answers whether a site can hold a Teams or Zoom call rather than how fast its link is. The call
+// needs the iperf3 client, 3.7 or later for --bidir.
+func simulateCall(config configuration, settings runSettings, client engineClient, server perfServer) {
+	eng := client.engine
+	if !eng.rawJSON {
+		log.Debugf("Skipping the call simulation to %s [%s], the %s engine can't run it", server.Address, server.displayName(), eng.name)
+		return
+	}
+	if server.Tunnel != nil {
+		log.Debugf("Skipping the call simulation to %s [%s], UDP can't be sent through its tunnel", server.Address, server.displayName())
+		return
+	}
+	target, err := parseBandwidth(cliFlags.callBitrate)
+	if err != nil || target <= 0 {
+		log.Errorf("Error simulating a call to %s [%s]: invalid call-bitrate %q", server.Address, server.displayName(), cliFlags.callBitrate)
+		return
+	}
+	argv, auth := iperfAuthArgv(priorityArgv(append([]string{}, client.argv...), client.native), client.native, server, testOptions{})
+	argv = append(argv, "-u", "-b", cliFlags.callBitrate, "-l", cliFlags.callPacketSize, "-t", cliFlags.callLength,
+		"-p", server.serverPort(eng), "-c", server.dialAddress(), "--bidir", "-J")
+	argv = append(argv, iperfAuthArgs(auth)...)
+	if server.bindAddress != "" {
+		argv = append(argv, "-B", server.bindAddress)
+	}
+	if settings.dryRun {
+		log.Infof("[DRY RUN] Would simulate a call to %s [%s] -> %s", server.Address, server.displayName(), strings.Join(argv, " "))
+		return
+	}
+	runID := newRunID()
+	record := func(name string, metric string, value float64) {
+		recordMeasurement(config, settings, measurement{
+			Timestamp:   measurementTime(),
+			Source:      config.Hostname,
+			Destination: server.displayName(),
+			Address:     server.Address,
+			Prefix:      cliFlags.callPrefix + "." + name,
+			Metric:      metric,
+			Value:       value,
+			RunID:       runID,
+			Tags:        server.Tags,
+		})
+	}
+
+	output, err := runCmdIn(server, argv)
+	var report callReport
+	if err == nil {
+		if err = json.Unmarshal([]byte(output), &report); err == nil && report.Error != "" {
+			err = fmt.Errorf("%s", report.Error)
+		}
+	}
+	if err != nil {
+		log.Errorf("Error simulating a call to %s [%s]: %v", server.Address, server.displayName(), err)
+		record("failed", "call_failed", 1)
+		atomic.AddInt32(&failedTests, 1)
+		return
+	}
+	for _, leg := range []struct {
+		direction string
+		stream    callStream
+	}{
+		{directionUpload, report.End.Sum},
+		{directionDownload, report.End.SumReverse},
+	} {
+		achieved := leg.stream.BitsPerSecond / target
+		mos := callMOS(achieved, leg.stream.JitterMs, leg.stream.LostPercent)
+		log.Infof("Call %s to %s [%s]: %.0f%% of %s, jitter %.2fms, loss %.2f%%, MOS %.2f (run %s)", leg.direction,
+			server.Address, server.displayName(), achieved*100, cliFlags.callBitrate, leg.stream.JitterMs, leg.stream.LostPercent, mos, runID)
+		record(leg.direction+".throughput", "throughput_pct", achieved*100)
+		record(leg.direction+".jitter", "jitter_ms", leg.stream.JitterMs)
+		record(leg.direction+".loss", "loss_pct", leg.stream.LostPercent)
+		record(leg.direction+".mos", "mos", mos)
+	}
+}
+
+// callMOS estimates the mean opinion score of a call leg with a simplified ITU-T G.107 E-model. The one-way
+// delay isn't measured, it is approximated from the jitter a jitter buffer would absorb, and a leg short of its
+// target bitrate is scored down in proportion since the call would have to drop its resolution.
+func callMOS(achieved float64, jitterMs float64, lossPct float64) float64 {
+	delay := 2*jitterMs + 10
+	r := 93.2 - delay/40
+	if delay >= 160 {
+		r = 93.2 - (delay-120)/10
+	}
+	r -= 2.5 * lossPct
+	r *= math.Min(1, achieved)
+	r = math.Max(0, math.Min(100, r))
+	mos := 1 + 0.035*r + 7e-6*r*(r-60)*(100-r)
+	return math.Max(1, math.Min(4.5, mos))
+}
@@ -0,0 +1,185 @@
+// The cloud-bandwidth agent API, served with --grpc-listen. Subscribers receive the measurements of the agent
+// as they are recorded and can trigger tests without waiting for the next cycle.
+//
+// Regenerate the Go code from the cbandwidthpb directory with:
+//
+//	protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative cbandwidth.proto
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: cbandwidth.proto
+
+package cbandwidthpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Agent_Subscribe_FullMethodName   = "/cloudbandwidth.v1.Agent/Subscribe"
+	Agent_TriggerTest_FullMethodName = "/cloudbandwidth.v1.Agent/TriggerTest"
+)
+
+// AgentClient is the client API for Agent service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type AgentClient interface {
+	// Subscribe streams the measurements recorded from now on that match the request's filters.
+	Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (Agent_SubscribeClient, error)
+	// TriggerTest starts a test cycle right away, its results are streamed to the subscribers.
+	TriggerTest(ctx context.Context, in *TriggerTestRequest, opts ...grpc.CallOption) (*TriggerTestResponse, error)
+}
+
+type agentClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewAgentClient(cc grpc.ClientConnInterface) AgentClient {
+	return &agentClient{cc}
+}
+
+func (c *agentClient) Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (Agent_SubscribeClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Agent_ServiceDesc.Streams[0], Agent_Subscribe_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &agentSubscribeClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Agent_SubscribeClient interface {
+	Recv() (*Measurement, error)
+	grpc.ClientStream
+}
+
+type agentSubscribeClient struct {
+	grpc.ClientStream
+}
+
+func (x *agentSubscribeClient) Recv() (*Measurement, error) {
+	m := new(Measurement)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *agentClient) TriggerTest(ctx context.Context, in *TriggerTestRequest, opts ...grpc.CallOption) (*TriggerTestResponse, error) {
+	out := new(TriggerTestResponse)
+	err := c.cc.Invoke(ctx, Agent_TriggerTest_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AgentServer is the server API for Agent service.
+// All implementations must embed UnimplementedAgentServer
+// for forward compatibility
+type AgentServer interface {
+	// Subscribe streams the measurements recorded from now on that match the request's filters.
+	Subscribe(*SubscribeRequest, Agent_SubscribeServer) error
+	// TriggerTest starts a test cycle right away, its results are streamed to the subscribers.
+	TriggerTest(context.Context, *TriggerTestRequest) (*TriggerTestResponse, error)
+	mustEmbedUnimplementedAgentServer()
+}
+
+// UnimplementedAgentServer must be embedded to have forward compatible implementations.
+type UnimplementedAgentServer struct {
+}
+
+func (UnimplementedAgentServer) Subscribe(*SubscribeRequest, Agent_SubscribeServer) error {
+	return status.Errorf(codes.Unimplemented, "method Subscribe not implemented")
+}
+func (UnimplementedAgentServer) TriggerTest(context.Context, *TriggerTestRequest) (*TriggerTestResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method TriggerTest not implemented")
+}
+func (UnimplementedAgentServer) mustEmbedUnimplementedAgentServer() {}
+
+// UnsafeAgentServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to AgentServer will
+// result in compilation errors.
+type UnsafeAgentServer interface {
+	mustEmbedUnimplementedAgentServer()
+}
+
+func RegisterAgentServer(s grpc.ServiceRegistrar, srv AgentServer) {
+	s.RegisterService(&Agent_ServiceDesc, srv)
+}
+
+func _Agent_Subscribe_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SubscribeRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(AgentServer).Subscribe(m, &agentSubscribeServer{stream})
+}
+
+type Agent_SubscribeServer interface {
+	Send(*Measurement) error
+	grpc.ServerStream
+}
+
+type agentSubscribeServer struct {
+	grpc.ServerStream
+}
+
+func (x *agentSubscribeServer) Send(m *Measurement) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Agent_TriggerTest_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TriggerTestRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AgentServer).TriggerTest(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Agent_TriggerTest_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AgentServer).TriggerTest(ctx, req.(*TriggerTestRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Agent_ServiceDesc is the grpc.ServiceDesc for Agent service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Agent_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "cloudbandwidth.v1.Agent",
+	HandlerType: (*AgentServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "TriggerTest",
+			Handler:    _Agent_TriggerTest_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Subscribe",
+			Handler:       _Agent_Subscribe_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "cbandwidth.proto",
+}
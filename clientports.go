@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clientPortRange hands out the client ports of the tests from --client-ports, so a strict firewall between the
+// agent and the servers can allow a narrow source port range instead of any port. Every run takes the next block
+// of consecutive ports, one per stream, as the ports of the previous run may still be in TIME_WAIT.
+type clientPortRange struct {
+	mu    sync.Mutex
+	first int
+	last  int
+	next  int
+}
+
+// clientPorts is the client port range, nil when the clients use ephemeral ports.
+var clientPorts *clientPortRange
+
+// parseClientPorts reads a port range such as 50100-50131, or a single port.
+func parseClientPorts(value string) (int, int, error) {
+	low, high := value, value
+	if i := strings.Index(value, "-"); i >= 0 {
+		low, high = value[:i], value[i+1:]
+	}
+	first, err := strconv.Atoi(strings.TrimSpace(low))
+	if err != nil {
+		return 0, 0, fmt.Errorf("client-ports must be a port range such as 50100-50131, got %q", value)
+	}
+	last, err := strconv.Atoi(strings.TrimSpace(high))
+	if err != nil || first < 1 || last > 65535 || first > last {
+		return 0, 0, fmt.Errorf("client-ports must be a port range such as 50100-50131, got %q", value)
+	}
+	return first, last, nil
+}
+
+// validateClientPorts checks the range and that it has a port for every stream of a test.
+func validateClientPorts(config configuration) []error {
+	if cliFlags.clientPorts == "" {
+		return nil
+	}
+	first, last, err := parseClientPorts(cliFlags.clientPorts)
+	if err != nil {
+		return []error{err}
+	}
+	size := last - first + 1
+	streams, _ := strconv.Atoi(cliFlags.parallelConn)
+	if cliFlags.parallelConn == parallelAuto {
+		streams, _ = strconv.Atoi(cliFlags.parallelMax)
+	}
+	for _, profile := range config.Profiles {
+		if n, err := strconv.Atoi(profile.Parallel); err == nil && n > streams {
+			streams = n
+		}
+	}
+	if streams > size {
+		return []error{fmt.Errorf("client-ports %s has %d ports, fewer than the %d parallel streams of a test", cliFlags.clientPorts, size, streams)}
+	}
+	return nil
+}
+
+// initClientPorts sets up the client port range if one was passed.
+func initClientPorts() {
+	if cliFlags.clientPorts == "" {
+		return
+	}
+	first, last, err := parseClientPorts(cliFlags.clientPorts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	clientPorts = &clientPortRange{first: first, last: last, next: first}
+	log.Infof("The iperf3 and goperf clients use the source ports %d-%d", first, last)
+}
+
+// take returns the first of the next n consecutive ports, from the start of the range when they don't fit before
+// its end.
+func (r *clientPortRange) take(n int) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if n > r.last-r.first+1 {
+		log.Warnf("The %d streams of a test don't fit the client ports %d-%d, the last use ports past the range", n, r.first, r.last)
+	}
+	if r.next+n-1 > r.last {
+		r.next = r.first
+	}
+	start := r.next
+	r.next += n
+	return start
+}
+
+// String is the range as it's written in --client-ports.
+func (r *clientPortRange) String() string {
+	return strconv.Itoa(r.first) + "-" + strconv.Itoa(r.last)
+}
+
+// clientArgv is the command line of a client run, with the next client ports when the engine can pin them.
+func clientArgv(eng engine, clientCmd []string, opts testOptions) []string {
+	if clientPorts != nil && eng.cport {
+		streams, err := strconv.Atoi(opts.parallel)
+		if err != nil || streams < 1 {
+			streams = 1
+		}
+		opts.cport = strconv.Itoa(clientPorts.take(streams))
+	}
+	return append(append([]string{}, clientCmd...), eng.args(opts)...)
+}
+
+// testFlow is the traffic between the agent and an endpoint a firewall has to allow, served at /ports.
+type testFlow struct {
+	Endpoint string `json:"endpoint"`
+	Address  string `json:"address"`
+	Engine   string `json:"engine"`
+	// Protocols are tcp, and udp for the UDP tests.
+	Protocols []string `json:"protocols"`
+	// ServerPorts are the ports of the endpoint the tests connect to.
+	ServerPorts []string `json:"server-ports"`
+	// ClientPorts is the source port range of the test streams, empty for ephemeral ports. The iperf3 control
+	// connection always comes from an ephemeral port.
+	ClientPorts string    `json:"client-ports,omitempty"`
+	LastTest    time.Time `json:"last-test"`
+}
+
+// testFlows are the flows of the endpoints tested since the agent started.
+var testFlows = struct {
+	sync.RWMutex
+	flows map[string]*testFlow
+}{flows: make(map[string]*testFlow)}
+
+// recordFlow records the ports an endpoint was tested on.
+func recordFlow(eng engine, server perfServer, address string, ports []string) {
+	protocols := []string{"tcp"}
+	if eng.name == engineGoperf && goperfSettings.Protocol == goperfUDP {
+		protocols = append(protocols, "udp")
+	}
+	flow := &testFlow{
+		Endpoint:    server.displayName(),
+		Address:     address,
+		Engine:      eng.name,
+		Protocols:   protocols,
+		ServerPorts: ports,
+		LastTest:    time.Now(),
+	}
+	if clientPorts != nil && eng.cport {
+		flow.ClientPorts = clientPorts.String()
+	}
+	testFlows.Lock()
+	testFlows.flows[address+"|"+eng.name+"|"+strings.Join(ports, ",")] = flow
+	testFlows.Unlock()
+}
+
+// currentFlows returns a copy of the flows for the API, sorted by endpoint.
+func currentFlows() []testFlow {
+	testFlows.RLock()
+	defer testFlows.RUnlock()
+	flows := make([]testFlow, 0, len(testFlows.flows))
+	for _, flow := range testFlows.flows {
+		flows = append(flows, *flow)
+	}
+	sort.Slice(flows, func(i, j int) bool {
+		if flows[i].Endpoint != flows[j].Endpoint {
+			return flows[i].Endpoint < flows[j].Endpoint
+		}
+		if flows[i].Address != flows[j].Address {
+			return flows[i].Address < flows[j].Address
+		}
+		return flows[i].Engine < flows[j].Engine
+	})
+	return flows
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// clientVersion is how the version of an engine's client is read and the oldest version the agent runs. Older
+// clients report results the newer ones aren't comparable with, iperf3 before 3.1 can't pin the client ports and
+// reports the sender's congestion control only since then.
+type clientVersion struct {
+	args    []string
+	pattern *regexp.Regexp
+	minimum string
+}
+
+// clientVersions are the engines whose client version is detected, by engine name.
+var clientVersions = map[string]clientVersion{
+	engineIperf3:  {args: []string{"--version"}, pattern: regexp.MustCompile(`iperf (\d+(?:\.\d+)+)`), minimum: "3.1"},
+	engineIperf2:  {args: []string{"-v"}, pattern: regexp.MustCompile(`iperf version (\d+(?:\.\d+)+)`), minimum: "2.0"},
+	engineNetperf: {args: []string{"-V"}, pattern: regexp.MustCompile(`Netperf version (\d+(?:\.\d+)+)`), minimum: "2.6"},
+}
+
+// enginePath is the client binary of an engine run with --nocontainer, --iperf-path, --iperf2-path or
+// --netperf-path when one was passed.
+func enginePath(eng engine) string {
+	switch {
+	case eng.name == engineIperf3 && cliFlags.iperfPath != "":
+		return cliFlags.iperfPath
+	case eng.name == engineIperf2 && cliFlags.iperf2Path != "":
+		return cliFlags.iperf2Path
+	case eng.name == engineNetperf && cliFlags.netperfPath != "":
+		return cliFlags.netperfPath
+	}
+	return eng.binary
+}
+
+// detectVersion runs the client of an engine to read its version, it fails if the client is older than the engine
+// supports. The version is empty for the engines without a versioned client and when it couldn't be read, the
+// tests then run without the client_version tag.
+func detectVersion(eng engine, argv []string) (string, error) {
+	detect, ok := clientVersions[eng.name]
+	if !ok {
+		return "", nil
+	}
+	args := append(append([]string{}, argv[1:]...), detect.args...)
+	// some clients print their version with a non-zero exit code, the output is what counts
+	output, err := auditedOutput(argv[0], args...)
+	match := detect.pattern.FindStringSubmatch(string(output))
+	if match == nil {
+		if err != nil {
+			log.Warnf("Could not read the version of the %s client %s, its results go without the client_version tag: %v", eng.name, argv[0], err)
+		} else {
+			log.Warnf("Could not read the version of the %s client %s from %q, its results go without the client_version tag", eng.name, argv[0], strings.TrimSpace(string(output)))
+		}
+		return "", nil
+	}
+	version := match[1]
+	if compareVersions(version, detect.minimum) < 0 {
+		return version, fmt.Errorf("the %s client %s is version %s, the agent needs %s or later", eng.name, argv[0], version, detect.minimum)
+	}
+	log.Infof("Using the %s client version %s", eng.name, version)
+	return version, nil
+}
+
+// compareVersions compares two dotted versions such as 3.9 and 3.10.1, missing parts count as 0.
+func compareVersions(a string, b string) int {
+	aParts, bParts := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(aParts) || i < len(bParts); i++ {
+		var x, y int
+		if i < len(aParts) {
+			x, _ = strconv.Atoi(aParts[i])
+		}
+		if i < len(bParts) {
+			y, _ = strconv.Atoi(bParts[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
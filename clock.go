@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	clockSourceInflux  = "influx"
+	defaultNTPPort     = "123"
+	clockCheckInterval = time.Hour
+	// ntpEpochOffset is the number of seconds between the NTP epoch in 1900 and the unix epoch.
+	ntpEpochOffset = 2208988800
+)
+
+// clock holds the offset of the local clock from the reference clock, updated by checkClock.
+var clock struct {
+	sync.Mutex
+	offset    time.Duration
+	lastCheck time.Time
+}
+
+// measurementTime is the timestamp of a new measurement, corrected by the measured clock offset if enabled.
+func measurementTime() time.Time {
+	clock.Lock()
+	defer clock.Unlock()
+	return time.Now().Add(clock.offset)
+}
+
+// checkClock compares the local clock against the clock-source at startup and then hourly, warns when the skew
+// is larger than clock-skew-warn and keeps the offset to correct timestamps with if clock-correct is set.
+func checkClock(config configuration) {
+	if cliFlags.clockSource == "" || cliFlags.dryRun {
+		return
+	}
+	clock.Lock()
+	due := time.Since(clock.lastCheck) >= clockCheckInterval
+	if due {
+		clock.lastCheck = time.Now()
+	}
+	clock.Unlock()
+	if !due {
+		return
+	}
+
+	var offset time.Duration
+	var err error
+	if cliFlags.clockSource == clockSourceInflux {
+		offset, err = influxClockOffset(config.InfluxURL)
+	} else {
+		offset, err = ntpClockOffset(cliFlags.clockSource)
+	}
+	if err != nil {
+		log.Errorf("Error checking the local clock against %s: %v", cliFlags.clockSource, err)
+		return
+	}
+
+	warnAfter, _ := strconv.ParseFloat(cliFlags.clockSkewWarn, 64)
+	skew := offset
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew.Seconds() > warnAfter {
+		direction := "behind"
+		if offset < 0 {
+			direction = "ahead of"
+		}
+		log.Warnf("!!! The local clock is %s %s %s, grafana may drop or misplace the data points of this agent. Fix the time sync of the host or pass --clock-correct", skew, direction, cliFlags.clockSource)
+	} else {
+		log.Debugf("The local clock is within %s of %s", skew, cliFlags.clockSource)
+	}
+	if cliFlags.clockCorrect {
+		clock.Lock()
+		clock.offset = offset
+		clock.Unlock()
+		log.Infof("Correcting measurement timestamps by %s", offset)
+	}
+}
+
+// ntpClockOffset queries an NTP server with a single SNTP request and returns the local clock offset.
+func ntpClockOffset(server string) (time.Duration, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, defaultNTPPort)
+	}
+	conn, err := net.DialTimeout("udp", server, 5*time.Second)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// LI 0, version 4, client mode
+	request := make([]byte, 48)
+	request[0] = 0x23
+	sent := time.Now()
+	if _, err := conn.Write(request); err != nil {
+		return 0, err
+	}
+	response := make([]byte, 48)
+	if _, err := conn.Read(response); err != nil {
+		return 0, err
+	}
+	received := time.Now()
+	if mode := response[0] & 0x07; mode != 4 {
+		return 0, fmt.Errorf("unexpected NTP response mode %d", mode)
+	}
+	if stratum := response[1]; stratum == 0 {
+		return 0, fmt.Errorf("the NTP server sent a kiss-of-death response")
+	}
+
+	serverReceived := ntpTime(response[32:40])
+	serverSent := ntpTime(response[40:48])
+	return (serverReceived.Sub(sent) + serverSent.Sub(received)) / 2, nil
+}
+
+// ntpTime decodes a 64 bit NTP timestamp.
+func ntpTime(b []byte) time.Time {
+	seconds := int64(binary.BigEndian.Uint32(b[:4])) - ntpEpochOffset
+	fraction := int64(binary.BigEndian.Uint32(b[4:]))
+	return time.Unix(seconds, fraction*1e9>>32)
+}
+
+// influxClockOffset reads the time from the Date header of the influx ping endpoint, it has one second precision
+// which is plenty to catch the skew that makes grafana drop points.
+func influxClockOffset(influxURL string) (time.Duration, error) {
+	if influxURL == "" || influxClient == nil {
+		return 0, fmt.Errorf("no influx URL was configured")
+	}
+	pingURL, err := url.Parse(influxURL)
+	if err != nil {
+		return 0, err
+	}
+	pingURL.Path = "/ping"
+	pingURL.RawQuery = ""
+	sent := time.Now()
+	resp, err := influxClient.Get(pingURL.String())
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	received := time.Now()
+	serverTime, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return 0, fmt.Errorf("no Date header in the influx response: %v", err)
+	}
+	// the header is truncated to the second, compare against the middle of that second
+	serverTime = serverTime.Add(500 * time.Millisecond)
+	return serverTime.Sub(sent.Add(received.Sub(sent) / 2)), nil
+}
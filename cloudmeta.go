@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const cloudMetadataTimeout = 2 * time.Second
+
+// cloudTags are the tags describing the cloud VM the agent runs on, added to every measurement it records.
+// They're prefixed with source_ so they don't collide with endpoint tags describing the destination.
+var cloudTags map[string]string
+
+// cloudInstance is the metadata read from a provider's metadata service.
+type cloudInstance struct {
+	cloud        string
+	region       string
+	zone         string
+	instanceType string
+	instanceID   string
+}
+
+// initCloudMetadata detects the cloud provider from its metadata service, the providers are probed at the same
+// time so an agent outside of a cloud only waits for a single timeout.
+func initCloudMetadata() {
+	if !cliFlags.cloudMetadata || cliFlags.dryRun {
+		return
+	}
+	// the metadata services are link local so any proxy settings are bypassed
+	client := &http.Client{Timeout: cloudMetadataTimeout, Transport: &http.Transport{}}
+	probes := []func(*http.Client) (cloudInstance, error){awsMetadata, gcpMetadata, azureMetadata}
+	results := make(chan cloudInstance, len(probes))
+	for _, probe := range probes {
+		go func(probe func(*http.Client) (cloudInstance, error)) {
+			instance, err := probe(client)
+			if err != nil {
+				log.Debugf("Cloud metadata probe failed: %v", err)
+			}
+			results <- instance
+		}(probe)
+	}
+	for range probes {
+		instance := <-results
+		if instance.cloud == "" {
+			continue
+		}
+		cloudTags = map[string]string{"source_cloud": instance.cloud}
+		for key, value := range map[string]string{
+			"source_region":        instance.region,
+			"source_zone":          instance.zone,
+			"source_instance_type": instance.instanceType,
+			"source_instance_id":   instance.instanceID,
+		} {
+			if value != "" {
+				cloudTags[key] = value
+			}
+		}
+		log.Infof("Detected %s instance %s (%s) in %s %s", instance.cloud, instance.instanceID, instance.instanceType, instance.region, instance.zone)
+		return
+	}
+	log.Warn("No cloud metadata service found, measurements are recorded without cloud tags")
+}
+
+// withCloudTags adds the cloud tags to a measurement's tags, tags already set are kept.
+func withCloudTags(tags map[string]string) map[string]string {
+	return withDefaultTags(tags, cloudTags)
+}
+
+// awsMetadata reads the EC2 instance identity document with an IMDSv2 session token.
+func awsMetadata(client *http.Client) (cloudInstance, error) {
+	req, _ := http.NewRequest("PUT", "http://169.254.169.254/latest/api/token", nil)
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+	token, err := metadataGet(client, req)
+	if err != nil {
+		return cloudInstance{}, fmt.Errorf("aws: %v", err)
+	}
+	req, _ = http.NewRequest("GET", "http://169.254.169.254/latest/dynamic/instance-identity/document", nil)
+	req.Header.Set("X-aws-ec2-metadata-token", string(token))
+	body, err := metadataGet(client, req)
+	if err != nil {
+		return cloudInstance{}, fmt.Errorf("aws: %v", err)
+	}
+	var doc struct {
+		Region           string `json:"region"`
+		AvailabilityZone string `json:"availabilityZone"`
+		InstanceType     string `json:"instanceType"`
+		InstanceID       string `json:"instanceId"`
+	}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return cloudInstance{}, fmt.Errorf("aws: %v", err)
+	}
+	return cloudInstance{"aws", doc.Region, doc.AvailabilityZone, doc.InstanceType, doc.InstanceID}, nil
+}
+
+// gcpMetadata reads the compute engine instance metadata, the zone and machine type are full resource paths.
+func gcpMetadata(client *http.Client) (cloudInstance, error) {
+	req, _ := http.NewRequest("GET", "http://metadata.google.internal/computeMetadata/v1/instance/?recursive=true", nil)
+	req.Header.Set("Metadata-Flavor", "Google")
+	body, err := metadataGet(client, req)
+	if err != nil {
+		return cloudInstance{}, fmt.Errorf("gcp: %v", err)
+	}
+	var doc struct {
+		ID          json.Number `json:"id"`
+		Zone        string      `json:"zone"`
+		MachineType string      `json:"machineType"`
+	}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return cloudInstance{}, fmt.Errorf("gcp: %v", err)
+	}
+	zone := doc.Zone[strings.LastIndex(doc.Zone, "/")+1:]
+	region := zone
+	if i := strings.LastIndex(zone, "-"); i > 0 {
+		region = zone[:i]
+	}
+	machineType := doc.MachineType[strings.LastIndex(doc.MachineType, "/")+1:]
+	return cloudInstance{"gcp", region, zone, machineType, doc.ID.String()}, nil
+}
+
+// azureMetadata reads the compute section of the azure instance metadata service.
+func azureMetadata(client *http.Client) (cloudInstance, error) {
+	req, _ := http.NewRequest("GET", "http://169.254.169.254/metadata/instance/compute?api-version=2021-02-01", nil)
+	req.Header.Set("Metadata", "true")
+	body, err := metadataGet(client, req)
+	if err != nil {
+		return cloudInstance{}, fmt.Errorf("azure: %v", err)
+	}
+	var doc struct {
+		Location string `json:"location"`
+		Zone     string `json:"zone"`
+		VMSize   string `json:"vmSize"`
+		VMID     string `json:"vmId"`
+	}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return cloudInstance{}, fmt.Errorf("azure: %v", err)
+	}
+	return cloudInstance{"azure", doc.Location, doc.Zone, doc.VMSize, doc.VMID}, nil
+}
+
+// metadataGet sends a metadata request and returns the body of a successful response.
+func metadataGet(client *http.Client, req *http.Request) ([]byte, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return body, nil
+}
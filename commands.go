@@ -0,0 +1,840 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+// bandwidthPattern matches iperf bandwidth targets such as 500K, 50M or 1.5G.
+var bandwidthPattern = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?[KMGkmg]?$`)
+
+// congestionPattern matches the names of the kernel's TCP congestion control algorithms such as bbr or cubic.
+var congestionPattern = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// commands returns the subcommands of the app, the global flags apply to all of them.
+func commands() []*cli.Command {
+	return []*cli.Command{
+		{
+			Name:  "run",
+			Usage: "poll the perf servers every test interval and record the results (default)",
+			Action: func(c *cli.Context) error {
+				runApp(false, false)
+				return nil
+			},
+		},
+		{
+			Name:  "once",
+			Usage: "poll every perf server a single time, record the results and exit",
+			Action: func(c *cli.Context) error {
+				runApp(true, false)
+				return nil
+			},
+		},
+		{
+			Name:  "cronjob",
+			Usage: "run a single test cycle with the native clients for a Kubernetes CronJob, exiting non-zero if a test or write failed",
+			Action: func(c *cli.Context) error {
+				return cronJobAction()
+			},
+		},
+		{
+			Name:  "server",
+			Usage: "run the perf server listener of the selected engine in the foreground",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:        "listen-port",
+					Value:       "",
+					Usage:       "port the listener binds to, defaults to the engine's default port",
+					Destination: &cliFlags.listenPort,
+					EnvVars:     []string{"CBANDWIDTH_LISTEN_PORT"},
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return runServer()
+			},
+		},
+		{
+			Name:   "goperf-client",
+			Usage:  "run a test against a goperf server and print its JSON result, run by the goperf engine",
+			Hidden: true,
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "address", Required: true},
+				&cli.StringFlag{Name: "port", Value: defaultGoperfPort},
+				&cli.StringFlag{Name: "bind"},
+				&cli.IntFlag{Name: "cport"},
+				&cli.IntFlag{Name: "length", Value: 10},
+				&cli.IntFlag{Name: "parallel", Value: 1},
+				&cli.BoolFlag{Name: "reverse"},
+				&cli.BoolFlag{Name: "udp"},
+				&cli.IntFlag{Name: "packet-size", Value: 1400},
+				&cli.StringFlag{Name: "bandwidth"},
+				&cli.StringFlag{Name: "secret", EnvVars: []string{goperfSecretEnv}},
+			},
+			Action: func(c *cli.Context) error {
+				opts := goperfClientOptions{
+					address:    c.String("address"),
+					port:       c.String("port"),
+					bind:       c.String("bind"),
+					cport:      c.Int("cport"),
+					seconds:    c.Int("length"),
+					streams:    c.Int("parallel"),
+					reverse:    c.Bool("reverse"),
+					udp:        c.Bool("udp"),
+					packetSize: c.Int("packet-size"),
+					secret:     c.String("secret"),
+				}
+				if opts.seconds <= 0 || opts.streams <= 0 || opts.packetSize < goperfUDPHeader {
+					return cli.Exit("length, parallel and packet-size must be positive", 1)
+				}
+				if bandwidth := c.String("bandwidth"); bandwidth != "" {
+					rate, err := parseBandwidth(bandwidth)
+					if err != nil {
+						return cli.Exit(err, 1)
+					}
+					opts.rate = rate
+				}
+				if err := runGoperfClient(opts); err != nil {
+					return cli.Exit(err, 1)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "controller",
+			Usage: "serve endpoint assignments to agents and write the results they push to the configured sinks",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:        "listen",
+					Value:       "",
+					Usage:       "address the controller listens on, defaults to :8443",
+					Destination: &cliFlags.controllerListen,
+					EnvVars:     []string{"CBANDWIDTH_CONTROLLER_LISTEN"},
+				},
+				&cli.StringFlag{
+					Name:        "tls-cert",
+					Value:       "",
+					Usage:       "PEM certificate served by the controller, plain HTTP is used without one",
+					Destination: &cliFlags.controllerTLSCert,
+					EnvVars:     []string{"CBANDWIDTH_CONTROLLER_TLS_CERT"},
+				},
+				&cli.StringFlag{
+					Name:        "tls-key",
+					Value:       "",
+					Usage:       "PEM private key of the controller certificate",
+					Destination: &cliFlags.controllerTLSKey,
+					EnvVars:     []string{"CBANDWIDTH_CONTROLLER_TLS_KEY"},
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if err := runController(); err != nil {
+					return cli.Exit(err, 1)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "config",
+			Usage: "configuration file utilities",
+			Subcommands: []*cli.Command{
+				{
+					Name:  "validate",
+					Usage: "validate the configuration file and CLI options without running any tests",
+					Action: func(c *cli.Context) error {
+						return validateAction()
+					},
+				},
+			},
+		},
+		{
+			Name:  "grafana",
+			Usage: "grafana utilities",
+			Subcommands: []*cli.Command{
+				{
+					Name:  "provision",
+					Usage: "create or update a ready-made dashboard through the grafana HTTP API",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:        "url",
+							Value:       "",
+							Usage:       "grafana base URL ex. --url=http://grafana:3000",
+							Destination: &cliFlags.grafanaURL,
+							EnvVars:     []string{"CBANDWIDTH_GRAFANA_URL"},
+						},
+						&cli.StringFlag{
+							Name:        "token",
+							Value:       "",
+							Usage:       "grafana service account token or API key",
+							Destination: &cliFlags.grafanaToken,
+							EnvVars:     []string{"CBANDWIDTH_GRAFANA_TOKEN"},
+						},
+						&cli.StringFlag{
+							Name:        "datasource",
+							Value:       "",
+							Usage:       "uid of the grafana datasource the panels query, defaults to the grafana default datasource",
+							Destination: &cliFlags.grafanaDatasource,
+							EnvVars:     []string{"CBANDWIDTH_GRAFANA_DATASOURCE"},
+						},
+						&cli.StringFlag{
+							Name:        "datasource-type",
+							Value:       "",
+							Usage:       "query language of the panels, graphite or influx, defaults to the --tsdbtype",
+							Destination: &cliFlags.grafanaDatasourceType,
+							EnvVars:     []string{"CBANDWIDTH_GRAFANA_DATASOURCE_TYPE"},
+						},
+						&cli.StringFlag{
+							Name:        "folder-uid",
+							Value:       "",
+							Usage:       "uid of the grafana folder the dashboard is saved in, defaults to the General folder",
+							Destination: &cliFlags.grafanaFolderUID,
+							EnvVars:     []string{"CBANDWIDTH_GRAFANA_FOLDER_UID"},
+						},
+					},
+					Action: func(c *cli.Context) error {
+						if err := provisionAction(); err != nil {
+							return cli.Exit(err, 1)
+						}
+						return nil
+					},
+				},
+			},
+		},
+		{
+			Name:  "report",
+			Usage: "summarize the results stored by the file output per endpoint as a Markdown or HTML report",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:        "period",
+					Value:       "30d",
+					Usage:       "the period summarized, compared to the period before it, ex. --period=7d",
+					Destination: &cliFlags.reportPeriod,
+				},
+				&cli.StringFlag{
+					Name:        "format",
+					Value:       reportFormatMarkdown,
+					Usage:       "the report format, markdown or html",
+					Destination: &cliFlags.reportFormat,
+				},
+				&cli.StringFlag{
+					Name:        "output",
+					Value:       "",
+					Usage:       "file the report is written to, defaults to stdout",
+					Destination: &cliFlags.reportOutput,
+				},
+				&cli.StringFlag{
+					Name:        "dir",
+					Value:       "",
+					Usage:       "directory of the stored results, defaults to the file-output dir",
+					Destination: &cliFlags.reportDir,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if err := reportAction(); err != nil {
+					return cli.Exit(err, 1)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "baseline",
+			Usage: "move the learned anomaly baselines and parallel tunings between agents",
+			Subcommands: []*cli.Command{
+				{
+					Name:  "export",
+					Usage: "export the baselines of a running agent from its API, for the --baseline-import of its replacement",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:        "agent",
+							Value:       defaultTopAgent,
+							Usage:       "URL of the agent API, served with --api-listen",
+							Destination: &cliFlags.baselineAgent,
+						},
+						&cli.StringFlag{
+							Name:        "address",
+							Value:       "",
+							Usage:       "only export the baselines of the endpoint with this address",
+							Destination: &cliFlags.baselineAddress,
+						},
+						&cli.StringFlag{
+							Name:        "output",
+							Value:       "",
+							Usage:       "file the baselines are written to, defaults to stdout",
+							Destination: &cliFlags.baselineOutput,
+						},
+					},
+					Action: func(c *cli.Context) error {
+						if err := baselineExportAction(); err != nil {
+							return cli.Exit(err, 1)
+						}
+						return nil
+					},
+				},
+			},
+		},
+		{
+			Name:      "probe",
+			Usage:     "characterize a new endpoint once and print a summary and a suggested iperf-servers entry",
+			ArgsUsage: "[name=]address[:port]",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:        "length",
+					Value:       defaultProbeLength,
+					Usage:       "the length in seconds of every test of the probe",
+					Destination: &cliFlags.probeLength,
+				},
+				&cli.StringFlag{
+					Name:        "max-streams",
+					Value:       defaultProbeMaxStreams,
+					Usage:       "the most parallel streams the sweep doubles up to",
+					Destination: &cliFlags.probeMaxStreams,
+				},
+				&cli.StringFlag{
+					Name:        "pings",
+					Value:       defaultProbePings,
+					Usage:       "the number of pings the latency is measured with",
+					Destination: &cliFlags.probePings,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if c.NArg() != 1 {
+					return cli.Exit("probe takes the endpoint to characterize, ex. cloud-bandwidth probe east=10.0.0.5", 1)
+				}
+				if err := probeAction(c.Args().First()); err != nil {
+					return cli.Exit(err, 1)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "top",
+			Usage: "show the live results, the running test, error counts and next cycles of an agent from its API",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:        "agent",
+					Value:       defaultTopAgent,
+					Usage:       "URL of the agent API, served with --api-listen",
+					Destination: &cliFlags.topAgent,
+					EnvVars:     []string{"CBANDWIDTH_TOP_AGENT"},
+				},
+				&cli.StringFlag{
+					Name:        "refresh",
+					Value:       "2",
+					Usage:       "the time in seconds between refreshes",
+					Destination: &cliFlags.topRefresh,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if err := topAction(); err != nil {
+					return cli.Exit(err, 1)
+				}
+				return nil
+			},
+		},
+		{
+			Name:      "verify",
+			Usage:     "check the signatures of measurements exported from the JSON sinks, exiting non-zero if any was altered",
+			ArgsUsage: "[file ...]",
+			Flags: []cli.Flag{
+				&cli.StringSliceFlag{
+					Name:        "public-key",
+					Usage:       "public key PEM file of an agent, repeat the flag for the results of several agents",
+					Destination: &cliFlags.verifyKeys,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if err := verifyAction(c.Args().Slice()); err != nil {
+					return cli.Exit(err, 1)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "provision",
+			Usage: "start perf server VMs in cloud regions and add them to the configuration file",
+			Flags: fleetFlags(),
+			Action: func(c *cli.Context) error {
+				if err := provisionFleetAction(); err != nil {
+					return cli.Exit(err, 1)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "deprovision",
+			Usage: "terminate the perf server VMs started by provision and remove them from the configuration file",
+			Flags: fleetFlags(),
+			Action: func(c *cli.Context) error {
+				if err := deprovisionFleetAction(); err != nil {
+					return cli.Exit(err, 1)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "version",
+			Usage: "print the version, git commit, build date and Go version",
+			Action: func(c *cli.Context) error {
+				printVersion(c.App.Name)
+				return nil
+			},
+		},
+		{
+			Name:      "completion",
+			Usage:     "print the shell completion script for bash or zsh",
+			ArgsUsage: "bash|zsh",
+			Action: func(c *cli.Context) error {
+				switch c.Args().First() {
+				case "bash":
+					fmt.Print(bashCompletion)
+				case "zsh":
+					fmt.Print(zshCompletion)
+				default:
+					return cli.Exit("completion requires a shell argument, either bash or zsh", 1)
+				}
+				return nil
+			},
+		},
+	}
+}
+
+// runServer starts the listener of the selected engine, natively or in a container, and blocks until it exits.
+func runServer() error {
+	// the engine and the goperf server settings come from the configuration file like the agent's
+	config := loadConfig()
+	if err := checkConfig(config, true); err != nil {
+		return cli.Exit(err, 1)
+	}
+	if err := initAudit(); err != nil {
+		return cli.Exit(err, 1)
+	}
+	eng, err := selectEngine(config)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	if eng.serverArgs == nil && eng.serve == nil {
+		return cli.Exit(fmt.Sprintf("the %s engine has no server to run", eng.name), 1)
+	}
+	port := cliFlags.listenPort
+	if port == "" {
+		port = eng.port
+	}
+	if eng.serve != nil {
+		configureGoperfEngine(config.Goperf)
+		log.Infof("Starting the %s server on port %s", eng.name, port)
+		if err := eng.serve(port); err != nil {
+			return cli.Exit(err, 1)
+		}
+		return nil
+	}
+
+	var command []string
+	if cliFlags.noContainer {
+		command = append([]string{eng.serverBinary}, strings.Fields(eng.serverArgs(port))...)
+	} else {
+		image := eng.serverImage
+		if cliFlags.imageRepo != defaultIperfRepo {
+			image = cliFlags.imageRepo
+		}
+		if image == "" {
+			return cli.Exit(fmt.Sprintf("there is no default container image for the %s server, pass one with --image or use the flag \"--nocontainer\"", eng.name), 1)
+		}
+		runtime, err := checkContainerRuntime()
+		if err != nil {
+			return cli.Exit(err.Error(), 1)
+		}
+		if err := prepareImage(runtime, image); err != nil {
+			return cli.Exit(err.Error(), 1)
+		}
+		command = append(insertRunArgs([]string{runtime, "run", "-i", "--rm", "-p", port + ":" + port, image}, imageRunArgs()...), strings.Fields(eng.serverArgs(port))...)
+	}
+
+	log.Infof("Starting the %s server on port %s", eng.name, port)
+	return runCmdAttached(command)
+}
+
+// checkConfig logs every problem of the configuration a run or server would start with, the error stops it.
+func checkConfig(config configuration, server bool) error {
+	errs := validateConfig(config, server)
+	for _, err := range errs {
+		log.Error(err)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("the configuration is invalid, see the errors above")
+	}
+	return nil
+}
+
+// validateAction loads the configuration and reports every problem found instead of stopping at the first.
+func validateAction() error {
+	if _, err := os.Stat(cliFlags.configPath); err != nil {
+		return cli.Exit(fmt.Sprintf("configuration file %s could not be read: %v", cliFlags.configPath, err), 1)
+	}
+	config := loadConfig()
+	errs := validateConfig(config, false)
+	for _, err := range errs {
+		log.Error(err)
+	}
+	if len(errs) > 0 {
+		return cli.Exit(fmt.Sprintf("configuration %s is invalid", cliFlags.configPath), 1)
+	}
+	log.Infof("configuration %s is valid", cliFlags.configPath)
+	return nil
+}
+
+// validateConfig checks the merged configuration for problems that would otherwise only show up at runtime. A server
+// has no endpoints of its own, server leaves them out of the checks.
+func validateConfig(config configuration, server bool) []error {
+	var errs []error
+
+	if eng, err := selectEngine(config); err != nil {
+		errs = append(errs, err)
+	} else if eng.name == engineSSH && config.SSH.User == "" {
+		errs = append(errs, fmt.Errorf("the ssh engine requires a user in ssh.user or --ssh-user"))
+	}
+	for _, setting := range []struct{ name, value string }{
+		{"test-interval", cliFlags.testInterval},
+		{"test-length", cliFlags.testLength},
+		{"influx-timeout", cliFlags.influxTimeout},
+		{"influx-flush-interval", cliFlags.influxFlushInterval},
+	} {
+		if seconds, err := strconv.Atoi(setting.value); err != nil || seconds <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be a positive number of seconds, got %q", setting.name, setting.value))
+		}
+	}
+	for _, setting := range []struct{ name, value string }{
+		{"test-gap", cliFlags.testGap},
+		{"test-gap-jitter", cliFlags.testGapJitter},
+		{"precheck-timeout", cliFlags.precheckTimeout},
+		{"omit", cliFlags.omit},
+		{"warmup", cliFlags.warmup},
+		{"busy-retry-wait", cliFlags.busyRetryWait},
+	} {
+		if seconds, err := strconv.Atoi(setting.value); err != nil || seconds < 0 {
+			errs = append(errs, fmt.Errorf("%s must be zero or a positive number of seconds, got %q", setting.name, setting.value))
+		}
+	}
+	if err := validateNetperfTests(); err != nil {
+		errs = append(errs, err)
+	}
+	if retries, err := strconv.Atoi(cliFlags.influxRetries); err != nil || retries < 0 {
+		errs = append(errs, fmt.Errorf("influx-retries must be zero or a positive number, got %q", cliFlags.influxRetries))
+	}
+	if retries, err := strconv.Atoi(cliFlags.busyRetries); err != nil || retries < 0 {
+		errs = append(errs, fmt.Errorf("busy-retries must be zero or a positive number, got %q", cliFlags.busyRetries))
+	}
+	if _, err := parseLabels(cliFlags.labels.Value()); err != nil {
+		errs = append(errs, err)
+	}
+	if cliFlags.auditLog != "" {
+		if _, _, err := auditRotation(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if cliFlags.graphiteProtocol != graphiteProtocolLine && cliFlags.graphiteProtocol != graphiteProtocolPickle {
+		errs = append(errs, fmt.Errorf("graphite-protocol must be line or pickle, got %q", cliFlags.graphiteProtocol))
+	}
+	if cliFlags.graphiteFormat != graphiteFormatDotted && cliFlags.graphiteFormat != graphiteFormatTagged {
+		errs = append(errs, fmt.Errorf("graphite-format must be dotted or tagged, got %q", cliFlags.graphiteFormat))
+	}
+	if size, err := strconv.Atoi(cliFlags.influxBatchSize); err != nil || size <= 0 {
+		errs = append(errs, fmt.Errorf("influx-batch-size must be a positive number of lines, got %q", cliFlags.influxBatchSize))
+	}
+	errs = append(errs, validateAnomaly()...)
+	if cliFlags.heartbeatValue != "sequence" && cliFlags.heartbeatValue != "timestamp" {
+		if _, err := strconv.ParseFloat(cliFlags.heartbeatValue, 64); err != nil {
+			errs = append(errs, fmt.Errorf("heartbeat-value must be sequence, timestamp or a number, got %q", cliFlags.heartbeatValue))
+		}
+	}
+	if cliFlags.latency {
+		if count, err := strconv.Atoi(cliFlags.latencyCount); err != nil || count <= 0 {
+			errs = append(errs, fmt.Errorf("latency-count must be a positive number of pings, got %q", cliFlags.latencyCount))
+		}
+	}
+	if cliFlags.callSim {
+		if rate, err := parseBandwidth(cliFlags.callBitrate); err != nil || rate <= 0 {
+			errs = append(errs, fmt.Errorf("call-bitrate must be a positive number with an optional K, M or G suffix, got %q", cliFlags.callBitrate))
+		}
+		if size, err := strconv.Atoi(cliFlags.callPacketSize); err != nil || size <= 0 {
+			errs = append(errs, fmt.Errorf("call-packet-size must be a positive number of bytes, got %q", cliFlags.callPacketSize))
+		}
+		if length, err := strconv.Atoi(cliFlags.callLength); err != nil || length <= 0 {
+			errs = append(errs, fmt.Errorf("call-length must be a positive number of seconds, got %q", cliFlags.callLength))
+		}
+	}
+	errs = append(errs, validateProfiles(config.Profiles)...)
+	errs = append(errs, validateCompare(config.Profiles)...)
+	errs = append(errs, validateBudget(config.Budget)...)
+	errs = append(errs, validateSLA(config)...)
+	errs = append(errs, validateBreaker(config.Breaker)...)
+	errs = append(errs, validateSlots(config)...)
+	errs = append(errs, validateGuardrails(config.Guardrails)...)
+	errs = append(errs, validatePriority()...)
+	errs = append(errs, validateNoShell(config)...)
+	errs = append(errs, validateImagePull()...)
+	errs = append(errs, validateExec(config)...)
+	errs = append(errs, validateGoperf(config)...)
+	if skew, err := strconv.ParseFloat(cliFlags.clockSkewWarn, 64); err != nil || skew < 0 {
+		errs = append(errs, fmt.Errorf("clock-skew-warn must be zero or a positive number of seconds, got %q", cliFlags.clockSkewWarn))
+	}
+	if cliFlags.clockSource == clockSourceInflux && config.InfluxURL == "" {
+		errs = append(errs, fmt.Errorf("clock-source influx requires an influx URL"))
+	}
+	if samples, err := strconv.Atoi(cliFlags.samples); err != nil || samples < 1 {
+		errs = append(errs, fmt.Errorf("samples must be a positive number, got %q", cliFlags.samples))
+	}
+	if omit, err := strconv.Atoi(cliFlags.omit); err == nil {
+		if length, err := strconv.Atoi(cliFlags.testLength); err == nil && omit >= length {
+			errs = append(errs, fmt.Errorf("omit must be shorter than the test-length of %ds, got %ds", length, omit))
+		}
+	}
+	if !validParallel(cliFlags.parallelConn) {
+		errs = append(errs, fmt.Errorf("parallel-connections must be a positive number of streams or auto, got %q", cliFlags.parallelConn))
+	}
+	if streams, err := strconv.Atoi(cliFlags.parallelMax); err != nil || streams <= 0 {
+		errs = append(errs, fmt.Errorf("parallel-max must be a positive number of streams, got %q", cliFlags.parallelMax))
+	}
+	if seconds, err := strconv.Atoi(cliFlags.parallelRetune); err != nil || seconds < 0 {
+		errs = append(errs, fmt.Errorf("parallel-retune must be zero or a positive number of seconds, got %q", cliFlags.parallelRetune))
+	}
+	if seconds, err := strconv.Atoi(cliFlags.fullRateInterval); err != nil || seconds < 0 {
+		errs = append(errs, fmt.Errorf("full-rate-interval must be zero or a positive number of seconds, got %q", cliFlags.fullRateInterval))
+	}
+	if threshold, err := strconv.ParseFloat(cliFlags.nicCheckThreshold, 64); err != nil || threshold < 0 {
+		errs = append(errs, fmt.Errorf("nic-check-threshold must be zero or a positive percentage, got %q", cliFlags.nicCheckThreshold))
+	}
+	if cliFlags.congestion != "" && !congestionPattern.MatchString(cliFlags.congestion) {
+		errs = append(errs, fmt.Errorf("congestion must be the name of a congestion control algorithm such as bbr or cubic, got %q", cliFlags.congestion))
+	}
+	if cliFlags.bandwidthCap != "" && !bandwidthPattern.MatchString(cliFlags.bandwidthCap) {
+		errs = append(errs, fmt.Errorf("bandwidth-cap must be a number with an optional K, M or G suffix, got %q", cliFlags.bandwidthCap))
+	}
+	if cliFlags.httpsProxy != "" {
+		if proxyURL, err := url.Parse(cliFlags.httpsProxy); err != nil || proxyURL.Host == "" {
+			errs = append(errs, fmt.Errorf("https-proxy must be a URL such as http://proxy:3128, got %q", cliFlags.httpsProxy))
+		}
+	}
+	errs = append(errs, validateWebhook(config.Webhook)...)
+	errs = append(errs, validateZabbix(config.Zabbix)...)
+	errs = append(errs, validateNetdata(config.Netdata)...)
+	errs = append(errs, validateTextfile(config.Textfile)...)
+	errs = append(errs, validateUnits(config.Units)...)
+	if config.Pushgateway.URL != "" {
+		if pushURL, err := url.Parse(config.Pushgateway.URL); err != nil || pushURL.Host == "" {
+			errs = append(errs, fmt.Errorf("pushgateway-url must be a URL such as http://pushgateway:9091, got %q", config.Pushgateway.URL))
+		}
+	}
+	if config.Broker.URL != "" {
+		if _, err := brokerProtocol(config.Broker.URL); err != nil {
+			errs = append(errs, err)
+		}
+		if config.Broker.QoS < 0 || config.Broker.QoS > 2 {
+			errs = append(errs, fmt.Errorf("broker-qos must be 0, 1 or 2, got %d", config.Broker.QoS))
+		}
+	}
+	// the endpoints may also come from a config source or the controller
+	if !server && len(allServers(config)) == 0 && !config.Discovery.Kubernetes.enabled() && config.ConfigSource.URL == "" && config.Agent.ControllerURL == "" {
+		errs = append(errs, fmt.Errorf("no perf servers were configured in iperf-servers, groups, --perf-servers, discovery, a config source or a controller"))
+	}
+	errs = append(errs, validateDiscovery(config.Discovery)...)
+	errs = append(errs, validateGroups(config)...)
+	errs = append(errs, validateTenants(config)...)
+	errs = append(errs, validateAlerts(config.Alerts)...)
+	errs = append(errs, validateHooks(config.Hooks)...)
+	errs = append(errs, validateClientPorts(config)...)
+	errs = append(errs, validateEventTriggers(config)...)
+	errs = append(errs, validateMaintenance(config.Maintenance)...)
+	errs = append(errs, validateTestWindows(config.TestWindows)...)
+	for i, server := range allServers(config) {
+		if server.Address == "" {
+			errs = append(errs, fmt.Errorf("perf server %d has no address", i+1))
+		}
+		if server.Engine != "" {
+			if _, ok := engines[server.Engine]; !ok {
+				errs = append(errs, fmt.Errorf("perf server %s engine %q must be one of iperf3, iperf2, netperf, ssh, exec or goperf", server.Address, server.Engine))
+			}
+		}
+		if server.Port != "" {
+			if port, err := strconv.Atoi(server.Port); err != nil || port < 1 || port > 65535 {
+				errs = append(errs, fmt.Errorf("perf server %s port must be a number between 1 and 65535, got %q", server.Address, server.Port))
+			}
+		}
+		if server.Ports != "" {
+			if _, err := parsePortRange(server.Ports); err != nil {
+				errs = append(errs, fmt.Errorf("perf server %s: %v", server.Address, err))
+			}
+			if server.Port != "" {
+				errs = append(errs, fmt.Errorf("perf server %s: set either port or ports", server.Address))
+			}
+			if server.Tunnel != nil {
+				errs = append(errs, fmt.Errorf("perf server %s: a tunnel forwards a single port, ports can't be tunneled", server.Address))
+			}
+			if eng, err := selectEngine(config); err == nil {
+				if name := endpointEngine(eng, server).name; name != engineIperf3 && name != engineIperf2 {
+					errs = append(errs, fmt.Errorf("perf server %s: the %s engine can't stripe a test across ports, use iperf3 or iperf2", server.Address, name))
+				}
+			}
+		}
+		for _, fallback := range server.Fallbacks {
+			if fallback == "" || fallback == server.Address || strings.ContainsAny(fallback, " /") {
+				errs = append(errs, fmt.Errorf("perf server %s fallbacks must be other addresses of the endpoint, got %q", server.Address, fallback))
+			}
+		}
+		if len(server.Fallbacks) > 0 && server.Tunnel != nil {
+			errs = append(errs, fmt.Errorf("perf server %s: a tunnel only forwards to the endpoint's address, it can't have fallbacks", server.Address))
+		}
+		if server.UnderlayAddress != "" && server.UnderlayAddress == server.Address {
+			errs = append(errs, fmt.Errorf("perf server %s underlay-address must be another address of the endpoint, outside the VPN", server.Address))
+		}
+		if server.BandwidthCap != "" && !bandwidthPattern.MatchString(server.BandwidthCap) {
+			errs = append(errs, fmt.Errorf("perf server %s bandwidth-cap must be a number with an optional K, M or G suffix, got %q", server.Address, server.BandwidthCap))
+		}
+		if err := validateRemoteDocker(server.Docker); err != nil {
+			errs = append(errs, fmt.Errorf("perf server %s: %v", server.Address, err))
+		}
+		if server.Docker != nil {
+			if server.Tunnel != nil {
+				errs = append(errs, fmt.Errorf("perf server %s: the server containers of a docker host can't be tunneled", server.Address))
+			}
+			if eng, err := selectEngine(config); err == nil {
+				if endpointEng := endpointEngine(eng, server); endpointEng.serverArgs == nil || endpointEng.prepare != nil {
+					errs = append(errs, fmt.Errorf("perf server %s: the %s engine can't start its server on a docker host, use iperf3, iperf2 or netperf", server.Address, endpointEng.name))
+				}
+			}
+		}
+		errs = append(errs, validateNetns(config, server)...)
+		errs = append(errs, validateIperfAuth(config, server)...)
+		if err := validateTunnel(server.Tunnel); err != nil {
+			errs = append(errs, fmt.Errorf("perf server %s: %v", server.Address, err))
+		}
+		if server.Tunnel != nil {
+			// netperf opens its data connection on a port negotiated over the control connection
+			if eng, err := selectEngine(config); err == nil && endpointEngine(eng, server).name == engineNetperf {
+				errs = append(errs, fmt.Errorf("perf server %s: netperf tests can't be tunneled, use iperf3 or iperf2", server.Address))
+			}
+		}
+	}
+	if cliFlags.graphiteTemplate != "" {
+		if _, err := parseGraphiteTemplate(cliFlags.graphiteTemplate); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if _, err := parseInfluxTemplate(config.InfluxTemplate); err != nil {
+		errs = append(errs, err)
+	}
+	if config.FileOutput.Dir != "" {
+		if err := validateFileOutputConfig(config.FileOutput); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if config.Grafana.Annotations {
+		if config.Grafana.URL == "" || config.Grafana.Token == "" {
+			errs = append(errs, fmt.Errorf("grafana annotations require a grafana url and token"))
+		}
+		if config.Grafana.AnnotationThreshold != "" && !bandwidthPattern.MatchString(config.Grafana.AnnotationThreshold) {
+			errs = append(errs, fmt.Errorf("grafana annotation-threshold must be a number with an optional K, M or G suffix, got %q", config.Grafana.AnnotationThreshold))
+		}
+	}
+	if len(config.Kafka.Brokers) > 0 {
+		if err := validateKafkaConfig(config.Kafka); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
+
+// bashCompletion is the urfave/cli bash completion script for the app.
+const bashCompletion = `#! /bin/bash
+
+_cloud_bandwidth_bash_autocomplete() {
+  if [[ "${COMP_WORDS[0]}" != "source" ]]; then
+    local cur opts base
+    COMPREPLY=()
+    cur="${COMP_WORDS[COMP_CWORD]}"
+    if [[ "$cur" == "-"* ]]; then
+      opts=$( ${COMP_WORDS[@]:0:$COMP_CWORD} ${cur} --generate-bash-completion )
+    else
+      opts=$( ${COMP_WORDS[@]:0:$COMP_CWORD} --generate-bash-completion )
+    fi
+    COMPREPLY=( $(compgen -W "${opts}" -- ${cur}) )
+    return 0
+  fi
+}
+
+complete -o bashdefault -o default -o nospace -F _cloud_bandwidth_bash_autocomplete cloud-bandwidth
+`
+
+// zshCompletion is the urfave/cli zsh completion script for the app.
+const zshCompletion = `#compdef cloud-bandwidth
+
+_cloud_bandwidth_zsh_autocomplete() {
+  local -a opts
+  local cur
+  cur=${words[-1]}
+  if [[ "$cur" == "-"* ]]; then
+    opts=("${(@f)$(_CLI_ZSH_AUTOCOMPLETE_HACK=1 ${words[@]:0:#words[@]-1} ${cur} --generate-bash-completion)}")
+  else
+    opts=("${(@f)$(_CLI_ZSH_AUTOCOMPLETE_HACK=1 ${words[@]:0:#words[@]-1} --generate-bash-completion)}")
+  fi
+
+  if [[ "${opts[1]}" != "" ]]; then
+    _describe 'values' opts
+  else
+    _files
+  fi
+}
+
+compdef _cloud_bandwidth_zsh_autocomplete cloud-bandwidth
+`
+
+// fleetFlags are the flags shared by the provision and deprovision commands.
+func fleetFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:        "provider",
+			Value:       providerAWS,
+			Usage:       "cloud provider to start the perf servers in, only aws is supported",
+			Destination: &cliFlags.fleetProvider,
+			EnvVars:     []string{"CBANDWIDTH_PROVIDER"},
+		},
+		&cli.StringFlag{
+			Name:        "regions",
+			Value:       "",
+			Usage:       "comma separated regions ex. --regions=us-east-1,eu-west-1",
+			Destination: &cliFlags.fleetRegions,
+			EnvVars:     []string{"CBANDWIDTH_REGIONS"},
+		},
+		&cli.StringFlag{
+			Name:        "instance-type",
+			Value:       defaultInstanceType,
+			Usage:       "instance type of the perf server VMs",
+			Destination: &cliFlags.fleetInstanceType,
+			EnvVars:     []string{"CBANDWIDTH_INSTANCE_TYPE"},
+		},
+		&cli.StringFlag{
+			Name:        "fleet",
+			Value:       defaultFleetName,
+			Usage:       "name the VMs and security groups are tagged with, deprovision only removes this fleet",
+			Destination: &cliFlags.fleetName,
+			EnvVars:     []string{"CBANDWIDTH_FLEET"},
+		},
+		&cli.StringFlag{
+			Name:        "allow-cidr",
+			Usage:       "source range allowed to reach the perf server port, required by provision ex. the agents' 203.0.113.0/24",
+			Destination: &cliFlags.fleetAllowCIDR,
+			EnvVars:     []string{"CBANDWIDTH_ALLOW_CIDR"},
+		},
+		&cli.BoolFlag{
+			Name:        "write-config",
+			Value:       true,
+			Usage:       "add or remove the perf servers in the configuration file, a copy is kept as a .bak file",
+			Destination: &cliFlags.fleetWriteConfig,
+			EnvVars:     []string{"CBANDWIDTH_WRITE_CONFIG"},
+		},
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// comparePrefix is appended to the prefixes of the candidate engine's results so they stay out of the series
+// of the endpoint's own engine.
+const comparePrefix = ".candidate"
+
+// compareConfig is the comparison mode. Every endpoint is tested a second time with a candidate engine right
+// after its own engine, or two test profiles are compared, and the difference to the baseline is recorded so an
+// engine or agent upgrade can be validated before cutting over.
+type compareConfig struct {
+	// Engine is the candidate engine compared to the endpoint's engine.
+	Engine string `yaml:"engine"`
+	// Profiles are the baseline and candidate test profiles compared to each other.
+	Profiles []string `yaml:"profiles"`
+	// Congestion is the candidate TCP congestion control algorithm compared to the endpoint's own.
+	Congestion string `yaml:"congestion"`
+}
+
+// baselineResult is a result of an endpoint kept to compare a candidate with.
+type baselineResult struct {
+	bps       int64
+	bandwidth string
+}
+
+// cycleResults are the first bitrate measured against an endpoint in each direction in a cycle, by test profile.
+type cycleResults map[string]baselineResult
+
+// add keeps the result of a test unless the profile and direction already have one.
+func (r cycleResults) add(server perfServer, direction string, bps int64, bandwidth string) {
+	key := profileName(server) + "|" + direction
+	if _, ok := r[key]; !ok {
+		r[key] = baselineResult{bps: bps, bandwidth: bandwidth}
+	}
+}
+
+// get returns the result of a profile, empty without profiles, in a direction.
+func (r cycleResults) get(profile string, direction string) (baselineResult, bool) {
+	result, ok := r[profile+"|"+direction]
+	return result, ok
+}
+
+// profileName is the name of the test profile an endpoint is tested with, empty without profiles.
+func profileName(server perfServer) string {
+	if server.profile == nil {
+		return ""
+	}
+	return server.profile.Name
+}
+
+// compareProfileNames splits the compare-profiles setting into the baseline and candidate profile names.
+func compareProfileNames(list string) []string {
+	var names []string
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// validateCompare checks the candidate engine exists, the candidate congestion control algorithm is a plain name
+// and the compared profiles are configured.
+func validateCompare(profiles []testProfile) []error {
+	var errs []error
+	if cliFlags.compareEngine != "" {
+		if _, ok := engines[cliFlags.compareEngine]; !ok {
+			errs = append(errs, fmt.Errorf("compare engine %q must be one of iperf3, iperf2, netperf, ssh, exec or goperf", cliFlags.compareEngine))
+		}
+	}
+	if cliFlags.compareCongestion != "" {
+		if !congestionPattern.MatchString(cliFlags.compareCongestion) {
+			errs = append(errs, fmt.Errorf("compare congestion must be the name of a congestion control algorithm such as bbr or cubic, got %q", cliFlags.compareCongestion))
+		}
+		// both candidates would be recorded under the same .candidate prefix
+		if cliFlags.compareEngine != "" {
+			errs = append(errs, fmt.Errorf("compare engine and compare congestion can't be set together"))
+		}
+	}
+	names := compareProfileNames(cliFlags.compareProfiles)
+	if len(names) == 0 {
+		return errs
+	}
+	if len(names) != 2 || names[0] == names[1] {
+		return append(errs, fmt.Errorf("compare profiles must name a baseline and a candidate test profile, got %q", cliFlags.compareProfiles))
+	}
+	for _, name := range names {
+		found := false
+		for _, profile := range profiles {
+			found = found || profile.Name == name
+		}
+		if !found {
+			errs = append(errs, fmt.Errorf("compare profile %q is not a configured test profile", name))
+		}
+	}
+	return errs
+}
+
+// compareEngine tests an endpoint with the candidate engine and records the difference to the endpoint's own
+// engine in every direction both can test. The candidate runs at the bandwidth of the baseline test under the
+// endpoint's profile, it connects to its own default port.
+func compareEngine(config configuration, settings runSettings, clients map[string]engineClient, eng engine, server perfServer, results cycleResults) {
+	client, ok := clients[settings.compareEngine]
+	if !ok || client.name == eng.name {
+		return
+	}
+	candidate := client.engine
+	if server.Tunnel != nil {
+		log.Debugf("Skipping the %s comparison to %s [%s], it is only run against endpoints reached directly", candidate.name, server.Address, server.displayName())
+		return
+	}
+	server.Port, server.Engine = "", candidate.name
+
+	var cleanup func()
+	if candidate.prepare != nil && settings.dryRun {
+		log.Infof("[DRY RUN] Would prepare the %s test to %s", candidate.name, server.Address)
+	} else if candidate.prepare != nil {
+		var err error
+		if cleanup, err = candidate.prepare(candidate, server); err != nil {
+			log.Errorf("Error preparing the %s comparison to %s: %v", candidate.name, server.Address, err)
+			return
+		}
+		defer cleanup()
+	}
+
+	// the candidate's results are kept apart and out of the anomaly baselines
+	test := settings
+	test.downloadPrefix += comparePrefix
+	test.uploadPrefix += comparePrefix
+	test.anomalyDrop = 0
+	test.netperfTest, test.netperfCPU = "", false
+	if candidate.name == engineNetperf {
+		test.netperfTest = netperfTCP
+	}
+	for _, direction := range []string{directionDownload, directionUpload} {
+		baseline, ok := results.get(profileName(server), direction)
+		if !ok || (direction == directionUpload && !candidate.upload) {
+			continue
+		}
+		if baseline.bandwidth != "" && !candidate.bandwidthCap {
+			log.Debugf("Skipping the %s comparison to %s [%s], it can't run at the %s of the baseline", candidate.name, server.Address, server.displayName(), baseline.bandwidth)
+			continue
+		}
+		bps, ok := runPerfTest(config, test, client, server, direction, baseline.bandwidth)
+		if ok {
+			recordComparison(config, settings, eng, server, direction, eng.name, baseline.bps, candidate.name, bps)
+		}
+	}
+}
+
+// compareCongestion tests an endpoint a second time with the candidate TCP congestion control algorithm right
+// after its own, ex. CUBIC against BBR over a lossy path, and records the difference in every direction. The
+// candidate runs at the bandwidth of the baseline test under the endpoint's profile.
+func compareCongestion(config configuration, settings runSettings, client engineClient, server perfServer, results cycleResults) {
+	eng := client.engine
+	if !eng.congestion {
+		log.Debugf("Skipping the %s congestion control comparison to %s [%s], %s can't set the algorithm", settings.compareCongestion, server.Address, server.displayName(), eng.name)
+		return
+	}
+	baselineName := settings.congestion
+	if server.profile != nil && server.profile.Congestion != "" {
+		// the profile's algorithm would otherwise win over the candidate's
+		profile := *server.profile
+		baselineName, profile.Congestion = profile.Congestion, ""
+		server.profile = &profile
+	}
+	if baselineName == settings.compareCongestion {
+		return
+	}
+	if baselineName == "" {
+		baselineName = "default"
+	}
+
+	// the candidate's results are kept apart and out of the anomaly baselines
+	test := settings
+	test.downloadPrefix += comparePrefix
+	test.uploadPrefix += comparePrefix
+	test.anomalyDrop = 0
+	test.congestion = settings.compareCongestion
+	for _, direction := range []string{directionDownload, directionUpload} {
+		baseline, ok := results.get(profileName(server), direction)
+		if !ok || (direction == directionUpload && !eng.upload) {
+			continue
+		}
+		bps, ok := runPerfTest(config, test, client, server, direction, baseline.bandwidth)
+		if ok {
+			recordComparison(config, settings, eng, server, direction, baselineName, baseline.bps, settings.compareCongestion, bps)
+		}
+	}
+}
+
+// compareProfiles records the difference between the results of the compared test profiles of an endpoint.
+func compareProfiles(config configuration, settings runSettings, eng engine, server perfServer, results cycleResults) {
+	profiles := settings.compareProfiles
+	for _, direction := range []string{directionDownload, directionUpload} {
+		baseline, ok := results.get(profiles[0], direction)
+		if !ok {
+			continue
+		}
+		if candidate, ok := results.get(profiles[1], direction); ok {
+			recordComparison(config, settings, eng, server, direction, profiles[0], baseline.bps, profiles[1], candidate.bps)
+		}
+	}
+}
+
+// recordComparison records the difference of a candidate to its baseline under <prefix>.compare_delta in bps, the
+// compare_delta_bps metric, and <prefix>.compare_delta_pct in percent of the baseline, tagged with the names of both.
+func recordComparison(config configuration, settings runSettings, eng engine, server perfServer, direction string, baselineName string, baseline int64, candidateName string, candidate int64) {
+	prefix := settings.downloadPrefix
+	if direction == directionUpload {
+		prefix = settings.uploadPrefix
+	}
+	delta := candidate - baseline
+	server.Tags = withTag(withTag(server.Tags, "baseline", baselineName), "candidate", candidateName)
+	server.runID = newRunID()
+	log.Infof("%s comparison of %s to %s for endpoint %s [%s] -> %d bps vs %d bps (run %s)", strings.Title(direction), candidateName, baselineName, server.Address, server.displayName(), candidate, baseline, server.runID)
+	recordTestMetric(config, settings, eng, server, direction, prefix, "compare_delta", float64(delta))
+	if baseline > 0 {
+		recordTestMetric(config, settings, eng, server, direction, prefix, "compare_delta_pct", float64(delta)/float64(baseline)*100)
+	}
+}
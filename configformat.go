@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	configYAML = "yaml"
+	configJSON = "json"
+	configTOML = "toml"
+)
+
+// configFormat is the format of a configuration file from its extension, YAML unless it's .json or .toml.
+func configFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return configJSON
+	case ".toml":
+		return configTOML
+	}
+	return configYAML
+}
+
+// configToYAML converts a JSON or TOML configuration to YAML, so every format is loaded by the same code with the
+// same keys, the configuration profiles included. A YAML configuration is returned as is.
+func configToYAML(data []byte, format string) ([]byte, error) {
+	var doc interface{}
+	switch format {
+	case configJSON:
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		if err := decoder.Decode(&doc); err != nil {
+			return nil, fmt.Errorf("invalid JSON configuration: %v", err)
+		}
+		doc = jsonNumbers(doc)
+	case configTOML:
+		var table map[string]interface{}
+		if err := toml.Unmarshal(data, &table); err != nil {
+			return nil, fmt.Errorf("invalid TOML configuration: %v", err)
+		}
+		doc = tomlTimes(table)
+	default:
+		return data, nil
+	}
+	return yaml.Marshal(doc)
+}
+
+// jsonNumbers turns the numbers of a decoded JSON document into integers where they're whole, so they're written
+// to YAML the way they were in the JSON.
+func jsonNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = jsonNumbers(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = jsonNumbers(item)
+		}
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	}
+	return value
+}
+
+// tomlTimes turns the dates and times of a decoded TOML document into their text, the configuration has no date
+// fields and YAML would write them as timestamps.
+func tomlTimes(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = tomlTimes(item)
+		}
+	case []map[string]interface{}:
+		for _, item := range v {
+			tomlTimes(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = tomlTimes(item)
+		}
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	}
+	return value
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestTOMLConfigToYAML(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		toml  string
+		check func(t *testing.T, config configuration)
+	}{
+		{
+			name: "arrays of tables",
+			toml: `
+test-length = "10"
+
+[[iperf-servers]]
+address = "172.17.0.3"
+name = "azure"
+
+[[iperf-servers]]
+address = "172.17.0.4"
+name = "aws"
+port = "5202"
+`,
+			check: func(t *testing.T, config configuration) {
+				if config.TestLength != "10" {
+					t.Errorf("test-length = %q, want 10", config.TestLength)
+				}
+				want := []perfServer{
+					{Address: "172.17.0.3", Name: "azure"},
+					{Address: "172.17.0.4", Name: "aws", Port: "5202"},
+				}
+				if !reflect.DeepEqual(config.PerfServers, want) {
+					t.Errorf("iperf-servers = %+v, want %+v", config.PerfServers, want)
+				}
+			},
+		},
+		{
+			name: "inline tables",
+			toml: `
+iperf-servers = [
+  { address = "172.17.0.3", name = "azure", tags = { region = "us-east", tier = "gold" } },
+]
+`,
+			check: func(t *testing.T, config configuration) {
+				if len(config.PerfServers) != 1 {
+					t.Fatalf("iperf-servers = %+v, want one endpoint", config.PerfServers)
+				}
+				want := map[string]string{"region": "us-east", "tier": "gold"}
+				if !reflect.DeepEqual(config.PerfServers[0].Tags, want) {
+					t.Errorf("tags = %v, want %v", config.PerfServers[0].Tags, want)
+				}
+			},
+		},
+		{
+			name: "multiline strings",
+			toml: `
+influx-url = """
+http://influx.example.com:8086\
+"""
+grafana-address = '''
+192.168.1.100'''
+`,
+			check: func(t *testing.T, config configuration) {
+				if config.InfluxURL != "http://influx.example.com:8086" {
+					t.Errorf("influx-url = %q, the line ending backslash should join the lines", config.InfluxURL)
+				}
+				if config.TsdbServer != "192.168.1.100" {
+					t.Errorf("grafana-address = %q, the newline after the opening quotes should be trimmed", config.TsdbServer)
+				}
+			},
+		},
+		{
+			name: "escapes",
+			toml: `
+[[iperf-servers]]
+address = "172.17.0.3"
+name = "tab\there \"quoted\" é \\ end"
+`,
+			check: func(t *testing.T, config configuration) {
+				want := "tab\there \"quoted\" é \\ end"
+				if len(config.PerfServers) != 1 || config.PerfServers[0].Name != want {
+					t.Errorf("iperf-servers = %+v, want the name %q", config.PerfServers, want)
+				}
+			},
+		},
+		{
+			name: "numbers and dates",
+			toml: `
+test-length = 10
+test-interval = 300
+https-proxy = 1979-05-27T07:32:00Z
+`,
+			check: func(t *testing.T, config configuration) {
+				if config.TestLength != "10" || config.TestInterval != "300" {
+					t.Errorf("test-length = %q, test-interval = %q, want 10 and 300", config.TestLength, config.TestInterval)
+				}
+				if config.HTTPSProxy != "1979-05-27T07:32:00Z" {
+					t.Errorf("https-proxy = %q, want the date as text", config.HTTPSProxy)
+				}
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data, err := configToYAML([]byte(tc.toml), configTOML)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var config configuration
+			if err := yaml.Unmarshal(data, &config); err != nil {
+				t.Fatalf("%v in\n%s", err, data)
+			}
+			tc.check(t, config)
+		})
+	}
+}
+
+func TestTOMLConfigErrors(t *testing.T) {
+	for _, doc := range []string{
+		"test-length = ",
+		"[zabbix]\n[zabbix]\n",
+		"name = \"unterminated",
+		"a = { b = 1",
+	} {
+		if _, err := configToYAML([]byte(doc), configTOML); err == nil {
+			t.Errorf("configToYAML(%q) succeeded, want an error", doc)
+		}
+	}
+}
+
+// TestConfigFormatsAgree checks that a YAML, JSON and TOML configuration load the same.
+func TestConfigFormatsAgree(t *testing.T) {
+	documents := map[string]string{
+		configYAML: `
+test-length: "10"
+iperf-servers:
+  - address: 172.17.0.3
+    name: azure
+    tags:
+      region: us-east
+`,
+		configJSON: `{"test-length": 10, "iperf-servers": [{"address": "172.17.0.3", "name": "azure", "tags": {"region": "us-east"}}]}`,
+		configTOML: `
+test-length = 10
+
+[[iperf-servers]]
+address = "172.17.0.3"
+name = "azure"
+tags = { region = "us-east" }
+`,
+	}
+	var want configuration
+	for _, format := range []string{configYAML, configJSON, configTOML} {
+		data, err := configToYAML([]byte(documents[format]), format)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		var config configuration
+		if err := yaml.Unmarshal(data, &config); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if format == configYAML {
+			want = config
+		} else if !reflect.DeepEqual(config, want) {
+			t.Errorf("the %s configuration loads as %+v, the YAML one as %+v", format, config, want)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// configProfilesKey holds the named configuration profiles of a configuration file. It isn't profiles, which
+// are the test profiles.
+const configProfilesKey = "config-profiles"
+
+// applyConfigProfile overlays a named profile of the configuration file on the settings outside of the profiles,
+// so a single file can serve several deployment tiers with shared defaults. Sections are merged key by key, any
+// other value of the profile replaces the shared one, lists included. The profiles are dropped from the returned
+// document, which is the file unchanged if no profile was selected.
+func applyConfigProfile(data []byte, name string) ([]byte, error) {
+	var doc map[interface{}]interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return data, nil
+	}
+	profiles, _ := doc[configProfilesKey].(map[interface{}]interface{})
+	profile, ok := profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("configuration profile %q is not defined under %s, the defined profiles are: %s", name, configProfilesKey, configProfileNames(profiles))
+	}
+	overlay, ok := profile.(map[interface{}]interface{})
+	if !ok && profile != nil {
+		return nil, fmt.Errorf("configuration profile %q must be a map of settings", name)
+	}
+	delete(doc, configProfilesKey)
+	mergeYAML(doc, overlay)
+	return yaml.Marshal(doc)
+}
+
+// mergeYAML merges an overlay into a YAML map in place, nested maps are merged and other values replaced.
+func mergeYAML(base map[interface{}]interface{}, overlay map[interface{}]interface{}) {
+	for key, value := range overlay {
+		if overlayMap, ok := value.(map[interface{}]interface{}); ok {
+			if baseMap, ok := base[key].(map[interface{}]interface{}); ok {
+				mergeYAML(baseMap, overlayMap)
+				continue
+			}
+		}
+		base[key] = value
+	}
+}
+
+// configProfileNames lists the names of the configuration profiles for messages.
+func configProfileNames(profiles map[interface{}]interface{}) string {
+	if len(profiles) == 0 {
+		return "none"
+	}
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, fmt.Sprint(name))
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
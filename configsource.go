@@ -0,0 +1,557 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	configSourceConsul = "consul"
+	configSourceEtcd   = "etcd"
+	// configSourceFile is the local configuration file watched by the config event trigger.
+	configSourceFile = "file"
+	// configSourceWait is how long a consul blocking query waits for a change.
+	configSourceWait = 5 * time.Minute
+	// configSourceRetry is the pause after a failed read or watch.
+	configSourceRetry = 10 * time.Second
+	// configFilePoll is how often the modification time of the local configuration file is checked.
+	configFilePoll = 5 * time.Second
+)
+
+type configSourceConfig struct {
+	// URL selects the backend and the key prefix ex. consul://consul:8500/cloud-bandwidth/site-a or
+	// etcd://etcd:2379/cloud-bandwidth/site-a, +https after the scheme uses TLS.
+	URL string `yaml:"url"`
+	// Token is the consul ACL token, etcd credentials are passed as user:password@ in the URL.
+	Token string `yaml:"token"`
+}
+
+// remoteConfig is the part of the configuration read from the config source, the settings it leaves out keep
+// their local values.
+type remoteConfig struct {
+	PerfServers      []perfServer  `yaml:"iperf-servers"`
+	Profiles         []testProfile `yaml:"profiles"`
+	TestInterval     string        `yaml:"test-interval"`
+	TestLength       string        `yaml:"test-length"`
+	Parallel         string        `yaml:"parallel"`
+	Omit             string        `yaml:"omit"`
+	Warmup           string        `yaml:"warmup"`
+	Samples          string        `yaml:"samples"`
+	BandwidthCap     string        `yaml:"bandwidth-cap"`
+	FullRateInterval string        `yaml:"full-rate-interval"`
+	TestGap          string        `yaml:"test-gap"`
+	TestGapJitter    string        `yaml:"test-gap-jitter"`
+	ShuffleEndpoints *bool         `yaml:"shuffle-endpoints"`
+}
+
+// configSource watches a consul KV prefix or etcd key range for the endpoints and test settings. Each key
+// under the prefix holds the YAML value of the setting named after it ex. cloud-bandwidth/site-a/test-length,
+// or the prefix key itself holds a whole YAML document.
+type configSource struct {
+	backend string
+	baseURL string
+	prefix  string
+	token   string
+	user    *url.Userinfo
+	client  *http.Client
+
+	mu      sync.Mutex
+	current *remoteConfig
+}
+
+var remoteSource *configSource
+
+// fileSource is the local configuration file re-read when it changes, with the config event trigger. The config
+// source wins over it like over the rest of the local configuration.
+var fileSource *configSource
+
+// mergeConfigSourceFlags fills any config source settings missing from the configuration file with the CLI values.
+func mergeConfigSourceFlags(cc *configSourceConfig) {
+	if cc.URL == "" {
+		cc.URL = cliFlags.configSource
+	}
+	if cc.Token == "" {
+		cc.Token = cliFlags.configSourceToken
+	}
+}
+
+// initConfigSource reads the config source once and keeps watching it in the background. An unreachable
+// source isn't fatal, the local configuration is used until it can be read.
+func initConfigSource(cc configSourceConfig) error {
+	if cc.URL == "" {
+		return nil
+	}
+	u, err := url.Parse(cc.URL)
+	if err != nil {
+		return fmt.Errorf("invalid config source URL: %v", err)
+	}
+	backend := strings.TrimSuffix(u.Scheme, "+https")
+	if backend != configSourceConsul && backend != configSourceEtcd {
+		return fmt.Errorf("config source URL must start with consul:// or etcd://, got %q", cc.URL)
+	}
+	scheme := "http"
+	if strings.HasSuffix(u.Scheme, "+https") {
+		scheme = "https"
+	}
+	prefix := u.Path
+	if backend == configSourceConsul {
+		prefix = strings.Trim(prefix, "/")
+	}
+	if prefix == "" || prefix == "/" {
+		return fmt.Errorf("config source URL must include a key prefix ex. %s://%s/cloud-bandwidth", backend, u.Host)
+	}
+	remoteSource = &configSource{
+		backend: backend,
+		baseURL: scheme + "://" + u.Host,
+		prefix:  prefix,
+		token:   cc.Token,
+		user:    u.User,
+		// no client timeout, watches are long lived and bounded by the backend
+		client: &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment}},
+	}
+	log.Debugf("[Config] Config Source = %s %s%s", backend, remoteSource.baseURL, "/"+strings.TrimPrefix(prefix, "/"))
+
+	index, err := remoteSource.refresh("")
+	if err != nil {
+		log.Errorf("Error reading the config source, using the local configuration until it can be read: %v", err)
+	}
+	go remoteSource.watch(index)
+	return nil
+}
+
+// initConfigFileSource watches the local configuration file with the config event trigger, a change to its
+// endpoints or test settings is applied like a change in the config source. The file's other settings are only
+// read at startup.
+func initConfigFileSource() error {
+	if !eventTriggers[triggerConfig] || !configFilePresent {
+		return nil
+	}
+	fileSource = &configSource{backend: configSourceFile, prefix: cliFlags.configPath}
+	info, err := os.Stat(fileSource.prefix)
+	if err != nil {
+		return err
+	}
+	if _, err := fileSource.refresh(""); err != nil {
+		return err
+	}
+	go fileSource.watchFile(info.ModTime())
+	return nil
+}
+
+// watchFile re-reads the local configuration file every time its modification time changes.
+func (c *configSource) watchFile(modified time.Time) {
+	for range time.Tick(configFilePoll) {
+		info, err := os.Stat(c.prefix)
+		if err != nil {
+			log.Errorf("Error watching the configuration file %s: %v", c.prefix, err)
+			continue
+		}
+		if info.ModTime().Equal(modified) {
+			continue
+		}
+		modified = info.ModTime()
+		if _, err := c.refresh(""); err != nil {
+			log.Errorf("Error reading the configuration file %s: %v", c.prefix, err)
+		}
+	}
+}
+
+// apply overlays the latest config source settings on the local configuration and settings of a cycle.
+func (c *configSource) apply(config configuration, settings runSettings) (configuration, runSettings) {
+	c.mu.Lock()
+	rc := c.current
+	c.mu.Unlock()
+	if rc == nil {
+		return config, settings
+	}
+	if len(rc.PerfServers) > 0 {
+		config.PerfServers = rc.PerfServers
+	}
+	if len(rc.Profiles) > 0 {
+		config.Profiles = rc.Profiles
+		if !containsString(config.GraphiteTags, "profile") {
+			config.GraphiteTags = append([]string{"profile"}, config.GraphiteTags...)
+		}
+	}
+	for _, setting := range []struct {
+		value string
+		field *string
+	}{
+		{rc.TestLength, &settings.length},
+		{rc.Parallel, &settings.parallel},
+		{rc.Omit, &settings.omit},
+		{rc.Warmup, &settings.warmup},
+		{rc.BandwidthCap, &settings.bandwidthCap},
+	} {
+		if setting.value != "" {
+			*setting.field = setting.value
+		}
+	}
+	for _, setting := range []struct {
+		value string
+		field *time.Duration
+	}{
+		{rc.TestInterval, &settings.interval},
+		{rc.FullRateInterval, &settings.fullRateInterval},
+		{rc.TestGap, &settings.testGap},
+		{rc.TestGapJitter, &settings.testGapJitter},
+	} {
+		if setting.value != "" {
+			*setting.field = seconds(setting.value)
+		}
+	}
+	if rc.Samples != "" {
+		settings.samples, _ = strconv.Atoi(rc.Samples)
+	}
+	if rc.ShuffleEndpoints != nil {
+		settings.shuffle = *rc.ShuffleEndpoints
+	}
+	return config, settings
+}
+
+// watch reloads the settings every time the keys change, consul is long polled with blocking queries and
+// etcd is watched with the watch API.
+func (c *configSource) watch(index string) {
+	for {
+		var err error
+		if c.backend == configSourceEtcd {
+			if err = c.etcdWatch(index); err == nil {
+				index, err = c.refresh("")
+			}
+		} else {
+			index, err = c.refresh(index)
+		}
+		if err != nil {
+			log.Errorf("Error watching the config source, retrying in %s: %v", configSourceRetry, err)
+			time.Sleep(configSourceRetry)
+		}
+	}
+}
+
+// refresh reads the keys and stores the parsed settings if they're valid, it returns the index to watch from.
+// For consul a non-empty index makes it a blocking query returning once the keys change.
+func (c *configSource) refresh(index string) (string, error) {
+	var keys map[string][]byte
+	var next string
+	var err error
+	switch c.backend {
+	case configSourceFile:
+		keys, err = readConfigFileKeys(c.prefix)
+	case configSourceEtcd:
+		keys, next, err = c.etcdRange()
+	default:
+		keys, next, err = c.consulKeys(index)
+		if err == nil && next == index {
+			// the blocking query timed out without a change
+			return next, nil
+		}
+	}
+	if err != nil {
+		return index, err
+	}
+	source := "the config source"
+	if c.backend == configSourceFile {
+		source = c.prefix
+	}
+	rc, err := parseRemoteConfig(c.prefix, keys)
+	if err != nil {
+		// keep the last valid settings rather than testing with a half applied change
+		log.Errorf("Ignoring the invalid settings in %s: %v", source, err)
+		return next, nil
+	}
+	if c.backend == configSourceFile {
+		// the passwords of the endpoints are expanded like at startup
+		resolveServerSecrets(rc.PerfServers)
+	}
+	c.mu.Lock()
+	changed := c.current != nil
+	c.current = rc
+	c.mu.Unlock()
+	if changed {
+		log.Infof("Applied the updated settings from %s, %d endpoints", source, len(rc.PerfServers))
+		triggerEvent(triggerConfig)
+	} else {
+		log.Infof("Read the settings from %s, %d endpoints", source, len(rc.PerfServers))
+	}
+	return next, nil
+}
+
+// readConfigFileKeys reads the local configuration file with the settings of the selected profile, as a YAML
+// document under the file's path.
+func readConfigFileKeys(path string) (map[string][]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if data, err = configToYAML(data, configFormat(path)); err != nil {
+		return nil, err
+	}
+	if data, err = applyConfigProfile(data, cliFlags.configProfile); err != nil {
+		return nil, err
+	}
+	return map[string][]byte{path: data}, nil
+}
+
+// parseRemoteConfig builds the settings from the keys under the prefix and validates them.
+func parseRemoteConfig(prefix string, keys map[string][]byte) (*remoteConfig, error) {
+	rc := &remoteConfig{}
+	if doc, ok := keys[prefix]; ok && len(bytes.TrimSpace(doc)) > 0 {
+		if err := yaml.Unmarshal(doc, rc); err != nil {
+			return nil, fmt.Errorf("%s: %v", prefix, err)
+		}
+	}
+	// every key below the prefix is a single setting, they win over the same setting in the prefix document
+	settings := make(map[string]interface{})
+	for key, value := range keys {
+		// a recursive read of cloud-bandwidth/site-a also returns the keys of cloud-bandwidth/site-ab
+		if !strings.HasPrefix(key, strings.TrimSuffix(prefix, "/")+"/") {
+			continue
+		}
+		name := strings.TrimPrefix(key, strings.TrimSuffix(prefix, "/")+"/")
+		if name == "" || strings.HasSuffix(name, "/") {
+			continue
+		}
+		var parsed interface{}
+		if err := yaml.Unmarshal(value, &parsed); err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+		settings[name] = parsed
+	}
+	if len(settings) > 0 {
+		doc, err := yaml.Marshal(settings)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.Unmarshal(doc, rc); err != nil {
+			return nil, err
+		}
+	}
+
+	var errs []string
+	for _, server := range rc.PerfServers {
+		if server.Address == "" {
+			errs = append(errs, "an iperf-servers entry has no address")
+		}
+	}
+	for _, err := range validateProfiles(rc.Profiles) {
+		errs = append(errs, err.Error())
+	}
+	for _, setting := range []struct{ name, value string }{
+		{"test-interval", rc.TestInterval},
+		{"test-length", rc.TestLength},
+		{"samples", rc.Samples},
+	} {
+		if n, err := strconv.Atoi(setting.value); setting.value != "" && (err != nil || n <= 0) {
+			errs = append(errs, fmt.Sprintf("%s must be a positive number, got %q", setting.name, setting.value))
+		}
+	}
+	if rc.Parallel != "" && !validParallel(rc.Parallel) {
+		errs = append(errs, fmt.Sprintf("parallel must be a positive number of streams or auto, got %q", rc.Parallel))
+	}
+	for _, setting := range []struct{ name, value string }{
+		{"omit", rc.Omit},
+		{"warmup", rc.Warmup},
+		{"full-rate-interval", rc.FullRateInterval},
+		{"test-gap", rc.TestGap},
+		{"test-gap-jitter", rc.TestGapJitter},
+	} {
+		if n, err := strconv.Atoi(setting.value); setting.value != "" && (err != nil || n < 0) {
+			errs = append(errs, fmt.Sprintf("%s must be zero or a positive number of seconds, got %q", setting.name, setting.value))
+		}
+	}
+	if rc.BandwidthCap != "" && rc.BandwidthCap != "0" && !bandwidthPattern.MatchString(rc.BandwidthCap) {
+		errs = append(errs, fmt.Sprintf("bandwidth-cap must be a number with an optional K, M or G suffix, got %q", rc.BandwidthCap))
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(errs, ", "))
+	}
+	return rc, nil
+}
+
+// consulKeys reads the keys under the prefix, a non-empty index blocks until they change or the wait passes.
+func (c *configSource) consulKeys(index string) (map[string][]byte, string, error) {
+	query := url.Values{"recurse": {"true"}}
+	if index != "" {
+		query.Set("index", index)
+		query.Set("wait", configSourceWait.String())
+	}
+	req, err := http.NewRequest("GET", c.baseURL+"/v1/kv/"+c.prefix+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, index, err
+	}
+	if c.token != "" {
+		req.Header.Set("X-Consul-Token", c.token)
+	}
+	resp, err := auditedDo(c.client, "consul", req)
+	if err != nil {
+		return nil, index, err
+	}
+	defer resp.Body.Close()
+	next := resp.Header.Get("X-Consul-Index")
+	keys := make(map[string][]byte)
+	if resp.StatusCode == http.StatusNotFound {
+		return keys, next, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, index, fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	var entries []struct {
+		Key   string `json:"Key"`
+		Value []byte `json:"Value"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, index, err
+	}
+	for _, entry := range entries {
+		keys[entry.Key] = entry.Value
+	}
+	return keys, next, nil
+}
+
+// etcdRange reads the keys under the prefix through the etcd v3 JSON gateway and returns the store revision.
+func (c *configSource) etcdRange() (map[string][]byte, string, error) {
+	var result struct {
+		Header struct {
+			Revision string `json:"revision"`
+		} `json:"header"`
+		Kvs []struct {
+			Key   []byte `json:"key"`
+			Value []byte `json:"value"`
+		} `json:"kvs"`
+	}
+	body := map[string]interface{}{"key": []byte(c.prefix), "range_end": etcdPrefixEnd(c.prefix)}
+	resp, err := c.etcdPost("/v3/kv/range", body)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, "", err
+	}
+	keys := make(map[string][]byte)
+	for _, kv := range result.Kvs {
+		keys[string(kv.Key)] = kv.Value
+	}
+	return keys, result.Header.Revision, nil
+}
+
+// etcdWatch blocks until a key under the prefix changes after the revision.
+func (c *configSource) etcdWatch(revision string) error {
+	create := map[string]interface{}{"key": []byte(c.prefix), "range_end": etcdPrefixEnd(c.prefix)}
+	if rev, err := strconv.ParseInt(revision, 10, 64); err == nil {
+		create["start_revision"] = strconv.FormatInt(rev+1, 10)
+	}
+	resp, err := c.etcdPost("/v3/watch", map[string]interface{}{"create_request": create})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// the gateway streams one JSON object per watch response, the first one confirms the watch was created
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var message struct {
+			Result struct {
+				Events []json.RawMessage `json:"events"`
+			} `json:"result"`
+			Error *struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &message); err != nil {
+			return err
+		}
+		if message.Error != nil {
+			return fmt.Errorf("%s", message.Error.Message)
+		}
+		if len(message.Result.Events) > 0 {
+			return nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("the etcd watch was closed")
+}
+
+// etcdPost sends a JSON request to the etcd gateway, authenticating first if the URL has credentials.
+func (c *configSource) etcdPost(path string, body interface{}) (*http.Response, error) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", c.baseURL+path, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.user != nil {
+		token, err := c.etcdToken()
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", token)
+	}
+	resp, err := auditedDo(c.client, "etcd", req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		respBody, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(respBody))
+	}
+	return resp, nil
+}
+
+// etcdToken authenticates with the user and password of the URL, a new token is requested for every call
+// since they expire after a few minutes by default.
+func (c *configSource) etcdToken() (string, error) {
+	password, _ := c.user.Password()
+	payload, _ := json.Marshal(map[string]string{"name": c.user.Username(), "password": password})
+	req, err := http.NewRequest("POST", c.baseURL+"/v3/auth/authenticate", bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := auditedDo(c.client, "etcd", req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Token string `json:"token"`
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("etcd authentication failed with status %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	return result.Token, nil
+}
+
+// etcdPrefixEnd is the range end matching every key starting with the prefix.
+func etcdPrefixEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return []byte{0}
+}
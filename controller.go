@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	agentIDHeader          = "X-Agent-ID"
+	defaultControllerPort  = ":8443"
+	defaultAssignmentGroup = "default"
+	// resultRetention is how long the controller remembers a result to drop it if an agent pushes it again.
+	resultRetention = time.Hour
+)
+
+type controllerConfig struct {
+	Listen  string `yaml:"listen"`
+	TLSCert string `yaml:"tls-cert"`
+	TLSKey  string `yaml:"tls-key"`
+	// Assignments maps agent IDs to the endpoints they test, agents not listed get the "default"
+	// assignment or else every iperf-servers entry.
+	Assignments map[string][]perfServer `yaml:"assignments"`
+}
+
+// agentRecord is an agent known to the controller.
+type agentRecord struct {
+	ID         string    `json:"id"`
+	Hostname   string    `json:"hostname"`
+	Version    string    `json:"version"`
+	RemoteAddr string    `json:"remote-addr"`
+	Registered time.Time `json:"registered"`
+	LastSeen   time.Time `json:"last-seen"`
+}
+
+// agentRegistry holds the registered agents, it is updated concurrently by the request handlers.
+var agentRegistry = struct {
+	sync.RWMutex
+	agents map[string]agentRecord
+}{agents: make(map[string]agentRecord)}
+
+// receivedResults remembers the results pushed by the agents for resultRetention.
+var receivedResults = &resultLog{keys: make(map[string]time.Time)}
+
+// resultLog is the set of results received recently, keyed by their run ID, prefix and metric.
+type resultLog struct {
+	sync.Mutex
+	keys   map[string]time.Time
+	pruned time.Time
+}
+
+// seen records a result and reports whether it was already received.
+func (l *resultLog) seen(key string) bool {
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	if now.Sub(l.pruned) > time.Minute {
+		for k, received := range l.keys {
+			if now.Sub(received) > resultRetention {
+				delete(l.keys, k)
+			}
+		}
+		l.pruned = now
+	}
+	if _, ok := l.keys[key]; ok {
+		return true
+	}
+	l.keys[key] = now
+	return false
+}
+
+// mergeControllerFlags fills any controller settings missing from the configuration file with the CLI values.
+func mergeControllerFlags(cc *controllerConfig) {
+	if cc.Listen == "" {
+		cc.Listen = cliFlags.controllerListen
+	}
+	if cc.TLSCert == "" {
+		cc.TLSCert = cliFlags.controllerTLSCert
+	}
+	if cc.TLSKey == "" {
+		cc.TLSKey = cliFlags.controllerTLSKey
+	}
+	if cc.Listen == "" {
+		cc.Listen = defaultControllerPort
+	}
+}
+
+// runController serves endpoint assignments to the agents and writes the results they push to the sinks.
+func runController() error {
+	config := loadConfig()
+	cc := config.Controller
+	if config.Agent.Key == "" {
+		return fmt.Errorf("the controller requires a shared agent key in agent.key or --agent-key")
+	}
+	setupSinks(config)
+	// the results the agents push are written with the controller's own sink settings
+	settings := resolveSettings()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/register", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var agent agentRecord
+		if err := json.NewDecoder(r.Body).Decode(&agent); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		agent.ID = r.Header.Get(agentIDHeader)
+		agent.RemoteAddr = r.RemoteAddr
+		agent.Registered = time.Now()
+		agent.LastSeen = agent.Registered
+		agentRegistry.Lock()
+		agentRegistry.agents[agent.ID] = agent
+		agentRegistry.Unlock()
+		log.Infof("Registered agent %s (%s %s) from %s", agent.ID, agent.Hostname, agent.Version, agent.RemoteAddr)
+		writeJSON(w, agent)
+	})
+	mux.HandleFunc("/v1/assignments", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, assignmentsFor(config, r.Header.Get(agentIDHeader)))
+	})
+	mux.HandleFunc("/v1/results", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var results []measurement
+		if err := json.NewDecoder(r.Body).Decode(&results); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, m := range results {
+			// an agent resends a batch when it didn't get the response, the results already written are dropped
+			if m.RunID != "" && receivedResults.seen(m.key()) {
+				log.Debugf("Dropping the duplicate result of run %s from agent %s", m.RunID, r.Header.Get(agentIDHeader))
+				continue
+			}
+			recordMeasurement(config, settings, m)
+		}
+		flushSinks()
+		log.Debugf("Received %d results from agent %s", len(results), r.Header.Get(agentIDHeader))
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/v1/slots", handleSlots)
+	mux.HandleFunc("/v1/agents", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, registeredAgents())
+	})
+	handler := authenticateAgents(config.Agent.Key, mux)
+
+	if cc.TLSCert != "" {
+		log.Infof("Serving the controller on %s", cc.Listen)
+		return http.ListenAndServeTLS(cc.Listen, cc.TLSCert, cc.TLSKey, handler)
+	}
+	log.Warnf("Serving the controller on %s without TLS, the agent key is sent in the clear", cc.Listen)
+	return http.ListenAndServe(cc.Listen, handler)
+}
+
+// authenticateAgents rejects requests without the shared key and an agent ID, and tracks when each agent was last seen.
+func authenticateAgents(key string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(key)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		id := r.Header.Get(agentIDHeader)
+		if id == "" {
+			http.Error(w, "missing "+agentIDHeader+" header", http.StatusBadRequest)
+			return
+		}
+		agentRegistry.Lock()
+		if agent, ok := agentRegistry.agents[id]; ok {
+			agent.LastSeen = time.Now()
+			agentRegistry.agents[id] = agent
+		}
+		agentRegistry.Unlock()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// assignmentsFor returns the endpoints an agent tests.
+func assignmentsFor(config configuration, id string) []perfServer {
+	if servers, ok := config.Controller.Assignments[id]; ok {
+		return servers
+	}
+	if servers, ok := config.Controller.Assignments[defaultAssignmentGroup]; ok {
+		return servers
+	}
+	return config.PerfServers
+}
+
+// registeredAgents returns the registered agents sorted by ID.
+func registeredAgents() []agentRecord {
+	agentRegistry.RLock()
+	defer agentRegistry.RUnlock()
+	agents := make([]agentRecord, 0, len(agentRegistry.agents))
+	for _, agent := range agentRegistry.agents {
+		agents = append(agents, agent)
+	}
+	sort.Slice(agents, func(i, j int) bool { return agents[i].ID < agents[j].ID })
+	return agents
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v2"
+)
+
+// failedTests and failedWrites count the tests that failed or couldn't reach their endpoint and the tsdb writes
+// that were given up on, the cronjob command exits non-zero if either is set.
+var failedTests, failedWrites int32
+
+// countTestMetric counts a failed test or an unreachable endpoint from the companion metrics of a test.
+func countTestMetric(name string, value float64) {
+	if (name == "failed" && value > 0) || (name == "reachable" && value == 0) {
+		atomic.AddInt32(&failedTests, 1)
+	}
+}
+
+// cronJobAction runs a single cycle for a Kubernetes CronJob and exits non-zero if a test or write failed, so the
+// Job is marked failed and retried according to its backoffLimit. The clients run natively in the agent's pod.
+func cronJobAction() error {
+	runApp(true, true)
+	tests, writes := atomic.LoadInt32(&failedTests), atomic.LoadInt32(&failedWrites)
+	if tests > 0 || writes > 0 {
+		return cli.Exit(fmt.Sprintf("the test cycle finished with %d failed tests and %d failed writes", tests, writes), 1)
+	}
+	log.Info("The test cycle finished without failures")
+	return nil
+}
+
+// readPerfServersFile reads the perf servers from a file such as a mounted ConfigMap key, either a YAML list in
+// the iperf-servers format or one [name=]host[:port] target per line. Lines starting with # are comments.
+func readPerfServersFile(path string) ([]perfServer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the perf servers file: %v", err)
+	}
+	var servers []perfServer
+	if err := yaml.Unmarshal(data, &servers); err == nil {
+		return servers, nil
+	}
+	var targets []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			targets = append(targets, line)
+		}
+	}
+	servers, err = parsePerfServers(strings.Join(targets, ","))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return servers, nil
+}
+
+// loadEnvFiles sets every flag's environment variable from the file named by the same variable with a _FILE
+// suffix, e.g. CBANDWIDTH_KENTIK_TOKEN_FILE=/var/run/secrets/kentik/token, for secrets mounted as files. A
+// variable that is set wins over its file.
+func loadEnvFiles(flags []cli.Flag) error {
+	var names []string
+	for _, flag := range flags {
+		switch f := flag.(type) {
+		case *cli.StringFlag:
+			names = append(names, f.EnvVars...)
+		case *cli.BoolFlag:
+			names = append(names, f.EnvVars...)
+		case *cli.IntFlag:
+			names = append(names, f.EnvVars...)
+		case *cli.StringSliceFlag:
+			names = append(names, f.EnvVars...)
+		}
+	}
+	for _, name := range names {
+		path, ok := os.LookupEnv(name + "_FILE")
+		// a flag of its own such as CBANDWIDTH_LOG_FILE names a file rather than holding the value of one
+		if !ok || containsString(names, name+"_FILE") {
+			continue
+		}
+		if _, set := os.LookupEnv(name); set {
+			continue
+		}
+		value, err := readSecretFile(path)
+		if err != nil {
+			return fmt.Errorf("%s_FILE: %v", name, err)
+		}
+		os.Setenv(name, value)
+	}
+	return nil
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// kubernetesServiceAccountDir holds the token, CA and namespace mounted into every pod.
+	kubernetesServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+)
+
+// discoveryConfig discovers perf servers in addition to the ones listed in iperf-servers.
+type discoveryConfig struct {
+	Kubernetes kubernetesDiscoveryConfig `yaml:"kubernetes"`
+}
+
+// kubernetesDiscoveryConfig selects the perf server pods of a cluster by label, or the ready addresses of a
+// Service's Endpoints. The pods are read again every cycle so the endpoints follow the pods as they churn.
+type kubernetesDiscoveryConfig struct {
+	// Namespace defaults to the namespace the agent runs in.
+	Namespace string `yaml:"namespace"`
+	// Label is a label selector of the perf server pods ex. app=iperf-server.
+	Label string `yaml:"label"`
+	// Service reads the addresses of the named Service's Endpoints instead of selecting pods.
+	Service string `yaml:"service"`
+	// Port is the port number or the name of the container or Endpoints port the perf server listens on,
+	// the global --perf-server-port is used without one.
+	Port string `yaml:"port"`
+	// Tags are added to every discovered endpoint.
+	Tags map[string]string `yaml:"tags"`
+	// API is the URL of the API server, the in-cluster one by default.
+	API string `yaml:"api"`
+	// Token is the bearer token of the API server, the pod's service account token by default.
+	Token string `yaml:"token"`
+}
+
+// enabled reports whether Kubernetes discovery was configured.
+func (kc kubernetesDiscoveryConfig) enabled() bool {
+	return kc.Label != "" || kc.Service != ""
+}
+
+// kubernetesDiscovery resolves the perf servers from the Kubernetes API.
+type kubernetesDiscovery struct {
+	config    kubernetesDiscoveryConfig
+	apiURL    string
+	tokenFile string
+	client    *http.Client
+
+	mu      sync.Mutex
+	current []perfServer
+}
+
+var discovery *kubernetesDiscovery
+
+// mergeDiscoveryFlags fills any discovery settings missing from the configuration file with the CLI values.
+func mergeDiscoveryFlags(dc *discoveryConfig) {
+	if dc.Kubernetes.Namespace == "" {
+		dc.Kubernetes.Namespace = cliFlags.kubernetesNamespace
+	}
+	if dc.Kubernetes.Label == "" {
+		dc.Kubernetes.Label = cliFlags.kubernetesLabel
+	}
+	if dc.Kubernetes.Service == "" {
+		dc.Kubernetes.Service = cliFlags.kubernetesService
+	}
+}
+
+// validateDiscovery checks the discovery settings.
+func validateDiscovery(dc discoveryConfig) []error {
+	var errs []error
+	kc := dc.Kubernetes
+	if !kc.enabled() {
+		if kc.Namespace != "" || kc.Port != "" || kc.API != "" {
+			errs = append(errs, fmt.Errorf("kubernetes discovery needs a label selector or a service"))
+		}
+		return errs
+	}
+	if kc.Label != "" && kc.Service != "" {
+		errs = append(errs, fmt.Errorf("kubernetes discovery takes either a label selector or a service, not both"))
+	}
+	if kc.API != "" {
+		if u, err := url.Parse(kc.API); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("kubernetes discovery api must be an http or https URL, got %q", kc.API))
+		}
+	}
+	if port, err := strconv.Atoi(kc.Port); err == nil && (port <= 0 || port > 65535) {
+		errs = append(errs, fmt.Errorf("kubernetes discovery port must be between 1 and 65535, got %d", port))
+	}
+	return errs
+}
+
+// initDiscovery sets up Kubernetes discovery and resolves the endpoints once. Outside of a cluster the API URL
+// and token have to be configured.
+func initDiscovery(dc discoveryConfig) error {
+	kc := dc.Kubernetes
+	if !kc.enabled() {
+		return nil
+	}
+	d := &kubernetesDiscovery{config: kc, apiURL: strings.TrimSuffix(kc.API, "/")}
+	tlsConfig := &tls.Config{}
+	if d.apiURL == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return fmt.Errorf("kubernetes discovery needs an api URL when not running in a cluster")
+		}
+		d.apiURL = "https://" + net.JoinHostPort(host, port)
+		pem, err := os.ReadFile(kubernetesServiceAccountDir + "/ca.crt")
+		if err != nil {
+			return fmt.Errorf("could not read the cluster CA certificate: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s/ca.crt", kubernetesServiceAccountDir)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if d.config.Token == "" {
+		// bound service account tokens are rotated, the file is read on every request
+		if _, err := os.Stat(kubernetesServiceAccountDir + "/token"); err == nil {
+			d.tokenFile = kubernetesServiceAccountDir + "/token"
+		}
+	}
+	if d.config.Namespace == "" {
+		namespace, err := os.ReadFile(kubernetesServiceAccountDir + "/namespace")
+		if err != nil {
+			return fmt.Errorf("kubernetes discovery needs a namespace when not running in a cluster")
+		}
+		d.config.Namespace = strings.TrimSpace(string(namespace))
+	}
+	d.client = &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+	}
+	discovery = d
+	selector := "label " + kc.Label
+	if kc.Service != "" {
+		selector = "service " + kc.Service
+	}
+	log.Debugf("[Config] Kubernetes Discovery = %s in namespace %s from %s", selector, d.config.Namespace, d.apiURL)
+	if err := d.refresh(); err != nil {
+		log.Errorf("Error discovering the perf servers in Kubernetes, retrying next cycle: %v", err)
+	}
+	return nil
+}
+
+// apply resolves the perf servers again and adds them to the endpoints of a cycle. The last resolved endpoints
+// are kept while the API can't be read. Listed endpoints take precedence over discovered ones at the same address.
+func (d *kubernetesDiscovery) apply(config configuration) configuration {
+	if err := d.refresh(); err != nil {
+		log.Errorf("Error discovering the perf servers in Kubernetes, using the %d endpoints found before: %v", len(d.discovered()), err)
+	}
+	listed := make(map[string]bool, len(config.PerfServers))
+	for _, server := range config.PerfServers {
+		listed[server.Address] = true
+	}
+	servers := append([]perfServer(nil), config.PerfServers...)
+	for _, server := range d.discovered() {
+		if !listed[server.Address] {
+			servers = append(servers, server)
+		}
+	}
+	config.PerfServers = servers
+	return config
+}
+
+// discovered returns the last resolved endpoints.
+func (d *kubernetesDiscovery) discovered() []perfServer {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.current
+}
+
+// refresh resolves the endpoints and stores them, logging the ones that came and went.
+func (d *kubernetesDiscovery) refresh() error {
+	var servers []perfServer
+	var err error
+	if d.config.Service != "" {
+		servers, err = d.endpointAddresses()
+	} else {
+		servers, err = d.podAddresses()
+	}
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	previous := d.current
+	d.current = servers
+	d.mu.Unlock()
+
+	before := make(map[string]bool, len(previous))
+	for _, server := range previous {
+		before[server.Address] = true
+	}
+	now := make(map[string]bool, len(servers))
+	for _, server := range servers {
+		now[server.Address] = true
+		if !before[server.Address] {
+			log.Infof("Discovered the perf server %s [%s] in Kubernetes", server.Address, server.displayName())
+		}
+	}
+	for _, server := range previous {
+		if !now[server.Address] {
+			log.Infof("The perf server %s [%s] is gone from Kubernetes", server.Address, server.displayName())
+		}
+	}
+	return nil
+}
+
+// kubernetesPodList is the part of a pod list the endpoints are resolved from.
+type kubernetesPodList struct {
+	Items []struct {
+		Metadata struct {
+			Name              string `json:"name"`
+			DeletionTimestamp string `json:"deletionTimestamp"`
+		} `json:"metadata"`
+		Spec struct {
+			NodeName   string `json:"nodeName"`
+			Containers []struct {
+				Ports []struct {
+					Name          string `json:"name"`
+					ContainerPort int    `json:"containerPort"`
+				} `json:"ports"`
+			} `json:"containers"`
+		} `json:"spec"`
+		Status struct {
+			Phase      string `json:"phase"`
+			PodIP      string `json:"podIP"`
+			Conditions []struct {
+				Type   string `json:"type"`
+				Status string `json:"status"`
+			} `json:"conditions"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+// kubernetesEndpoints is the part of an Endpoints object the endpoints are resolved from.
+type kubernetesEndpoints struct {
+	Subsets []struct {
+		Addresses []struct {
+			IP        string `json:"ip"`
+			NodeName  string `json:"nodeName"`
+			TargetRef struct {
+				Name string `json:"name"`
+			} `json:"targetRef"`
+		} `json:"addresses"`
+		Ports []struct {
+			Name string `json:"name"`
+			Port int    `json:"port"`
+		} `json:"ports"`
+	} `json:"subsets"`
+}
+
+// podAddresses resolves the running and ready pods matching the label selector, terminating pods left out.
+func (d *kubernetesDiscovery) podAddresses() ([]perfServer, error) {
+	var pods kubernetesPodList
+	path := fmt.Sprintf("/api/v1/namespaces/%s/pods?labelSelector=%s", url.PathEscape(d.config.Namespace), url.QueryEscape(d.config.Label))
+	if err := d.get(path, &pods); err != nil {
+		return nil, err
+	}
+	var servers []perfServer
+	for _, pod := range pods.Items {
+		if pod.Status.Phase != "Running" || pod.Status.PodIP == "" || pod.Metadata.DeletionTimestamp != "" {
+			continue
+		}
+		ready := false
+		for _, condition := range pod.Status.Conditions {
+			if condition.Type == "Ready" {
+				ready = condition.Status == "True"
+			}
+		}
+		if !ready {
+			continue
+		}
+		port := d.config.Port
+		if _, err := strconv.Atoi(port); port != "" && err != nil {
+			port = ""
+			for _, container := range pod.Spec.Containers {
+				for _, p := range container.Ports {
+					if p.Name == d.config.Port {
+						port = strconv.Itoa(p.ContainerPort)
+					}
+				}
+			}
+			if port == "" {
+				log.Warnf("The pod %s has no port named %s, skipping it", pod.Metadata.Name, d.config.Port)
+				continue
+			}
+		}
+		servers = append(servers, d.server(pod.Status.PodIP, pod.Metadata.Name, pod.Spec.NodeName, port))
+	}
+	return servers, nil
+}
+
+// endpointAddresses resolves the ready addresses of the Service's Endpoints.
+func (d *kubernetesDiscovery) endpointAddresses() ([]perfServer, error) {
+	var endpoints kubernetesEndpoints
+	path := fmt.Sprintf("/api/v1/namespaces/%s/endpoints/%s", url.PathEscape(d.config.Namespace), url.PathEscape(d.config.Service))
+	if err := d.get(path, &endpoints); err != nil {
+		return nil, err
+	}
+	var servers []perfServer
+	for _, subset := range endpoints.Subsets {
+		port := d.config.Port
+		if _, err := strconv.Atoi(port); port != "" && err != nil {
+			port = ""
+			for _, p := range subset.Ports {
+				if p.Name == d.config.Port {
+					port = strconv.Itoa(p.Port)
+				}
+			}
+			if port == "" {
+				log.Warnf("The endpoints of the service %s have no port named %s, skipping them", d.config.Service, d.config.Port)
+				continue
+			}
+		}
+		for _, address := range subset.Addresses {
+			name := address.TargetRef.Name
+			if name == "" {
+				name = address.IP
+			}
+			servers = append(servers, d.server(address.IP, name, address.NodeName, port))
+		}
+	}
+	return servers, nil
+}
+
+// server builds the endpoint of a discovered address, tagged with its namespace and node.
+func (d *kubernetesDiscovery) server(ip string, name string, node string, port string) perfServer {
+	server := perfServer{Address: ip, Name: name, Port: port, Tags: withTag(d.config.Tags, "namespace", d.config.Namespace)}
+	if node != "" {
+		server.Tags["node"] = node
+	}
+	return server
+}
+
+// get reads an object from the API server.
+func (d *kubernetesDiscovery) get(path string, out interface{}) error {
+	req, err := http.NewRequest("GET", d.apiURL+path, nil)
+	if err != nil {
+		return err
+	}
+	token := d.config.Token
+	if token == "" && d.tokenFile != "" {
+		if token, err = readSecretFile(d.tokenFile); err != nil {
+			return err
+		}
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := auditedDo(d.client, "kubernetes", req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %s from the Kubernetes API: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDNSPrefix  = "bandwidth.dns"
+	dnsResolveTimeout = 5 * time.Second
+)
+
+// resolvedStore holds the address each endpoint hostname last resolved to, to detect a changed answer.
+var resolvedStore = struct {
+	sync.Mutex
+	ips map[string]string
+}{ips: make(map[string]string)}
+
+// resolveEndpoint resolves an endpoint's hostname before it is tested and records the resolution time and, from
+// the second cycle on, whether the address changed since the previous cycle. The chosen address is tagged on the
+// endpoint's results as resolved_ip and with --dns-pin the tests of the cycle connect to it, so a flapping DNS
+// answer can't move them to another address halfway through.
+func resolveEndpoint(config configuration, settings runSettings, server perfServer) perfServer {
+	if net.ParseIP(server.Address) != nil {
+		return server
+	}
+	if settings.dryRun {
+		log.Infof("[DRY RUN] Would resolve %s [%s]", server.Address, server.displayName())
+		return server
+	}
+	if server.Tunnel != nil {
+		log.Debugf("Skipping the resolution of %s [%s], it is resolved at the far end of its tunnel", server.Address, server.displayName())
+		return server
+	}
+	runID := newRunID()
+	record := func(name string, metric string, value float64, tags map[string]string) {
+		recordMeasurement(config, settings, measurement{
+			Timestamp:   measurementTime(),
+			Source:      config.Hostname,
+			Destination: server.displayName(),
+			Address:     server.Address,
+			Prefix:      cliFlags.dnsPrefix + "." + name,
+			Metric:      metric,
+			Value:       value,
+			RunID:       runID,
+			Tags:        tags,
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dnsResolveTimeout)
+	defer cancel()
+	start := time.Now()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, server.Address)
+	elapsed := time.Since(start)
+	if err == nil && len(addrs) == 0 {
+		err = &net.DNSError{Err: "no addresses", Name: server.Address}
+	}
+	if err != nil {
+		log.Errorf("Error resolving %s [%s]: %v", server.Address, server.displayName(), err)
+		record("failed", "resolve_failed", 1, server.Tags)
+		return server
+	}
+	// the first answer is the address a dial would try first
+	ip := addrs[0].IP.String()
+	tags := withTag(server.Tags, "resolved_ip", ip)
+	log.Infof("Resolved %s [%s] to %s in %s (run %s)", server.Address, server.displayName(), ip, elapsed, runID)
+	record("resolve", "resolve_ms", durationMillis(elapsed), tags)
+
+	resolvedStore.Lock()
+	previous, seen := resolvedStore.ips[server.Address]
+	resolvedStore.ips[server.Address] = ip
+	resolvedStore.Unlock()
+	if seen {
+		changed := 0.0
+		if previous != ip {
+			changed = 1
+			log.Warnf("Endpoint %s [%s] resolved to %s, it was %s last cycle", server.Address, server.displayName(), ip, previous)
+		}
+		record("changed", "address_changed", changed, tags)
+	}
+
+	server.Tags = tags
+	if settings.dnsPin {
+		server.resolvedIP = ip
+	}
+	return server
+}
+
+// dialAddress is the address the tests of the endpoint connect to, the fallback the pre-check fell back to or the
+// address pinned by --dns-pin if one was resolved this cycle.
+func (p perfServer) dialAddress() string {
+	if p.fallback != "" {
+		return p.fallback
+	}
+	if p.resolvedIP != "" {
+		return p.resolvedIP
+	}
+	return p.Address
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+)
+
+// ipv6Prefix is appended to the prefixes of the IPv6 results of a dual-stack endpoint.
+const ipv6Prefix = ".ipv6"
+
+// resolveDualStack looks up the A and AAAA records of an endpoint hostname with --dual-stack. An endpoint with
+// both is pinned to its first IPv4 address for its own tests and keeps its first IPv6 address to be tested again
+// over, the results of both are tagged with their ip_family. Endpoints with one family are tested as usual.
+func resolveDualStack(settings runSettings, server perfServer) perfServer {
+	if net.ParseIP(server.Address) != nil {
+		return server
+	}
+	if server.Tunnel != nil || server.Interface != "" {
+		log.Debugf("Skipping the dual-stack tests of %s [%s], they're only run against endpoints reached directly", server.Address, server.displayName())
+		return server
+	}
+	if settings.dryRun {
+		log.Infof("[DRY RUN] Would resolve the IPv4 and IPv6 addresses of %s [%s]", server.Address, server.displayName())
+		return server
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dnsResolveTimeout)
+	defer cancel()
+	ipv4, err4 := net.DefaultResolver.LookupIP(ctx, "ip4", server.Address)
+	ipv6, err6 := net.DefaultResolver.LookupIP(ctx, "ip6", server.Address)
+	if err4 != nil || err6 != nil || len(ipv4) == 0 || len(ipv6) == 0 {
+		log.Debugf("Endpoint %s [%s] isn't dual-stack, testing it as usual", server.Address, server.displayName())
+		return server
+	}
+	log.Debugf("Endpoint %s [%s] is dual-stack at %s and %s", server.Address, server.displayName(), ipv4[0], ipv6[0])
+	server.resolvedIP, server.ipv6 = ipv4[0].String(), ipv6[0].String()
+	server.Tags = withTag(server.Tags, "ip_family", "ipv4")
+	return server
+}
+
+// measureDualStack tests a dual-stack endpoint again over IPv6 and records how much faster IPv6 is than IPv4 under
+// <prefix>.ipv6_delta in bps and <prefix>.ipv6_delta_pct in percent of IPv4, negative if IPv6 is slower. The
+// IPv6 results are written under the prefixes with .ipv6 appended and run at the bandwidth of the IPv4 test.
+func measureDualStack(config configuration, settings runSettings, client engineClient, server perfServer, results cycleResults) {
+	eng := client.engine
+	// the tests fell back to another address of the endpoint, its IPv4 results aren't of the hostname
+	if server.fallback != "" {
+		return
+	}
+	v6 := server
+	v6.resolvedIP, v6.ipv6 = server.ipv6, ""
+	v6.Tags = withTag(server.Tags, "ip_family", "ipv6")
+
+	if eng.prepare != nil && settings.dryRun {
+		log.Infof("[DRY RUN] Would prepare the %s test to %s", eng.name, v6.resolvedIP)
+	} else if eng.prepare != nil {
+		cleanup, err := eng.prepare(eng, v6)
+		if err != nil {
+			log.Errorf("Error preparing the %s IPv6 test to %s: %v", eng.name, v6.resolvedIP, err)
+			return
+		}
+		defer cleanup()
+	}
+
+	// the IPv6 results are kept apart and out of the anomaly baselines
+	test := settings
+	test.downloadPrefix += ipv6Prefix
+	test.uploadPrefix += ipv6Prefix
+	test.anomalyDrop = 0
+	for _, direction := range []string{directionDownload, directionUpload} {
+		ipv4, ok := results.get(profileName(server), direction)
+		if !ok {
+			continue
+		}
+		bps, ok := runPerfTest(config, test, client, v6, direction, ipv4.bandwidth)
+		if !ok {
+			continue
+		}
+		prefix := settings.downloadPrefix
+		if direction == directionUpload {
+			prefix = settings.uploadPrefix
+		}
+		delta := bps - ipv4.bps
+		server.runID = newRunID()
+		log.Infof("%s dual-stack delta for endpoint %s [%s] -> %d bps over IPv6 vs %d bps over IPv4 (run %s)", strings.Title(direction), server.Address, server.displayName(), bps, ipv4.bps, server.runID)
+		recordTestMetric(config, settings, eng, server, direction, prefix, "ipv6_delta", float64(delta))
+		if ipv4.bps > 0 {
+			recordTestMetric(config, settings, eng, server, direction, prefix, "ipv6_delta_pct", float64(delta)/float64(ipv4.bps)*100)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultElasticIndex     = "cbandwidth-%{+yyyy.MM.dd}"
+	defaultElasticBatchSize = 100
+	// elasticMaxPending is the most measurements kept for the next flush while no URL can be reached, the oldest
+	// are dropped beyond it.
+	elasticMaxPending = 100000
+)
+
+// elasticDatePattern matches the logstash style date math in index names, e.g. %{+yyyy.MM.dd}.
+var elasticDatePattern = regexp.MustCompile(`%\{\+([^}]+)\}`)
+
+type elasticsearchConfig struct {
+	URLs          []string `yaml:"urls"`
+	Index         string   `yaml:"index"`
+	Username      string   `yaml:"username"`
+	Password      string   `yaml:"password"`
+	APIKey        string   `yaml:"api-key"`
+	BatchSize     int      `yaml:"batch-size"`
+	TLSSkipVerify bool     `yaml:"tls-skip-verify"`
+}
+
+// elasticSink buffers measurement documents and indexes them with the bulk API. Measurements are kept for the
+// next flush if none of the URLs can be reached.
+type elasticSink struct {
+	config  elasticsearchConfig
+	client  *http.Client
+	mu      sync.Mutex
+	pending []measurement
+	dropped int
+}
+
+// elasticDocument is the indexed document, the measurement plus the @timestamp field kibana expects.
+type elasticDocument struct {
+	measurement
+	AtTimestamp time.Time `json:"@timestamp"`
+}
+
+var elastic *elasticSink
+
+// mergeElasticFlags fills any elasticsearch settings missing from the configuration file with the CLI values.
+func mergeElasticFlags(ec *elasticsearchConfig) {
+	if len(ec.URLs) == 0 && cliFlags.elasticURL != "" {
+		ec.URLs = strings.Split(cliFlags.elasticURL, ",")
+	}
+	if ec.Index == "" {
+		ec.Index = cliFlags.elasticIndex
+	}
+	if ec.Username == "" {
+		ec.Username = cliFlags.elasticUsername
+	}
+	if ec.Password == "" {
+		ec.Password = cliFlags.elasticPassword
+	}
+	if ec.APIKey == "" {
+		ec.APIKey = cliFlags.elasticAPIKey
+	}
+	if ec.BatchSize <= 0 {
+		ec.BatchSize = defaultElasticBatchSize
+	}
+}
+
+// initElastic sets up the elasticsearch sink if any URLs were configured.
+func initElastic(ec elasticsearchConfig) {
+	if len(ec.URLs) == 0 {
+		return
+	}
+	if ec.Index == "" {
+		ec.Index = defaultElasticIndex
+	}
+	elastic = &elasticSink{
+		config: ec,
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: ec.TLSSkipVerify},
+			},
+		},
+	}
+	log.Debugf("[Config] Elasticsearch URLs = %s", strings.Join(ec.URLs, ","))
+	log.Debugf("[Config] Elasticsearch Index = %s", ec.Index)
+}
+
+// add buffers a measurement and flushes once another batch is full, so measurements kept from a failed flush
+// are retried with every batch rather than with every measurement.
+func (e *elasticSink) add(m measurement) {
+	e.mu.Lock()
+	e.pending = append(e.pending, m)
+	if over := len(e.pending) - elasticMaxPending; over > 0 {
+		e.pending = e.pending[over:]
+		e.dropped += over
+	}
+	full := len(e.pending)%e.config.BatchSize == 0
+	e.mu.Unlock()
+	if full {
+		e.flush()
+	}
+}
+
+// flush indexes all buffered measurements in a single bulk request, trying each URL in turn. The measurements are
+// put back for the next flush if every URL fails.
+func (e *elasticSink) flush() {
+	e.mu.Lock()
+	batch := e.pending
+	e.pending = nil
+	dropped := e.dropped
+	e.dropped = 0
+	e.mu.Unlock()
+	if dropped > 0 {
+		log.Errorf("Dropped %d elasticsearch measurements, more than %d were waiting to be indexed", dropped, elasticMaxPending)
+	}
+	if len(batch) == 0 {
+		return
+	}
+
+	var body bytes.Buffer
+	for _, m := range batch {
+		// the document ID is derived from the run so a batch retried against the next URL replaces the
+		// documents a partially failed request already indexed
+		action, _ := json.Marshal(map[string]map[string]string{
+			"index": {"_index": elasticIndexName(e.config.Index, m.Timestamp), "_id": elasticDocumentID(m)},
+		})
+		doc, err := json.Marshal(elasticDocument{measurement: m, AtTimestamp: m.Timestamp})
+		if err != nil {
+			log.Errorf("Error encoding the measurement for elasticsearch: %v", err)
+			continue
+		}
+		body.Write(action)
+		body.WriteByte('\n')
+		body.Write(doc)
+		body.WriteByte('\n')
+	}
+
+	var err error
+	for _, url := range e.config.URLs {
+		if err = e.bulk(url, body.Bytes()); err == nil {
+			log.Debugf("Indexed %d measurements to elasticsearch at %s", len(batch), url)
+			return
+		}
+		log.Errorf("Error writing to elasticsearch at %s: %v", url, err)
+	}
+	log.Errorf("Could not index %d measurements to any elasticsearch URL, keeping them for the next flush", len(batch))
+	atomic.AddInt32(&failedWrites, 1)
+	e.mu.Lock()
+	e.pending = append(batch, e.pending...)
+	e.mu.Unlock()
+}
+
+// bulk posts a bulk request body and reports any per document errors.
+func (e *elasticSink) bulk(url string, body []byte) error {
+	req, err := http.NewRequest("POST", strings.TrimRight(url, "/")+"/_bulk", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if e.config.APIKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+e.config.APIKey)
+	} else if e.config.Username != "" {
+		req.SetBasicAuth(e.config.Username, e.config.Password)
+	}
+
+	resp, err := auditedDo(e.client, "elasticsearch", req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, respBody)
+	}
+
+	var result struct {
+		Errors bool `json:"errors"`
+	}
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return err
+	}
+	if result.Errors {
+		// the documents were received, retrying another URL would index the successful ones twice
+		log.Errorf("Elasticsearch rejected some measurements: %s", respBody)
+	}
+	return nil
+}
+
+// elasticIndexName expands the date math in an index pattern for the given time.
+func elasticIndexName(pattern string, t time.Time) string {
+	return elasticDatePattern.ReplaceAllStringFunc(pattern, func(ref string) string {
+		format := elasticDatePattern.FindStringSubmatch(ref)[1]
+		layout := strings.NewReplacer("yyyy", "2006", "yy", "06", "MM", "01", "dd", "02", "HH", "15").Replace(format)
+		return t.UTC().Format(layout)
+	})
+}
+
+// elasticDocumentID is the document ID of a measurement, derived from its run ID, prefix and metric.
+func elasticDocumentID(m measurement) string {
+	sum := sha256.Sum256([]byte(m.key()))
+	return hex.EncodeToString(sum[:16])
+}
@@ -0,0 +1,1528 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	engineIperf3  = "iperf3"
+	engineIperf2  = "iperf2"
+	engineNetperf = "netperf"
+
+	defaultIperf2Port    = "5001"
+	defaultNetserverRepo = "quay.io/networkstatic/netserver"
+)
+
+// Engine runs a single test of a target endpoint with the options of a profile and returns the parsed result.
+// engineClient implements it for the iperf3, iperf2, netperf, goperf and exec engines by running the client their
+// engine descriptor describes, so the tests don't depend on how an engine is driven.
+type Engine interface {
+	Run(ctx context.Context, target perfServer, profile testOptions) (sample, error)
+}
+
+// engine describes how to drive a particular bandwidth measuring client and parse its results.
+type engine struct {
+	name string
+	// server is the name of the remote listener, used in error messages.
+	server string
+	// binary is the client executable used with --nocontainer.
+	binary string
+	// image is the default container image, empty if there is no published image for the engine.
+	image string
+	// local is true if the client always runs on the host, such as the user's command run by the exec engine.
+	local bool
+	// port is the default port of the remote listener.
+	port string
+	// upload is true if the engine can also run the test in the reverse direction.
+	upload bool
+	// args are the client arguments of a test, the client is executed directly without a shell.
+	args func(opts testOptions) []string
+	// parse extracts the result in Kbits/sec from the client output.
+	parse func(output string) (string, error)
+	// retransmits optionally extracts the TCP retransmit count from the client output.
+	retransmits func(output string) (int, bool)
+	// fullRun optionally extracts the average in Kbits/sec over the whole test including the omitted seconds.
+	fullRun func(output string) (string, bool)
+	// omit is true if the engine can leave the first seconds of a test out of the result.
+	omit bool
+	// rawJSON is true if the engine can report its results as JSON for the raw output store.
+	rawJSON bool
+	// failed reports whether the command output indicates the test did not run.
+	failed func(output string) bool
+	// serverBinary is the listener executable started by the server command with --nocontainer.
+	serverBinary string
+	// serverImage is the default container image of the listener, empty if there is no published image.
+	serverImage string
+	// serverArgs are the arguments starting the listener in the foreground on the given port.
+	serverArgs func(port string) string
+	// prepare optionally runs before an endpoint is tested and returns a function undoing it afterwards.
+	prepare func(eng engine, server perfServer) (func(), error)
+	// bandwidthCap is true if the engine can limit the test to a target bandwidth.
+	bandwidthCap bool
+	// metric is the name of the result of tests measuring something other than a bitrate, such as the
+	// transaction rate of the netperf request/response tests. parse then returns the value as is.
+	metric string
+	// cpu optionally extracts the local and remote CPU utilization percentages from the client output.
+	cpu func(output string) (float64, float64, bool)
+	// transferred optionally extracts the bytes a test transferred, they're estimated from the bitrate otherwise.
+	transferred func(output string) (int64, bool)
+	// congestion is true if the engine can set the TCP congestion control algorithm of a test.
+	congestion bool
+	// parallel is true if the engine runs the parallel streams of a test, which can then be tuned.
+	parallel bool
+	// congestionUsed optionally extracts the congestion control algorithm the sender used from the client output.
+	congestionUsed func(output string) (string, bool)
+	// intervals optionally extracts the bitrate of every reporting interval from the JSON report of the client.
+	intervals func(output string) ([]intervalSample, bool)
+	// udp optionally extracts the datagram loss percentage and the jitter in milliseconds of a UDP test.
+	udp func(output string) (float64, float64, bool)
+	// serve optionally runs the listener built into the agent on the given port, instead of serverArgs.
+	serve func(port string) error
+	// cport is true if the client can bind its streams to the ports of --client-ports.
+	cport bool
+	// env optionally returns environment variables added to the client's, such as a secret kept off its command
+	// line.
+	env func() []string
+}
+
+// testOptions are the settings of a single test run.
+type testOptions struct {
+	address string
+	port    string
+	// length is the test duration in seconds.
+	length string
+	// parallel is the number of parallel streams.
+	parallel string
+	// omit is the number of seconds at the start of the test left out of the result, "0" for none.
+	omit string
+	// reverse runs the test in the upload direction.
+	reverse bool
+	// bandwidth is the target rate such as 50M passed to iperf -b, empty for a full rate test.
+	bandwidth string
+	// json asks the client for its JSON report instead of the text output.
+	json bool
+	// testType is the netperf test run, TCP_STREAM if empty.
+	testType string
+	// cpu asks the client to measure the local and remote CPU utilization.
+	cpu bool
+	// congestion is the TCP congestion control algorithm such as bbr or cubic, the host default if empty.
+	congestion string
+	// bind is the local address the client binds to, the address of the endpoint's interface.
+	bind string
+	// cport is the client port of the first stream, the other streams use the ports after it. Empty for
+	// ephemeral ports.
+	cport string
+	// username and publicKey authenticate the iperf3 client, the password is passed in its environment.
+	username  string
+	publicKey string
+	// rawID is the key the output of the run is stored under, empty to not store it.
+	rawID string
+	// udp runs a UDP test at the bandwidth instead of a TCP test, with the iperf3 and goperf engines.
+	udp bool
+}
+
+// iperf3Report is the part of the iperf3 JSON report the results are read from.
+type iperf3Report struct {
+	Intervals []struct {
+		Sum struct {
+			End           float64 `json:"end"`
+			BitsPerSecond float64 `json:"bits_per_second"`
+			Omitted       bool    `json:"omitted"`
+		} `json:"sum"`
+	} `json:"intervals"`
+	End struct {
+		SumSent struct {
+			Bytes         int64   `json:"bytes"`
+			BitsPerSecond float64 `json:"bits_per_second"`
+			Retransmits   int     `json:"retransmits"`
+		} `json:"sum_sent"`
+		SumReceived struct {
+			Bytes         int64   `json:"bytes"`
+			BitsPerSecond float64 `json:"bits_per_second"`
+		} `json:"sum_received"`
+		// Sum is the summary of a UDP test, with the loss and jitter measured by the receiver.
+		Sum struct {
+			BitsPerSecond float64 `json:"bits_per_second"`
+			JitterMs      float64 `json:"jitter_ms"`
+			LostPercent   float64 `json:"lost_percent"`
+			Packets       int64   `json:"packets"`
+		} `json:"sum"`
+		SenderCongestion string `json:"sender_tcp_congestion"`
+	} `json:"end"`
+	Error string `json:"error"`
+}
+
+// parseIperf3JSON decodes an iperf3 JSON report, false if the output is the text format or the test failed.
+func parseIperf3JSON(output string) (iperf3Report, bool) {
+	var report iperf3Report
+	if !strings.HasPrefix(strings.TrimSpace(output), "{") {
+		return report, false
+	}
+	if err := json.Unmarshal([]byte(output), &report); err != nil || report.Error != "" {
+		return report, false
+	}
+	return report, report.receivedBps() > 0
+}
+
+// receivedBps is the bitrate the receiver measured. iperf3 before 3.13 only reports the sum of a UDP test, at the
+// rate sent, the datagrams lost are taken off it.
+func (r iperf3Report) receivedBps() float64 {
+	if r.End.SumReceived.BitsPerSecond > 0 || r.End.Sum.Packets == 0 {
+		return r.End.SumReceived.BitsPerSecond
+	}
+	return r.End.Sum.BitsPerSecond * (1 - r.End.Sum.LostPercent/100)
+}
+
+// fullRunAverage averages the interval reports including the omitted ones.
+func (r iperf3Report) fullRunAverage() (string, bool) {
+	if len(r.Intervals) == 0 {
+		return "", false
+	}
+	var total float64
+	for _, interval := range r.Intervals {
+		total += interval.Sum.BitsPerSecond
+	}
+	return kbitsString(total / float64(len(r.Intervals))), true
+}
+
+// kbitsString formats a bitrate in Kbits/sec the way the text output reports it.
+func kbitsString(bps float64) string {
+	return strconv.FormatFloat(bps/1000, 'f', 2, 64)
+}
+
+var (
+	// iperf3Receiver matches the bitrate of an iperf3 receiver summary line.
+	iperf3Receiver = regexp.MustCompile(`([0-9.]+) Kbits/sec.*receiver`)
+	// iperf3Retransmits matches the Retr column of an iperf3 sender summary line.
+	iperf3Retransmits = regexp.MustCompile(`Kbits/sec\s+([0-9]+)\s+sender`)
+	// iperf3Interval matches the bitrate of an iperf3 interval report, omitted intervals included.
+	iperf3Interval = regexp.MustCompile(`(?m)^\[\s*(SUM|[0-9]+)\]\s+[0-9.]+-[0-9.]+\s+sec\s+[0-9.]+ \w+\s+([0-9.]+) Kbits/sec(.*)$`)
+	// iperfBitrate matches any iperf bitrate reported in Kbits/sec.
+	iperfBitrate = regexp.MustCompile(`([0-9.]+) Kbits/sec`)
+)
+
+var engines = map[string]engine{
+	engineIperf3: {
+		name:         engineIperf3,
+		server:       "iperf",
+		binary:       "iperf3",
+		image:        defaultIperfRepo,
+		port:         defaultIperfPort,
+		upload:       true,
+		bandwidthCap: true,
+		args: func(opts testOptions) []string {
+			args := []string{"-P", opts.parallel, "-t", opts.length, "-f", "k", "-p", opts.port, "-c", opts.address}
+			if opts.json {
+				args = append(args, "-J")
+			}
+			if opts.reverse {
+				args = append(args, "-R")
+			}
+			if opts.omit != "" && opts.omit != "0" {
+				args = append(args, "-O", opts.omit)
+			}
+			if opts.bandwidth != "" {
+				args = append(args, "-b", opts.bandwidth)
+			}
+			if opts.congestion != "" {
+				args = append(args, "-C", opts.congestion)
+			}
+			if opts.bind != "" {
+				args = append(args, "-B", opts.bind)
+			}
+			if opts.cport != "" {
+				args = append(args, "--cport", opts.cport)
+			}
+			if opts.udp {
+				args = append(args, "-u")
+			}
+			return append(args, iperfAuthArgs(opts)...)
+		},
+		// the receiver summary is the last line reporting a bitrate, the SUM line when running parallel streams
+		parse: func(output string) (string, error) {
+			if report, ok := parseIperf3JSON(output); ok {
+				return kbitsString(report.receivedBps()), nil
+			}
+			return lastMatch(iperf3Receiver, output)
+		},
+		fullRun: func(output string) (string, bool) {
+			if report, ok := parseIperf3JSON(output); ok {
+				return report.fullRunAverage()
+			}
+			return fullRunAverage(output)
+		},
+		omit:    true,
+		rawJSON: true,
+		transferred: func(output string) (int64, bool) {
+			report, ok := parseIperf3JSON(output)
+			if !ok {
+				return 0, false
+			}
+			if report.End.SumSent.Bytes > report.End.SumReceived.Bytes {
+				return report.End.SumSent.Bytes, true
+			}
+			return report.End.SumReceived.Bytes, true
+		},
+		retransmits: func(output string) (int, bool) {
+			if report, ok := parseIperf3JSON(output); ok {
+				return report.End.SumSent.Retransmits, true
+			}
+			count, err := lastMatch(iperf3Retransmits, output)
+			if err != nil {
+				return 0, false
+			}
+			retransmits, err := strconv.Atoi(count)
+			return retransmits, err == nil
+		},
+		failed: func(output string) bool {
+			return strings.Contains(output, "error")
+		},
+		congestion: true,
+		parallel:   true,
+		cport:      true,
+		// the JSON report has the algorithm of the sender, the server in the upload direction
+		congestionUsed: func(output string) (string, bool) {
+			report, ok := parseIperf3JSON(output)
+			return report.End.SenderCongestion, ok && report.End.SenderCongestion != ""
+		},
+		intervals: iperf3Intervals,
+		// the loss and jitter of a UDP test are only in the JSON report
+		udp: func(output string) (float64, float64, bool) {
+			report, ok := parseIperf3JSON(output)
+			return report.End.Sum.LostPercent, report.End.Sum.JitterMs, ok && report.End.Sum.Packets > 0
+		},
+		serverBinary: "iperf3",
+		serverImage:  defaultIperfRepo,
+		serverArgs: func(port string) string {
+			return fmt.Sprintf("-s -p %s", port)
+		},
+	},
+	// iperf2 uses the classic iperf client syntax, the reverse test requires an iperf 2.1+ server.
+	engineIperf2: {
+		name:         engineIperf2,
+		server:       "iperf",
+		binary:       "iperf",
+		port:         defaultIperf2Port,
+		upload:       true,
+		bandwidthCap: true,
+		args: func(opts testOptions) []string {
+			args := []string{"-c", opts.address, "-p", opts.port, "-t", opts.length, "-P", opts.parallel, "-f", "k"}
+			if opts.reverse {
+				args = append(args, "--reverse")
+			}
+			if opts.bandwidth != "" {
+				args = append(args, "-b", opts.bandwidth)
+			}
+			if opts.congestion != "" {
+				args = append(args, "-Z", opts.congestion)
+			}
+			if opts.bind != "" {
+				args = append(args, "-B", opts.bind)
+			}
+			return args
+		},
+		parse: func(output string) (string, error) {
+			return lastMatch(iperfBitrate, output)
+		},
+		congestion: true,
+		parallel:   true,
+		failed: func(output string) bool {
+			return strings.Contains(output, "failed") || strings.Contains(output, "error")
+		},
+		serverBinary: "iperf",
+		serverArgs: func(port string) string {
+			return fmt.Sprintf("-s -p %s", port)
+		},
+	},
+	engineNetperf: {
+		name:   engineNetperf,
+		server: "netserver",
+		binary: "netperf",
+		image:  defaultNetperfRepo,
+		port:   defaultNetperfPort,
+		args: func(opts testOptions) []string {
+			testType := opts.testType
+			if testType == "" {
+				testType = netperfTCP
+			}
+			args := []string{"-P", "0", "-t", testType, "-f", "k", "-l", opts.length, "-p", opts.port, "-H", opts.address}
+			if opts.bind != "" {
+				args = append(args, "-L", opts.bind)
+			}
+			if opts.cpu {
+				args = append(args, "-c", "-C")
+			}
+			return args
+		},
+		// with -P 0 netperf prints a single result line, the throughput is the fifth column
+		parse: func(output string) (string, error) {
+			lines := strings.Split(strings.TrimSpace(output), "\n")
+			fields := strings.Fields(lines[len(lines)-1])
+			if len(fields) < 5 {
+				return "", fmt.Errorf("no throughput found in the netperf output")
+			}
+			return fields[4], nil
+		},
+		// the error reporting is not great for netperf so we are basically looking for a word in the STDERR
+		failed: func(output string) bool {
+			return strings.Contains(output, "sure")
+		},
+		serverBinary: "netserver",
+		serverImage:  defaultNetserverRepo,
+		serverArgs: func(port string) string {
+			return fmt.Sprintf("-D -p %s", port)
+		},
+	},
+}
+
+// hostNetworkArgv adds host networking to a container run command.
+func hostNetworkArgv(argv []string) []string {
+	return insertRunArgs(argv, "--network=host")
+}
+
+// insertRunArgs adds options to a container run command right after "run".
+func insertRunArgs(argv []string, args ...string) []string {
+	if len(args) == 0 {
+		return argv
+	}
+	for i, arg := range argv {
+		if arg == "run" {
+			return append(append(append([]string{}, argv[:i+1]...), args...), argv[i+1:]...)
+		}
+	}
+	return argv
+}
+
+// fullRunAverage averages the iperf3 interval reports including the omitted ones, the SUM lines are
+// used when testing with parallel streams.
+func fullRunAverage(output string) (string, bool) {
+	var streams, sums []float64
+	for _, match := range iperf3Interval.FindAllStringSubmatch(output, -1) {
+		if strings.Contains(match[3], "sender") || strings.Contains(match[3], "receiver") {
+			continue
+		}
+		kbps, err := strconv.ParseFloat(match[2], 64)
+		if err != nil {
+			continue
+		}
+		if match[1] == "SUM" {
+			sums = append(sums, kbps)
+		} else {
+			streams = append(streams, kbps)
+		}
+	}
+	samples := streams
+	if len(sums) > 0 {
+		samples = sums
+	}
+	if len(samples) == 0 {
+		return "", false
+	}
+	var total float64
+	for _, kbps := range samples {
+		total += kbps
+	}
+	return strconv.FormatFloat(total/float64(len(samples)), 'f', 2, 64), true
+}
+
+// lastMatch returns the first capture group of the last match of re in the output.
+func lastMatch(re *regexp.Regexp, output string) (string, error) {
+	matches := re.FindAllStringSubmatch(output, -1)
+	if len(matches) == 0 {
+		return "", fmt.Errorf("no result matching %q found in the output", re.String())
+	}
+	return matches[len(matches)-1][1], nil
+}
+
+// selectEngine returns the engine chosen by the configuration file, the CLI, or the legacy --netperf flag.
+func selectEngine(config configuration) (engine, error) {
+	name := cliFlags.engine
+	if config.Engine != "" {
+		name = config.Engine
+	}
+	if name == "" {
+		name = engineIperf3
+		if cliFlags.netperf {
+			name = engineNetperf
+		}
+	}
+	eng, ok := engines[name]
+	if !ok {
+		return engine{}, fmt.Errorf("unsupported engine %q, must be one of iperf3, iperf2, netperf, ssh, exec or goperf", name)
+	}
+	return eng, nil
+}
+
+// perfRun polls every perf server with its engine and records the results.
+func perfRun(config configuration, settings runSettings, eng engine) {
+	clients, err := setupEngines(config, settings, eng)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// when each endpoint group is next due, by group name
+	next := make(map[string]time.Time)
+
+	// the endpoints and settings from a config source or discovery can change between cycles
+	plan := func() []scheduledCycle {
+		cycleConfig, cycleSettings := config, settings
+		if fileSource != nil {
+			cycleConfig, cycleSettings = fileSource.apply(cycleConfig, cycleSettings)
+		}
+		if remoteSource != nil {
+			cycleConfig, cycleSettings = remoteSource.apply(cycleConfig, cycleSettings)
+		}
+		if discovery != nil {
+			cycleConfig = discovery.apply(cycleConfig)
+		}
+		return scheduledCycles(cycleConfig, cycleSettings)
+	}
+
+	// begin the program loop
+	for {
+		cycles := plan()
+		for _, cycle := range cycles {
+			if time.Now().Before(next[cycle.name]) {
+				continue
+			}
+			if cycle.name != "" {
+				log.Infof("Running the test cycle of the %s endpoint group", cycle.name)
+			}
+			runCycle(cycle.config, cycle.settings, eng, clients)
+			// polling interval as defined in the configuration file, cli args or the endpoint group
+			next[cycle.name] = time.Now().Add(cycle.settings.interval)
+			statusScheduled(cycle.name, next[cycle.name])
+		}
+		// cycles triggered over the APIs or by an event run while waiting for the next group, with the settings
+		// as they are by then and their results tagged with the reason
+		timer := time.NewTimer(nextCycleWait(cycles, next))
+		for waiting := true; waiting; {
+			select {
+			case <-timer.C:
+				waiting = false
+			case trigger := <-testTriggers:
+				ran := false
+				for _, cycle := range plan() {
+					triggered := cycle.config
+					triggered.PerfServers = nil
+					for _, server := range triggeredServers(cycle.config.PerfServers, trigger.endpoints) {
+						server.Tags = withTag(server.Tags, "trigger", trigger.reason)
+						triggered.PerfServers = append(triggered.PerfServers, server)
+					}
+					if len(triggered.PerfServers) == 0 {
+						continue
+					}
+					log.Infof("Running the test cycle triggered by %s for %s", triggerLabel(trigger.reason), endpointsLabel(trigger.endpoints))
+					runCycle(triggered, cycle.settings, eng, clients)
+					ran = true
+				}
+				if !ran {
+					log.Warnf("No endpoint matches the test cycle triggered by %s for %s", triggerLabel(trigger.reason), endpointsLabel(trigger.endpoints))
+				}
+			}
+		}
+	}
+}
+
+// setupEngines resolves the client of the default engine and of every engine selected per endpoint,
+// returning the clients by engine name. It runs once at startup, so a missing or too old client stops the agent
+// before the first test.
+func setupEngines(config configuration, settings runSettings, eng engine) (map[string]engineClient, error) {
+	client, err := setupEngine(eng, settings, true)
+	if err != nil {
+		return nil, err
+	}
+	clients := map[string]engineClient{eng.name: client}
+	for _, server := range allServers(config) {
+		if server.Engine == "" {
+			continue
+		}
+		if _, ok := clients[server.Engine]; ok {
+			continue
+		}
+		serverEngine, ok := engines[server.Engine]
+		if !ok {
+			return nil, fmt.Errorf("unsupported engine %q for perf server %s, must be one of iperf3, iperf2, netperf, ssh, exec or goperf", server.Engine, server.Address)
+		}
+		if clients[server.Engine], err = setupEngine(serverEngine, settings, false); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := clients[settings.compareEngine]; settings.compareEngine != "" && !ok {
+		candidate, ok := engines[settings.compareEngine]
+		if !ok {
+			return nil, fmt.Errorf("unsupported compare engine %q, must be one of iperf3, iperf2, netperf, ssh, exec or goperf", settings.compareEngine)
+		}
+		if clients[settings.compareEngine], err = setupEngine(candidate, settings, false); err != nil {
+			return nil, err
+		}
+	}
+	return clients, nil
+}
+
+// setupEngine resolves the engine and the command used to invoke its client. A custom --image only applies
+// to the default engine, engines selected per endpoint use their own image.
+func setupEngine(eng engine, settings runSettings, isDefault bool) (engineClient, error) {
+	client := engineClient{engine: resolveEngine(eng, settings), native: settings.noContainer || eng.local}
+	var perfBinary string
+	if eng.local && eng.binary == "" {
+		return client, fmt.Errorf("the %s engine needs a command, pass one with --exec-command", eng.name)
+	}
+	if client.native {
+		perfBinary = enginePath(eng)
+		if cliFlags.perfBinary != "" && isDefault {
+			perfBinary = cliFlags.perfBinary
+		}
+	} else {
+		// swap the default iperf3 image for the engine's own default
+		image := cliFlags.imageRepo
+		if image == defaultIperfRepo || !isDefault {
+			image = eng.image
+		}
+		if image == "" {
+			return client, fmt.Errorf("there is no default container image for %s, pass one with --image or use the flag \"--nocontainer\"", eng.name)
+		}
+		runtime, err := checkContainerRuntime()
+		if err == nil {
+			if !settings.dryRun {
+				if err := prepareImage(runtime, image); err != nil {
+					return client, err
+				}
+			}
+			perfBinary = fmt.Sprintf("%s run -i --rm %s %s", runtime, strings.Join(imageRunArgs(), " "), image)
+		} else if path, lookErr := exec.LookPath(enginePath(eng)); lookErr == nil {
+			// fall back to a locally installed client rather than giving up
+			log.Warnf("%v, falling back to the native %s client at %s", err, eng.name, path)
+			client.native = true
+			perfBinary = enginePath(eng)
+		} else {
+			return client, err
+		}
+	}
+	log.Debugf("[Config] Perf Engine = %s", eng.name)
+	log.Debugf("[Config] Perf Binary = %s", perfBinary)
+	if !eng.omit && settings.omit != "0" {
+		log.Warnf("%s does not support omitting the start of a test, consider a --warmup instead", eng.name)
+	}
+	if !eng.bandwidthCap && settings.bandwidthCap != "" {
+		log.Warnf("%s does not support a bandwidth cap, tests will run at full rate", eng.name)
+	}
+	if !eng.congestion && settings.congestion != "" {
+		log.Warnf("%s does not support setting the congestion control algorithm, tests will use the host default", eng.name)
+	}
+	if !eng.cport && clientPorts != nil {
+		log.Warnf("%s does not support pinning the client ports, tests will use ephemeral ports", eng.name)
+	}
+
+	// the native binary is kept whole since Windows paths such as C:\Program Files\iperf3\iperf3.exe
+	// can contain spaces
+	if client.native {
+		client.argv = []string{perfBinary}
+	} else {
+		client.argv = strings.Fields(perfBinary)
+	}
+	// the version tags the results, so a fleet mixing client versions can tell their results apart
+	if !settings.dryRun {
+		version, err := detectVersion(eng, client.argv)
+		if err != nil {
+			return client, err
+		}
+		client.version = version
+	}
+	return client, nil
+}
+
+// endpointEngine returns the engine an endpoint is tested with, its own engine setting wins over the default.
+func endpointEngine(eng engine, server perfServer) engine {
+	if serverEngine, ok := engines[server.Engine]; ok {
+		return serverEngine
+	}
+	return eng
+}
+
+// runCycle tests every perf server once. The clients map is only read, engines assigned by a controller
+// that weren't set up at start are set up for the cycle.
+func runCycle(config configuration, settings runSettings, defaultEngine engine, clients map[string]engineClient) {
+	checkClock(config)
+	// the controller assigns the ungrouped endpoints, groups are always tested from the local configuration
+	if controller != nil && config.group == nil {
+		config.PerfServers = controller.assignments(config.PerfServers)
+	}
+	for i, server := range cycleOrder(settings, config.PerfServers) {
+		// planned maintenance is kept out of the results and the baselines
+		if window, ok := activeMaintenance(server, time.Now()); ok {
+			suppressTests(config, settings, endpointEngine(defaultEngine, server), server, window)
+			continue
+		}
+		// the time of day can shorten or cap the tests, or let them run long at full rate
+		settings, server := applyTestWindow(settings, server, time.Now())
+		// an endpoint that failed too many cycles in a row is left alone until its cool-down is over
+		breakerState := breakerClosed
+		if breaker != nil && !settings.dryRun {
+			if breakerState = breaker.begin(server, time.Now()); breakerState == breakerOpen {
+				breaker.skip(config, settings, server)
+				continue
+			}
+		}
+		// endpointFailed counts a cycle the endpoint couldn't be tested in towards opening its breaker
+		endpointFailed := func() {
+			if breaker != nil && !settings.dryRun {
+				breaker.testResult(server, false)
+				breaker.end(config, settings, server, time.Now())
+			}
+		}
+		if settings.noShell {
+			if err := checkShellFreeServer(server, endpointEngine(defaultEngine, server)); err != nil {
+				log.Errorf("Skipping the tests to %s [%s] with --no-shell: %v", server.Address, server.displayName(), err)
+				continue
+			}
+		}
+		if i > 0 && !settings.dryRun {
+			if gap := testGap(settings); gap > 0 {
+				log.Debugf("Waiting %s before testing the next endpoint", gap)
+				time.Sleep(gap)
+			}
+		}
+		if settings.dnsTiming {
+			server = resolveEndpoint(config, settings, server)
+		}
+		if settings.dualStack {
+			server = resolveDualStack(settings, server)
+		}
+		if settings.vpnDetect {
+			server = tagVPN(server)
+		}
+		if server.Netns != "" || server.Interface != "" {
+			server = tenantTags(server)
+			if settings.dryRun {
+				log.Infof("[DRY RUN] Would test %s [%s] from netns %q over interface %q", server.Address, server.displayName(), server.Netns, server.Interface)
+			} else if bound, err := bindInterface(server); err != nil {
+				log.Errorf("Skipping the tests to %s [%s]: %v", server.Address, server.displayName(), err)
+				recordError(config, settings, endpointEngine(defaultEngine, server), server, directionDownload, settings.downloadPrefix, classifyError(err, ""))
+				atomic.AddInt32(&failedTests, 1)
+				endpointFailed()
+				continue
+			} else {
+				server = bound
+			}
+		}
+		if settings.traceroute {
+			checkPath(config, settings, server)
+		}
+		if settings.latency {
+			probeLatency(config, settings, server)
+		}
+		client, ok := clients[endpointEngine(defaultEngine, server).name]
+		if !ok {
+			// an engine first selected by a reloaded configuration is set up once and kept for the later cycles
+			var err error
+			if client, err = setupEngine(endpointEngine(defaultEngine, server), settings, false); err != nil {
+				log.Errorf("Skipping the tests to %s [%s]: %v", server.Address, server.displayName(), err)
+				recordError(config, settings, endpointEngine(defaultEngine, server), server, directionDownload, settings.downloadPrefix, classifyError(err, ""))
+				atomic.AddInt32(&failedTests, 1)
+				endpointFailed()
+				continue
+			}
+			clients[client.engine.name] = client
+		}
+		eng := client.engine
+		if client.version != "" {
+			server.Tags = withTag(server.Tags, "client_version", client.version)
+		}
+		// an endpoint whose data budget is used up is skipped or only probed at the budget's capped rate
+		overBudget := budget != nil && budget.exhausted(server)
+		if overBudget && (budget.config.Action == budgetSkip || !eng.bandwidthCap) {
+			log.Infof("Skipping the tests to %s [%s], its data budget is used up", server.Address, server.displayName())
+			budget.record(config, settings, server)
+			continue
+		}
+		var cleanup func()
+		if eng.prepare != nil && settings.dryRun {
+			log.Infof("[DRY RUN] Would prepare the %s test to %s", eng.name, server.Address)
+		} else if eng.prepare != nil {
+			var err error
+			if cleanup, err = eng.prepare(eng, server); err != nil {
+				log.Errorf("Error preparing the %s test to %s: %v", eng.name, server.Address, err)
+				recordError(config, settings, eng, server, directionDownload, settings.downloadPrefix, classifyError(err, ""))
+				atomic.AddInt32(&failedTests, 1)
+				endpointFailed()
+				continue
+			}
+		}
+		// the perf server of an endpoint with a docker host only runs during its tests
+		if server.Docker != nil && settings.dryRun {
+			log.Infof("[DRY RUN] Would start the %s server container for %s on %s", eng.name, server.Address, server.Docker.Host)
+		} else if server.Docker != nil {
+			removeContainers, err := startRemoteContainers(eng, server)
+			if err != nil {
+				log.Errorf("Error starting the %s server of %s [%s]: %v", eng.name, server.Address, server.displayName(), err)
+				recordError(config, settings, eng, server, directionDownload, settings.downloadPrefix, classifyError(err, ""))
+				atomic.AddInt32(&failedTests, 1)
+				if cleanup != nil {
+					cleanup()
+				}
+				endpointFailed()
+				continue
+			}
+			prepared := cleanup
+			cleanup = func() {
+				removeContainers()
+				if prepared != nil {
+					prepared()
+				}
+			}
+		}
+		var tun *tunnel
+		if server.Tunnel != nil && !settings.dryRun {
+			var err error
+			if tun, err = openTunnel(server, eng); err != nil {
+				log.Errorf("Error opening the tunnel to %s via %s: %v", server.Address, tunnelVia(server.Tunnel), err)
+				recordError(config, settings, eng, server, directionDownload, settings.downloadPrefix, classifyError(err, ""))
+				atomic.AddInt32(&failedTests, 1)
+				if cleanup != nil {
+					cleanup()
+				}
+				endpointFailed()
+				continue
+			}
+			server.tunnelHost, server.tunnelPort = tun.localAddress()
+		}
+		reachable := true
+		if !settings.dryRun {
+			server, reachable = precheck(config, settings, eng, server, tun)
+		}
+		if !reachable {
+			if tun != nil {
+				tun.close()
+			}
+			if cleanup != nil {
+				cleanup()
+			}
+			endpointFailed()
+			continue
+		}
+		// a short probe decides whether the full tests of an endpoint whose breaker is half open resume
+		if breakerState == breakerHalfOpen {
+			runPerfTest(config, breaker.probeSettings(settings), client, server, directionDownload, cycleBandwidth(settings, eng, server))
+			if !breaker.probed(server) {
+				if tun != nil {
+					tun.close()
+				}
+				if cleanup != nil {
+					cleanup()
+				}
+				breaker.end(config, settings, server, time.Now())
+				continue
+			}
+		}
+		if settings.callSim {
+			simulateCall(config, settings, client, server)
+		}
+		// every test profile runs back to back against the endpoint
+		results := make(cycleResults)
+		for _, profiled := range profiledServers(config.Profiles, server) {
+			bandwidth := cycleBandwidth(settings, eng, profiled)
+			if overBudget {
+				profiled.BandwidthCap, bandwidth = budget.config.CappedRate, budget.config.CappedRate
+			}
+			for _, test := range engineTests(settings, eng) {
+				if bps, ok := runPerfTest(config, test, client, profiled, directionDownload, bandwidth); ok {
+					results.add(profiled, directionDownload, bps, bandwidth)
+				}
+				if !eng.upload {
+					continue
+				}
+				if bps, ok := runPerfTest(config, test, client, profiled, directionUpload, bandwidth); ok {
+					results.add(profiled, directionUpload, bps, bandwidth)
+				}
+			}
+			if settings.compareEngine != "" {
+				compareEngine(config, settings, clients, eng, profiled, results)
+			}
+			if settings.compareCongestion != "" {
+				compareCongestion(config, settings, client, profiled, results)
+			}
+			if profiled.UnderlayAddress != "" {
+				measureOverlayOverhead(config, settings, client, profiled, results)
+			}
+			if profiled.ipv6 != "" {
+				measureDualStack(config, settings, client, profiled, results)
+			}
+		}
+		if len(settings.compareProfiles) == 2 {
+			compareProfiles(config, settings, eng, server, results)
+		}
+		if budget != nil {
+			budget.record(config, settings, server)
+		}
+		if tun != nil {
+			tun.close()
+		}
+		if cleanup != nil {
+			cleanup()
+		}
+		if breaker != nil && !settings.dryRun {
+			breaker.end(config, settings, server, time.Now())
+		}
+	}
+	if settings.heartbeat {
+		recordHeartbeat(config, settings)
+	}
+	flushSinks()
+	if !settings.dryRun {
+		saveBaselines(config.Hostname)
+	}
+}
+
+// runPerfTest runs a single test in one direction to an endpoint and records the result. It returns the bitrate
+// for the comparison mode, ok is false if the test failed or measured something other than a bitrate.
+func runPerfTest(config configuration, settings runSettings, client engineClient, server perfServer, direction string, bandwidth string) (int64, bool) {
+	eng := client.engine
+	// the result and companion metrics of this test share a run ID to trace them back to it
+	server.runID = newRunID()
+	endpointAddress := server.dialAddress()
+	endpointName := server.displayName()
+	prefix := settings.downloadPrefix
+	label := "Download"
+	if direction == directionUpload {
+		prefix = settings.uploadPrefix
+		label = "Upload"
+	}
+	if settings.netperfTest != "" {
+		eng = netperfEngine(eng, settings.netperfTest, settings.netperfCPU)
+		prefix = netperfTestPrefix(prefix, settings.netperfTest)
+		if settings.netperfTest != netperfTCP {
+			label += " " + settings.netperfTest
+		}
+	}
+
+	opts := testOptions{
+		address:    endpointAddress,
+		port:       server.serverPort(eng),
+		length:     settings.length,
+		parallel:   settings.parallel,
+		reverse:    direction == directionUpload,
+		bandwidth:  bandwidth,
+		testType:   settings.netperfTest,
+		cpu:        settings.netperfTest != "" && settings.netperfCPU,
+		congestion: settings.congestion,
+		bind:       server.bindAddress,
+	}
+	opts = profileOptions(server, opts)
+	if !eng.congestion {
+		opts.congestion = ""
+	}
+	// iperf3 reports in JSON when the raw output is kept so the stored evidence is machine readable, with a data
+	// budget for the bytes it transferred, with a congestion control algorithm for the one the sender used and for
+	// the interval bitrates
+	intervals := (settings.intervalStats || settings.intervalSeries) && eng.intervals != nil
+	opts.json = (raws != nil || budget != nil || opts.congestion != "" || intervals) && eng.rawJSON
+	if eng.omit {
+		opts.omit = settings.omit
+	}
+	clientCmd := append([]string{}, client.argv...)
+	if server.tunnelHost != "" {
+		// the client connects to the local end of the tunnel, a container needs the host network to reach it
+		opts.address, opts.port = server.tunnelHost, server.tunnelPort
+	}
+	// a container client also needs the host network to bind to the address of the endpoint's interface, and to
+	// keep its client ports through the NAT of the container network
+	if (server.tunnelHost != "" || server.bindAddress != "" || (clientPorts != nil && eng.cport)) && !client.native {
+		clientCmd = hostNetworkArgv(clientCmd)
+	}
+	clientCmd, opts = iperfAuthArgv(clientCmd, client.native, server, opts)
+	clientCmd = priorityArgv(clientCmd, client.native)
+	var tester Engine = engineClient{engine: eng, argv: clientCmd, native: client.native, version: client.version}
+	// a test doesn't start while the host is busy, it would slow down the workloads next to it and be held back by them
+	if guardrails != nil && !settings.dryRun {
+		if reason, detail, ok := guardrails.check(server); !ok {
+			log.Infof("Skipping the %s test to %s [%s], %s", strings.ToLower(label), endpointAddress, endpointName, detail)
+			server.Tags = withTag(server.Tags, "suppressed_reason", reason)
+			recordTestMetric(config, settings, eng, server, direction, prefix, "suppressed", 1)
+			return 0, false
+		}
+	}
+	// the slot of the perf server is held from the parallel tuning to the last run, the tests of other agents
+	// sharing the server queue behind it
+	if slots != nil && !settings.dryRun {
+		release, err := slots.reserve(server, endpointAddress, server.serverPort(eng))
+		if err != nil {
+			log.Errorf("%s test to %s [%s] skipped: %v", label, endpointAddress, endpointName, err)
+			recordError(config, settings, eng, server, direction, prefix, errorBusy)
+			recordTestMetric(config, settings, eng, server, direction, prefix, "failed", 1)
+			if breaker != nil {
+				breaker.testResult(server, false)
+			}
+			return 0, false
+		}
+		defer release()
+	}
+	// a test striped across the ports of the endpoint runs a client to each of them at once
+	ports := stripePorts(eng, server)
+	// with parallel auto the streams are ramped up until the throughput stops improving, once per endpoint
+	autoParallel := opts.parallel == parallelAuto
+	// the pre-test hook runs before the warmup, a failed hook is recorded but doesn't stop the test. The warmup
+	// primes the path before the parallel tuning too, so its first steps don't run on a cold path.
+	var warm sample
+	warmedUp := false
+	if !settings.dryRun {
+		if hooks != nil {
+			hooks.run(config, settings, eng, server, direction, prefix, hookPreTest, nil, nil)
+		}
+		if settings.warmup != "0" {
+			warmOpts := opts
+			if autoParallel {
+				warmOpts.parallel = "1"
+			}
+			warm, warmedUp = warmup(eng, server, clientCmd, warmOpts, settings.warmup)
+		}
+	}
+	if autoParallel {
+		opts.parallel = "1"
+		if eng.parallel && settings.dryRun {
+			log.Infof("[DRY RUN] Would tune the parallel streams of the %s tests to %s [%s] up to %d", direction, endpointAddress, endpointName, settings.parallelMax)
+		} else if eng.parallel {
+			opts.parallel = strconv.Itoa(parallelStreams(settings, eng, server, direction, clientCmd, opts, ports))
+		}
+	}
+	_, stripes, command := clientCommands(eng, clientCmd, opts, ports)
+	if settings.dryRun {
+		// record a zero result so the payloads that would be sent are logged
+		log.Infof("[DRY RUN] Would run the %s test %s to %s [%s] -> %s", strings.ToLower(label), server.runID, endpointAddress, endpointName, command)
+		recordMeasurement(config, settings, measurement{
+			Timestamp:   measurementTime(),
+			Source:      config.Hostname,
+			Destination: endpointName,
+			Address:     endpointAddress,
+			Direction:   direction,
+			Prefix:      prefix,
+			Engine:      eng.name,
+			Metric:      eng.metric,
+			RunID:       server.runID,
+			Tags:        withTag(rateTags(settings, server, bandwidth), "engine", eng.name),
+		})
+		return 0, false
+	}
+
+	// run the test back to back the configured number of times, a failed run is left out of the statistics
+	count := settings.samples
+	serverPorts := ports
+	if len(serverPorts) == 0 {
+		serverPorts = []string{server.serverPort(eng)}
+	}
+	recordFlow(eng, server, endpointAddress, serverPorts)
+	defer statusTesting(eng, server, direction, opts.length, count, serverPorts)()
+	start := time.Now()
+	cpuStart, cpuOK := readCPUTimes()
+	var host *hostSampler
+	if settings.hostStats {
+		host = startHostSampler(server)
+	}
+	var nic *nicCheck
+	if settings.nicCheck {
+		nic = startNICCheck(server)
+	}
+	// the guardrail measures the other traffic on the interface across the test for the next one
+	var guardNIC *nicCheck
+	if guardrails != nil && guardrails.maxNIC > 0 && !settings.dryRun {
+		guardNIC = startNICCheck(server)
+	}
+	// the failed runs are kept for the data budget, they may have transferred data before failing
+	var samples, failed []sample
+	var lastErr error
+	// the post-test hook runs once the test is recorded, with its result or its error
+	var hookResult *measurement
+	if hooks != nil {
+		defer func() { hooks.run(config, settings, eng, server, direction, prefix, hookPostTest, hookResult, lastErr) }()
+	}
+	for i := 0; i < count; i++ {
+		var rawID string
+		if raws != nil {
+			ext := "txt"
+			if opts.json {
+				ext = "json"
+			}
+			rawID = rawKey(config.Hostname, server, direction, time.Now(), i+1, ext)
+		}
+		var result sample
+		var err error
+		// a run the server turned away as busy with another client's test is retried after a backoff
+		for retry := 0; ; retry++ {
+			// every run takes the next client ports, the ports of the previous run may still be in TIME_WAIT
+			if clientPorts != nil && eng.cport && (i > 0 || retry > 0) {
+				_, stripes, _ = clientCommands(eng, clientCmd, opts, ports)
+			}
+			if len(stripes) > 0 {
+				result, err = runStripedSample(eng, server, stripes, ports, rawID)
+			} else {
+				run := opts
+				run.rawID = rawID
+				result, err = tester.Run(context.Background(), server, run)
+			}
+			if err == nil || retry >= settings.busyRetries || classifyError(err, "") != errorBusy {
+				break
+			}
+			wait := busyBackoff(settings, retry)
+			log.Infof("The perf server %s [%s] is busy, retrying the %s test in %s (%d/%d)", endpointAddress, endpointName, direction, wait.Round(time.Second), retry+1, settings.busyRetries)
+			time.Sleep(wait)
+		}
+		if err != nil {
+			lastErr = err
+			failed = append(failed, result)
+			recordError(config, settings, eng, server, direction, prefix, classifyError(err, ""))
+			continue
+		}
+		samples = append(samples, result)
+	}
+	if cpuOK {
+		// the host CPU utilization during the runs shows results held back by CPU contention
+		if cpuEnd, ok := readCPUTimes(); ok {
+			if utilization, ok := cpuUtilization(cpuStart, cpuEnd); ok {
+				recordTestMetric(config, settings, eng, server, direction, prefix, "cpu_util", utilization)
+			}
+		}
+	}
+	if host != nil {
+		recordHostStats(config, settings, eng, server, direction, prefix, host.finish())
+	}
+	if nic != nil {
+		nic.finish(config, settings, eng, server, direction, prefix, samples, count, opts.length)
+	}
+	if guardNIC != nil {
+		guardrails.measureNIC(guardNIC, direction, samples, count, opts.length)
+	}
+	if budget != nil {
+		used := transferredBytes(samples, opts.length) + failedBytes(failed, samples, opts, opts.length)
+		if settings.warmup != "0" {
+			if warmedUp {
+				used += transferredBytes([]sample{warm}, settings.warmup)
+			} else {
+				used += failedBytes([]sample{warm}, samples, opts, settings.warmup)
+			}
+		}
+		budget.use(server, used)
+	}
+	if len(samples) == 0 {
+		if annotations != nil {
+			annotations.testFailed(server, direction, start, lastErr.Error())
+		}
+		recordTestMetric(config, settings, eng, server, direction, prefix, "failed", 1)
+		if breaker != nil {
+			breaker.testResult(server, false)
+		}
+		return 0, false
+	}
+
+	// the values are the bitrates, or the results of an engine with another metric
+	values := make([]float64, 0, len(samples))
+	var fullRunValues, retransmitValues, localCPUValues, remoteCPUValues, lossValues, jitterValues []float64
+	var rawIDs []string
+	// the results are tagged with the congestion control algorithm the sender reported, or the one requested
+	congestion := opts.congestion
+	for _, result := range samples {
+		if result.congestion != "" {
+			congestion = result.congestion
+		}
+		if eng.metric != "" {
+			values = append(values, result.value)
+		} else {
+			values = append(values, float64(result.bps))
+		}
+		if result.hasCPU {
+			localCPUValues = append(localCPUValues, result.localCPU)
+			remoteCPUValues = append(remoteCPUValues, result.remoteCPU)
+		}
+		if result.hasUDP {
+			lossValues = append(lossValues, result.lossPct)
+			jitterValues = append(jitterValues, result.jitterMs)
+		}
+		if result.rawID != "" {
+			rawIDs = append(rawIDs, result.rawID)
+		}
+		if result.hasFullRun {
+			fullRunValues = append(fullRunValues, float64(result.fullRunBps))
+		}
+		if result.hasRetransmits {
+			retransmitValues = append(retransmitValues, float64(result.retransmits))
+		}
+	}
+	// a single run is recorded as is, several are recorded as their median
+	m := measurement{
+		Timestamp:   measurementTime(),
+		Source:      config.Hostname,
+		Destination: endpointName,
+		Address:     endpointAddress,
+		Direction:   direction,
+		Prefix:      prefix,
+		Engine:      eng.name,
+		Bps:         int64(percentile(values, 50)),
+		RunID:       server.runID,
+		RawID:       strings.Join(rawIDs, ","),
+		Tags:        withTag(rateTags(settings, server, bandwidth), "engine", eng.name),
+	}
+	if congestion != "" {
+		m.Tags = withTag(m.Tags, "congestion", congestion)
+	}
+	if eng.metric != "" {
+		m.Bps, m.Metric, m.Value = 0, eng.metric, percentile(values, 50)
+	}
+	hookResult = &m
+
+	// Write the results to the tsdb.
+	unit := "bps"
+	if eng.metric != "" {
+		unit = eng.metric
+	}
+	log.Infof("%s results for endpoint %s [%s] -> %s %s (run %s)", label, endpointAddress, endpointName, m.formattedValue(""), unit, server.runID)
+	recordMeasurement(config, settings, m)
+	if breaker != nil {
+		breaker.testResult(server, true)
+	}
+	recordTestMetric(config, settings, eng, server, direction, prefix, "failed", float64(count-len(samples))/float64(count))
+	if autoParallel && eng.parallel {
+		streams, _ := strconv.Atoi(opts.parallel)
+		recordTestMetric(config, settings, eng, server, direction, prefix, "parallel_streams", float64(streams))
+	}
+	if len(localCPUValues) > 0 {
+		recordTestMetric(config, settings, eng, server, direction, prefix, "local_cpu_util", percentile(localCPUValues, 50))
+		recordTestMetric(config, settings, eng, server, direction, prefix, "remote_cpu_util", percentile(remoteCPUValues, 50))
+	}
+	if len(lossValues) > 0 {
+		recordTestMetric(config, settings, eng, server, direction, prefix, "loss_pct", percentile(lossValues, 50))
+		recordTestMetric(config, settings, eng, server, direction, prefix, "jitter_ms", percentile(jitterValues, 50))
+	}
+	// the annotations, anomaly baseline and sample statistics are of bitrates
+	if eng.metric != "" {
+		return 0, false
+	}
+	resultsBps := m.Bps
+	// the grafana annotations are the operator's, a tenant's results are kept out of them
+	if annotations != nil && config.tenant() == nil {
+		annotations.testResult(server, direction, start, resultsBps, bandwidth)
+	}
+	if alerts != nil {
+		alerts.testResult(config, eng, server, direction, resultsBps, bandwidth)
+	}
+	if settings.anomalyDrop > 0 && bandwidth == "" {
+		checkAnomaly(config, settings, eng, server, direction, prefix, resultsBps)
+	}
+	// a capped test doesn't measure what the SLA promises
+	if slas != nil && bandwidth == "" {
+		slas.testResult(config, settings, eng, server, direction, prefix, resultsBps)
+	}
+	if count > 1 {
+		recordSampleStats(config, settings, eng, server, direction, prefix, values)
+	}
+	if settings.fullRunAverage && opts.omit != "0" && len(fullRunValues) > 0 {
+		recordTestMetric(config, settings, eng, server, direction, prefix, "full_run", percentile(fullRunValues, 50))
+	}
+	if len(retransmitValues) > 0 {
+		recordTestMetric(config, settings, eng, server, direction, prefix, "retransmits", mean(retransmitValues))
+	}
+	if intervals {
+		recordIntervals(config, settings, eng, server, direction, prefix, samples)
+	}
+	return resultsBps, true
+}
+
+// clientCommands builds the client command line of a test run, or one per port of a striped test, and the command
+// as it's logged.
+func clientCommands(eng engine, clientCmd []string, opts testOptions, ports []string) ([]string, [][]string, string) {
+	if len(ports) == 0 {
+		argv := clientArgv(eng, clientCmd, opts)
+		return argv, nil, strings.Join(argv, " ")
+	}
+	var stripes [][]string
+	var commands []string
+	for _, port := range ports {
+		stripe := opts
+		stripe.port = port
+		stripes = append(stripes, clientArgv(eng, clientCmd, stripe))
+		commands = append(commands, strings.Join(stripes[len(stripes)-1], " "))
+	}
+	return nil, stripes, strings.Join(commands, " & ")
+}
+
+// sample is the parsed result of a single client run.
+type sample struct {
+	bps            int64
+	fullRunBps     int64
+	hasFullRun     bool
+	retransmits    int
+	hasRetransmits bool
+	// value is the result of engines with a metric other than the bitrate.
+	value     float64
+	localCPU  float64
+	remoteCPU float64
+	hasCPU    bool
+	// lossPct and jitterMs are the datagram loss and jitter of a UDP test.
+	lossPct  float64
+	jitterMs float64
+	hasUDP   bool
+	// bytes is the data the run transferred, zero if the engine doesn't report it.
+	bytes int64
+	// congestion is the congestion control algorithm the run used, empty if the engine doesn't report it.
+	congestion string
+	// rawID is the key the run's output was stored under, empty without a raw output store.
+	rawID string
+	// started is when the run started, intervals are the bitrates it reported every interval.
+	started   time.Time
+	intervals []intervalSample
+}
+
+// Run runs the client of the engine once against the target with the options of a profile and parses the result.
+// The client is killed when ctx is done.
+func (c engineClient) Run(ctx context.Context, target perfServer, profile testOptions) (sample, error) {
+	return runSample(ctx, c.engine, target, clientArgv(c.engine, c.argv, profile), profile.rawID)
+}
+
+// engineEnv is the environment of the client of an engine testing an endpoint.
+func engineEnv(eng engine, server perfServer) []string {
+	env := clientEnv(server)
+	if eng.env != nil {
+		env = append(env, eng.env()...)
+	}
+	return env
+}
+
+// runSample runs the client once and parses the result, the returned error summarizes a failure for annotations.
+// The output of the run is stored under rawID if one is passed, failed runs included.
+func runSample(ctx context.Context, eng engine, server perfServer, argv []string, rawID string) (sample, error) {
+	result := sample{started: measurementTime()}
+	output, err := runCmdInContext(ctx, server, argv, engineEnv(eng, server))
+	if rawID != "" {
+		if storeErr := raws.put(rawID, []byte(output)); storeErr != nil {
+			log.Errorf("Error storing the raw output %s: %v", rawID, storeErr)
+		} else {
+			result.rawID = rawID
+			log.Debugf("Stored the raw output of the test to %s as %s", server.Address, rawID)
+		}
+	}
+	if err != nil || eng.failed(output) {
+		// a run that failed part way may still report the data it transferred, the data budget counts it
+		if eng.transferred != nil {
+			result.bytes, _ = eng.transferred(output)
+		}
+		if result.rawID != "" {
+			log.Errorf("The output of the failed test was stored as %s", result.rawID)
+		}
+		class := classifyError(err, output)
+		log.Errorf("Error testing to the target server at %s (run %s): %s error", net.JoinHostPort(server.Address, server.serverPort(eng)), server.runID, class)
+		log.Errorf("Verify %s is running and reachable at %s", eng.server, net.JoinHostPort(server.Address, server.serverPort(eng)))
+		if eng.name != engineNetperf {
+			log.Errorln(err, output)
+		}
+		return result, &testError{class: class, reason: failureReason(err, output)}
+	}
+
+	// verify the results are a valid integer and convert to bps for plotting.
+	results, err := eng.parse(output)
+	if err != nil {
+		log.Errorf("no result found in the %s output, please run with --debug for details: %v", eng.name, err)
+		log.Debug(output)
+		return result, &testError{class: errorParse, reason: err.Error()}
+	}
+	if eng.metric != "" {
+		if result.value, err = strconv.ParseFloat(results, 64); err != nil {
+			log.Errorf("no valid number returned from the %s test, please run with --debug for details: %v", eng.name, err)
+			return result, err
+		}
+	} else if result.bps, err = convertKbitsToBits(results); err != nil {
+		log.Errorf("no valid bitrate returned from the %s test, please run with --debug for details: %v", eng.name, err)
+		return result, &testError{class: errorParse, reason: err.Error()}
+	}
+	if eng.cpu != nil {
+		result.localCPU, result.remoteCPU, result.hasCPU = eng.cpu(output)
+	}
+	if eng.transferred != nil {
+		result.bytes, _ = eng.transferred(output)
+	}
+	if eng.udp != nil {
+		result.lossPct, result.jitterMs, result.hasUDP = eng.udp(output)
+	}
+	if eng.fullRun != nil {
+		if fullRun, ok := eng.fullRun(output); ok {
+			if result.fullRunBps, err = convertKbitsToBits(fullRun); err == nil {
+				result.hasFullRun = true
+			}
+		}
+	}
+	if eng.retransmits != nil {
+		result.retransmits, result.hasRetransmits = eng.retransmits(output)
+	}
+	if eng.congestionUsed != nil {
+		result.congestion, _ = eng.congestionUsed(output)
+	}
+	if eng.intervals != nil {
+		result.intervals, _ = eng.intervals(output)
+	}
+	return result, nil
+}
+
+// recordSampleStats records the spread of the runs of a test, and each run if --keep-samples is set.
+func recordSampleStats(config configuration, settings runSettings, eng engine, server perfServer, direction string, prefix string, values []float64) {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	recordTestMetric(config, settings, eng, server, direction, prefix, "min", sorted[0])
+	recordTestMetric(config, settings, eng, server, direction, prefix, "p10", percentile(sorted, 10))
+	recordTestMetric(config, settings, eng, server, direction, prefix, "avg", mean(sorted))
+	recordTestMetric(config, settings, eng, server, direction, prefix, "p90", percentile(sorted, 90))
+	recordTestMetric(config, settings, eng, server, direction, prefix, "max", sorted[len(sorted)-1])
+	if !settings.keepSamples {
+		return
+	}
+	for i, value := range values {
+		recordMeasurement(config, settings, measurement{
+			Timestamp:   measurementTime(),
+			Source:      config.Hostname,
+			Destination: server.displayName(),
+			Address:     server.Address,
+			Direction:   direction,
+			Prefix:      prefix + ".sample",
+			Engine:      eng.name,
+			Metric:      "sample_bps",
+			Value:       value,
+			Tags:        withTag(withTag(server.Tags, "engine", eng.name), "sample", strconv.Itoa(i+1)),
+		})
+	}
+}
+
+// percentile returns the p-th percentile of the values interpolating between the closest ranks.
+func percentile(values []float64, p float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	rank := p / 100 * float64(len(sorted)-1)
+	lower := int(rank)
+	if lower+1 >= len(sorted) {
+		return sorted[len(sorted)-1]
+	}
+	return sorted[lower] + (rank-float64(lower))*(sorted[lower+1]-sorted[lower])
+}
+
+// mean returns the average of the values.
+func mean(values []float64) float64 {
+	var total float64
+	for _, value := range values {
+		total += value
+	}
+	return total / float64(len(values))
+}
+
+// warmup runs a short unrecorded test before the measured one so the path and the TCP windows are primed. It
+// returns the run with the bytes or bitrate read from its output for the data budget, and whether it succeeded.
+func warmup(eng engine, server perfServer, clientCmd []string, opts testOptions, length string) (sample, bool) {
+	opts.length = length
+	opts.omit = ""
+	var result sample
+	output, err := runCmdInContext(context.Background(), server, clientArgv(eng, clientCmd, opts), engineEnv(eng, server))
+	if eng.transferred != nil {
+		result.bytes, _ = eng.transferred(output)
+	}
+	if err != nil || eng.failed(output) {
+		log.Debugf("Warm-up test to %s failed: %v %s", opts.address, err, output)
+		return result, false
+	}
+	if kbps, err := eng.parse(output); err == nil && eng.metric == "" {
+		result.bps, _ = convertKbitsToBits(kbps)
+	}
+	return result, true
+}
+
+// transferredBytes is the data transferred by the runs of a test, estimated from the bitrate and length of the
+// runs the engine didn't report it for.
+func transferredBytes(samples []sample, length string) int64 {
+	seconds, _ := strconv.ParseInt(length, 10, 64)
+	var total int64
+	for _, result := range samples {
+		if result.bytes > 0 {
+			total += result.bytes
+		} else {
+			total += result.bps / 8 * seconds
+		}
+	}
+	return total
+}
+
+// failedBytes is the data the failed runs of a test may have transferred. A run counts the bytes its client
+// reported, or else a whole run at the mean bitrate of the successful runs or at the bandwidth cap of its streams,
+// so a budget rather overcounts a metered link than runs over it.
+func failedBytes(failed []sample, samples []sample, opts testOptions, length string) int64 {
+	seconds, _ := strconv.ParseInt(length, 10, 64)
+	var bps int64
+	if len(samples) > 0 {
+		for _, result := range samples {
+			bps += result.bps
+		}
+		bps /= int64(len(samples))
+	} else if rate, err := parseBandwidth(opts.bandwidth); opts.bandwidth != "" && err == nil {
+		streams, err := strconv.ParseInt(opts.parallel, 10, 64)
+		if err != nil || streams < 1 {
+			streams = 1
+		}
+		bps = int64(rate) * streams
+	}
+	var total int64
+	for _, result := range failed {
+		if result.bytes > 0 {
+			total += result.bytes
+		} else {
+			total += bps / 8 * seconds
+		}
+	}
+	return total
+}
+
+// failureReason summarizes a failed test for annotations, the last line of output is usually the client's error.
+func failureReason(err error, output string) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if last := strings.TrimSpace(lines[len(lines)-1]); last != "" {
+		return last
+	}
+	if err != nil {
+		return err.Error()
+	}
+	return "unknown error"
+}
+
+// recordTestMetric records a companion metric of a test under <prefix>.<name>. failed is the share of
+// the runs of a test that failed, it's only recorded for the successful tests with --failure-rate so its
+// average is the failure rate. The other metrics except retransmits, anomaly and the utilization, loss and
+// jitter metrics are in bps and named <name>_bps.
+func recordTestMetric(config configuration, settings runSettings, eng engine, server perfServer, direction string, prefix string, name string, value float64) {
+	countTestMetric(name, value)
+	if name == "failed" && value == 0 && !settings.failureRate {
+		return
+	}
+	metric := name
+	switch name {
+	case "failed":
+		metric = "test_failed"
+	case "retransmits", "anomaly", "reachable", "cpu_util", "local_cpu_util", "remote_cpu_util", "compare_delta_pct", "overlay_overhead_pct", "ipv6_delta_pct", "suppressed",
+		"cpu_peak", "mem_util", "nic_util", "nic_drops", "nic_divergence_pct", "parallel_streams", "loss_pct", "jitter_ms",
+		"pre_hook_failed", "post_hook_failed", "sla_compliance_pct", "sla_month_compliance_pct":
+	default:
+		metric = name + "_bps"
+	}
+	recordMeasurement(config, settings, measurement{
+		Timestamp:   measurementTime(),
+		Source:      config.Hostname,
+		Destination: server.displayName(),
+		Address:     server.Address,
+		Direction:   direction,
+		Prefix:      prefix + "." + name,
+		Engine:      eng.name,
+		Metric:      metric,
+		Value:       value,
+		RunID:       server.runID,
+		Tags:        withTag(server.Tags, "engine", eng.name),
+	})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// errorClass is the kind of failure a test or pre-check ran into, counted per endpoint so failures can be alerted
+// on by their cause.
+type errorClass string
+
+const (
+	errorDNS         errorClass = "dns"
+	errorRefused     errorClass = "refused"
+	errorUnreachable errorClass = "unreachable"
+	errorTimeout     errorClass = "timeout"
+	errorBusy        errorClass = "busy"
+	errorAuth        errorClass = "auth"
+	errorParse       errorClass = "parse"
+	errorOther       errorClass = "other"
+)
+
+// errorPatterns match the client output and error messages of each class, in the order they're checked. The
+// messages are the ones of iperf3, iperf2, netperf, ssh and the Go net package.
+var errorPatterns = []struct {
+	class    errorClass
+	patterns []string
+}{
+	{errorBusy, []string{"server is busy"}},
+	{errorAuth, []string{"authorization failed", "authentication failed", "unable to authenticate", "permission denied", "access denied", "host key"}},
+	{errorDNS, []string{"unable to resolve", "could not resolve", "no such host", "name or service not known", "temporary failure in name resolution", "nodename nor servname", "getaddrinfo"}},
+	{errorRefused, []string{"connection refused"}},
+	{errorUnreachable, []string{"no route to host", "network is unreachable", "host is unreachable"}},
+	{errorTimeout, []string{"timed out", "timeout", "deadline exceeded"}},
+}
+
+// testError is a failed test run with the class of its failure.
+type testError struct {
+	class  errorClass
+	reason string
+}
+
+func (e *testError) Error() string {
+	return e.reason
+}
+
+// classifyError returns the class of a failure from its error and the output of the client.
+func classifyError(err error, output string) errorClass {
+	var classified *testError
+	if errors.As(err, &classified) {
+		return classified.class
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return errorDNS
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return errorRefused
+	}
+	if errors.Is(err, syscall.EHOSTUNREACH) || errors.Is(err, syscall.ENETUNREACH) {
+		return errorUnreachable
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return errorTimeout
+	}
+	text := strings.ToLower(output)
+	if err != nil {
+		text += "\n" + strings.ToLower(err.Error())
+	}
+	for _, class := range errorPatterns {
+		for _, pattern := range class.patterns {
+			if strings.Contains(text, pattern) {
+				return class.class
+			}
+		}
+	}
+	return errorOther
+}
+
+// errorCounts counts the failures of every class per endpoint and direction since the agent started.
+var errorCounts = struct {
+	sync.Mutex
+	counts map[string]int
+}{counts: make(map[string]int)}
+
+// recordError counts a failure of an endpoint in a direction and records the count of its class under
+// <prefix>.errors.<class> as test_errors, tagged with the class. The count only goes up so it can be graphed as a
+// rate, it restarts with the agent.
+func recordError(config configuration, settings runSettings, eng engine, server perfServer, direction string, prefix string, class errorClass) {
+	key := server.Address + "|" + server.displayName() + "|" + direction + "|" + string(class)
+	errorCounts.Lock()
+	errorCounts.counts[key]++
+	count := errorCounts.counts[key]
+	errorCounts.Unlock()
+	recordMeasurement(config, settings, measurement{
+		Timestamp:   measurementTime(),
+		Source:      config.Hostname,
+		Destination: server.displayName(),
+		Address:     server.Address,
+		Direction:   direction,
+		Prefix:      prefix + ".errors." + string(class),
+		Engine:      eng.name,
+		Metric:      "test_errors",
+		Value:       float64(count),
+		RunID:       server.runID,
+		Tags:        withTag(withTag(server.Tags, "engine", eng.name), "class", string(class)),
+	})
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const engineExec = "exec"
+
+// execConfig is the user-provided executable run by the exec engine, e.g. a proprietary probe wrapped in a script.
+type execConfig struct {
+	Command string `yaml:"command"`
+	// Args are passed to the command before the arguments describing the test.
+	Args []string `yaml:"args"`
+	// Metric names the value the command reports when it measures something other than a bitrate.
+	Metric string `yaml:"metric"`
+	// Upload also runs the command with --direction upload.
+	Upload bool `yaml:"upload"`
+}
+
+// execResult is the JSON object the command prints on stdout, bits_per_second for a bitrate or value for a
+// named metric. A non-empty error fails the test.
+type execResult struct {
+	BitsPerSecond *float64 `json:"bits_per_second"`
+	Value         *float64 `json:"value"`
+	Error         string   `json:"error"`
+}
+
+// execSettings is the merged exec configuration used by the exec engine.
+var execSettings execConfig
+
+// the exec engine runs a user-provided executable for each test, which always runs on the host.
+func init() {
+	engines[engineExec] = engine{
+		name:         engineExec,
+		server:       "the exec command's endpoint",
+		local:        true,
+		bandwidthCap: true,
+		parallel:     true,
+		args: func(opts testOptions) []string {
+			args := append([]string{}, execSettings.Args...)
+			args = append(args, "--address", opts.address, "--length", opts.length, "--parallel", opts.parallel)
+			if opts.port != "" {
+				args = append(args, "--port", opts.port)
+			}
+			direction := directionDownload
+			if opts.reverse {
+				direction = directionUpload
+			}
+			args = append(args, "--direction", direction)
+			if opts.bandwidth != "" {
+				args = append(args, "--bandwidth", opts.bandwidth)
+			}
+			if opts.bind != "" {
+				args = append(args, "--bind", opts.bind)
+			}
+			return args
+		},
+		parse: func(output string) (string, error) {
+			result, err := parseExecResult(output)
+			if err != nil {
+				return "", err
+			}
+			if execSettings.Metric != "" {
+				if result.Value == nil {
+					return "", fmt.Errorf("the exec command printed no value")
+				}
+				return strconv.FormatFloat(*result.Value, 'f', -1, 64), nil
+			}
+			if result.BitsPerSecond == nil {
+				return "", fmt.Errorf("the exec command printed no bits_per_second")
+			}
+			return kbitsString(*result.BitsPerSecond), nil
+		},
+		failed: func(output string) bool {
+			result, err := parseExecResult(output)
+			return err == nil && result.Error != ""
+		},
+	}
+}
+
+// mergeExecFlags fills any exec settings missing from the configuration file with the CLI values.
+func mergeExecFlags(ec *execConfig) {
+	if ec.Command == "" {
+		ec.Command = cliFlags.execCommand
+	}
+	if ec.Metric == "" {
+		ec.Metric = cliFlags.execMetric
+	}
+	if cliFlags.execUpload {
+		ec.Upload = true
+	}
+}
+
+// configureExecEngine sets the command, metric and directions of the exec engine from the configuration.
+func configureExecEngine(ec execConfig) {
+	execSettings = ec
+	eng := engines[engineExec]
+	eng.binary = ec.Command
+	eng.metric = ec.Metric
+	eng.upload = ec.Upload
+	engines[engineExec] = eng
+}
+
+// parseExecResult decodes the JSON object printed by the exec command, the last line starting with { if it logged
+// anything else.
+func parseExecResult(output string) (execResult, error) {
+	var result execResult
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		line := strings.TrimSpace(lines[i])
+		if !strings.HasPrefix(line, "{") {
+			continue
+		}
+		if err := json.Unmarshal([]byte(line), &result); err != nil {
+			return result, fmt.Errorf("the exec command printed an invalid JSON result: %v", err)
+		}
+		return result, nil
+	}
+	return result, fmt.Errorf("the exec command didn't print a JSON result")
+}
+
+// validateExec checks the exec engine has a command when an endpoint or the default engine uses it.
+func validateExec(config configuration) []error {
+	used := config.Engine == engineExec || cliFlags.engine == engineExec || cliFlags.compareEngine == engineExec
+	for _, server := range allServers(config) {
+		used = used || server.Engine == engineExec
+	}
+	if used && config.Exec.Command == "" {
+		return []error{fmt.Errorf("the exec engine needs a command, set exec.command or --exec-command")}
+	}
+	return nil
+}
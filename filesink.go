@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+const (
+	fileFormatCSV     = "csv"
+	fileFormatParquet = "parquet"
+	filePrefix        = "cbandwidth-"
+)
+
+var csvHeader = []string{"timestamp", "source", "destination", "address", "direction", "prefix", "engine", "bps", "metric", "value", "tags"}
+
+type fileOutputConfig struct {
+	Dir            string `yaml:"dir"`
+	Format         string `yaml:"format"`
+	RotateSizeMB   int    `yaml:"rotate-size-mb"`
+	RotateInterval string `yaml:"rotate-interval"`
+	MaxFiles       int    `yaml:"max-files"`
+	// RawRetention is how long the raw files are kept before they're compacted into hourly averages, such as 7d,
+	// and RollupRetention how long the hourly averages are kept. Empty keeps them.
+	RawRetention    string `yaml:"raw-retention"`
+	RollupRetention string `yaml:"rollup-retention"`
+}
+
+// parquetRow is the parquet schema of a measurement, tags are flattened to k=v pairs like the csv.
+type parquetRow struct {
+	Timestamp   int64   `parquet:"name=timestamp, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	Source      string  `parquet:"name=source, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Destination string  `parquet:"name=destination, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Address     string  `parquet:"name=address, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Direction   string  `parquet:"name=direction, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Prefix      string  `parquet:"name=prefix, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Engine      string  `parquet:"name=engine, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Bps         int64   `parquet:"name=bps, type=INT64"`
+	Metric      string  `parquet:"name=metric, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Value       float64 `parquet:"name=value, type=DOUBLE"`
+	Tags        string  `parquet:"name=tags, type=BYTE_ARRAY, convertedtype=UTF8"`
+}
+
+// fileSink appends measurements to the current output file and rotates it by size and age.
+type fileSink struct {
+	config          fileOutputConfig
+	rotateInterval  time.Duration
+	rawRetention    time.Duration
+	rollupRetention time.Duration
+	mu              sync.Mutex
+	file            *os.File
+	opened          time.Time
+	csvWriter       *csv.Writer
+	parquetWriter   *writer.ParquetWriter
+}
+
+var files *fileSink
+
+// mergeFileOutputFlags fills any file output settings missing from the configuration file with the CLI values.
+func mergeFileOutputFlags(fc *fileOutputConfig) {
+	if fc.Dir == "" {
+		fc.Dir = cliFlags.fileOutputDir
+	}
+	if fc.Format == "" {
+		fc.Format = cliFlags.fileOutputFormat
+	}
+	if fc.RotateInterval == "" {
+		fc.RotateInterval = "86400"
+	}
+	if fc.RotateSizeMB == 0 {
+		fc.RotateSizeMB = 100
+	}
+}
+
+// validateFileOutputConfig checks the file output settings without creating any files.
+func validateFileOutputConfig(fc fileOutputConfig) error {
+	if fc.Format != fileFormatCSV && fc.Format != fileFormatParquet {
+		return fmt.Errorf("unsupported file output format %q, must be csv or parquet", fc.Format)
+	}
+	if seconds, err := strconv.Atoi(fc.RotateInterval); err != nil || seconds <= 0 {
+		return fmt.Errorf("file output rotate-interval must be a positive number of seconds, got %q", fc.RotateInterval)
+	}
+	for _, setting := range []struct{ name, value string }{
+		{"raw-retention", fc.RawRetention},
+		{"rollup-retention", fc.RollupRetention},
+	} {
+		if setting.value == "" {
+			continue
+		}
+		if _, err := parsePeriod(setting.value); err != nil {
+			return fmt.Errorf("file output %s must be a number of days such as 7d, weeks such as 2w or a duration such as 12h, got %q", setting.name, setting.value)
+		}
+	}
+	return nil
+}
+
+// initFileOutput sets up the file sink if an output directory was configured.
+func initFileOutput(fc fileOutputConfig) error {
+	if fc.Dir == "" {
+		return nil
+	}
+	if err := validateFileOutputConfig(fc); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(fc.Dir, 0755); err != nil {
+		return fmt.Errorf("could not create the file output directory: %v", err)
+	}
+	interval, _ := time.ParseDuration(fc.RotateInterval + "s")
+	files = &fileSink{config: fc, rotateInterval: interval}
+	if fc.RawRetention != "" {
+		files.rawRetention, _ = parsePeriod(fc.RawRetention)
+	}
+	if fc.RollupRetention != "" {
+		files.rollupRetention, _ = parsePeriod(fc.RollupRetention)
+	}
+	log.Debugf("[Config] File Output = %s (%s)", fc.Dir, fc.Format)
+	if fc.RawRetention != "" || fc.RollupRetention != "" {
+		log.Debugf("[Config] File Output Retention = raw %s, hourly rollups %s", fc.RawRetention, fc.RollupRetention)
+	}
+	return nil
+}
+
+// add appends a measurement to the current file, rotating it first if needed.
+func (f *fileSink) add(m measurement) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file != nil && f.needsRotation() {
+		f.closeFile()
+	}
+	if f.file == nil {
+		if err := f.openFile(); err != nil {
+			log.Errorf("Error opening the output file in %s: %v", f.config.Dir, err)
+			return
+		}
+	}
+
+	start := time.Now()
+	offset, _ := f.file.Seek(0, io.SeekCurrent)
+	var err error
+	if f.config.Format == fileFormatParquet {
+		err = f.parquetWriter.Write(parquetRow{
+			Timestamp:   m.Timestamp.UnixNano() / 1e6,
+			Source:      m.Source,
+			Destination: m.Destination,
+			Address:     m.Address,
+			Direction:   m.Direction,
+			Prefix:      m.Prefix,
+			Engine:      m.Engine,
+			Bps:         m.Bps,
+			Metric:      m.Metric,
+			Value:       m.Value,
+			Tags:        flattenTags(m.Tags),
+		})
+	} else {
+		err = f.csvWriter.Write([]string{
+			m.Timestamp.Format(time.RFC3339),
+			m.Source,
+			m.Destination,
+			m.Address,
+			m.Direction,
+			m.Prefix,
+			m.Engine,
+			strconv.FormatInt(m.Bps, 10),
+			m.Metric,
+			strconv.FormatFloat(m.Value, 'f', -1, 64),
+			flattenTags(m.Tags),
+		})
+		f.csvWriter.Flush()
+		if err == nil {
+			err = f.csvWriter.Error()
+		}
+	}
+	// the parquet rows are buffered, their size is only counted once a page is written out
+	end, _ := f.file.Seek(0, io.SeekCurrent)
+	auditWrite("file", f.file.Name(), int(end-offset), start, err)
+	if err != nil {
+		log.Errorf("Error writing to the output file %s: %v", f.file.Name(), err)
+	}
+}
+
+// needsRotation reports whether the current file is older than the rotate interval or larger than the size limit.
+func (f *fileSink) needsRotation() bool {
+	if time.Since(f.opened) >= f.rotateInterval {
+		return true
+	}
+	info, err := f.file.Stat()
+	return err == nil && info.Size() >= int64(f.config.RotateSizeMB)*1024*1024
+}
+
+// openFile starts a new timestamped output file. A parquet file can't be appended to, so a file started in the same
+// second as the previous one is named after the next free second.
+func (f *fileSink) openFile() error {
+	f.opened = time.Now()
+	var name string
+	var file *os.File
+	for {
+		name = filepath.Join(f.config.Dir, fmt.Sprintf("%s%s.%s", filePrefix, f.opened.UTC().Format(fileTimeLayout), f.config.Format))
+		var err error
+		file, err = os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			break
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+		f.opened = f.opened.Add(time.Second)
+	}
+	f.file = file
+
+	if f.config.Format == fileFormatParquet {
+		pw, err := writer.NewParquetWriterFromWriter(file, new(parquetRow), 1)
+		if err != nil {
+			file.Close()
+			f.file = nil
+			return err
+		}
+		pw.CompressionType = parquet.CompressionCodec_SNAPPY
+		f.parquetWriter = pw
+	} else {
+		f.csvWriter = csv.NewWriter(file)
+		if err := f.csvWriter.Write(csvHeader); err != nil {
+			return err
+		}
+	}
+	log.Debugf("Writing measurements to %s", name)
+	f.pruneFiles()
+	f.compact(f.opened)
+	return nil
+}
+
+// closeFile finishes the current file, parquet files are only readable once their footer is written.
+func (f *fileSink) closeFile() {
+	if f.parquetWriter != nil {
+		if err := f.parquetWriter.WriteStop(); err != nil {
+			log.Errorf("Error finishing the parquet file %s: %v", f.file.Name(), err)
+		}
+		f.parquetWriter = nil
+	}
+	if f.csvWriter != nil {
+		f.csvWriter.Flush()
+		f.csvWriter = nil
+	}
+	f.file.Close()
+	f.file = nil
+}
+
+// flush finishes the current parquet file at the end of every cycle so its results are readable, the next results
+// go to a new file. A csv file is readable as it's written and is kept until it's rotated.
+func (f *fileSink) flush() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file != nil && f.config.Format == fileFormatParquet {
+		f.closeFile()
+	}
+}
+
+// close finishes the current file on shutdown.
+func (f *fileSink) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file != nil {
+		f.closeFile()
+	}
+}
+
+// pruneFiles removes the oldest raw output files beyond max-files, the rollups expire with rollup-retention.
+func (f *fileSink) pruneFiles() {
+	if f.config.MaxFiles <= 0 {
+		return
+	}
+	matches := f.rawFiles()
+	if len(matches) <= f.config.MaxFiles {
+		return
+	}
+	for _, name := range matches[:len(matches)-f.config.MaxFiles] {
+		if err := os.Remove(name); err != nil {
+			log.Errorf("Error removing the old output file %s: %v", name, err)
+		}
+	}
+}
+
+// flattenTags formats tags as sorted k=v pairs separated by semicolons.
+func flattenTags(tags map[string]string) string {
+	pairs := make([]string, 0, len(tags))
+	for _, k := range sortedTagKeys(tags) {
+		pairs = append(pairs, k+"="+tags[k])
+	}
+	return strings.Join(pairs, ";")
+}
@@ -3,7 +3,20 @@ module github.com/nerdalert/cloud-bandwidth
 go 1.12
 
 require (
+	github.com/BurntSushi/toml v1.3.2
+	github.com/aws/aws-sdk-go v1.55.8
+	github.com/eclipse/paho.mqtt.golang v1.4.3
+	github.com/gosnmp/gosnmp v1.34.0
+	github.com/nats-io/nats.go v1.22.1
+	github.com/segmentio/kafka-go v0.4.47
 	github.com/sirupsen/logrus v1.8.1
 	github.com/urfave/cli/v2 v2.3.0
+	github.com/xitongsys/parquet-go v1.6.2
+	golang.org/x/crypto v0.17.0
+	golang.org/x/net v0.17.0
+	golang.org/x/sys v0.15.0
+	google.golang.org/grpc v1.56.3
+	google.golang.org/protobuf v1.30.0
+	gopkg.in/natefinch/lumberjack.v2 v2.2.1
 	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,695 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	engineGoperf      = "goperf"
+	defaultGoperfPort = "5301"
+	goperfVersion     = 1
+	goperfTCP         = "tcp"
+	goperfUDP         = "udp"
+	// defaultGoperfPacketSize keeps the UDP datagrams within the MTU of a path with tunnel overhead.
+	defaultGoperfPacketSize = "1400"
+	// goperfUDPHeader is the token, sequence number and send time at the start of every datagram.
+	goperfUDPHeader = 24
+	// defaultGoperfUDPRate is the rate of a UDP test without a bandwidth cap, the iperf3 default.
+	defaultGoperfUDPRate = 1e6
+	// goperfSecretEnv passes the secret to the goperf client, off its command line.
+	goperfSecretEnv = "CBANDWIDTH_GOPERF_SECRET"
+	// goperfBuffer is the size of the writes and reads of a TCP stream.
+	goperfBuffer = 128 * 1024
+	// goperfGrace is how long the receiver of a UDP stream waits for the datagrams still in flight when the sender
+	// is done.
+	goperfGrace = 500 * time.Millisecond
+	// goperfMaxFrame bounds the control messages, they're small JSON objects.
+	goperfMaxFrame = 1 << 20
+	goperfTimeout  = 10 * time.Second
+)
+
+// goperfConfig is the protocol of the built-in goperf engine, which needs no perf client or server binary since
+// both ends are this agent.
+type goperfConfig struct {
+	// Protocol is tcp (default) or udp, the UDP tests also report the loss and jitter.
+	Protocol string `yaml:"protocol"`
+	// PacketSize is the size of the UDP datagrams in bytes.
+	PacketSize string `yaml:"packet-size"`
+	// Secret is shared by the agents and the server, a server with a secret only runs the tests of the clients that
+	// know it.
+	Secret string `yaml:"secret"`
+	// MaxRate caps the bitrate of all the tests a server runs at once, such as 1G, unlimited if empty. MaxLength is
+	// the longest test in seconds it runs.
+	MaxRate   string `yaml:"max-rate"`
+	MaxLength string `yaml:"max-length"`
+}
+
+// goperfSettings is the merged goperf configuration used by the goperf engine.
+var goperfSettings goperfConfig
+
+// goperfHello is the first message of every connection, it describes the stream the client wants. Rate is the
+// target of the stream in bits per second, zero for a full rate TCP stream.
+type goperfHello struct {
+	Version    int    `json:"version"`
+	Protocol   string `json:"protocol"`
+	Reverse    bool   `json:"reverse"`
+	Seconds    int    `json:"seconds"`
+	Rate       int64  `json:"rate"`
+	PacketSize int    `json:"packet-size"`
+}
+
+// goperfAccept is the answer of the server to a hello, Token identifies the datagrams of a UDP stream. A server
+// with a secret first answers with a Challenge, the client proves it knows the secret with a goperfAuth.
+type goperfAccept struct {
+	Token     uint64 `json:"token,omitempty"`
+	Challenge string `json:"challenge,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// goperfAuth answers the challenge of a server with a secret, MAC is the goperfMAC of the challenge.
+type goperfAuth struct {
+	MAC string `json:"mac"`
+}
+
+// goperfDone is sent by the sender of a UDP stream over the control connection once it sent its last datagram.
+type goperfDone struct {
+	Packets int64 `json:"packets"`
+}
+
+// goperfReport is what the receiving end of a stream measured, Intervals are the bytes received every second.
+type goperfReport struct {
+	Bytes     int64     `json:"bytes"`
+	Seconds   float64   `json:"seconds"`
+	Packets   int64     `json:"packets,omitempty"`
+	Lost      int64     `json:"lost,omitempty"`
+	JitterMs  float64   `json:"jitter_ms,omitempty"`
+	Intervals []float64 `json:"intervals,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// goperfResult is the JSON object the client prints, the sum of its streams as measured by their receivers.
+type goperfResult struct {
+	Protocol      string           `json:"protocol"`
+	BitsPerSecond float64          `json:"bits_per_second"`
+	Bytes         int64            `json:"bytes"`
+	Seconds       float64          `json:"seconds"`
+	Packets       int64            `json:"packets,omitempty"`
+	LostPackets   int64            `json:"lost_packets,omitempty"`
+	LostPercent   float64          `json:"lost_percent,omitempty"`
+	JitterMs      float64          `json:"jitter_ms,omitempty"`
+	Intervals     []goperfInterval `json:"intervals,omitempty"`
+	Error         string           `json:"error,omitempty"`
+}
+
+// goperfInterval is the bitrate of every stream together during a second of the test, End is its end in seconds.
+type goperfInterval struct {
+	End           float64 `json:"end"`
+	BitsPerSecond float64 `json:"bits_per_second"`
+}
+
+// the goperf engine runs this binary as the client, and the server subcommand as the listener at the far end.
+func init() {
+	executable, err := os.Executable()
+	if err != nil {
+		executable = os.Args[0]
+	}
+	engines[engineGoperf] = engine{
+		name:         engineGoperf,
+		server:       "the goperf server",
+		binary:       executable,
+		local:        true,
+		port:         defaultGoperfPort,
+		upload:       true,
+		bandwidthCap: true,
+		parallel:     true,
+		cport:        true,
+		args: func(opts testOptions) []string {
+			args := []string{"goperf-client", "--address", opts.address, "--port", opts.port, "--length", opts.length, "--parallel", opts.parallel}
+			if opts.reverse {
+				args = append(args, "--reverse")
+			}
+			if goperfSettings.Protocol == goperfUDP || opts.udp {
+				args = append(args, "--udp", "--packet-size", goperfSettings.PacketSize)
+			}
+			if opts.bandwidth != "" {
+				args = append(args, "--bandwidth", opts.bandwidth)
+			}
+			if opts.bind != "" {
+				args = append(args, "--bind", opts.bind)
+			}
+			if opts.cport != "" {
+				args = append(args, "--cport", opts.cport)
+			}
+			return args
+		},
+		parse: func(output string) (string, error) {
+			result, err := parseGoperfResult(output)
+			if err != nil {
+				return "", err
+			}
+			return kbitsString(result.BitsPerSecond), nil
+		},
+		failed: func(output string) bool {
+			result, err := parseGoperfResult(output)
+			return err == nil && result.Error != ""
+		},
+		transferred: func(output string) (int64, bool) {
+			result, err := parseGoperfResult(output)
+			return result.Bytes, err == nil
+		},
+		intervals: func(output string) ([]intervalSample, bool) {
+			result, err := parseGoperfResult(output)
+			if err != nil {
+				return nil, false
+			}
+			intervals := make([]intervalSample, 0, len(result.Intervals))
+			for _, interval := range result.Intervals {
+				intervals = append(intervals, intervalSample{end: time.Duration(interval.End * float64(time.Second)), bps: interval.BitsPerSecond})
+			}
+			return intervals, len(intervals) > 0
+		},
+		udp: func(output string) (float64, float64, bool) {
+			result, err := parseGoperfResult(output)
+			return result.LostPercent, result.JitterMs, err == nil && result.Protocol == goperfUDP
+		},
+		serve: runGoperfServer,
+		env: func() []string {
+			if goperfSettings.Secret == "" {
+				return nil
+			}
+			return []string{goperfSecretEnv + "=" + goperfSettings.Secret}
+		},
+	}
+}
+
+// mergeGoperfFlags fills any goperf settings missing from the configuration file with the CLI values.
+func mergeGoperfFlags(gc *goperfConfig) {
+	if gc.Protocol == "" {
+		gc.Protocol = cliFlags.goperfProtocol
+	}
+	if gc.PacketSize == "" {
+		gc.PacketSize = cliFlags.goperfPacketSize
+	}
+	if gc.Secret == "" {
+		gc.Secret = cliFlags.goperfSecret
+	}
+	if gc.MaxRate == "" {
+		gc.MaxRate = cliFlags.goperfMaxRate
+	}
+	if gc.MaxLength == "" {
+		gc.MaxLength = cliFlags.goperfMaxLength
+	}
+}
+
+// validateGoperf checks the protocol, the packet size and the server limits, a UDP test can't be tunneled.
+func validateGoperf(config configuration) []error {
+	gc := config.Goperf
+	var errs []error
+	if gc.MaxRate != "" {
+		if _, err := parseBandwidth(gc.MaxRate); err != nil {
+			errs = append(errs, fmt.Errorf("goperf max-rate %v", err))
+		}
+	}
+	if length, err := strconv.Atoi(gc.MaxLength); gc.MaxLength != "" && (err != nil || length < 1) {
+		errs = append(errs, fmt.Errorf("goperf max-length must be a positive number of seconds, got %q", gc.MaxLength))
+	}
+	if gc.Protocol != goperfTCP && gc.Protocol != goperfUDP {
+		errs = append(errs, fmt.Errorf("goperf protocol must be tcp or udp, got %q", gc.Protocol))
+	}
+	if size, err := strconv.Atoi(gc.PacketSize); err != nil || size < goperfUDPHeader || size > 65507 {
+		errs = append(errs, fmt.Errorf("goperf packet-size must be between %d and 65507 bytes, got %q", goperfUDPHeader, gc.PacketSize))
+	}
+	if gc.Protocol != goperfUDP {
+		return errs
+	}
+	eng, err := selectEngine(config)
+	if err != nil {
+		return errs
+	}
+	for _, server := range allServers(config) {
+		if server.Tunnel != nil && endpointEngine(eng, server).name == engineGoperf {
+			errs = append(errs, fmt.Errorf("perf server %s: goperf udp tests can't be tunneled, use the tcp protocol", server.Address))
+		}
+	}
+	return errs
+}
+
+// configureGoperfEngine sets the protocol of the goperf engine from the configuration.
+func configureGoperfEngine(gc goperfConfig) {
+	goperfSettings = gc
+}
+
+// parseGoperfResult decodes the JSON result printed by the goperf client.
+func parseGoperfResult(output string) (goperfResult, error) {
+	var result goperfResult
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	line := strings.TrimSpace(lines[len(lines)-1])
+	if !strings.HasPrefix(line, "{") {
+		return result, fmt.Errorf("the goperf client didn't print a JSON result")
+	}
+	if err := json.Unmarshal([]byte(line), &result); err != nil {
+		return result, fmt.Errorf("the goperf client printed an invalid JSON result: %v", err)
+	}
+	return result, nil
+}
+
+// writeFrame sends a control message as a 4 byte big-endian length followed by its JSON.
+func writeFrame(w io.Writer, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[4:], data)
+	_, err = w.Write(frame)
+	return err
+}
+
+// readFrame reads a control message written by writeFrame.
+func readFrame(r io.Reader, v interface{}) error {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return err
+	}
+	length := binary.BigEndian.Uint32(header[:])
+	if length > goperfMaxFrame {
+		return fmt.Errorf("control message of %d bytes is too long", length)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// goperfClientOptions are the arguments of the goperf client.
+type goperfClientOptions struct {
+	address    string
+	port       string
+	bind       string
+	cport      int
+	seconds    int
+	streams    int
+	reverse    bool
+	udp        bool
+	rate       float64
+	packetSize int
+	secret     string
+}
+
+// runGoperfClient runs a test against a goperf server and prints its JSON result, with the error of a failed test.
+func runGoperfClient(opts goperfClientOptions) error {
+	result, err := goperfTest(opts)
+	if err != nil {
+		result = goperfResult{Error: err.Error()}
+	}
+	data, _ := json.Marshal(result)
+	fmt.Println(string(data))
+	if err != nil {
+		return fmt.Errorf("goperf test failed")
+	}
+	return nil
+}
+
+// goperfTest runs the streams of a test at once and sums the reports of their receivers. The bandwidth cap is
+// split evenly between the streams.
+func goperfTest(opts goperfClientOptions) (goperfResult, error) {
+	protocol := goperfTCP
+	rate := opts.rate
+	if opts.udp {
+		protocol = goperfUDP
+		if rate == 0 {
+			rate = defaultGoperfUDPRate
+		}
+	}
+	hello := goperfHello{
+		Version:    goperfVersion,
+		Protocol:   protocol,
+		Reverse:    opts.reverse,
+		Seconds:    opts.seconds,
+		Rate:       int64(rate / float64(opts.streams)),
+		PacketSize: opts.packetSize,
+	}
+	reports := make([]goperfReport, opts.streams)
+	errs := make([]error, opts.streams)
+	var wg sync.WaitGroup
+	for i := 0; i < opts.streams; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			reports[i], errs[i] = goperfStream(opts, hello, i)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return goperfResult{}, err
+		}
+	}
+
+	result := goperfResult{Protocol: protocol}
+	var jitter float64
+	var sums []float64
+	for _, report := range reports {
+		result.Bytes += report.Bytes
+		result.Packets += report.Packets
+		result.LostPackets += report.Lost
+		jitter += report.JitterMs
+		if report.Seconds > result.Seconds {
+			result.Seconds = report.Seconds
+		}
+		for i, bytes := range report.Intervals {
+			if i >= len(sums) {
+				sums = append(sums, 0)
+			}
+			sums[i] += bytes
+		}
+	}
+	if result.Seconds > 0 {
+		result.BitsPerSecond = float64(result.Bytes) * 8 / result.Seconds
+	}
+	// the last interval is the partial second before the test ended, it's left out like an unfinished report unless
+	// it's nearly complete, the UDP streams end with their last datagram
+	for i, bytes := range sums {
+		if float64(i+1) > result.Seconds+0.1 {
+			break
+		}
+		result.Intervals = append(result.Intervals, goperfInterval{End: float64(i + 1), BitsPerSecond: bytes * 8})
+	}
+	if opts.udp {
+		result.JitterMs = jitter / float64(len(reports))
+		if sent := result.Packets + result.LostPackets; sent > 0 {
+			result.LostPercent = float64(result.LostPackets) / float64(sent) * 100
+		}
+	}
+	return result, nil
+}
+
+// goperfStream runs a single stream and returns the report of its receiver, the server in the forward direction
+// and this client in reverse. With a client port, stream i binds its TCP and UDP sockets to the port i after it.
+func goperfStream(opts goperfClientOptions, hello goperfHello, stream int) (goperfReport, error) {
+	dialer := net.Dialer{Timeout: goperfTimeout}
+	localPort := 0
+	if opts.cport > 0 {
+		localPort = opts.cport + stream
+	}
+	if opts.bind != "" || localPort > 0 {
+		dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(opts.bind), Port: localPort}
+	}
+	if localPort > 0 {
+		dialer.Control = reuseClientPort
+	}
+	address := net.JoinHostPort(opts.address, opts.port)
+	conn, err := dialer.Dial("tcp", address)
+	if err != nil {
+		return goperfReport{}, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Duration(hello.Seconds)*time.Second + 3*goperfTimeout))
+	if err := writeFrame(conn, hello); err != nil {
+		return goperfReport{}, err
+	}
+	var accept goperfAccept
+	if err := readFrame(conn, &accept); err != nil {
+		return goperfReport{}, fmt.Errorf("no answer from the goperf server at %s: %v", address, err)
+	}
+	if accept.Challenge != "" {
+		if opts.secret == "" {
+			return goperfReport{}, fmt.Errorf("the goperf server at %s needs a secret, set the goperf secret", address)
+		}
+		if err := writeFrame(conn, goperfAuth{MAC: goperfMAC(opts.secret, accept.Challenge)}); err != nil {
+			return goperfReport{}, err
+		}
+		if err := readFrame(conn, &accept); err != nil {
+			return goperfReport{}, fmt.Errorf("no answer from the goperf server at %s: %v", address, err)
+		}
+	}
+	if accept.Error != "" {
+		return goperfReport{}, fmt.Errorf("the goperf server refused the test: %s", accept.Error)
+	}
+	duration := time.Duration(hello.Seconds) * time.Second
+
+	if hello.Protocol == goperfTCP {
+		if hello.Reverse {
+			return receiveTCP(conn, 0), nil
+		}
+		if _, err := sendTCP(conn, duration, hello.Rate); err != nil {
+			return goperfReport{}, err
+		}
+		conn.(*net.TCPConn).CloseWrite()
+		var report goperfReport
+		if err := readFrame(conn, &report); err != nil {
+			return goperfReport{}, fmt.Errorf("no report from the goperf server: %v", err)
+		}
+		return report, nil
+	}
+
+	var local *net.UDPAddr
+	if opts.bind != "" || localPort > 0 {
+		local = &net.UDPAddr{IP: net.ParseIP(opts.bind), Port: localPort}
+	}
+	remote, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return goperfReport{}, err
+	}
+	// the server sends from the socket it was reached at, so a connected socket gets its datagrams through NAT
+	udp, err := net.DialUDP("udp", local, remote)
+	if err != nil {
+		return goperfReport{}, err
+	}
+	defer udp.Close()
+	if !hello.Reverse {
+		packets, err := sendUDP(udp.Write, accept.Token, duration, hello.Rate, hello.PacketSize)
+		if err != nil {
+			return goperfReport{}, err
+		}
+		if err := writeFrame(conn, goperfDone{Packets: packets}); err != nil {
+			return goperfReport{}, err
+		}
+		var report goperfReport
+		if err := readFrame(conn, &report); err != nil {
+			return goperfReport{}, fmt.Errorf("no report from the goperf server: %v", err)
+		}
+		return report, nil
+	}
+
+	// the server starts sending once a datagram with the token tells it where to, it's repeated until the first
+	// datagram of the test arrives
+	receiver := newUDPReceiver()
+	first := make(chan struct{})
+	go func() {
+		announce := make([]byte, goperfUDPHeader)
+		binary.BigEndian.PutUint64(announce, accept.Token)
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		for i := 0; i < 50; i++ {
+			udp.Write(announce)
+			select {
+			case <-first:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	done := make(chan goperfDone, 1)
+	go func() {
+		var sent goperfDone
+		if err := readFrame(conn, &sent); err == nil {
+			done <- sent
+		}
+		close(done)
+	}()
+	buf := make([]byte, 65536)
+	var once sync.Once
+	var deadline time.Time
+	for {
+		if !deadline.IsZero() {
+			udp.SetReadDeadline(deadline)
+		} else {
+			udp.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		}
+		n, err := udp.Read(buf)
+		if err == nil && n >= goperfUDPHeader && binary.BigEndian.Uint64(buf) == accept.Token {
+			once.Do(func() { close(first) })
+			receiver.receive(buf[:n], time.Now())
+		}
+		if deadline.IsZero() {
+			select {
+			case sent, ok := <-done:
+				if !ok {
+					once.Do(func() { close(first) })
+					return goperfReport{}, fmt.Errorf("the goperf server closed the control connection")
+				}
+				receiver.sent = sent.Packets
+				deadline = time.Now().Add(goperfGrace)
+			default:
+			}
+		} else if time.Now().After(deadline) {
+			return receiver.report(), nil
+		}
+	}
+}
+
+// sendTCP writes to a stream for the duration at the rate in bits per second, full rate if zero, and returns the
+// bytes written.
+func sendTCP(conn net.Conn, duration time.Duration, rate int64) (int64, error) {
+	buf := make([]byte, goperfBuffer)
+	start := time.Now()
+	end := start.Add(duration)
+	var sent int64
+	for time.Now().Before(end) {
+		n, err := conn.Write(buf)
+		sent += int64(n)
+		if err != nil {
+			return sent, err
+		}
+		pace(start, sent, rate)
+	}
+	return sent, nil
+}
+
+// receiveTCP reads a stream until the sender closes it and reports the bytes read every second. The reads are
+// paced at the rate in bits per second, as fast as the data arrives if zero.
+func receiveTCP(conn net.Conn, rate int64) goperfReport {
+	buf := make([]byte, goperfBuffer)
+	var report goperfReport
+	var start time.Time
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			now := time.Now()
+			if start.IsZero() {
+				start = now
+			}
+			report.Bytes += int64(n)
+			report.Intervals = addInterval(report.Intervals, now.Sub(start), n)
+			pace(start, report.Bytes, rate)
+		}
+		if err != nil {
+			break
+		}
+	}
+	if !start.IsZero() {
+		report.Seconds = time.Since(start).Seconds()
+	}
+	return report
+}
+
+// sendUDP sends the datagrams of a stream with write for the duration at the rate in bits per second and returns
+// how many it sent.
+func sendUDP(write func([]byte) (int, error), token uint64, duration time.Duration, rate int64, size int) (int64, error) {
+	buf := make([]byte, size)
+	binary.BigEndian.PutUint64(buf, token)
+	start := time.Now()
+	end := start.Add(duration)
+	var packets, sent int64
+	for time.Now().Before(end) {
+		binary.BigEndian.PutUint64(buf[8:], uint64(packets+1))
+		binary.BigEndian.PutUint64(buf[16:], uint64(time.Now().UnixNano()))
+		if _, err := write(buf); err != nil {
+			// a full socket buffer drops the datagram like the network would
+			if !isNoBufferSpace(err) {
+				return packets, err
+			}
+		}
+		packets++
+		sent += int64(size)
+		pace(start, sent, rate)
+	}
+	return packets, nil
+}
+
+// pace sleeps while the bytes sent since the start are ahead of the rate in bits per second.
+func pace(start time.Time, sent int64, rate int64) {
+	if rate <= 0 {
+		return
+	}
+	due := start.Add(time.Duration(float64(sent) * 8 / float64(rate) * float64(time.Second)))
+	if wait := time.Until(due); wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// addInterval adds the bytes received at an offset from the start of a stream to its interval of a second.
+func addInterval(intervals []float64, offset time.Duration, n int) []float64 {
+	i := int(offset / time.Second)
+	for len(intervals) <= i {
+		intervals = append(intervals, 0)
+	}
+	intervals[i] += float64(n)
+	return intervals
+}
+
+// isNoBufferSpace reports whether a send failed on a full socket buffer, ENOBUFS.
+func isNoBufferSpace(err error) bool {
+	return errors.Is(err, syscall.ENOBUFS)
+}
+
+// udpReceiver measures a UDP stream: the datagrams and bytes received, the loss against the datagrams the sender
+// sent and the jitter of their transit time as in RFC 3550. The clocks of both ends don't need to be in sync since
+// only the differences between transit times count.
+type udpReceiver struct {
+	mu        sync.Mutex
+	start     time.Time
+	last      time.Time
+	packets   int64
+	bytes     int64
+	sent      int64
+	transit   float64
+	jitter    float64
+	intervals []float64
+}
+
+func newUDPReceiver() *udpReceiver {
+	return &udpReceiver{}
+}
+
+// receive counts a datagram received at a time, its send time is in its header.
+func (r *udpReceiver) receive(datagram []byte, at time.Time) {
+	sentAt := int64(binary.BigEndian.Uint64(datagram[16:]))
+	// the announcement of a reverse stream has no sequence number
+	if binary.BigEndian.Uint64(datagram[8:]) == 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.start.IsZero() {
+		r.start = at
+	}
+	r.last = at
+	transit := float64(at.UnixNano()-sentAt) / float64(time.Millisecond)
+	if r.packets > 0 {
+		r.jitter += (math.Abs(transit-r.transit) - r.jitter) / 16
+	}
+	r.transit = transit
+	r.packets++
+	r.bytes += int64(len(datagram))
+	r.intervals = addInterval(r.intervals, at.Sub(r.start), len(datagram))
+}
+
+// report summarizes the stream, the duration is from the first to the last datagram received.
+func (r *udpReceiver) report() goperfReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	report := goperfReport{Bytes: r.bytes, Packets: r.packets, JitterMs: r.jitter, Intervals: r.intervals}
+	if r.packets > 0 {
+		report.Seconds = r.last.Sub(r.start).Seconds()
+	}
+	if r.sent > r.packets {
+		report.Lost = r.sent - r.packets
+	}
+	return report
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGoperfFrames(t *testing.T) {
+	hello := goperfHello{Version: goperfVersion, Protocol: goperfUDP, Reverse: true, Seconds: 5, Rate: 1e6, PacketSize: 1400}
+	var buf bytes.Buffer
+	if err := writeFrame(&buf, hello); err != nil {
+		t.Fatal(err)
+	}
+	if length := binary.BigEndian.Uint32(buf.Bytes()); int(length) != buf.Len()-4 {
+		t.Errorf("the frame length is %d, the JSON is %d bytes", length, buf.Len()-4)
+	}
+	var got goperfHello
+	if err := readFrame(&buf, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, hello) {
+		t.Errorf("read %+v, wrote %+v", got, hello)
+	}
+
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], goperfMaxFrame+1)
+	if err := readFrame(bytes.NewReader(header[:]), &got); err == nil {
+		t.Error("a frame over the limit was read")
+	}
+	binary.BigEndian.PutUint32(header[:], 10)
+	if err := readFrame(bytes.NewReader(append(header[:], `{"ver`...)), &got); err == nil {
+		t.Error("a truncated frame was read")
+	}
+}
+
+func TestCheckGoperfHello(t *testing.T) {
+	valid := goperfHello{Version: goperfVersion, Protocol: goperfUDP, Seconds: 10, Rate: 1e6, PacketSize: 1400}
+	if err := checkGoperfHello(valid, 10); err != nil {
+		t.Errorf("checkGoperfHello(%+v) = %v", valid, err)
+	}
+	for name, change := range map[string]func(*goperfHello){
+		"version":     func(h *goperfHello) { h.Version++ },
+		"protocol":    func(h *goperfHello) { h.Protocol = "sctp" },
+		"no length":   func(h *goperfHello) { h.Seconds = 0 },
+		"too long":    func(h *goperfHello) { h.Seconds = 11 },
+		"small udp":   func(h *goperfHello) { h.PacketSize = goperfUDPHeader - 1 },
+		"large udp":   func(h *goperfHello) { h.PacketSize = 65508 },
+		"no udp rate": func(h *goperfHello) { h.Rate = 0 },
+	} {
+		hello := valid
+		change(&hello)
+		if err := checkGoperfHello(hello, 10); err == nil {
+			t.Errorf("%s: checkGoperfHello(%+v) succeeded, want an error", name, hello)
+		}
+	}
+}
+
+func TestUDPReceiver(t *testing.T) {
+	receiver := newUDPReceiver()
+	start := time.Now()
+	datagram := make([]byte, 100)
+	for seq := 1; seq <= 10; seq++ {
+		// every other datagram takes a millisecond longer, the datagrams 3 and 7 are lost
+		if seq == 3 || seq == 7 {
+			continue
+		}
+		sent := start.Add(time.Duration(seq) * 100 * time.Millisecond)
+		binary.BigEndian.PutUint64(datagram[8:], uint64(seq))
+		binary.BigEndian.PutUint64(datagram[16:], uint64(sent.UnixNano()))
+		receiver.receive(datagram, sent.Add(time.Duration(10+seq%2)*time.Millisecond))
+	}
+	// the announcement of a reverse stream isn't counted
+	receiver.receive(make([]byte, goperfUDPHeader), time.Now())
+	receiver.sent = 10
+
+	report := receiver.report()
+	if report.Packets != 8 || report.Lost != 2 || report.Bytes != 800 {
+		t.Errorf("report %+v, want 8 datagrams of 800 bytes and 2 lost", report)
+	}
+	if report.JitterMs <= 0 || report.JitterMs >= 1 {
+		t.Errorf("jitter %.3f ms, want between 0 and the 1 ms variation", report.JitterMs)
+	}
+	if want := 899 * time.Millisecond; report.Seconds != want.Seconds() {
+		t.Errorf("seconds %v, want %v from the first to the last datagram", report.Seconds, want.Seconds())
+	}
+}
+
+// TestGoperfStreams runs the client against a server over loopback in both directions with both protocols.
+func TestGoperfStreams(t *testing.T) {
+	port := startGoperfServer(t, goperfConfig{})
+	for _, tc := range []struct {
+		name    string
+		reverse bool
+		udp     bool
+	}{
+		{"tcp", false, false},
+		{"tcp reverse", true, false},
+		{"udp", false, true},
+		{"udp reverse", true, true},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			result, err := goperfTest(goperfClientOptions{address: "127.0.0.1", port: port, seconds: 1, streams: 2, reverse: tc.reverse, udp: tc.udp, rate: 8e6, packetSize: 1000})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Bytes <= 0 || result.BitsPerSecond <= 0 || result.Seconds <= 0 {
+				t.Errorf("result %+v, want the bytes and bitrate of the streams", result)
+			}
+			if tc.udp && (result.Protocol != goperfUDP || result.Packets <= 0 || result.Bytes != result.Packets*1000) {
+				t.Errorf("result %+v, want the datagrams of 1000 bytes received", result)
+			}
+			// both streams are paced at half the 8M cap
+			if result.BitsPerSecond > 8e6*1.5 {
+				t.Errorf("the streams ran at %s over the cap of 8M", formatRate(result.BitsPerSecond))
+			}
+		})
+	}
+}
+
+func TestGoperfSecret(t *testing.T) {
+	port := startGoperfServer(t, goperfConfig{Secret: "s3cret"})
+	for secret, refused := range map[string]string{
+		"s3cret": "",
+		"wrong":  "doesn't know the goperf secret",
+		"":       "needs a secret",
+	} {
+		_, err := goperfTest(goperfClientOptions{address: "127.0.0.1", port: port, seconds: 1, streams: 1, rate: 1e6, secret: secret})
+		switch {
+		case refused == "" && err != nil:
+			t.Errorf("secret %q: %v", secret, err)
+		case refused != "" && (err == nil || !strings.Contains(err.Error(), refused)):
+			t.Errorf("secret %q: got %v, want the test refused as %q", secret, err, refused)
+		}
+	}
+	if mac := goperfMAC("s3cret", "challenge"); mac == goperfMAC("s3cret", "other") || mac == goperfMAC("other", "challenge") || len(mac) != 64 {
+		t.Errorf("goperfMAC = %s, want a hex HMAC-SHA256 of the challenge and secret", mac)
+	}
+}
+
+func TestGoperfServerLimits(t *testing.T) {
+	port := startGoperfServer(t, goperfConfig{MaxRate: "10M", MaxLength: "1"})
+	for _, tc := range []struct {
+		name    string
+		opts    goperfClientOptions
+		refused string
+	}{
+		{"within the cap", goperfClientOptions{rate: 8e6}, ""},
+		{"full rate", goperfClientOptions{}, "needs a bandwidth cap"},
+		{"over the cap", goperfClientOptions{rate: 20e6}, "would exceed the server cap"},
+		{"streams over the cap", goperfClientOptions{rate: 16e6, streams: 2}, "would exceed the server cap"},
+		{"too long", goperfClientOptions{rate: 1e6, seconds: 2}, "between 1 and 1 seconds"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := tc.opts
+			opts.address, opts.port = "127.0.0.1", port
+			if opts.seconds == 0 {
+				opts.seconds = 1
+			}
+			if opts.streams == 0 {
+				opts.streams = 1
+			}
+			_, err := goperfTest(opts)
+			switch {
+			case tc.refused == "" && err != nil:
+				t.Error(err)
+			case tc.refused != "" && (err == nil || !strings.Contains(err.Error(), tc.refused)):
+				t.Errorf("got %v, want the test refused as %q", err, tc.refused)
+			}
+		})
+	}
+
+	if _, err := newGoperfServer(nil, goperfConfig{MaxRate: "fast"}); err == nil {
+		t.Error("a server with an invalid max-rate was set up")
+	}
+	if _, err := newGoperfServer(nil, goperfConfig{MaxLength: "0"}); err == nil {
+		t.Error("a server with a zero max-length was set up")
+	}
+}
+
+// startGoperfServer serves goperf tests on a loopback port for the rest of the test and returns the port.
+func startGoperfServer(t *testing.T, gc goperfConfig) string {
+	t.Helper()
+	for attempt := 0; attempt < 10; attempt++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := listener.Addr().(*net.TCPAddr).Port
+		// the UDP port of the same number may be taken, another one is tried then
+		udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+		if err != nil {
+			listener.Close()
+			continue
+		}
+		s, err := newGoperfServer(udp, gc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			listener.Close()
+			udp.Close()
+		})
+		go s.serve(listener)
+		return strconv.Itoa(port)
+	}
+	t.Fatal("no free loopback port for both tcp and udp")
+	return ""
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "syscall"
+
+// reuseClientPort lets a stream bind a pinned client port whose previous connection is still in TIME_WAIT, the
+// kernel accepts the new connection as the TCP timestamps tell it apart from the old one.
+func reuseClientPort(network string, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
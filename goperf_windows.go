@@ -0,0 +1,8 @@
+package main
+
+import "syscall"
+
+// reuseClientPort leaves the socket as is, SO_REUSEADDR on Windows lets another socket take over a bound port.
+func reuseClientPort(network string, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultGoperfMaxLength bounds the length in seconds of a test a client can ask the server for.
+const defaultGoperfMaxLength = "3600"
+
+// goperfSession is a UDP stream of the goperf server, the datagrams are matched to it by their token. A forward
+// stream has a receiver, a reverse stream waits on peer for the address the client announces itself from.
+type goperfSession struct {
+	receiver *udpReceiver
+	peer     chan *net.UDPAddr
+}
+
+// goperfServer is the listener of the goperf engine, a TCP control and stream port and a UDP port of the same
+// number shared by the UDP streams.
+type goperfServer struct {
+	udp *net.UDPConn
+	// secret, maxRate in bits per second and maxSeconds are the limits of the server's tests from goperfConfig,
+	// maxRate is zero without a cap.
+	secret     string
+	maxRate    int64
+	maxSeconds int
+	mu         sync.Mutex
+	sessions   map[uint64]*goperfSession
+	// rate is the bitrate of the streams running, counted against maxRate.
+	rate int64
+}
+
+// runGoperfServer serves goperf tests on the port until the listener fails.
+func runGoperfServer(port string) error {
+	listener, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return fmt.Errorf("error listening on tcp port %s: %v", port, err)
+	}
+	defer listener.Close()
+	udpAddr, err := net.ResolveUDPAddr("udp", ":"+port)
+	if err != nil {
+		return err
+	}
+	udp, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return fmt.Errorf("error listening on udp port %s: %v", port, err)
+	}
+	defer udp.Close()
+	s, err := newGoperfServer(udp, goperfSettings)
+	if err != nil {
+		return err
+	}
+	if s.secret == "" {
+		log.Warnf("The goperf server runs the tests of any client, set a goperf secret to only run the agents' tests")
+	}
+	return s.serve(listener)
+}
+
+// newGoperfServer sets up a server on the UDP socket with the limits of the goperf configuration.
+func newGoperfServer(udp *net.UDPConn, gc goperfConfig) (*goperfServer, error) {
+	s := &goperfServer{udp: udp, secret: gc.Secret, sessions: make(map[uint64]*goperfSession)}
+	if gc.MaxRate != "" {
+		rate, err := parseBandwidth(gc.MaxRate)
+		if err != nil {
+			return nil, fmt.Errorf("goperf max-rate %v", err)
+		}
+		s.maxRate = int64(rate)
+	}
+	maxLength := gc.MaxLength
+	if maxLength == "" {
+		maxLength = defaultGoperfMaxLength
+	}
+	var err error
+	if s.maxSeconds, err = strconv.Atoi(maxLength); err != nil || s.maxSeconds < 1 {
+		return nil, fmt.Errorf("goperf max-length must be a positive number of seconds, got %q", maxLength)
+	}
+	return s, nil
+}
+
+// serve runs the tests of the clients connecting to the listener until it fails.
+func (s *goperfServer) serve(listener net.Listener) error {
+	go s.readUDP()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+// readUDP hands every datagram to the session of its token, datagrams of unknown tokens are dropped.
+func (s *goperfServer) readUDP() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := s.udp.ReadFromUDP(buf)
+		if err != nil {
+			log.Errorf("Error reading the goperf udp port: %v", err)
+			return
+		}
+		if n < goperfUDPHeader {
+			continue
+		}
+		s.mu.Lock()
+		session, ok := s.sessions[binary.BigEndian.Uint64(buf)]
+		s.mu.Unlock()
+		switch {
+		case !ok:
+		case session.receiver != nil:
+			session.receiver.receive(buf[:n], time.Now())
+		default:
+			select {
+			case session.peer <- addr:
+			default:
+			}
+		}
+	}
+}
+
+// handle runs the stream a client asked for on a control connection.
+func (s *goperfServer) handle(conn net.Conn) {
+	defer conn.Close()
+	client := conn.RemoteAddr().String()
+	conn.SetDeadline(time.Now().Add(goperfTimeout))
+	var hello goperfHello
+	if err := readFrame(conn, &hello); err != nil {
+		log.Debugf("Invalid goperf hello from %s: %v", client, err)
+		return
+	}
+	if err := checkGoperfHello(hello, s.maxSeconds); err != nil {
+		log.Warnf("Refused the goperf test of %s: %v", client, err)
+		writeFrame(conn, goperfAccept{Error: err.Error()})
+		return
+	}
+	if err := s.authenticate(conn); err != nil {
+		log.Warnf("Refused the goperf test of %s: %v", client, err)
+		writeFrame(conn, goperfAccept{Error: err.Error()})
+		return
+	}
+	release, err := s.reserveRate(hello.Rate)
+	if err != nil {
+		log.Warnf("Refused the goperf test of %s: %v", client, err)
+		writeFrame(conn, goperfAccept{Error: err.Error()})
+		return
+	}
+	defer release()
+	var token [8]byte
+	if _, err := rand.Read(token[:]); err != nil {
+		writeFrame(conn, goperfAccept{Error: err.Error()})
+		return
+	}
+	accept := goperfAccept{Token: binary.BigEndian.Uint64(token[:]) | 1}
+	duration := time.Duration(hello.Seconds) * time.Second
+	conn.SetDeadline(time.Now().Add(duration + 3*goperfTimeout))
+	log.Debugf("goperf %s test of %s for %s reverse=%t", hello.Protocol, client, duration, hello.Reverse)
+
+	if hello.Protocol == goperfTCP {
+		if err := writeFrame(conn, accept); err != nil {
+			return
+		}
+		if hello.Reverse {
+			if _, err := sendTCP(conn, duration, hello.Rate); err != nil {
+				log.Debugf("goperf stream to %s ended: %v", client, err)
+			}
+			return
+		}
+		// under a cap the stream is read at the rate it asked for, TCP holds the client back to it
+		var limit int64
+		if s.maxRate > 0 {
+			limit = hello.Rate
+		}
+		writeFrame(conn, receiveTCP(conn, limit))
+		return
+	}
+
+	session := &goperfSession{peer: make(chan *net.UDPAddr, 1)}
+	if !hello.Reverse {
+		session.receiver = newUDPReceiver()
+	}
+	s.mu.Lock()
+	s.sessions[accept.Token] = session
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.sessions, accept.Token)
+		s.mu.Unlock()
+	}()
+	if err := writeFrame(conn, accept); err != nil {
+		return
+	}
+
+	if !hello.Reverse {
+		var done goperfDone
+		if err := readFrame(conn, &done); err != nil {
+			log.Debugf("goperf stream from %s ended: %v", client, err)
+			return
+		}
+		time.Sleep(goperfGrace)
+		session.receiver.mu.Lock()
+		session.receiver.sent = done.Packets
+		session.receiver.mu.Unlock()
+		writeFrame(conn, session.receiver.report())
+		return
+	}
+
+	var peer *net.UDPAddr
+	select {
+	case peer = <-session.peer:
+	case <-time.After(goperfTimeout):
+		log.Warnf("The goperf client %s never announced its udp address", client)
+		return
+	}
+	write := func(datagram []byte) (int, error) {
+		return s.udp.WriteToUDP(datagram, peer)
+	}
+	packets, err := sendUDP(write, accept.Token, duration, hello.Rate, hello.PacketSize)
+	if err != nil {
+		log.Debugf("goperf stream to %s ended: %v", peer, err)
+	}
+	writeFrame(conn, goperfDone{Packets: packets})
+	// the client closes the connection once it has counted the datagrams still in flight
+	var closed [1]byte
+	conn.Read(closed[:])
+}
+
+// authenticate challenges the client of a server with a secret to prove it knows the secret with the HMAC of a
+// random nonce, the secret itself never crosses the network.
+func (s *goperfServer) authenticate(conn net.Conn) error {
+	if s.secret == "" {
+		return nil
+	}
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return err
+	}
+	challenge := hex.EncodeToString(nonce[:])
+	if err := writeFrame(conn, goperfAccept{Challenge: challenge}); err != nil {
+		return err
+	}
+	var auth goperfAuth
+	if err := readFrame(conn, &auth); err != nil {
+		return fmt.Errorf("no answer to the challenge: %v", err)
+	}
+	if !hmac.Equal([]byte(auth.MAC), []byte(goperfMAC(s.secret, challenge))) {
+		return fmt.Errorf("the client doesn't know the goperf secret")
+	}
+	return nil
+}
+
+// goperfMAC is the answer to a challenge of the server, the hex HMAC-SHA256 of the challenge keyed by the secret.
+func goperfMAC(secret string, challenge string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(challenge))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// reserveRate counts the bitrate of a stream against the server's max-rate until the returned function is called.
+// A full rate stream can't be counted, it's refused under a cap.
+func (s *goperfServer) reserveRate(rate int64) (func(), error) {
+	if s.maxRate <= 0 {
+		return func() {}, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rate <= 0 {
+		return nil, fmt.Errorf("the server caps the streams at %s, the test needs a bandwidth cap", formatRate(float64(s.maxRate)))
+	}
+	if s.rate+rate > s.maxRate {
+		return nil, fmt.Errorf("a %s stream would exceed the server cap of %s with %s in use", formatRate(float64(rate)), formatRate(float64(s.maxRate)), formatRate(float64(s.rate)))
+	}
+	s.rate += rate
+	return func() {
+		s.mu.Lock()
+		s.rate -= rate
+		s.mu.Unlock()
+	}, nil
+}
+
+// checkGoperfHello refuses the streams the server can't run or that are longer than maxSeconds.
+func checkGoperfHello(hello goperfHello, maxSeconds int) error {
+	if hello.Version != goperfVersion {
+		return fmt.Errorf("unsupported protocol version %d, the server runs version %d", hello.Version, goperfVersion)
+	}
+	if hello.Protocol != goperfTCP && hello.Protocol != goperfUDP {
+		return fmt.Errorf("unsupported protocol %q", hello.Protocol)
+	}
+	if hello.Seconds <= 0 || hello.Seconds > maxSeconds {
+		return fmt.Errorf("the test length must be between 1 and %d seconds, got %d", maxSeconds, hello.Seconds)
+	}
+	if hello.Protocol == goperfUDP && (hello.PacketSize < goperfUDPHeader || hello.PacketSize > 65507 || hello.Rate <= 0) {
+		return fmt.Errorf("udp streams need a packet size between %d and 65507 bytes and a rate, got %d bytes at %d bps", goperfUDPHeader, hello.PacketSize, hello.Rate)
+	}
+	return nil
+}
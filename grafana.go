@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	grafanaDashboardUID   = "cloud-bandwidth"
+	grafanaDashboardTitle = "Cloud Bandwidth"
+)
+
+type grafanaConfig struct {
+	URL        string `yaml:"url"`
+	Token      string `yaml:"token"`
+	Datasource string `yaml:"datasource"`
+	FolderUID  string `yaml:"folder-uid"`
+	// Annotations posts an annotation when a test fails or a full rate result is below AnnotationThreshold.
+	Annotations         bool   `yaml:"annotations"`
+	AnnotationThreshold string `yaml:"annotation-threshold"`
+}
+
+// mergeGrafanaFlags fills any grafana settings missing from the configuration file with the CLI values.
+func mergeGrafanaFlags(gc *grafanaConfig) {
+	if gc.URL == "" {
+		gc.URL = cliFlags.grafanaURL
+	}
+	if gc.Token == "" {
+		gc.Token = cliFlags.grafanaToken
+	}
+	if gc.Datasource == "" {
+		gc.Datasource = cliFlags.grafanaDatasource
+	}
+	if gc.FolderUID == "" {
+		gc.FolderUID = cliFlags.grafanaFolderUID
+	}
+	if cliFlags.grafanaAnnotations {
+		gc.Annotations = true
+	}
+	if gc.AnnotationThreshold == "" {
+		gc.AnnotationThreshold = cliFlags.grafanaAnnotationThreshold
+	}
+}
+
+// provisionAction creates or updates the cloud-bandwidth dashboard in grafana.
+func provisionAction() error {
+	config := loadConfig()
+	gc := config.Grafana
+	if gc.URL == "" || gc.Token == "" {
+		return fmt.Errorf("grafana provision requires --url and --token or a grafana section in the configuration file")
+	}
+	dsType := cliFlags.grafanaDatasourceType
+	if dsType == "" {
+		dsType = "graphite"
+		if cliFlags.tsdbType == "influx" {
+			dsType = "influx"
+		}
+	}
+	if dsType != "graphite" && dsType != "influx" {
+		return fmt.Errorf("unsupported datasource type %q, must be graphite or influx", dsType)
+	}
+	// the panels are labeled in the units the tsdb is written in
+	if err := initUnits(config.Units); err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"dashboard": grafanaDashboard(config, dsType),
+		"folderUid": gc.FolderUID,
+		"overwrite": true,
+		"message":   "provisioned by cloud-bandwidth " + version,
+	})
+	if err != nil {
+		return err
+	}
+	var result struct {
+		URL     string `json:"url"`
+		Version int    `json:"version"`
+	}
+	if err := grafanaRequest(gc, "POST", "/api/dashboards/db", body, &result); err != nil {
+		return fmt.Errorf("could not provision the grafana dashboard: %v", err)
+	}
+	log.Infof("Provisioned the %s dashboard version %d at %s%s", grafanaDashboardTitle, result.Version, strings.TrimRight(gc.URL, "/"), result.URL)
+	return nil
+}
+
+// grafanaRequest sends an authenticated request to the grafana HTTP API and decodes the JSON response.
+func grafanaRequest(gc grafanaConfig, method string, path string, body []byte, result interface{}) error {
+	req, err := http.NewRequest(method, strings.TrimRight(gc.URL, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+gc.Token)
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := auditedDo(client, "grafana", req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, respBody)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(respBody, result)
+}
+
+// reportsRetransmits reports whether the engine or the engine of any endpoint records the TCP retransmits.
+func reportsRetransmits(config configuration) bool {
+	eng, err := selectEngine(config)
+	if err != nil {
+		return false
+	}
+	if eng.retransmits != nil {
+		return true
+	}
+	for _, server := range allServers(config) {
+		if endpointEngine(eng, server).retransmits != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// grafanaDashboard builds the dashboard model with download and upload panels, failure rate panels with
+// --failure-rate and retransmit panels if an engine of the endpoints reports the retransmits.
+func grafanaDashboard(config configuration, dsType string) map[string]interface{} {
+	type panelDef struct {
+		title  string
+		prefix string
+		field  string
+		unit   string
+	}
+	// the bandwidth panels show the unit the datasource's sink writes
+	unit := unitOf("graphite")
+	if dsType == "influx" {
+		unit = unitOf("influx")
+	}
+	defs := []panelDef{
+		{"Download", cliFlags.downloadPrefix, "iperfResultsBps", unit.grafanaUnit()},
+		{"Upload", cliFlags.uploadPrefix, "iperfResultsBps", unit.grafanaUnit()},
+	}
+	if cliFlags.failureRate {
+		defs = append(defs,
+			panelDef{"Download Failure Rate", cliFlags.downloadPrefix + ".failed", "test_failed", "percentunit"},
+			panelDef{"Upload Failure Rate", cliFlags.uploadPrefix + ".failed", "test_failed", "percentunit"})
+	}
+	if reportsRetransmits(config) {
+		defs = append(defs,
+			panelDef{"Download Retransmits", cliFlags.downloadPrefix + ".retransmits", "retransmits", "short"},
+			panelDef{"Upload Retransmits", cliFlags.uploadPrefix + ".retransmits", "retransmits", "short"})
+	}
+
+	var datasource interface{}
+	if config.Grafana.Datasource != "" {
+		datasource = map[string]string{"uid": config.Grafana.Datasource}
+	}
+	panels := make([]map[string]interface{}, 0, len(defs))
+	for i, def := range defs {
+		var target map[string]interface{}
+		if dsType == "influx" {
+			target = map[string]interface{}{
+				"refId":    "A",
+				"rawQuery": true,
+				"alias":    "$tag_iperfDestination",
+				"query": fmt.Sprintf(`SELECT mean("%s") FROM "%s" WHERE "testType" = '%s' AND $timeFilter GROUP BY time($__interval), "iperfDestination" fill(null)`,
+					def.field, config.InfluxTemplate.Measurement, def.prefix),
+			}
+		} else if cliFlags.graphiteFormat == graphiteFormatTagged {
+			target = map[string]interface{}{
+				"refId":  "A",
+				"target": fmt.Sprintf("aliasByTags(seriesByTag('name=%s'), 'dest')", def.prefix),
+			}
+		} else {
+			// the endpoint name is the last node of the default graphite path
+			target = map[string]interface{}{
+				"refId":  "A",
+				"target": fmt.Sprintf("aliasByNode(%s.*, %d)", def.prefix, strings.Count(def.prefix, ".")+1),
+			}
+		}
+		panels = append(panels, map[string]interface{}{
+			"id":         i + 1,
+			"type":       "timeseries",
+			"title":      def.title,
+			"datasource": datasource,
+			"gridPos":    map[string]int{"h": 8, "w": 12, "x": (i % 2) * 12, "y": (i / 2) * 8},
+			"fieldConfig": map[string]interface{}{
+				"defaults":  map[string]string{"unit": def.unit},
+				"overrides": []interface{}{},
+			},
+			"targets": []interface{}{target},
+		})
+	}
+
+	return map[string]interface{}{
+		"uid":           grafanaDashboardUID,
+		"title":         grafanaDashboardTitle,
+		"tags":          []string{"cloud-bandwidth"},
+		"timezone":      "browser",
+		"schemaVersion": 36,
+		"refresh":       "1m",
+		"time":          map[string]string{"from": "now-24h", "to": "now"},
+		"panels":        panels,
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	graphiteProtocolLine   = "line"
+	graphiteProtocolPickle = "pickle"
+	defaultPicklePort      = "2004"
+	// the graphite-format of the metric names, dotted paths or the tagged series of Graphite 1.1
+	graphiteFormatDotted = "dotted"
+	graphiteFormatTagged = "tagged"
+	// graphitePickleBatch is the most points per pickle message, carbon rejects messages over 1MB.
+	graphitePickleBatch = 500
+	// graphiteMaxPending is the most points kept for the next flush while carbon is unreachable, the oldest are
+	// dropped beyond it.
+	graphiteMaxPending  = 100000
+	graphiteDialTimeout = 10 * time.Second
+)
+
+// graphiteWriter batches the points written to graphite, nil until the sinks are set up.
+var graphiteWriter *graphiteBatcher
+
+// graphitePoint is a rendered graphite metric path with its value and timestamp.
+type graphitePoint struct {
+	path      string
+	value     string
+	timestamp int64
+}
+
+// graphiteBatcher buffers the graphite points of a cycle and writes them over a single connection when the sinks
+// are flushed, instead of connecting to carbon for every point. Points are kept for the next flush if carbon
+// can't be reached.
+type graphiteBatcher struct {
+	address string
+	pickle  bool
+	mu      sync.Mutex
+	pending []graphitePoint
+	dropped int
+}
+
+// initGraphiteWriter sets up the graphite batch writer. The pickle protocol listens on 2004, the carbon port
+// follows it unless another port than the plaintext default was set.
+func initGraphiteWriter(address string) error {
+	protocol := cliFlags.graphiteProtocol
+	if protocol != graphiteProtocolLine && protocol != graphiteProtocolPickle {
+		return fmt.Errorf("graphite-protocol must be line or pickle, got %q", protocol)
+	}
+	if cliFlags.graphiteFormat != graphiteFormatDotted && cliFlags.graphiteFormat != graphiteFormatTagged {
+		return fmt.Errorf("graphite-format must be dotted or tagged, got %q", cliFlags.graphiteFormat)
+	}
+	graphiteWriter = newGraphiteBatcher(address)
+	log.Debugf("[Config] Graphite Protocol = %s to %s, %s series", protocol, graphiteWriter.address, cliFlags.graphiteFormat)
+	return nil
+}
+
+// newGraphiteBatcher returns a batch writer to a carbon address in the --graphite-protocol.
+func newGraphiteBatcher(address string) *graphiteBatcher {
+	writer := &graphiteBatcher{address: address, pickle: cliFlags.graphiteProtocol == graphiteProtocolPickle}
+	if host, port, err := net.SplitHostPort(address); err == nil && writer.pickle && port == defaultCarbonPort {
+		writer.address = net.JoinHostPort(host, defaultPicklePort)
+	}
+	return writer
+}
+
+// graphitePointOf renders a measurement as a graphite point.
+func graphitePointOf(config configuration, m measurement) graphitePoint {
+	return graphitePoint{path: graphitePath(config, m), value: m.formattedValue("graphite"), timestamp: m.Timestamp.Unix()}
+}
+
+// line formats the point in the graphite plaintext protocol.
+func (p graphitePoint) line() string {
+	return fmt.Sprintf("%s %s %d\n", p.path, p.value, p.timestamp)
+}
+
+// add buffers a point until the next flush.
+func (b *graphiteBatcher) add(point graphitePoint) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pending = append(b.pending, point)
+	if over := len(b.pending) - graphiteMaxPending; over > 0 {
+		b.pending = b.pending[over:]
+		b.dropped += over
+	}
+}
+
+// flush writes the buffered points over one connection, as pickle messages of up to graphitePickleBatch points
+// or as plaintext lines. The points are put back for the next flush if the write fails.
+func (b *graphiteBatcher) flush() {
+	b.mu.Lock()
+	points := b.pending
+	b.pending = nil
+	dropped := b.dropped
+	b.dropped = 0
+	b.mu.Unlock()
+	if dropped > 0 {
+		log.Errorf("Dropped %d graphite points, more than %d were waiting for %s", dropped, graphiteMaxPending, b.address)
+	}
+	if len(points) == 0 {
+		return
+	}
+
+	var payload bytes.Buffer
+	for i := 0; i < len(points); i += graphitePickleBatch {
+		end := i + graphitePickleBatch
+		if end > len(points) {
+			end = len(points)
+		}
+		if b.pickle {
+			payload.Write(graphitePickle(points[i:end]))
+			continue
+		}
+		for _, point := range points[i:end] {
+			payload.WriteString(point.line())
+		}
+	}
+	if cliFlags.debug && !b.pickle {
+		log.Infof("Sending the following msg to the tsdb: %s", payload.String())
+	}
+	start := time.Now()
+	err := writeGraphite(b.address, payload.Bytes())
+	auditWrite("graphite", b.address, payload.Len(), start, err)
+	if err != nil {
+		log.Errorf("Error writing %d points to the graphite server at %s, keeping them for the next cycle: %v", len(points), b.address, err)
+		log.Errorf("Verify the graphite server is running and reachable at %s", b.address)
+		atomic.AddInt32(&failedWrites, 1)
+		b.mu.Lock()
+		b.pending = append(points, b.pending...)
+		b.mu.Unlock()
+		return
+	}
+	log.Debugf("Wrote %d points to the graphite server at %s", len(points), b.address)
+}
+
+// writeGraphite writes a payload to carbon over a single TCP connection.
+func writeGraphite(address string, payload []byte) error {
+	conn, err := net.DialTimeout("tcp", address, graphiteDialTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.Write(payload); err != nil {
+		return err
+	}
+	return nil
+}
+
+// graphitePickle encodes points as a carbon pickle message, a 4 byte big-endian length followed by a protocol 2
+// pickle of the list [(path, (timestamp, value)), ...].
+func graphitePickle(points []graphitePoint) []byte {
+	var p bytes.Buffer
+	// PROTO 2, EMPTY_LIST, MARK
+	p.Write([]byte{0x80, 0x02, ']', '('})
+	for _, point := range points {
+		// BINUNICODE path
+		p.WriteByte('X')
+		binary.Write(&p, binary.LittleEndian, uint32(len(point.path)))
+		p.WriteString(point.path)
+		// LONG1 timestamp, 8 bytes of two's complement little-endian
+		p.Write([]byte{0x8a, 8})
+		binary.Write(&p, binary.LittleEndian, point.timestamp)
+		// BINFLOAT value
+		value, _ := strconv.ParseFloat(strings.TrimSpace(point.value), 64)
+		p.WriteByte('G')
+		binary.Write(&p, binary.BigEndian, math.Float64bits(value))
+		// TUPLE2 (timestamp, value), TUPLE2 (path, ...)
+		p.Write([]byte{0x86, 0x86})
+	}
+	// APPENDS, STOP
+	p.Write([]byte{'e', '.'})
+
+	message := make([]byte, 4, 4+p.Len())
+	binary.BigEndian.PutUint32(message, uint32(p.Len()))
+	return append(message, p.Bytes()...)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The sinks a group's results can be limited to, tsdb is the graphite or influx output.
+const (
+	sinkTSDB          = "tsdb"
+	sinkKafka         = "kafka"
+	sinkElasticsearch = "elasticsearch"
+	sinkFile          = "file-output"
+	sinkPushgateway   = "pushgateway"
+	sinkBroker        = "broker"
+	sinkWebhook       = "webhook"
+	sinkZabbix        = "zabbix"
+	sinkNetdata       = "netdata"
+	sinkTextfile      = "textfile"
+)
+
+var groupSinks = []string{sinkTSDB, sinkKafka, sinkElasticsearch, sinkFile, sinkPushgateway, sinkBroker, sinkWebhook, sinkZabbix, sinkNetdata, sinkTextfile}
+
+// endpointGroup is a set of endpoints tested on their own schedule, e.g. a backbone tested every minute next to
+// branches tested hourly. Unset settings fall back to the global ones.
+type endpointGroup struct {
+	Name string `yaml:"name"`
+	// Interval is the pause between the group's cycles in seconds.
+	Interval string `yaml:"interval"`
+	// Profiles are the names of the test profiles the group's endpoints are tested with.
+	Profiles       []string `yaml:"profiles"`
+	DownloadPrefix string   `yaml:"download-prefix"`
+	UploadPrefix   string   `yaml:"upload-prefix"`
+	// Sinks limits the outputs the group's results are written to, all of the configured ones if empty.
+	Sinks       []string     `yaml:"sinks"`
+	PerfServers []perfServer `yaml:"iperf-servers"`
+	// tenant is the tenant the group was made from, nil for the groups of the configuration.
+	tenant *tenantConfig
+}
+
+// scheduledCycle is the endpoints tested together with the settings of their group, the ungrouped iperf-servers
+// have an empty name.
+type scheduledCycle struct {
+	name     string
+	config   configuration
+	settings runSettings
+}
+
+// scheduledCycles returns the cycle of the ungrouped endpoints followed by one per group. The ungrouped cycle
+// is left out when every endpoint is in a group, unless a controller assigns the endpoints.
+func scheduledCycles(config configuration, settings runSettings) []scheduledCycle {
+	var cycles []scheduledCycle
+	if len(config.PerfServers) > 0 || len(config.Groups) == 0 || controller != nil {
+		cycles = append(cycles, scheduledCycle{config: config, settings: settings})
+	}
+	for i := range config.Groups {
+		groupCfg, groupSettings := groupCycle(config, settings, &config.Groups[i])
+		cycles = append(cycles, scheduledCycle{name: config.Groups[i].Name, config: groupCfg, settings: groupSettings})
+	}
+	return cycles
+}
+
+// groupCycle applies a group's settings to a copy of the configuration and settings. The group's endpoints are
+// tagged with the group name, or the tenant name for a tenant, whose prefixes default to the global ones under its
+// name.
+func groupCycle(config configuration, settings runSettings, group *endpointGroup) (configuration, runSettings) {
+	config.group = group
+	tag := "group"
+	if group.tenant != nil {
+		tag = "tenant"
+		settings.downloadPrefix = group.Name + "." + settings.downloadPrefix
+		settings.uploadPrefix = group.Name + "." + settings.uploadPrefix
+		if group.tenant.ownTSDB() {
+			config.InfluxURL = group.tenant.InfluxURL
+			config.GraphiteHostPort = group.tenant.GraphiteAddress
+		}
+	}
+	config.PerfServers = make([]perfServer, 0, len(group.PerfServers))
+	for _, server := range group.PerfServers {
+		server.Tags = withTag(server.Tags, tag, group.Name)
+		config.PerfServers = append(config.PerfServers, server)
+	}
+	if len(group.Profiles) > 0 {
+		var profiles []testProfile
+		for _, profile := range config.Profiles {
+			if containsString(group.Profiles, profile.Name) {
+				profiles = append(profiles, profile)
+			}
+		}
+		config.Profiles = profiles
+	}
+	if group.Interval != "" {
+		settings.interval = seconds(group.Interval)
+	}
+	if group.DownloadPrefix != "" {
+		settings.downloadPrefix = group.DownloadPrefix
+	}
+	if group.UploadPrefix != "" {
+		settings.uploadPrefix = group.UploadPrefix
+	}
+	return config, settings
+}
+
+// allServers returns the ungrouped endpoints followed by the endpoints of every group and tenant.
+func allServers(config configuration) []perfServer {
+	servers := append([]perfServer(nil), config.PerfServers...)
+	for _, group := range config.Groups {
+		servers = append(servers, group.PerfServers...)
+	}
+	return servers
+}
+
+// sinkEnabled reports whether the results of the cycle's group are written to a sink. A tenant's results are only
+// written to the shared sinks it lists.
+func (c configuration) sinkEnabled(sink string) bool {
+	if c.tenant() != nil {
+		return containsString(c.group.Sinks, sink)
+	}
+	return c.group == nil || len(c.group.Sinks) == 0 || containsString(c.group.Sinks, sink)
+}
+
+// resultScope is the tenant or group of the results with the tags, empty outside of them. It keeps the baselines and
+// the other state of an address tested by two tenants or groups apart.
+func resultScope(tags map[string]string) string {
+	if tenant := tags["tenant"]; tenant != "" {
+		return "tenant=" + tenant
+	}
+	if group := tags["group"]; group != "" {
+		return "group=" + group
+	}
+	return ""
+}
+
+// validateGroups checks the group names, intervals, profiles and sinks.
+func validateGroups(config configuration) []error {
+	var errs []error
+	seen := make(map[string]bool)
+	for i, group := range config.Groups {
+		if group.Name == "" {
+			errs = append(errs, fmt.Errorf("endpoint group %d has no name", i+1))
+		} else if seen[group.Name] {
+			errs = append(errs, fmt.Errorf("endpoint group %q is defined more than once", group.Name))
+		}
+		seen[group.Name] = true
+		if len(group.PerfServers) == 0 {
+			errs = append(errs, fmt.Errorf("endpoint group %q has no iperf-servers", group.Name))
+		}
+		if group.Interval != "" {
+			if interval, err := strconv.Atoi(group.Interval); err != nil || interval <= 0 {
+				errs = append(errs, fmt.Errorf("endpoint group %q interval must be a positive number of seconds, got %q", group.Name, group.Interval))
+			}
+		}
+		for _, name := range group.Profiles {
+			found := false
+			for _, profile := range config.Profiles {
+				found = found || profile.Name == name
+			}
+			if !found {
+				errs = append(errs, fmt.Errorf("endpoint group %q uses the undefined test profile %q", group.Name, name))
+			}
+		}
+		for _, sink := range group.Sinks {
+			if !containsString(groupSinks, sink) {
+				errs = append(errs, fmt.Errorf("endpoint group %q sink %q must be one of %s", group.Name, sink, strings.Join(groupSinks, ", ")))
+			}
+		}
+	}
+	return errs
+}
+
+// nextCycleWait returns the time until the next group is due.
+func nextCycleWait(cycles []scheduledCycle, next map[string]time.Time) time.Duration {
+	var wait time.Duration
+	for i, cycle := range cycles {
+		until := time.Until(next[cycle.name])
+		if i == 0 || until < wait {
+			wait = until
+		}
+	}
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
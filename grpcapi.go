@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"google.golang.org/grpc/credentials"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/nerdalert/cloud-bandwidth/cbandwidthpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// subscriberBuffer is the number of measurements queued for a subscriber, a subscriber further behind misses
+// measurements rather than holding up the tests.
+const subscriberBuffer = 256
+
+// measurementStream fans the recorded measurements out to the subscribers of the gRPC API.
+type measurementStream struct {
+	sync.Mutex
+	subscribers map[chan measurement]*cbandwidthpb.SubscribeRequest
+}
+
+var streams *measurementStream
+
+// startGRPC serves the gRPC agent API in the background. Tests can only be triggered if the agent runs in a loop.
+// The API is served over TLS with --grpc-tls-cert, a token is refused in plaintext unless --grpc-insecure is set
+// since the clients would send it in the clear.
+func startGRPC(listenAddr string, token string) {
+	if (cliFlags.grpcTLSCert == "") != (cliFlags.grpcTLSKey == "") {
+		log.Fatal("grpc-tls-cert and grpc-tls-key must be set together")
+	}
+	var opts []grpc.ServerOption
+	if cliFlags.grpcTLSCert != "" {
+		creds, err := credentials.NewServerTLSFromFile(cliFlags.grpcTLSCert, cliFlags.grpcTLSKey)
+		if err != nil {
+			log.Fatalf("Error loading the gRPC API certificate: %v", err)
+		}
+		opts = append(opts, grpc.Creds(creds))
+	} else if token != "" && !cliFlags.grpcInsecure {
+		log.Fatal("the gRPC API has a token but no TLS certificate, its clients would send the token in the clear: " +
+			"set --grpc-tls-cert and --grpc-tls-key, or --grpc-insecure to serve it in plaintext anyway")
+	} else if token != "" {
+		log.Warnf("Serving the gRPC API on %s without TLS, the token is sent in the clear", listenAddr)
+	}
+
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		log.Fatalf("Error serving the gRPC API on %s: %v", listenAddr, err)
+	}
+	streams = &measurementStream{subscribers: make(map[chan measurement]*cbandwidthpb.SubscribeRequest)}
+
+	if token != "" {
+		opts = append(opts,
+			grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+				if err := authorizeGRPC(ctx, token); err != nil {
+					return nil, err
+				}
+				return handler(ctx, req)
+			}),
+			grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+				if err := authorizeGRPC(ss.Context(), token); err != nil {
+					return err
+				}
+				return handler(srv, ss)
+			}),
+		)
+	} else {
+		log.Warnf("Serving the gRPC API on %s without a token, anyone who can reach it can trigger tests", listenAddr)
+	}
+	server := grpc.NewServer(opts...)
+	cbandwidthpb.RegisterAgentServer(server, &grpcAgent{})
+
+	log.Infof("Serving the gRPC API on %s", listenAddr)
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			log.Errorf("Error serving the gRPC API on %s: %v", listenAddr, err)
+		}
+	}()
+}
+
+// authorizeGRPC checks the bearer token of a call.
+func authorizeGRPC(ctx context.Context, token string) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get("authorization") {
+		if subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(value, "Bearer ")), []byte(token)) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "missing or invalid bearer token")
+}
+
+// grpcAgent implements the Agent service of cbandwidthpb/cbandwidth.proto.
+type grpcAgent struct {
+	cbandwidthpb.UnimplementedAgentServer
+}
+
+// Subscribe streams the measurements matching the request until the subscriber goes away.
+func (a *grpcAgent) Subscribe(req *cbandwidthpb.SubscribeRequest, stream cbandwidthpb.Agent_SubscribeServer) error {
+	ch := make(chan measurement, subscriberBuffer)
+	streams.Lock()
+	streams.subscribers[ch] = req
+	streams.Unlock()
+	defer func() {
+		streams.Lock()
+		delete(streams.subscribers, ch)
+		streams.Unlock()
+	}()
+	log.Debugf("gRPC subscriber connected, destinations %v prefixes %v", req.Destinations, req.Prefixes)
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case m := <-ch:
+			if err := stream.Send(measurementProto(m)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// TriggerTest queues a test cycle of the requested endpoints, one triggered cycle can be pending at a time.
+func (a *grpcAgent) TriggerTest(ctx context.Context, req *cbandwidthpb.TriggerTestRequest) (*cbandwidthpb.TriggerTestResponse, error) {
+	if testTriggers == nil {
+		return &cbandwidthpb.TriggerTestResponse{Message: "the agent isn't running tests in a loop"}, nil
+	}
+	if !queueTrigger(testTrigger{reason: triggerAPI, endpoints: req.Endpoints}) {
+		return &cbandwidthpb.TriggerTestResponse{Message: "a triggered test cycle is already pending"}, nil
+	}
+	return &cbandwidthpb.TriggerTestResponse{Accepted: true, Message: "the test cycle starts once the current one completes"}, nil
+}
+
+// publish hands a measurement to the subscribers whose filters it matches.
+func (s *measurementStream) publish(m measurement) {
+	s.Lock()
+	defer s.Unlock()
+	for ch, req := range s.subscribers {
+		if !subscriptionMatches(req, m) {
+			continue
+		}
+		select {
+		case ch <- m:
+		default:
+			log.Warnf("Dropping a measurement for a slow gRPC subscriber")
+		}
+	}
+}
+
+// subscriptionMatches reports whether a measurement passes a subscription's destination and prefix filters.
+func subscriptionMatches(req *cbandwidthpb.SubscribeRequest, m measurement) bool {
+	if len(req.Destinations) > 0 && !containsString(req.Destinations, m.Destination) && !containsString(req.Destinations, m.Address) {
+		return false
+	}
+	if len(req.Prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range req.Prefixes {
+		if strings.HasPrefix(m.Prefix, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// measurementProto converts a measurement to its API message.
+func measurementProto(m measurement) *cbandwidthpb.Measurement {
+	return &cbandwidthpb.Measurement{
+		Timestamp:   timestamppb.New(m.Timestamp),
+		Source:      m.Source,
+		Destination: m.Destination,
+		Address:     m.Address,
+		Direction:   m.Direction,
+		Prefix:      m.Prefix,
+		Engine:      m.Engine,
+		Bps:         m.Bps,
+		Metric:      m.Metric,
+		Value:       m.Value,
+		RunId:       m.RunID,
+		RawId:       m.RawID,
+		Tags:        m.Tags,
+	}
+}
+
+// triggeredServers returns the endpoints of a triggered cycle, every endpoint if none were requested.
+func triggeredServers(servers []perfServer, endpoints []string) []perfServer {
+	if len(endpoints) == 0 {
+		return servers
+	}
+	var triggered []perfServer
+	for _, server := range servers {
+		if containsString(endpoints, server.Address) || containsString(endpoints, server.displayName()) {
+			triggered = append(triggered, server)
+		}
+	}
+	return triggered
+}
+
+// endpointsLabel describes the endpoints of a triggered cycle in the logs.
+func endpointsLabel(endpoints []string) string {
+	if len(endpoints) == 0 {
+		return "all endpoints"
+	}
+	return strings.Join(endpoints, ", ")
+}
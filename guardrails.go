@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// guardrailNICSample is how long the interface to an endpoint is sampled before a test to measure its utilization,
+// when no earlier test on it measured the other traffic recently enough.
+const guardrailNICSample = time.Second
+
+// guardrailNICMaxAge is how long the other traffic measured across a test stands in for a sample before the next
+// tests on the same interface.
+const guardrailNICMaxAge = 10 * time.Minute
+
+// guardrailsConfig skips a test while the host is busy, so the agent doesn't take bandwidth and CPU from the
+// production workloads next to it or record a result held back by them. Empty thresholds aren't checked.
+type guardrailsConfig struct {
+	// MaxLoad is the highest 1 minute load average per CPU a test starts at.
+	MaxLoad string `yaml:"max-load"`
+	// MaxMemory is the highest share of the host memory in use a test starts at, in percent.
+	MaxMemory string `yaml:"max-memory"`
+	// MaxNIC is the highest utilization of the interface to the endpoint a test starts at, in percent of the link
+	// speed. The traffic besides the agent's own is measured across every test and checked before the next test on
+	// the same interface, the interface is only sampled for a second before a test without a recent measurement.
+	MaxNIC string `yaml:"max-nic"`
+}
+
+// hostGuardrails are the parsed thresholds, zero for the unchecked ones.
+type hostGuardrails struct {
+	maxLoad   float64
+	maxMemory float64
+	maxNIC    float64
+
+	mu sync.Mutex
+	// nicUtil is the utilization by other traffic measured across the last test, by interface set.
+	nicUtil map[string]nicUtilization
+}
+
+// nicUtilization is the utilization of an interface by other traffic than the agent's, in percent of its link
+// speed, and when it was measured.
+type nicUtilization struct {
+	util float64
+	at   time.Time
+}
+
+var guardrails *hostGuardrails
+
+// mergeGuardrailsFlags fills any guardrail settings missing from the configuration file with the CLI values.
+func mergeGuardrailsFlags(gc *guardrailsConfig) {
+	if gc.MaxLoad == "" {
+		gc.MaxLoad = cliFlags.guardMaxLoad
+	}
+	if gc.MaxMemory == "" {
+		gc.MaxMemory = cliFlags.guardMaxMemory
+	}
+	if gc.MaxNIC == "" {
+		gc.MaxNIC = cliFlags.guardMaxNIC
+	}
+}
+
+// validateGuardrails checks the thresholds are positive numbers and the percentages at most 100.
+func validateGuardrails(gc guardrailsConfig) []error {
+	var errs []error
+	if load, err := strconv.ParseFloat(gc.MaxLoad, 64); gc.MaxLoad != "" && (err != nil || load <= 0) {
+		errs = append(errs, fmt.Errorf("guardrails max-load must be a positive load average per CPU, got %q", gc.MaxLoad))
+	}
+	for _, setting := range []struct{ name, value string }{
+		{"max-memory", gc.MaxMemory},
+		{"max-nic", gc.MaxNIC},
+	} {
+		if pct, err := strconv.ParseFloat(setting.value, 64); setting.value != "" && (err != nil || pct <= 0 || pct > 100) {
+			errs = append(errs, fmt.Errorf("guardrails %s must be a percentage between 0 and 100, got %q", setting.name, setting.value))
+		}
+	}
+	return errs
+}
+
+// initGuardrails sets up the guardrails if any threshold was configured.
+func initGuardrails(gc guardrailsConfig) {
+	if gc.MaxLoad == "" && gc.MaxMemory == "" && gc.MaxNIC == "" {
+		return
+	}
+	guardrails = &hostGuardrails{nicUtil: make(map[string]nicUtilization)}
+	guardrails.maxLoad, _ = strconv.ParseFloat(gc.MaxLoad, 64)
+	guardrails.maxMemory, _ = strconv.ParseFloat(gc.MaxMemory, 64)
+	guardrails.maxNIC, _ = strconv.ParseFloat(gc.MaxNIC, 64)
+	log.Debugf("[Config] Guardrails = load %s per CPU, memory %s%%, NIC %s%%", gc.MaxLoad, gc.MaxMemory, gc.MaxNIC)
+}
+
+// check returns the reason the host is too busy to test an endpoint and what it measured, ok if it isn't. A
+// resource that can't be read, such as off Linux or on an interface without a link speed, isn't checked.
+func (g *hostGuardrails) check(server perfServer) (string, string, bool) {
+	if g.maxLoad > 0 {
+		if load, ok := readLoadAverage(); ok {
+			if perCPU := load / float64(runtime.NumCPU()); perCPU > g.maxLoad {
+				return "load", fmt.Sprintf("the load average is %.2f per CPU, over %g", perCPU, g.maxLoad), false
+			}
+		}
+	}
+	if g.maxMemory > 0 {
+		if used, ok := readMemoryUtilization(); ok && used > g.maxMemory {
+			return "memory", fmt.Sprintf("%.1f%% of the memory is in use, over %g%%", used, g.maxMemory), false
+		}
+	}
+	if g.maxNIC > 0 {
+		if util, ok := g.nicUtilization(server); ok && util > g.maxNIC {
+			return "nic", fmt.Sprintf("the interface to the endpoint is %.1f%% utilized, over %g%%", util, g.maxNIC), false
+		}
+	}
+	return "", "", true
+}
+
+// nicUtilization returns the utilization of the interface to an endpoint by other traffic measured across the last
+// test on it, and samples the interface when there's none recent.
+func (g *hostGuardrails) nicUtilization(server perfServer) (float64, bool) {
+	key := strings.Join(hostStatsInterfaces(server), ",")
+	g.mu.Lock()
+	measured, ok := g.nicUtil[key]
+	g.mu.Unlock()
+	if ok && time.Since(measured.at) < guardrailNICMaxAge {
+		return measured.util, true
+	}
+	return sampleNICUtilization(server)
+}
+
+// measureNIC keeps the utilization of the interface by other traffic across a test for the check of the next one,
+// the busier direction once the bytes the engine reported are taken out of the direction of the test. The interface
+// bytes include the protocol headers, so a saturating test leaves a few percent of the link as other traffic. Tests
+// with a failed run are left out since the failed run's bytes aren't reported.
+func (g *hostGuardrails) measureNIC(c *nicCheck, direction string, samples []sample, runs int, length string) {
+	end, ok := readNICCounters(c.ifaces)
+	elapsed := time.Since(c.started).Seconds()
+	speed := nicSpeed(c.ifaces)
+	if !ok || elapsed <= 0 || speed == 0 || len(samples) != runs {
+		return
+	}
+	// the client sends in the download direction and receives in the reversed upload direction
+	sent, received := end.txBytes-c.start.txBytes, end.rxBytes-c.start.rxBytes
+	own := uint64(transferredBytes(samples, length))
+	if direction == directionUpload {
+		received = subtractBytes(received, own)
+	} else {
+		sent = subtractBytes(sent, own)
+	}
+	busiest := received
+	if sent > busiest {
+		busiest = sent
+	}
+	g.mu.Lock()
+	g.nicUtil[strings.Join(c.ifaces, ",")] = nicUtilization{util: float64(busiest) * 8 / elapsed / speed * 100, at: time.Now()}
+	g.mu.Unlock()
+}
+
+// subtractBytes takes the test's bytes out of an interface counter delta, down to zero.
+func subtractBytes(counted, own uint64) uint64 {
+	if own > counted {
+		return 0
+	}
+	return counted - own
+}
+
+// readLoadAverage returns the 1 minute load average from /proc/loadavg.
+func readLoadAverage() (float64, bool) {
+	data, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, false
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, false
+	}
+	load, err := strconv.ParseFloat(fields[0], 64)
+	return load, err == nil
+}
+
+// sampleNICUtilization measures the busier direction of the interface to an endpoint over a short sample, in
+// percent of its link speed.
+func sampleNICUtilization(server perfServer) (float64, bool) {
+	ifaces := hostStatsInterfaces(server)
+	speed := nicSpeed(ifaces)
+	if speed == 0 {
+		return 0, false
+	}
+	start, ok := readNICCounters(ifaces)
+	if !ok {
+		return 0, false
+	}
+	started := time.Now()
+	time.Sleep(guardrailNICSample)
+	end, ok := readNICCounters(ifaces)
+	elapsed := time.Since(started).Seconds()
+	if !ok || elapsed <= 0 {
+		return 0, false
+	}
+	busiest := end.rxBytes - start.rxBytes
+	if tx := end.txBytes - start.txBytes; tx > busiest {
+		busiest = tx
+	}
+	return float64(busiest) * 8 / elapsed / speed * 100, true
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"strconv"
+)
+
+const defaultHeartbeatPrefix = "bandwidth.heartbeat"
+
+// cycleSequence counts the cycles run since the agent started.
+var cycleSequence int
+
+// recordHeartbeat records an agent alive data point at the end of every cycle, even if every test failed or
+// no endpoints are configured, so a dead agent can be told apart from a broken network. The value is the
+// cycle sequence number, the unix timestamp or a constant number depending on --heartbeat-value.
+func recordHeartbeat(config configuration, settings runSettings) {
+	cycleSequence++
+	var value float64
+	switch cliFlags.heartbeatValue {
+	case "sequence":
+		value = float64(cycleSequence)
+	case "timestamp":
+		value = float64(measurementTime().Unix())
+	default:
+		value, _ = strconv.ParseFloat(cliFlags.heartbeatValue, 64)
+	}
+	recordMeasurement(config, settings, measurement{
+		Timestamp:   measurementTime(),
+		Source:      config.Hostname,
+		Destination: config.Hostname,
+		Prefix:      cliFlags.heartbeatPrefix,
+		Metric:      "heartbeat",
+		Value:       value,
+	})
+}
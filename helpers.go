@@ -16,33 +16,49 @@ func validateIP(ip string) error {
 	return fmt.Errorf("%s is not a valid v4 or v6 IP", ip)
 }
 
-func splitPerfPair(tunnelDestInput string) []string {
-	return strings.Split(tunnelDestInput, ":")
-}
-
-// convertKbitsToBits iperf3 no longer supports bps, so convert Kbps to bps for tsdb plotting.
-func convertKbitsToBits(kbps string) (int, error) {
-	// round the number to remove any decimals.
+// convertKbitsToBits iperf3 no longer supports bps, so convert Kbps to bps for tsdb plotting. The decimals of the
+// Kbps are kept down to the bit, the sinks round the result to their unit and precision. Scientific notation such
+// as netperf's 2.5e+07 is read as well, and a result that isn't a bitrate an int64 holds is an error rather than a
+// wrapped around number.
+func convertKbitsToBits(kbps string) (int64, error) {
 	log.Debugf("kbps : %s", kbps)
-	float, err := strconv.ParseFloat(kbps, 32)
+	float, err := strconv.ParseFloat(strings.TrimSpace(kbps), 64)
 	if err != nil {
 		return 0, err
 	}
-	kbpsInt := int(math.Round(float))
-	bps := kbpsInt * 1000
+	return kbitsToBits(float)
+}
 
-	return bps, nil
+// kbitsToBits converts a bitrate in Kbps to bps, it fails on a negative, infinite or NaN bitrate and on one too
+// large for an int64.
+func kbitsToBits(kbps float64) (int64, error) {
+	if math.IsNaN(kbps) || math.IsInf(kbps, 0) || kbps < 0 {
+		return 0, fmt.Errorf("%v is not a valid bitrate", kbps)
+	}
+	bps := math.Round(kbps * 1000)
+	// float64(math.MaxInt64) rounds up to 2^63, which an int64 doesn't hold
+	if bps >= math.MaxInt64 {
+		return 0, fmt.Errorf("%v Kbps is too large a bitrate", kbps)
+	}
+	return int64(bps), nil
 }
 
 // printPerfServers concatenate the perf server pairs to make readable for a debug print.
-func printPerfServers(perfServers []servers) {
-	var endpointList []string
-
-	for _, serverPair := range perfServers {
-		for k, v := range serverPair {
-			endPointAddressPair := fmt.Sprintf("%s:%s", k, v)
-			endpointList = append(endpointList, endPointAddressPair)
-			log.Debugf("[Config] Perf Server = %s", endPointAddressPair)
+func printPerfServers(perfServers []perfServer) {
+	for _, server := range perfServers {
+		endPointAddressPair := fmt.Sprintf("%s=%s", server.displayName(), server.Address)
+		if server.Port != "" {
+			endPointAddressPair = fmt.Sprintf("%s=%s", server.displayName(), net.JoinHostPort(server.Address, server.Port))
+		}
+		if server.Engine != "" {
+			endPointAddressPair += " engine=" + server.Engine
+		}
+		if server.Tunnel != nil {
+			endPointAddressPair += " via " + tunnelVia(server.Tunnel)
+		}
+		for _, k := range sortedTagKeys(server.Tags) {
+			endPointAddressPair += fmt.Sprintf(" %s=%s", k, server.Tags[k])
 		}
+		log.Debugf("[Config] Perf Server = %s", endPointAddressPair)
 	}
 }
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"testing"
+	"testing/quick"
+)
+
+// The largest bitrate that converts, 2^63 bps and up doesn't fit an int64.
+const maxConvertibleKbps = float64(1<<63-1024) / 1000
+
+func TestKbitsToBitsInRange(t *testing.T) {
+	property := func(kbps float64) bool {
+		kbps = math.Abs(math.Mod(kbps, maxConvertibleKbps))
+		bps, err := kbitsToBits(kbps)
+		return err == nil && bps >= 0 && math.Abs(float64(bps)-kbps*1000) <= 1+kbps*1000*1e-15
+	}
+	if err := quick.Check(property, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestKbitsToBitsNegative(t *testing.T) {
+	property := func(kbps float64) bool {
+		kbps = -math.Abs(kbps)
+		if kbps == 0 {
+			return true
+		}
+		_, err := kbitsToBits(kbps)
+		return err != nil
+	}
+	if err := quick.Check(property, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestKbitsToBitsOverflow(t *testing.T) {
+	property := func(factor float64) bool {
+		kbps := float64(math.MaxInt64) / 1000 * (1 + math.Abs(math.Mod(factor, 1e6)))
+		_, err := kbitsToBits(kbps)
+		return err != nil
+	}
+	if err := quick.Check(property, nil); err != nil {
+		t.Error(err)
+	}
+	for _, kbps := range []float64{float64(math.MaxInt64) / 1000, math.Inf(1), math.Inf(-1), math.NaN()} {
+		if bps, err := kbitsToBits(kbps); err == nil {
+			t.Errorf("kbitsToBits(%v) = %d, want an error", kbps, bps)
+		}
+	}
+	bps, err := kbitsToBits(maxConvertibleKbps)
+	if err != nil || bps <= 0 {
+		t.Errorf("kbitsToBits(%v) = %d, %v, want the largest bitrate", maxConvertibleKbps, bps, err)
+	}
+}
+
+func TestConvertKbitsToBits(t *testing.T) {
+	property := func(kbps uint32) bool {
+		bps, err := convertKbitsToBits(" " + strconv.FormatUint(uint64(kbps), 10) + "\n")
+		return err == nil && bps == int64(kbps)*1000
+	}
+	if err := quick.Check(property, nil); err != nil {
+		t.Error(err)
+	}
+	for _, kbps := range []string{"", "fast", "12 Mbps", "1e400", "-1", "NaN", "0x"} {
+		if bps, err := convertKbitsToBits(kbps); err == nil {
+			t.Errorf("convertKbitsToBits(%q) = %d, want an error", kbps, bps)
+		}
+	}
+	if bps, err := convertKbitsToBits("0.0015"); err != nil || bps != 2 {
+		t.Errorf("convertKbitsToBits(0.0015) = %d, %v, want 2", bps, err)
+	}
+}
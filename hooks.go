@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	hookPreTest  = "pre-test"
+	hookPostTest = "post-test"
+	// defaultHookTimeout is how long a hook may run in seconds before it is stopped and counted as failed.
+	defaultHookTimeout = "30"
+)
+
+// hooksConfig runs a command or calls a URL before and after every test, e.g. to toggle a QoS policy, rotate a VPN
+// or notify a CMDB. A failed hook is logged and recorded but doesn't stop the test.
+type hooksConfig struct {
+	PreTest  hookConfig `yaml:"pre-test"`
+	PostTest hookConfig `yaml:"post-test"`
+}
+
+// hookConfig is a command run without a shell, or a URL the hook event is posted to as JSON.
+type hookConfig struct {
+	Command string   `yaml:"command"`
+	Args    []string `yaml:"args"`
+	URL     string   `yaml:"url"`
+	// Timeout is how long the hook may take in seconds, 30 by default.
+	Timeout string `yaml:"timeout"`
+}
+
+// hookEvent describes the test a hook runs for. The post-test hook also gets the result, or the error of a failed
+// test.
+type hookEvent struct {
+	Stage       string    `json:"stage"`
+	Timestamp   time.Time `json:"timestamp"`
+	Source      string    `json:"source"`
+	Destination string    `json:"destination"`
+	Address     string    `json:"address"`
+	Direction   string    `json:"direction"`
+	Engine      string    `json:"engine"`
+	RunID       string    `json:"run-id"`
+	// Status is ok or failed after the test, empty before it.
+	Status string  `json:"status,omitempty"`
+	Bps    int64   `json:"bps,omitempty"`
+	Metric string  `json:"metric,omitempty"`
+	Value  float64 `json:"value,omitempty"`
+	Error  string  `json:"error,omitempty"`
+}
+
+// hookRunner runs the configured hooks.
+type hookRunner struct {
+	config hooksConfig
+	client *http.Client
+}
+
+var hooks *hookRunner
+
+// mergeHooksFlags fills any hooks missing from the configuration file with the CLI values, a URL or a command line.
+func mergeHooksFlags(hc *hooksConfig) {
+	mergeHookFlag(&hc.PreTest, cliFlags.preTestHook)
+	mergeHookFlag(&hc.PostTest, cliFlags.postTestHook)
+	for _, hook := range []*hookConfig{&hc.PreTest, &hc.PostTest} {
+		if hook.Timeout == "" {
+			hook.Timeout = defaultHookTimeout
+		}
+	}
+}
+
+func mergeHookFlag(hook *hookConfig, flag string) {
+	if hook.Command != "" || hook.URL != "" || flag == "" {
+		return
+	}
+	if strings.HasPrefix(flag, "http://") || strings.HasPrefix(flag, "https://") {
+		hook.URL = flag
+		return
+	}
+	fields := strings.Fields(flag)
+	hook.Command, hook.Args = fields[0], fields[1:]
+}
+
+// validateHooks checks every hook is either a command or a URL with a valid timeout.
+func validateHooks(hc hooksConfig) []error {
+	var errs []error
+	for _, stage := range []struct {
+		name string
+		hook hookConfig
+	}{{hookPreTest, hc.PreTest}, {hookPostTest, hc.PostTest}} {
+		if stage.hook.Command != "" && stage.hook.URL != "" {
+			errs = append(errs, fmt.Errorf("the %s hook can run a command or call a URL, not both", stage.name))
+		}
+		if stage.hook.URL != "" {
+			if u, err := url.Parse(stage.hook.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				errs = append(errs, fmt.Errorf("the %s hook url must be an http or https URL, got %q", stage.name, redactRawURL(stage.hook.URL)))
+			}
+		}
+		if timeout, err := strconv.Atoi(stage.hook.Timeout); err != nil || timeout <= 0 {
+			errs = append(errs, fmt.Errorf("the %s hook timeout must be a positive number of seconds, got %q", stage.name, stage.hook.Timeout))
+		}
+	}
+	return errs
+}
+
+// initHooks sets up the hooks if a pre-test or a post-test hook was configured.
+func initHooks(hc hooksConfig) {
+	if hc.PreTest.Command == "" && hc.PreTest.URL == "" && hc.PostTest.Command == "" && hc.PostTest.URL == "" {
+		return
+	}
+	hooks = &hookRunner{config: hc, client: &http.Client{}}
+	for _, stage := range []struct {
+		name string
+		hook hookConfig
+	}{{hookPreTest, hc.PreTest}, {hookPostTest, hc.PostTest}} {
+		if stage.hook.URL != "" {
+			log.Debugf("[Config] %s hook = %s", stage.name, redactRawURL(stage.hook.URL))
+		} else if stage.hook.Command != "" {
+			log.Debugf("[Config] %s hook = %s", stage.name, strings.Join(append([]string{stage.hook.Command}, stage.hook.Args...), " "))
+		}
+	}
+}
+
+// run runs the hook of a stage for a test and records whether it failed as the pre_hook_failed or post_hook_failed
+// metric of the test. The result is the measurement of a post-test hook, nil if the test failed with testErr.
+func (h *hookRunner) run(config configuration, settings runSettings, eng engine, server perfServer, direction string, prefix string, stage string, result *measurement, testErr error) {
+	hook := h.config.PreTest
+	metric := "pre_hook_failed"
+	if stage == hookPostTest {
+		hook, metric = h.config.PostTest, "post_hook_failed"
+	}
+	if hook.Command == "" && hook.URL == "" {
+		return
+	}
+	event := hookEvent{
+		Stage:       stage,
+		Timestamp:   measurementTime(),
+		Source:      config.Hostname,
+		Destination: server.displayName(),
+		Address:     server.Address,
+		Direction:   direction,
+		Engine:      eng.name,
+		RunID:       server.runID,
+	}
+	if stage == hookPostTest {
+		event.Status = "ok"
+		if result != nil {
+			event.Bps, event.Metric, event.Value = result.Bps, result.Metric, result.Value
+		} else {
+			event.Status = "failed"
+			if testErr != nil {
+				event.Error = testErr.Error()
+			}
+		}
+	}
+	timeout, _ := strconv.Atoi(hook.Timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	defer cancel()
+	var err error
+	if hook.URL != "" {
+		err = h.post(ctx, hook.URL, event)
+	} else {
+		err = h.exec(ctx, hook, event)
+	}
+	failed := 0.0
+	if err != nil {
+		failed = 1
+		log.Errorf("The %s hook of the %s test to %s [%s] failed: %v", stage, direction, server.Address, server.displayName(), err)
+	} else {
+		log.Debugf("Ran the %s hook of the %s test to %s [%s]", stage, direction, server.Address, server.displayName())
+	}
+	recordTestMetric(config, settings, eng, server, direction, prefix, metric, failed)
+}
+
+// exec runs a hook command with the event as JSON on its stdin and as CBANDWIDTH_HOOK_* environment variables.
+func (h *hookRunner) exec(ctx context.Context, hook hookConfig, event hookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, hook.Command, hook.Args...)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Env = append(os.Environ(),
+		"CBANDWIDTH_HOOK_STAGE="+event.Stage,
+		"CBANDWIDTH_HOOK_SOURCE="+event.Source,
+		"CBANDWIDTH_HOOK_ENDPOINT="+event.Destination,
+		"CBANDWIDTH_HOOK_ADDRESS="+event.Address,
+		"CBANDWIDTH_HOOK_DIRECTION="+event.Direction,
+		"CBANDWIDTH_HOOK_ENGINE="+event.Engine,
+		"CBANDWIDTH_HOOK_RUN_ID="+event.RunID,
+		"CBANDWIDTH_HOOK_STATUS="+event.Status,
+		"CBANDWIDTH_HOOK_BPS="+strconv.FormatInt(event.Bps, 10),
+		"CBANDWIDTH_HOOK_METRIC="+event.Metric,
+		"CBANDWIDTH_HOOK_VALUE="+strconv.FormatFloat(event.Value, 'f', -1, 64),
+		"CBANDWIDTH_HOOK_ERROR="+event.Error,
+	)
+	start := time.Now()
+	output, err := cmd.CombinedOutput()
+	auditCommand(append([]string{hook.Command}, hook.Args...), start, err)
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %s seconds", hook.Timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// post posts the event to a hook URL, a response other than 2xx fails the hook.
+func (h *hookRunner) post(ctx context.Context, rawURL string, event hookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", rawURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := auditedDo(h.client, "hook", req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// hostStatsInterval is how often the host is sampled during a test.
+const hostStatsInterval = time.Second
+
+// nicCounters is a snapshot of the byte, drop and error counters of the network interfaces a test runs over.
+type nicCounters struct {
+	rxBytes uint64
+	txBytes uint64
+	// drops are the packets dropped and the errors in both directions.
+	drops uint64
+}
+
+// hostStats summarizes the host during a test. The peaks are of the one second samples, a test shorter than a
+// sample has its whole duration as the only one.
+type hostStats struct {
+	cpuPeak    float64
+	hasCPU     bool
+	memPeak    float64
+	hasMem     bool
+	rxBps      float64
+	txBps      float64
+	nicUtil    float64
+	hasNICUtil bool
+	drops      uint64
+	hasNIC     bool
+}
+
+// hostSampler samples the CPU and memory of the host and the counters of the interface to an endpoint in the
+// background while its test runs, so a low result can be told apart from a saturated host.
+type hostSampler struct {
+	ifaces  []string
+	speed   float64
+	started time.Time
+	nic     nicCounters
+	hasNIC  bool
+	stop    chan struct{}
+	done    chan struct{}
+	stats   hostStats
+}
+
+// startHostSampler starts sampling the host during a test to an endpoint. It is only available on Linux, nil
+// elsewhere.
+func startHostSampler(server perfServer) *hostSampler {
+	cpu, ok := readCPUTimes()
+	if !ok {
+		return nil
+	}
+	s := &hostSampler{ifaces: hostStatsInterfaces(server), started: time.Now(), stop: make(chan struct{}), done: make(chan struct{})}
+	s.nic, s.hasNIC = readNICCounters(s.ifaces)
+	s.speed = nicSpeed(s.ifaces)
+	s.sampleMemory()
+	go s.run(cpu)
+	return s
+}
+
+// run records the peak CPU and memory utilization every interval until the sampler is stopped.
+func (s *hostSampler) run(cpu cpuTimes) {
+	defer close(s.done)
+	ticker := time.NewTicker(hostStatsInterval)
+	defer ticker.Stop()
+	last := s.started
+	for {
+		select {
+		case <-s.stop:
+			s.sampleCPU(cpu, !s.stats.hasCPU || time.Since(last) >= hostStatsInterval/2)
+			s.sampleMemory()
+			return
+		case <-ticker.C:
+			cpu = s.sampleCPU(cpu, true)
+			last = time.Now()
+			s.sampleMemory()
+		}
+	}
+}
+
+// sampleCPU updates the CPU peak with the utilization since the last snapshot if counted, it returns the new
+// snapshot. The partial interval at the end of a test only counts if it's at least half an interval or there is no
+// other sample, a few jiffies are too coarse to be a utilization.
+func (s *hostSampler) sampleCPU(last cpuTimes, count bool) cpuTimes {
+	now, ok := readCPUTimes()
+	if !ok {
+		return last
+	}
+	if utilization, ok := cpuUtilization(last, now); ok && count && (!s.stats.hasCPU || utilization > s.stats.cpuPeak) {
+		s.stats.cpuPeak, s.stats.hasCPU = utilization, true
+	}
+	return now
+}
+
+// sampleMemory updates the memory peak.
+func (s *hostSampler) sampleMemory() {
+	if used, ok := readMemoryUtilization(); ok && (!s.stats.hasMem || used > s.stats.memPeak) {
+		s.stats.memPeak, s.stats.hasMem = used, true
+	}
+}
+
+// finish stops the sampler and returns the stats of the test.
+func (s *hostSampler) finish() hostStats {
+	close(s.stop)
+	<-s.done
+	stats := s.stats
+	elapsed := time.Since(s.started).Seconds()
+	if end, ok := readNICCounters(s.ifaces); ok && s.hasNIC && elapsed > 0 {
+		stats.hasNIC = true
+		stats.rxBps = float64(end.rxBytes-s.nic.rxBytes) * 8 / elapsed
+		stats.txBps = float64(end.txBytes-s.nic.txBytes) * 8 / elapsed
+		stats.drops = end.drops - s.nic.drops
+		if s.speed > 0 {
+			busiest := stats.rxBps
+			if stats.txBps > busiest {
+				busiest = stats.txBps
+			}
+			stats.nicUtil, stats.hasNICUtil = busiest/s.speed*100, true
+		}
+	}
+	return stats
+}
+
+// recordHostStats records the host stats of a test as companion metrics of its result, the peak CPU and memory
+// utilization in percent as cpu_peak and mem_util, the interface throughput as nic_rx and nic_tx in bps, its
+// utilization of the link speed as nic_util and the packets dropped or in error as nic_drops.
+func recordHostStats(config configuration, settings runSettings, eng engine, server perfServer, direction string, prefix string, stats hostStats) {
+	if stats.hasCPU {
+		recordTestMetric(config, settings, eng, server, direction, prefix, "cpu_peak", stats.cpuPeak)
+	}
+	if stats.hasMem {
+		recordTestMetric(config, settings, eng, server, direction, prefix, "mem_util", stats.memPeak)
+	}
+	if !stats.hasNIC {
+		return
+	}
+	recordTestMetric(config, settings, eng, server, direction, prefix, "nic_rx", stats.rxBps)
+	recordTestMetric(config, settings, eng, server, direction, prefix, "nic_tx", stats.txBps)
+	recordTestMetric(config, settings, eng, server, direction, prefix, "nic_drops", float64(stats.drops))
+	if stats.hasNICUtil {
+		recordTestMetric(config, settings, eng, server, direction, prefix, "nic_util", stats.nicUtil)
+	}
+}
+
+// hostStatsInterfaces returns the interface the route to an endpoint leaves through, or every interface but the
+// loopback if the route isn't known such as through a tunnel.
+func hostStatsInterfaces(server perfServer) []string {
+	if server.Tunnel == nil {
+		if iface, err := routeInterface(server.dialAddress()); err == nil && iface != nil {
+			return []string{iface.Name}
+		}
+	}
+	entries, err := os.ReadDir(sysClassNet)
+	if err != nil {
+		return nil
+	}
+	var ifaces []string
+	for _, entry := range entries {
+		if entry.Name() != "lo" {
+			ifaces = append(ifaces, entry.Name())
+		}
+	}
+	return ifaces
+}
+
+// readNICCounters sums the counters of the interfaces from sysfs.
+func readNICCounters(ifaces []string) (nicCounters, bool) {
+	var counters nicCounters
+	found := false
+	for _, iface := range ifaces {
+		stats := filepath.Join(sysClassNet, iface, "statistics")
+		rx, err := readCounter(filepath.Join(stats, "rx_bytes"))
+		if err != nil {
+			continue
+		}
+		tx, _ := readCounter(filepath.Join(stats, "tx_bytes"))
+		counters.rxBytes += rx
+		counters.txBytes += tx
+		for _, name := range []string{"rx_dropped", "tx_dropped", "rx_errors", "tx_errors"} {
+			value, _ := readCounter(filepath.Join(stats, name))
+			counters.drops += value
+		}
+		found = true
+	}
+	return counters, found
+}
+
+// nicSpeed returns the link speed of the interfaces in bps, zero if any of them doesn't report one such as
+// virtual and wireless interfaces.
+func nicSpeed(ifaces []string) float64 {
+	var speed float64
+	for _, iface := range ifaces {
+		mbps, err := readCounter(filepath.Join(sysClassNet, iface, "speed"))
+		if err != nil || mbps == 0 {
+			return 0
+		}
+		speed += float64(mbps) * 1e6
+	}
+	return speed
+}
+
+// readCounter reads a sysfs file holding a single unsigned number, a negative speed fails to parse.
+func readCounter(name string) (uint64, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// readMemoryUtilization returns the percentage of the host memory in use from /proc/meminfo, memory the kernel
+// can reclaim such as the page cache is counted as available.
+func readMemoryUtilization() (float64, bool) {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, false
+	}
+	defer file.Close()
+	var total, available uint64
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "MemTotal:":
+			total, _ = strconv.ParseUint(fields[1], 10, 64)
+		case "MemAvailable:":
+			available, _ = strconv.ParseUint(fields[1], 10, 64)
+		}
+	}
+	if total == 0 || available > total {
+		return 0, false
+	}
+	return float64(total-available) / float64(total) * 100, true
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const (
+	imagePullAlways       = "always"
+	imagePullIfNotPresent = "ifnotpresent"
+	imagePullNever        = "never"
+)
+
+// imageDigestPattern matches an image reference pinned by its content digest, e.g. networkstatic/iperf3@sha256:...
+var imageDigestPattern = regexp.MustCompile(`@sha256:[0-9a-f]{64}$`)
+
+// preparedImages are the images checked and pulled by prepareImage, each is prepared once per agent process.
+var preparedImages = struct {
+	sync.Mutex
+	images map[string]error
+}{images: make(map[string]error)}
+
+// validateImagePull checks the pull policy and the digest of a pinned --image.
+func validateImagePull() []error {
+	var errs []error
+	switch cliFlags.imagePullPolicy {
+	case imagePullAlways, imagePullIfNotPresent, imagePullNever:
+	default:
+		errs = append(errs, fmt.Errorf("image-pull-policy must be always, ifnotpresent or never, got %q", cliFlags.imagePullPolicy))
+	}
+	if strings.Contains(cliFlags.imageRepo, "@") && !imageDigestPattern.MatchString(cliFlags.imageRepo) {
+		errs = append(errs, fmt.Errorf("image %q must be pinned as <image>@sha256:<64 hex digits>", cliFlags.imageRepo))
+	}
+	return errs
+}
+
+// imagePinned reports whether an image reference is pinned by digest.
+func imagePinned(image string) bool {
+	return imageDigestPattern.MatchString(image)
+}
+
+// imageRunArgs are the pull options of a container run. The images were prepared when the agent started, so with
+// ifnotpresent and never a test never pulls, and a test can't start on an image that changed mid-deployment.
+func imageRunArgs() []string {
+	if cliFlags.imagePullPolicy == imagePullAlways {
+		return []string{"--pull=always"}
+	}
+	return []string{"--pull=never"}
+}
+
+// prepareImage pulls an image according to the pull policy before its first test and logs the digest it runs. With
+// never, the image must already be on the host.
+func prepareImage(runtime string, image string) error {
+	preparedImages.Lock()
+	defer preparedImages.Unlock()
+	if err, ok := preparedImages.images[image]; ok {
+		return err
+	}
+	err := pullImage(runtime, image)
+	preparedImages.images[image] = err
+	return err
+}
+
+func pullImage(runtime string, image string) error {
+	_, inspectErr := auditedOutput(runtime, "image", "inspect", image)
+	present := inspectErr == nil
+	switch {
+	case cliFlags.imagePullPolicy == imagePullNever && !present:
+		return fmt.Errorf("image %s isn't on this host and image-pull-policy is never, load it with %s load or %s pull", image, runtime, runtime)
+	case cliFlags.imagePullPolicy == imagePullAlways || !present:
+		log.Infof("Pulling %s", image)
+		if output, err := auditedOutput(runtime, "pull", image); err != nil {
+			return fmt.Errorf("error pulling %s: %v: %s", image, err, strings.TrimSpace(string(output)))
+		}
+	}
+	// the runtime verifies the content of a pinned image against its digest when pulling it, a present one
+	// only matches the reference if it has that digest
+	output, err := auditedOutput(runtime, "image", "inspect", "--format", "{{join .RepoDigests \" \"}}", image)
+	if err != nil {
+		return fmt.Errorf("error inspecting %s: %v: %s", image, err, strings.TrimSpace(string(output)))
+	}
+	digests := strings.Fields(string(output))
+	if imagePinned(image) {
+		digest := image[strings.LastIndex(image, "@")+1:]
+		found := false
+		for _, repoDigest := range digests {
+			found = found || strings.HasSuffix(repoDigest, "@"+digest)
+		}
+		if !found {
+			return fmt.Errorf("image %s on this host doesn't have the pinned digest %s", image, digest)
+		}
+		log.Infof("Using %s, verified against its pinned digest", image)
+		return nil
+	}
+	if len(digests) > 0 {
+		log.Infof("Using %s at %s, pass that as the --image to keep it from changing", image, digests[0])
+	} else {
+		log.Infof("Using the locally built %s, it has no registry digest", image)
+	}
+	return nil
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// influxRetryBackoff is the pause before the first retry of a failed write, it doubles with every retry.
+	influxRetryBackoff = time.Second
+	// influxMaxRetryAfter caps the pause a Retry-After header can ask for.
+	influxMaxRetryAfter = 5 * time.Minute
+	// influxMaxPending is the most lines buffered while the endpoint is slow or pushing back, the oldest are
+	// dropped beyond it so a long outage doesn't grow the agent's memory without bound.
+	influxMaxPending = 100000
+	// defaultInfluxTimeout bounds the writes until the client is built from --influx-timeout.
+	defaultInfluxTimeout = 30 * time.Second
+	// influxDialTimeout and influxKeepAlive bound connecting to the endpoint and detect a connection that died
+	// without being closed, e.g. dropped by a NAT or a firewall.
+	influxDialTimeout = 10 * time.Second
+	influxKeepAlive   = 30 * time.Second
+	// influxMaxIdleConns is the pool of idle connections kept alive per endpoint between the batches, the
+	// batchers of the tenants and the flush loop write to an endpoint at once.
+	influxMaxIdleConns    = 8
+	influxIdleConnTimeout = 90 * time.Second
+)
+
+var (
+	// influxClient is the HTTP client shared by the Influx and Kentik writes, its connections are kept alive and
+	// reused across the writes.
+	influxClient = &http.Client{Timeout: defaultInfluxTimeout, Transport: newInfluxTransport(http.ProxyFromEnvironment, nil, defaultInfluxTimeout)}
+	// influxGzipWriters are reused to compress the request bodies instead of allocating a writer per write.
+	influxGzipWriters = sync.Pool{New: func() interface{} { return gzip.NewWriter(io.Discard) }}
+	// influxRetries is the number of times a failed write is retried.
+	influxRetries int
+	// influxWriter batches the lines written to influx, nil until the sinks are set up.
+	influxWriter *influxBatcher
+)
+
+// influxStatusError is a write rejected by the influx endpoint. retryAfter is the pause the endpoint asked for
+// with a Retry-After header on a 429 or 503.
+type influxStatusError struct {
+	code       int
+	body       string
+	retryAfter time.Duration
+}
+
+func (e influxStatusError) Error() string {
+	if e.body == "" {
+		return fmt.Sprintf("unexpected status code: %d", e.code)
+	}
+	return fmt.Sprintf("unexpected status code: %d: %s", e.code, e.body)
+}
+
+// initInfluxClient builds the influx HTTP client. An explicit --https-proxy wins over the HTTP(S)_PROXY
+// environment variables and a CA bundle is added to the system roots for proxies intercepting TLS.
+func initInfluxClient() error {
+	timeout, err := strconv.Atoi(cliFlags.influxTimeout)
+	if err != nil || timeout <= 0 {
+		return fmt.Errorf("influx-timeout must be a positive number of seconds, got %q", cliFlags.influxTimeout)
+	}
+	influxRetries, err = strconv.Atoi(cliFlags.influxRetries)
+	if err != nil || influxRetries < 0 {
+		return fmt.Errorf("influx-retries must be zero or a positive number, got %q", cliFlags.influxRetries)
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if cliFlags.httpsProxy != "" {
+		proxyURL, err := url.Parse(cliFlags.httpsProxy)
+		if err != nil || proxyURL.Host == "" {
+			return fmt.Errorf("invalid https-proxy %q", cliFlags.httpsProxy)
+		}
+		proxy = http.ProxyURL(proxyURL)
+		log.Debugf("[Config] HTTPS Proxy = %s", proxyURL.Redacted())
+	}
+
+	tlsConfig := &tls.Config{}
+	if cliFlags.influxCACert != "" {
+		pem, err := os.ReadFile(cliFlags.influxCACert)
+		if err != nil {
+			return fmt.Errorf("could not read the influx CA bundle: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", cliFlags.influxCACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	influxClient = &http.Client{
+		Timeout:   time.Duration(timeout) * time.Second,
+		Transport: newInfluxTransport(proxy, tlsConfig, time.Duration(timeout)*time.Second),
+	}
+	return nil
+}
+
+// newInfluxTransport returns the pooled transport of the influx client. Every phase of a write has a timeout so a
+// write can't wedge on a dead connection, the whole write is also bounded by the client timeout.
+func newInfluxTransport(proxy func(*http.Request) (*url.URL, error), tlsConfig *tls.Config, timeout time.Duration) *http.Transport {
+	return &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   influxDialTimeout,
+			KeepAlive: influxKeepAlive,
+		}).DialContext,
+		TLSClientConfig: tlsConfig,
+		// a custom TLS config turns HTTP/2 off unless it's asked for
+		ForceAttemptHTTP2:     true,
+		TLSHandshakeTimeout:   influxDialTimeout,
+		ResponseHeaderTimeout: timeout,
+		ExpectContinueTimeout: time.Second,
+		MaxIdleConns:          influxMaxIdleConns * 4,
+		MaxIdleConnsPerHost:   influxMaxIdleConns,
+		IdleConnTimeout:       influxIdleConnTimeout,
+	}
+}
+
+// influxLinePoint is a line waiting in the batch with the run it belongs to.
+type influxLinePoint struct {
+	line  string
+	runID string
+}
+
+// influxBatcher buffers the influx lines and writes them in batches of batchSize lines per request, when a batch
+// fills up, every flush interval and at the end of every cycle. Lines keep arriving while a batch is retried.
+type influxBatcher struct {
+	url       string
+	batchSize int
+	gzip      bool
+	mu        sync.Mutex
+	pending   []influxLinePoint
+	dropped   int
+	// email and token are the Kentik credentials the lines are written with.
+	email string
+	token string
+	// writing serializes the writes so the batches reach the endpoint in order
+	writing sync.Mutex
+	// full wakes the flush loop once a batch is full
+	full chan struct{}
+}
+
+// initInfluxWriter sets up the influx batch writer and its flush loop.
+func initInfluxWriter(influxURL string) error {
+	writer, err := newInfluxBatcher(influxURL, cliFlags.kentikEmail, cliFlags.kentikToken)
+	if err != nil {
+		return err
+	}
+	influxWriter = writer
+	log.Debugf("[Config] Influx Batches = %d lines every %ssec, gzip %t", writer.batchSize, cliFlags.influxFlushInterval, writer.gzip)
+	return nil
+}
+
+// newInfluxBatcher returns a batch writer to an influx URL with the given credentials and starts its flush loop.
+func newInfluxBatcher(influxURL string, email string, token string) (*influxBatcher, error) {
+	batchSize, err := strconv.Atoi(cliFlags.influxBatchSize)
+	if err != nil || batchSize <= 0 {
+		return nil, fmt.Errorf("influx-batch-size must be a positive number of lines, got %q", cliFlags.influxBatchSize)
+	}
+	interval, err := strconv.Atoi(cliFlags.influxFlushInterval)
+	if err != nil || interval <= 0 {
+		return nil, fmt.Errorf("influx-flush-interval must be a positive number of seconds, got %q", cliFlags.influxFlushInterval)
+	}
+	writer := &influxBatcher{url: influxURL, batchSize: batchSize, gzip: !cliFlags.influxNoGzip, email: email, token: token, full: make(chan struct{}, 1)}
+	go func() {
+		ticker := time.NewTicker(time.Duration(interval) * time.Second)
+		for {
+			select {
+			case <-ticker.C:
+			case <-writer.full:
+			}
+			writer.flush()
+		}
+	}()
+	return writer, nil
+}
+
+// add buffers a line and hands the batch to the flush loop once it is full, so a test never waits on a write
+// that is being retried.
+func (b *influxBatcher) add(line string, runID string) {
+	b.mu.Lock()
+	b.pending = append(b.pending, influxLinePoint{line: line, runID: runID})
+	if over := len(b.pending) - influxMaxPending; over > 0 {
+		b.pending = b.pending[over:]
+		b.dropped += over
+	}
+	full := len(b.pending) >= b.batchSize
+	b.mu.Unlock()
+	if full {
+		select {
+		case b.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// flush writes the buffered lines in batches of up to batchSize lines.
+func (b *influxBatcher) flush() {
+	b.writing.Lock()
+	defer b.writing.Unlock()
+	for {
+		b.mu.Lock()
+		if b.dropped > 0 {
+			log.Errorf("Dropped %d influx lines, the endpoint at %s isn't keeping up", b.dropped, b.url)
+			b.dropped = 0
+		}
+		n := len(b.pending)
+		if n > b.batchSize {
+			n = b.batchSize
+		}
+		batch := b.pending[:n:n]
+		b.pending = b.pending[n:]
+		b.mu.Unlock()
+		if len(batch) == 0 {
+			return
+		}
+		writeInflux(b, batch)
+	}
+}
+
+// writeInflux sends a batch of lines to influx and retries it when the endpoint couldn't be reached or failed on
+// its side, after the pause of a Retry-After header if the endpoint sent one. The lines carry the measurement's
+// timestamp so a retry of a write that was stored but whose response was lost overwrites the same points instead
+// of adding others.
+func writeInflux(b *influxBatcher, batch []influxLinePoint) {
+	influxURL := b.url
+	lines := make([]string, len(batch))
+	runs := make([]string, 0, len(batch))
+	for i, point := range batch {
+		lines[i] = point.line
+		if !containsString(runs, point.runID) {
+			runs = append(runs, point.runID)
+		}
+	}
+	body := strings.Join(lines, "\n") + "\n"
+	label := fmt.Sprintf("run %s", strings.Join(runs, ", "))
+	if len(runs) > 3 {
+		label = fmt.Sprintf("%d lines of %d runs", len(batch), len(runs))
+	} else if len(batch) > 1 {
+		label = fmt.Sprintf("%d lines of runs %s", len(batch), strings.Join(runs, ", "))
+	}
+	log.Debugf("Writing %s to influx at %s -> %s", label, influxURL, body)
+
+	backoff := influxRetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := sendInflux(influxURL, b.email, b.token, body, b.gzip)
+		if err == nil {
+			return
+		}
+		if attempt >= influxRetries || !retryableInflux(err) {
+			log.Errorf("Error writing %s to the Influx endpoint -> [%s]: %v", label, influxURL, err)
+			atomic.AddInt32(&failedWrites, 1)
+			if _, ok := err.(influxStatusError); !ok {
+				log.Errorf("Verify the Influx server is running and reachable at %s", influxURL)
+			}
+			return
+		}
+		pause := backoff
+		if status, ok := err.(influxStatusError); ok && status.retryAfter > 0 {
+			pause = status.retryAfter
+		}
+		log.Warnf("Retrying the write of %s to the Influx endpoint in %s: %v", label, pause, err)
+		if _, ok := err.(influxStatusError); !ok {
+			// the retry opens a new connection rather than reusing one that may be dead
+			influxClient.CloseIdleConnections()
+		}
+		time.Sleep(pause)
+		backoff *= 2
+	}
+}
+
+// parseRetryAfter reads a Retry-After header in seconds or as an HTTP date, zero if it's missing or invalid.
+func parseRetryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	var pause time.Duration
+	if secs, err := strconv.Atoi(header); err == nil {
+		pause = time.Duration(secs) * time.Second
+	} else if t, err := http.ParseTime(header); err == nil {
+		pause = time.Until(t)
+	}
+	if pause < 0 {
+		return 0
+	}
+	if pause > influxMaxRetryAfter {
+		return influxMaxRetryAfter
+	}
+	return pause
+}
+
+// retryableInflux reports whether a failed write may succeed when sent again. Requests the endpoint rejected
+// as invalid or unauthorized are not retried.
+func retryableInflux(err error) bool {
+	status, ok := err.(influxStatusError)
+	if !ok {
+		return true
+	}
+	return status.code == http.StatusTooManyRequests || status.code >= 500
+}
+
+// influxTimestamp formats a timestamp in the precision of the influx URL's precision parameter, nanoseconds by
+// default as in the line protocol.
+func influxTimestamp(influxURL string, t time.Time) string {
+	precision := ""
+	if u, err := url.Parse(influxURL); err == nil {
+		precision = u.Query().Get("precision")
+	}
+	switch precision {
+	case "u", "us":
+		return strconv.FormatInt(t.UnixNano()/int64(time.Microsecond), 10)
+	case "ms":
+		return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+	case "s":
+		return strconv.FormatInt(t.Unix(), 10)
+	case "m":
+		return strconv.FormatInt(t.Unix()/60, 10)
+	case "h":
+		return strconv.FormatInt(t.Unix()/3600, 10)
+	}
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+const (
+	defaultInfluxMeasurement = "iperf3"
+	// defaultInfluxField is the field of the bandwidth results, companion metrics are written under their metric name.
+	defaultInfluxField = "iperfResultsBps"
+)
+
+// defaultInfluxTags is the tag set written when no influx-template tags are configured, in the order they're written.
+var defaultInfluxTags = []influxTagConfig{
+	{"testType", "{{.Prefix}}"},
+	{"iperfDestination", "{{.Dest}}"},
+	{"iperfSource", "{{.Source}}"},
+	{"agentVersion", "{{.Version}}"},
+	{"unit", "{{.Unit}}"},
+}
+
+// influxTemplateConfig shapes the influx line protocol payload. The measurement, every tag value and the field
+// name are Go templates rendered against influxTemplateData.
+type influxTemplateConfig struct {
+	Measurement string            `yaml:"measurement"`
+	Tags        map[string]string `yaml:"tags"`
+	// EndpointTags appends the tags of the perf server to the tag set, on by default.
+	EndpointTags *bool  `yaml:"endpoint-tags"`
+	Field        string `yaml:"field"`
+}
+
+// influxTagConfig is a tag key and the template of its value.
+type influxTagConfig struct {
+	key      string
+	template string
+}
+
+// influxTemplateData is the data available to the influx templates. Field is the default field name of the
+// measurement, iperfResultsBps for a bandwidth result or the metric name of a companion metric. Unit is the unit of
+// a bandwidth result such as Mbps, empty for a companion metric.
+type influxTemplateData struct {
+	Prefix    string
+	Source    string
+	Dest      string
+	Address   string
+	Direction string
+	Engine    string
+	Metric    string
+	Field     string
+	Unit      string
+	Version   string
+	Tags      map[string]string
+}
+
+// influxTag is a tag key with its parsed value template.
+type influxTag struct {
+	key  string
+	tmpl *template.Template
+}
+
+// influxFormat is the parsed influx-template.
+type influxFormat struct {
+	measurement  *template.Template
+	tags         []influxTag
+	endpointTags bool
+	field        *template.Template
+}
+
+// influxTemplate renders the influx line protocol payloads, it's set up with the sinks.
+var influxTemplate *influxFormat
+
+// mergeInfluxTemplateFlags fills any influx-template settings missing from the configuration file with the CLI
+// values. The measurement falls back to measurement-name and then to iperf3.
+func mergeInfluxTemplateFlags(ic *influxTemplateConfig, measurementName string) {
+	if ic.Measurement == "" {
+		ic.Measurement = cliFlags.influxMeasurement
+	}
+	if ic.Measurement == "" {
+		ic.Measurement = measurementName
+	}
+	if ic.Measurement == "" {
+		ic.Measurement = defaultInfluxMeasurement
+	}
+	if len(ic.Tags) == 0 && cliFlags.influxTags != "" {
+		ic.Tags = make(map[string]string)
+		for _, pair := range strings.Split(cliFlags.influxTags, ",") {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 {
+				// rejected by parseInfluxTemplate
+				ic.Tags[strings.TrimSpace(pair)] = ""
+				continue
+			}
+			ic.Tags[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+	if ic.EndpointTags == nil && cliFlags.influxNoEndpointTags {
+		off := false
+		ic.EndpointTags = &off
+	}
+	if ic.Field == "" {
+		ic.Field = cliFlags.influxField
+	}
+}
+
+// parseInfluxTemplate parses the influx-template and verifies it renders a valid line for a sample measurement.
+func parseInfluxTemplate(ic influxTemplateConfig) (*influxFormat, error) {
+	name := ic.Measurement
+	if name == "" {
+		name = defaultInfluxMeasurement
+	}
+	field := ic.Field
+	if field == "" {
+		field = "{{.Field}}"
+	}
+	var err error
+	format := &influxFormat{endpointTags: ic.EndpointTags == nil || *ic.EndpointTags}
+	if format.measurement, err = newInfluxTemplate("measurement", name); err != nil {
+		return nil, err
+	}
+	if format.field, err = newInfluxTemplate("field", field); err != nil {
+		return nil, err
+	}
+	tags := defaultInfluxTags
+	if len(ic.Tags) > 0 {
+		tags = nil
+		for _, key := range sortedTagKeys(ic.Tags) {
+			tags = append(tags, influxTagConfig{key, ic.Tags[key]})
+		}
+	}
+	for _, tag := range tags {
+		if tag.key == "" || tag.template == "" {
+			return nil, fmt.Errorf("invalid influx template: tags must be key=template pairs, got %q", tag.key)
+		}
+		tmpl, err := newInfluxTemplate("tag "+tag.key, tag.template)
+		if err != nil {
+			return nil, err
+		}
+		format.tags = append(format.tags, influxTag{tag.key, tmpl})
+	}
+	sample := measurement{Prefix: "bandwidth.download", Source: "agent", Destination: "endpoint", Address: "192.0.2.1",
+		Direction: directionDownload, Engine: engineIperf3}
+	if _, err := format.line(sample); err != nil {
+		return nil, fmt.Errorf("invalid influx template: %v", err)
+	}
+	return format, nil
+}
+
+// newInfluxTemplate parses one of the influx templates.
+func newInfluxTemplate(name string, text string) (*template.Template, error) {
+	tmpl, err := template.New(name).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid influx template: %v", err)
+	}
+	return tmpl, nil
+}
+
+// line renders the measurement, tag set and field value of a measurement, without the string fields and the
+// timestamp. Tags rendering an empty value are left out since influx rejects them.
+func (f *influxFormat) line(m measurement) (string, error) {
+	data := influxTemplateData{
+		Prefix:    m.Prefix,
+		Source:    m.Source,
+		Dest:      m.Destination,
+		Address:   m.Address,
+		Direction: m.Direction,
+		Engine:    m.Engine,
+		Metric:    m.Metric,
+		Field:     defaultInfluxField,
+		Version:   version,
+		Tags:      m.Tags,
+	}
+	if m.Metric != "" {
+		data.Field = m.Metric
+	} else {
+		data.Unit = unitOf("influx").name
+	}
+	name, err := renderInflux(f.measurement, data)
+	if err != nil {
+		return "", err
+	}
+	if name == "" {
+		return "", fmt.Errorf("template rendered an empty measurement name")
+	}
+	field, err := renderInflux(f.field, data)
+	if err != nil {
+		return "", err
+	}
+	if field == "" {
+		return "", fmt.Errorf("template rendered an empty field name")
+	}
+
+	line := influxMeasurementEscape(name)
+	written := make(map[string]bool, len(f.tags))
+	for _, tag := range f.tags {
+		value, err := renderInflux(tag.tmpl, data)
+		if err != nil {
+			return "", err
+		}
+		written[tag.key] = true
+		if value != "" {
+			line += fmt.Sprintf(",%s=%s", influxEscape(tag.key), influxEscape(value))
+		}
+	}
+	if f.endpointTags {
+		// a templated tag wins over an endpoint tag of the same key
+		keys := make([]string, 0, len(m.Tags))
+		for k := range m.Tags {
+			if !written[k] && m.Tags[k] != "" {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			line += fmt.Sprintf(",%s=%s", influxEscape(k), influxEscape(m.Tags[k]))
+		}
+	}
+	return fmt.Sprintf("%s %s=%s", line, influxEscape(field), m.formattedValue("influx")), nil
+}
+
+// renderInflux executes one of the influx templates.
+func renderInflux(tmpl *template.Template, data influxTemplateData) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// influxMeasurementEscape escapes the characters that are special in an Influx measurement name.
+func influxMeasurementEscape(value string) string {
+	return strings.NewReplacer(",", "\\,", " ", "\\ ").Replace(value)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"time"
+)
+
+// intervalSample is the bitrate of one reporting interval of a run, one second by default.
+type intervalSample struct {
+	// end is the end of the interval from the start of the run.
+	end time.Duration
+	bps float64
+}
+
+// iperf3Intervals extracts the interval bitrates from an iperf3 JSON report, summed over the parallel streams. The
+// omitted intervals are left out like they are from the result.
+func iperf3Intervals(output string) ([]intervalSample, bool) {
+	report, ok := parseIperf3JSON(output)
+	if !ok {
+		return nil, false
+	}
+	var intervals []intervalSample
+	for _, interval := range report.Intervals {
+		if interval.Sum.Omitted {
+			continue
+		}
+		intervals = append(intervals, intervalSample{
+			end: time.Duration(interval.Sum.End * float64(time.Second)),
+			bps: interval.Sum.BitsPerSecond,
+		})
+	}
+	return intervals, len(intervals) > 0
+}
+
+// sumIntervals adds up the intervals of the clients of a striped run, which ran at the same time. An interval
+// only some of the clients reported is dropped.
+func sumIntervals(stripes [][]intervalSample) []intervalSample {
+	if len(stripes) == 0 {
+		return nil
+	}
+	total := append([]intervalSample(nil), stripes[0]...)
+	for _, stripe := range stripes[1:] {
+		if len(stripe) < len(total) {
+			total = total[:len(stripe)]
+		}
+		for i := range total {
+			total[i].bps += stripe[i].bps
+		}
+	}
+	return total
+}
+
+// recordIntervals records the spread of the interval bitrates of a test's runs with --interval-stats, and every
+// interval at the time it ended with --interval-series, so the bursts and short outages an average hides show up.
+func recordIntervals(config configuration, settings runSettings, eng engine, server perfServer, direction string, prefix string, samples []sample) {
+	var values []float64
+	for _, result := range samples {
+		for _, interval := range result.intervals {
+			values = append(values, interval.bps)
+		}
+	}
+	if len(values) == 0 {
+		return
+	}
+	if settings.intervalStats {
+		min, max := values[0], values[0]
+		for _, value := range values {
+			min, max = math.Min(min, value), math.Max(max, value)
+		}
+		recordTestMetric(config, settings, eng, server, direction, prefix, "interval_min", min)
+		recordTestMetric(config, settings, eng, server, direction, prefix, "interval_max", max)
+		recordTestMetric(config, settings, eng, server, direction, prefix, "interval_stddev", stddev(values))
+	}
+	if !settings.intervalSeries {
+		return
+	}
+	for i, result := range samples {
+		tags := withTag(server.Tags, "engine", eng.name)
+		if len(samples) > 1 {
+			tags = withTag(tags, "sample", strconv.Itoa(i+1))
+		}
+		for _, interval := range result.intervals {
+			recordMeasurement(config, settings, measurement{
+				Timestamp:   result.started.Add(interval.end),
+				Source:      config.Hostname,
+				Destination: server.displayName(),
+				Address:     server.Address,
+				Direction:   direction,
+				Prefix:      prefix + ".interval",
+				Engine:      eng.name,
+				Metric:      "interval_bps",
+				Value:       interval.bps,
+				RunID:       server.runID,
+				Tags:        tags,
+			})
+		}
+	}
+}
+
+// stddev returns the population standard deviation of the values.
+func stddev(values []float64) float64 {
+	avg := mean(values)
+	var squares float64
+	for _, value := range values {
+		squares += (value - avg) * (value - avg)
+	}
+	return math.Sqrt(squares / float64(len(values)))
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// containerAuthKey is where the public key of an endpoint's iperf3 authentication is mounted in a client container.
+const containerAuthKey = "/run/cbandwidth/iperf3-auth.pem"
+
+// iperfAuthConfig authenticates the iperf3 client to a server started with --rsa-private-key-path and
+// --authorized-users-path.
+type iperfAuthConfig struct {
+	Username string `yaml:"username" json:"username"`
+	// Password is passed to the client in IPERF3_PASSWORD, never on its command line.
+	Password string `yaml:"password" json:"-"`
+	// PublicKey is the path of the server's RSA public key in PEM format.
+	PublicKey string `yaml:"public-key" json:"public-key"`
+}
+
+// validateIperfAuth checks an endpoint's iperf3 authentication is complete and tested with an iperf3 client.
+func validateIperfAuth(config configuration, server perfServer) []error {
+	auth := server.Auth
+	if auth == nil {
+		return nil
+	}
+	var errs []error
+	if auth.Username == "" || auth.Password == "" || auth.PublicKey == "" {
+		errs = append(errs, fmt.Errorf("perf server %s auth needs a username, password and public-key", server.Address))
+	}
+	if eng, err := selectEngine(config); err == nil {
+		if name := endpointEngine(eng, server).name; name != engineIperf3 && name != engineSSH {
+			errs = append(errs, fmt.Errorf("perf server %s: the %s engine can't authenticate, auth needs iperf3 or ssh", server.Address, name))
+		}
+	}
+	return errs
+}
+
+// iperfAuthArgv sets the username and public key of an endpoint's iperf3 authentication in the test options. A
+// container client gets the key mounted and the password passed through from the environment of the docker CLI.
+func iperfAuthArgv(clientCmd []string, native bool, server perfServer, opts testOptions) ([]string, testOptions) {
+	if server.Auth == nil {
+		return clientCmd, opts
+	}
+	opts.username, opts.publicKey = server.Auth.Username, server.Auth.PublicKey
+	if !native {
+		key, err := filepath.Abs(server.Auth.PublicKey)
+		if err != nil {
+			key = server.Auth.PublicKey
+		}
+		opts.publicKey = containerAuthKey
+		clientCmd = insertRunArgs(clientCmd, "-v", key+":"+containerAuthKey+":ro", "-e", "IPERF3_PASSWORD")
+	}
+	return clientCmd, opts
+}
+
+// iperfAuthArgs are the iperf3 client arguments of the authentication in the test options.
+func iperfAuthArgs(opts testOptions) []string {
+	if opts.username == "" {
+		return nil
+	}
+	return []string{"--username", opts.username, "--rsa-public-key-path", opts.publicKey}
+}
+
+// clientEnv is the environment the client of an endpoint runs with on top of the agent's, the password of its
+// iperf3 authentication.
+func clientEnv(server perfServer) []string {
+	if server.Auth == nil {
+		return nil
+	}
+	return []string{"IPERF3_PASSWORD=" + server.Auth.Password}
+}
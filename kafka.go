@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+)
+
+const (
+	defaultKafkaTopic = "cloud-bandwidth"
+	kafkaFormatJSON   = "json"
+	kafkaFormatAvro   = "avro"
+)
+
+// avroSchema is the record schema registered with the schema registry when the avro format is used.
+const avroSchema = `{"type":"record","name":"Measurement","namespace":"com.github.nerdalert.cloudbandwidth","fields":[` +
+	`{"name":"timestamp","type":{"type":"long","logicalType":"timestamp-millis"}},` +
+	`{"name":"source","type":"string"},` +
+	`{"name":"destination","type":"string"},` +
+	`{"name":"address","type":"string"},` +
+	`{"name":"direction","type":"string"},` +
+	`{"name":"prefix","type":"string"},` +
+	`{"name":"engine","type":"string"},` +
+	`{"name":"bps","type":"long"},` +
+	`{"name":"metric","type":"string","default":""},` +
+	`{"name":"value","type":"double","default":0},` +
+	`{"name":"tags","type":{"type":"map","values":"string"},"default":{}}]}`
+
+type kafkaConfig struct {
+	Brokers        []string `yaml:"brokers"`
+	Topic          string   `yaml:"topic"`
+	Format         string   `yaml:"format"`
+	SchemaRegistry string   `yaml:"schema-registry"`
+	SASLMechanism  string   `yaml:"sasl-mechanism"`
+	Username       string   `yaml:"username"`
+	Password       string   `yaml:"password"`
+	TLS            bool     `yaml:"tls"`
+	TLSCAFile      string   `yaml:"tls-ca-file"`
+	TLSCertFile    string   `yaml:"tls-cert-file"`
+	TLSKeyFile     string   `yaml:"tls-key-file"`
+	TLSSkipVerify  bool     `yaml:"tls-skip-verify"`
+}
+
+var (
+	kafkaWriter   *kafka.Writer
+	kafkaFormat   string
+	kafkaSchemaID uint32
+)
+
+// mergeKafkaFlags fills any kafka settings missing from the configuration file with the CLI values.
+func mergeKafkaFlags(kc *kafkaConfig) {
+	if len(kc.Brokers) == 0 && cliFlags.kafkaBrokers != "" {
+		kc.Brokers = strings.Split(cliFlags.kafkaBrokers, ",")
+	}
+	if kc.Topic == "" {
+		kc.Topic = cliFlags.kafkaTopic
+	}
+	if kc.Format == "" {
+		kc.Format = cliFlags.kafkaFormat
+	}
+	if kc.SchemaRegistry == "" {
+		kc.SchemaRegistry = cliFlags.kafkaSchemaRegistry
+	}
+	if kc.SASLMechanism == "" {
+		kc.SASLMechanism = cliFlags.kafkaSASLMechanism
+	}
+	if kc.Username == "" {
+		kc.Username = cliFlags.kafkaUsername
+	}
+	if kc.Password == "" {
+		kc.Password = cliFlags.kafkaPassword
+	}
+	if cliFlags.kafkaTLS {
+		kc.TLS = true
+	}
+}
+
+// initKafka sets up the kafka writer if any brokers were configured.
+func initKafka(kc kafkaConfig) error {
+	if len(kc.Brokers) == 0 {
+		return nil
+	}
+	if kc.Topic == "" {
+		kc.Topic = defaultKafkaTopic
+	}
+
+	if err := validateKafkaConfig(kc); err != nil {
+		return err
+	}
+
+	transport := &kafka.Transport{}
+	if kc.TLS {
+		tlsConfig, err := tlsClientConfig(kc.TLSCAFile, kc.TLSCertFile, kc.TLSKeyFile, kc.TLSSkipVerify)
+		if err != nil {
+			return err
+		}
+		transport.TLS = tlsConfig
+	}
+	mechanism, err := kafkaSASLMechanism(kc)
+	if err != nil {
+		return err
+	}
+	transport.SASL = mechanism
+
+	kafkaFormat = kafkaFormatJSON
+	if kc.Format == kafkaFormatAvro {
+		id, err := registerAvroSchema(kc.SchemaRegistry, kc.Topic+"-value")
+		if err != nil {
+			return err
+		}
+		kafkaFormat = kafkaFormatAvro
+		kafkaSchemaID = id
+	}
+
+	kafkaWriter = &kafka.Writer{
+		Addr:      kafka.TCP(kc.Brokers...),
+		Topic:     kc.Topic,
+		Balancer:  &kafka.Hash{},
+		Transport: transport,
+	}
+	log.Debugf("[Config] Kafka Brokers = %s", strings.Join(kc.Brokers, ","))
+	log.Debugf("[Config] Kafka Topic = %s", kc.Topic)
+	log.Debugf("[Config] Kafka Format = %s", kafkaFormat)
+
+	return nil
+}
+
+// validateKafkaConfig checks the kafka settings without connecting to the brokers or schema registry.
+func validateKafkaConfig(kc kafkaConfig) error {
+	switch kc.Format {
+	case "", kafkaFormatJSON:
+	case kafkaFormatAvro:
+		if kc.SchemaRegistry == "" {
+			return fmt.Errorf("kafka format avro requires a schema registry URL")
+		}
+	default:
+		return fmt.Errorf("unsupported kafka format %q, must be json or avro", kc.Format)
+	}
+	_, err := kafkaSASLMechanism(kc)
+	return err
+}
+
+// tlsClientConfig builds a client TLS configuration with an optional CA bundle and client certificate.
+func tlsClientConfig(caFile string, certFile string, keyFile string, skipVerify bool) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: skipVerify}
+	if caFile != "" {
+		caCert, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no valid certificates found in %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// kafkaSASLMechanism returns the SASL mechanism matching the configured name, or nil if none is set.
+func kafkaSASLMechanism(kc kafkaConfig) (sasl.Mechanism, error) {
+	switch strings.ToLower(kc.SASLMechanism) {
+	case "":
+		return nil, nil
+	case "plain":
+		return plain.Mechanism{Username: kc.Username, Password: kc.Password}, nil
+	case "scram-sha-256":
+		return scram.Mechanism(scram.SHA256, kc.Username, kc.Password)
+	case "scram-sha-512":
+		return scram.Mechanism(scram.SHA512, kc.Username, kc.Password)
+	default:
+		return nil, fmt.Errorf("unsupported kafka sasl mechanism %q, must be plain, scram-sha-256 or scram-sha-512", kc.SASLMechanism)
+	}
+}
+
+// sendKafka publishes a measurement to the kafka topic keyed by the endpoint name.
+func sendKafka(m measurement) {
+	value, err := encodeKafkaValue(m)
+	if err != nil {
+		log.Errorf("Error encoding the measurement for kafka: %v", err)
+		return
+	}
+	if cliFlags.debug {
+		log.Infof("Sending the following msg to kafka topic %s: %s", kafkaWriter.Topic, value)
+	}
+	start := time.Now()
+	err = kafkaWriter.WriteMessages(context.Background(), kafka.Message{
+		Key:   []byte(m.Destination),
+		Value: value,
+		// consumers can drop a message delivered twice by the run ID, the avro schema has no field for it
+		Headers: kafkaHeaders(m),
+	})
+	auditWrite("kafka", kafkaWriter.Topic, len(value), start, err)
+	if err != nil {
+		log.Errorf("Error writing to the kafka topic %s: %v", kafkaWriter.Topic, err)
+	}
+}
+
+// kafkaHeaders carries the run ID and the signature of a measurement, the avro schema has no fields for them.
+func kafkaHeaders(m measurement) []kafka.Header {
+	headers := []kafka.Header{{Key: "run-id", Value: []byte(m.RunID)}}
+	if m.Signature != "" {
+		headers = append(headers, kafka.Header{Key: "key-id", Value: []byte(m.KeyID)}, kafka.Header{Key: "signature", Value: []byte(m.Signature)})
+	}
+	return headers
+}
+
+// encodeKafkaValue serializes a measurement in the configured kafka format.
+func encodeKafkaValue(m measurement) ([]byte, error) {
+	if kafkaFormat != kafkaFormatAvro {
+		return json.Marshal(m)
+	}
+
+	// confluent wire format: magic byte, 4 byte schema id, avro binary body.
+	var buf bytes.Buffer
+	buf.WriteByte(0)
+	id := make([]byte, 4)
+	binary.BigEndian.PutUint32(id, kafkaSchemaID)
+	buf.Write(id)
+
+	avroLong(&buf, m.Timestamp.UnixNano()/1e6)
+	avroString(&buf, m.Source)
+	avroString(&buf, m.Destination)
+	avroString(&buf, m.Address)
+	avroString(&buf, m.Direction)
+	avroString(&buf, m.Prefix)
+	avroString(&buf, m.Engine)
+	avroLong(&buf, m.Bps)
+	avroString(&buf, m.Metric)
+	avroDouble(&buf, m.Value)
+	avroMap(&buf, m.Tags)
+
+	return buf.Bytes(), nil
+}
+
+// avroLong writes a zig-zag varint encoded avro long.
+func avroLong(buf *bytes.Buffer, v int64) {
+	b := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutVarint(b, v)
+	buf.Write(b[:n])
+}
+
+// avroDouble writes a little endian IEEE 754 avro double.
+func avroDouble(buf *bytes.Buffer, v float64) {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, math.Float64bits(v))
+	buf.Write(b)
+}
+
+// avroString writes a length prefixed avro string.
+func avroString(buf *bytes.Buffer, s string) {
+	avroLong(buf, int64(len(s)))
+	buf.WriteString(s)
+}
+
+// avroMap writes a string map as a single avro block followed by the terminating empty block.
+func avroMap(buf *bytes.Buffer, values map[string]string) {
+	if len(values) > 0 {
+		avroLong(buf, int64(len(values)))
+		for _, k := range sortedTagKeys(values) {
+			avroString(buf, k)
+			avroString(buf, values[k])
+		}
+	}
+	avroLong(buf, 0)
+}
+
+// registerAvroSchema registers the measurement schema under the given subject and returns its id.
+func registerAvroSchema(registryURL string, subject string) (uint32, error) {
+	body, err := json.Marshal(map[string]string{"schema": avroSchema})
+	if err != nil {
+		return 0, err
+	}
+	url := fmt.Sprintf("%s/subjects/%s/versions", strings.TrimRight(registryURL, "/"), subject)
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+	resp, err := auditedDo(http.DefaultClient, "schema-registry", req)
+	if err != nil {
+		return 0, fmt.Errorf("could not connect to the schema registry at %s: %v", registryURL, err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("schema registry returned %s: %s", resp.Status, respBody)
+	}
+
+	var result struct {
+		ID uint32 `json:"id"`
+	}
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return 0, err
+	}
+	log.Debugf("[Config] Kafka Avro Schema ID = %d", result.ID)
+	return result.ID, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// labelTags are the --label tags added to every measurement of the agent, e.g. the deployment or site injected
+// by an orchestrator.
+var labelTags map[string]string
+
+// parseLabels parses key=value labels.
+func parseLabels(labels []string) (map[string]string, error) {
+	tags := make(map[string]string, len(labels))
+	for _, label := range labels {
+		kv := strings.SplitN(label, "=", 2)
+		key := strings.TrimSpace(kv[0])
+		if len(kv) != 2 || key == "" {
+			return nil, fmt.Errorf("label %q must be a key=value pair", label)
+		}
+		tags[key] = strings.TrimSpace(kv[1])
+	}
+	return tags, nil
+}
+
+// initLabels sets up the --label tags.
+func initLabels() error {
+	tags, err := parseLabels(cliFlags.labels.Value())
+	if err != nil {
+		return err
+	}
+	labelTags = tags
+	for _, key := range sortedTagKeys(labelTags) {
+		log.Debugf("[Config] Label %s = %s", key, labelTags[key])
+	}
+	return nil
+}
+
+// withLabels adds the --label tags to a measurement's tags, tags already set are kept.
+func withLabels(tags map[string]string) map[string]string {
+	return withDefaultTags(tags, labelTags)
+}
+
+// withDefaultTags returns the tags with any defaults they don't set, the tags themselves if there are none.
+func withDefaultTags(tags map[string]string, defaults map[string]string) map[string]string {
+	if len(defaults) == 0 {
+		return tags
+	}
+	tagged := make(map[string]string, len(tags)+len(defaults))
+	for k, v := range defaults {
+		tagged[k] = v
+	}
+	for k, v := range tags {
+		tagged[k] = v
+	}
+	return tagged
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	defaultLatencyPrefix = "bandwidth.latency"
+	latencyProbeInterval = 200 * time.Millisecond
+	latencyProbeTimeout  = time.Second
+)
+
+// pingNetworks holds the ICMP socket type usable by this process for each address family, detected once.
+var pingNetworks struct {
+	sync.Once
+	v4, v6 string
+}
+
+// detectPingNetworks picks privileged raw ICMP sockets when the process has CAP_NET_RAW or runs as root and falls
+// back to the unprivileged ICMP datagram sockets of Linux and macOS otherwise, so the agent can run as a non-root
+// container. Windows has no unprivileged ICMP sockets and only opens raw ones for administrators, an agent that
+// isn't elevated has no latency probes.
+func detectPingNetworks() {
+	pingNetworks.v4 = firstPingNetwork([]string{"ip4:icmp", "udp4"}, "0.0.0.0")
+	pingNetworks.v6 = firstPingNetwork([]string{"ip6:ipv6-icmp", "udp6"}, "::")
+	switch pingNetworks.v4 {
+	case "ip4:icmp":
+		log.Debug("[Config] Latency Probes = privileged ICMP")
+	case "udp4":
+		log.Debug("[Config] Latency Probes = unprivileged ICMP")
+	default:
+		if runtime.GOOS == "windows" {
+			log.Errorf("No ICMP socket is available for the latency probes, run the agent as an administrator")
+			return
+		}
+		log.Errorf("No ICMP socket is available for the latency probes, grant the agent CAP_NET_RAW or allow its group unprivileged ping with sysctl net.ipv4.ping_group_range")
+	}
+}
+
+// firstPingNetwork returns the first network an ICMP socket can be opened on, empty if none.
+func firstPingNetwork(networks []string, listen string) string {
+	for _, network := range networks {
+		// the ICMP datagram sockets are a Linux and macOS feature, Windows only has the raw sockets
+		if runtime.GOOS == "windows" && network[:3] == "udp" {
+			continue
+		}
+		conn, err := icmp.ListenPacket(network, listen)
+		if err != nil {
+			log.Debugf("ICMP %s socket unavailable: %v", network, err)
+			continue
+		}
+		conn.Close()
+		return network
+	}
+	return ""
+}
+
+// probeLatency pings an endpoint latency-count times and records the average round trip time, the jitter
+// between consecutive replies and the percentage of probes lost.
+func probeLatency(config configuration, settings runSettings, server perfServer) {
+	count, _ := strconv.Atoi(cliFlags.latencyCount)
+	if settings.dryRun {
+		log.Infof("[DRY RUN] Would ping %s [%s] %d times", server.Address, server.displayName(), count)
+		return
+	}
+	if server.Tunnel != nil {
+		log.Debugf("Skipping the latency probes to %s [%s], ICMP can't be sent through its tunnel", server.Address, server.displayName())
+		return
+	}
+	pingNetworks.Do(detectPingNetworks)
+
+	var rtts []time.Duration
+	var err error
+	if nsErr := inNetns(server.Netns, func() { rtts, err = ping(server.dialAddress(), server.bindAddress, count) }); nsErr != nil {
+		err = nsErr
+	}
+	if err != nil {
+		log.Errorf("Error probing the latency to %s [%s]: %v", server.Address, server.displayName(), err)
+		return
+	}
+	loss := float64(count-len(rtts)) / float64(count) * 100
+	runID := newRunID()
+	log.Infof("Latency to %s [%s]: %d/%d replies %v (run %s)", server.Address, server.displayName(), len(rtts), count, rtts, runID)
+
+	record := func(name string, metric string, value float64) {
+		recordMeasurement(config, settings, measurement{
+			Timestamp:   measurementTime(),
+			Source:      config.Hostname,
+			Destination: server.displayName(),
+			Address:     server.Address,
+			Prefix:      cliFlags.latencyPrefix + "." + name,
+			Metric:      metric,
+			Value:       value,
+			RunID:       runID,
+			Tags:        server.Tags,
+		})
+	}
+	record("loss", "loss_pct", loss)
+	if len(rtts) == 0 {
+		return
+	}
+	var sum, jitter time.Duration
+	for i, rtt := range rtts {
+		sum += rtt
+		if i > 0 {
+			diff := rtt - rtts[i-1]
+			if diff < 0 {
+				diff = -diff
+			}
+			jitter += diff
+		}
+	}
+	record("rtt", "rtt_ms", durationMillis(sum/time.Duration(len(rtts))))
+	if len(rtts) > 1 {
+		record("jitter", "jitter_ms", durationMillis(jitter/time.Duration(len(rtts)-1)))
+	}
+}
+
+// ping sends count ICMP echo requests to an address from a source address, any with an empty one, and returns the
+// round trip time of every reply received.
+func ping(address string, source string, count int) ([]time.Duration, error) {
+	ip, err := net.ResolveIPAddr("ip", address)
+	if err != nil {
+		return nil, err
+	}
+	network, listen, protocol := pingNetworks.v4, "0.0.0.0", 1
+	var requestType, replyType icmp.Type = ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply
+	if ip.IP.To4() == nil {
+		network, listen, protocol = pingNetworks.v6, "::", 58
+		requestType, replyType = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+	}
+	if network == "" {
+		return nil, fmt.Errorf("no ICMP socket is available")
+	}
+	if source != "" {
+		listen = source
+	}
+	conn, err := icmp.ListenPacket(network, listen)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var target net.Addr = ip
+	privileged := network[:3] != "udp"
+	if !privileged {
+		target = &net.UDPAddr{IP: ip.IP, Zone: ip.Zone}
+	}
+	// the kernel replaces the ID of unprivileged echo requests, replies are matched by their sequence
+	id := rand.Intn(0xffff)
+	var rtts []time.Duration
+	buf := make([]byte, 1500)
+	for seq := 1; seq <= count; seq++ {
+		request, err := (&icmp.Message{
+			Type: requestType,
+			Body: &icmp.Echo{ID: id, Seq: seq, Data: []byte("cloud-bandwidth")},
+		}).Marshal(nil)
+		if err != nil {
+			return nil, err
+		}
+		sent := time.Now()
+		if _, err := conn.WriteTo(request, target); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(sent.Add(latencyProbeTimeout))
+		for {
+			n, peer, err := conn.ReadFrom(buf)
+			if err != nil {
+				log.Debugf("No reply from %s to ICMP seq %d: %v", address, seq, err)
+				break
+			}
+			reply, err := icmp.ParseMessage(protocol, buf[:n])
+			if err != nil || reply.Type != replyType {
+				continue
+			}
+			echo, ok := reply.Body.(*icmp.Echo)
+			if !ok || echo.Seq != seq || (privileged && echo.ID != id) || !samePeer(peer, ip.IP) {
+				continue
+			}
+			rtts = append(rtts, time.Since(sent))
+			break
+		}
+		if seq < count {
+			time.Sleep(time.Until(sent.Add(latencyProbeInterval)))
+		}
+	}
+	return rtts, nil
+}
+
+// samePeer reports whether a reply came from the pinged address.
+func samePeer(peer net.Addr, ip net.IP) bool {
+	switch addr := peer.(type) {
+	case *net.IPAddr:
+		return addr.IP.Equal(ip)
+	case *net.UDPAddr:
+		return addr.IP.Equal(ip)
+	}
+	return false
+}
+
+// durationMillis converts a duration to fractional milliseconds.
+func durationMillis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// latestResult is the last result of an endpoint in a direction with an engine, served at /latest.
+type latestResult struct {
+	Endpoint  string    `json:"endpoint"`
+	Address   string    `json:"address"`
+	Profile   string    `json:"profile,omitempty"`
+	Group     string    `json:"group,omitempty"`
+	Direction string    `json:"direction"`
+	Engine    string    `json:"engine"`
+	Bps       int64     `json:"bps"`
+	Timestamp time.Time `json:"timestamp"`
+	RunID     string    `json:"run-id"`
+	// Previous is the result before this one and DeltaPercent the change from it, unset on the first result.
+	Previous     *int64   `json:"previous-bps,omitempty"`
+	DeltaPercent *float64 `json:"delta-percent,omitempty"`
+	// Metrics are the companion metrics of the result such as retransmits or jitter_ms, by metric name.
+	Metrics map[string]float64 `json:"metrics,omitempty"`
+	// tenant is the tenant of the result, its results are cached for the anomaly checks but not served.
+	tenant string
+}
+
+// latestResults caches the last result per tenant or group, endpoint, profile, direction and engine. The tests
+// write it while the API, the top command and the anomaly checks read it.
+var latestResults = struct {
+	sync.RWMutex
+	results map[string]*latestResult
+}{results: make(map[string]*latestResult)}
+
+// latestKey identifies the results of an endpoint the same way as perfServer.resultKey, per direction and engine.
+func latestKey(scope string, address string, profile string, direction string, engine string) string {
+	key := address
+	if profile != "" {
+		key += "|" + profile
+	}
+	if scope != "" {
+		key = scope + "|" + key
+	}
+	return key + "|" + direction + "|" + engine
+}
+
+// recordLatest caches a result, or a companion metric of the cached result with the same run ID.
+func recordLatest(m measurement) {
+	if m.Direction != directionDownload && m.Direction != directionUpload {
+		return
+	}
+	key := latestKey(resultScope(m.Tags), m.Address, m.Tags["profile"], m.Direction, m.Engine)
+	latestResults.Lock()
+	defer latestResults.Unlock()
+	current := latestResults.results[key]
+	if m.Metric != "" {
+		if current != nil && current.RunID == m.RunID {
+			current.Metrics[m.Metric] = m.Value
+		}
+		return
+	}
+	result := &latestResult{
+		Endpoint:  m.Destination,
+		Address:   m.Address,
+		Profile:   m.Tags["profile"],
+		Group:     m.Tags["group"],
+		Direction: m.Direction,
+		Engine:    m.Engine,
+		Bps:       m.Bps,
+		Timestamp: m.Timestamp,
+		RunID:     m.RunID,
+		Metrics:   make(map[string]float64),
+		tenant:    m.Tags["tenant"],
+	}
+	if current != nil {
+		previous := current.Bps
+		result.Previous = &previous
+		if previous > 0 {
+			delta := float64(m.Bps-previous) / float64(previous) * 100
+			result.DeltaPercent = &delta
+		}
+	}
+	latestResults.results[key] = result
+}
+
+// latestDelta returns the change in percent of the last result of an endpoint from the one before it.
+func latestDelta(server perfServer, direction string, engine string) (float64, bool) {
+	profile := ""
+	if server.profile != nil {
+		profile = server.profile.Name
+	}
+	latestResults.RLock()
+	defer latestResults.RUnlock()
+	result := latestResults.results[latestKey(resultScope(server.Tags), server.Address, profile, direction, engine)]
+	if result == nil || result.DeltaPercent == nil {
+		return 0, false
+	}
+	return *result.DeltaPercent, true
+}
+
+// currentLatest returns a copy of the cached results for the API, sorted by endpoint, group, direction and engine.
+// The results of the tenants are left out.
+func currentLatest() []latestResult {
+	latestResults.RLock()
+	defer latestResults.RUnlock()
+	results := make([]latestResult, 0, len(latestResults.results))
+	for _, result := range latestResults.results {
+		if result.tenant != "" {
+			continue
+		}
+		copied := *result
+		copied.Metrics = make(map[string]float64, len(result.Metrics))
+		for name, value := range result.Metrics {
+			copied.Metrics[name] = value
+		}
+		results = append(results, copied)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if a.Endpoint != b.Endpoint {
+			return a.Endpoint < b.Endpoint
+		}
+		if a.Address != b.Address {
+			return a.Address < b.Address
+		}
+		if a.Profile != b.Profile {
+			return a.Profile < b.Profile
+		}
+		if a.Group != b.Group {
+			return a.Group < b.Group
+		}
+		if a.Direction != b.Direction {
+			return a.Direction < b.Direction
+		}
+		return a.Engine < b.Engine
+	})
+	return results
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// logFile is the rotating log file while --log-file is set.
+var logFile *lumberjack.Logger
+
+// configureLogging applies the log level, format and file settings to the logger. --debug is kept as a shortcut
+// for --log-level=debug. It runs again after the configuration file is read since it can set them too.
+func configureLogging() error {
+	level := logrus.InfoLevel
+	if cliFlags.logLevel != "" {
+		parsed, err := logrus.ParseLevel(cliFlags.logLevel)
+		if err != nil {
+			return fmt.Errorf("log-level must be trace, debug, info, warn or error, got %q", cliFlags.logLevel)
+		}
+		level = parsed
+	}
+	if cliFlags.debug && level < logrus.DebugLevel {
+		level = logrus.DebugLevel
+	}
+	log.SetLevel(level)
+
+	switch cliFlags.logFormat {
+	case "", logFormatText:
+		log.SetFormatter(&logrus.TextFormatter{})
+	case logFormatJSON:
+		log.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return fmt.Errorf("log-format must be text or json, got %q", cliFlags.logFormat)
+	}
+
+	if cliFlags.logFile == "" {
+		log.SetOutput(os.Stderr)
+		return nil
+	}
+	maxSize, err := strconv.Atoi(cliFlags.logMaxSize)
+	if err != nil || maxSize <= 0 {
+		return fmt.Errorf("log-max-size must be a positive number of megabytes, got %q", cliFlags.logMaxSize)
+	}
+	maxBackups, err := strconv.Atoi(cliFlags.logMaxBackups)
+	if err != nil || maxBackups < 0 {
+		return fmt.Errorf("log-max-backups must be zero or a positive number, got %q", cliFlags.logMaxBackups)
+	}
+	if logFile != nil && logFile.Filename == cliFlags.logFile {
+		logFile.MaxSize, logFile.MaxBackups = maxSize, maxBackups
+		return nil
+	}
+	if logFile != nil {
+		logFile.Close()
+	}
+	logFile = &lumberjack.Logger{
+		Filename:   cliFlags.logFile,
+		MaxSize:    maxSize,
+		MaxBackups: maxBackups,
+		Compress:   true,
+	}
+	log.SetOutput(logFile)
+	return nil
+}
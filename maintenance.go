@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxMaintenanceDuration bounds a recurring window so looking back for its start stays cheap.
+const maxMaintenanceDuration = 7 * 24 * time.Hour
+
+// maintenanceWindow is a planned maintenance during which the tests are skipped, either recurring from a cron
+// expression for a duration or a single range of RFC 3339 times. It applies to every endpoint unless endpoints
+// are listed.
+type maintenanceWindow struct {
+	Name string `yaml:"name"`
+	// Cron is a five field minute, hour, day of month, month and day of week expression of the window's start.
+	Cron     string `yaml:"cron"`
+	Duration string `yaml:"duration"`
+	Start    string `yaml:"start"`
+	End      string `yaml:"end"`
+	// Timezone is the IANA zone the cron expression is evaluated in, the agent's local time if empty.
+	Timezone string `yaml:"timezone"`
+	// Endpoints are the names or addresses of the endpoints under maintenance, every endpoint if empty.
+	Endpoints []string `yaml:"endpoints"`
+}
+
+// maintenanceSchedule is a parsed maintenance window.
+type maintenanceSchedule struct {
+	window   maintenanceWindow
+	cron     *cronSchedule
+	duration time.Duration
+	location *time.Location
+	start    time.Time
+	end      time.Time
+}
+
+// maintenance are the parsed maintenance windows, set up when the agent starts.
+var maintenance []maintenanceSchedule
+
+// cronSchedule holds the values each field of a cron expression matches.
+type cronSchedule struct {
+	minute, hour, dom, month, dow []bool
+	// domAny and dowAny record an unrestricted day field, cron matches either day field when both are set.
+	domAny, dowAny bool
+}
+
+// initMaintenance parses the maintenance windows.
+func initMaintenance(windows []maintenanceWindow) error {
+	maintenance = nil
+	for i, window := range windows {
+		schedule, err := parseMaintenanceWindow(window)
+		if err != nil {
+			return fmt.Errorf("maintenance window %s: %v", maintenanceName(window, i), err)
+		}
+		maintenance = append(maintenance, schedule)
+		log.Debugf("[Config] Maintenance Window = %s", maintenanceName(window, i))
+	}
+	return nil
+}
+
+// maintenanceName names a window in messages, by its position if it has no name.
+func maintenanceName(window maintenanceWindow, i int) string {
+	if window.Name != "" {
+		return window.Name
+	}
+	return strconv.Itoa(i + 1)
+}
+
+// parseMaintenanceWindow checks a window is either a cron expression with a duration or a start and end time.
+func parseMaintenanceWindow(window maintenanceWindow) (maintenanceSchedule, error) {
+	schedule := maintenanceSchedule{window: window, location: time.Local}
+	if window.Timezone != "" {
+		location, err := time.LoadLocation(window.Timezone)
+		if err != nil {
+			return schedule, fmt.Errorf("unknown timezone %q", window.Timezone)
+		}
+		schedule.location = location
+	}
+	switch {
+	case window.Cron != "" && (window.Start != "" || window.End != ""):
+		return schedule, fmt.Errorf("set either cron and duration or start and end")
+	case window.Cron != "":
+		cron, err := parseCron(window.Cron)
+		if err != nil {
+			return schedule, err
+		}
+		duration, err := time.ParseDuration(window.Duration)
+		if err != nil || duration < time.Minute || duration > maxMaintenanceDuration {
+			return schedule, fmt.Errorf("duration must be between 1m and 168h, got %q", window.Duration)
+		}
+		schedule.cron, schedule.duration = cron, duration
+	case window.Start != "" && window.End != "":
+		var err error
+		if schedule.start, err = time.Parse(time.RFC3339, window.Start); err != nil {
+			return schedule, fmt.Errorf("start must be an RFC 3339 time such as 2026-11-01T22:00:00Z, got %q", window.Start)
+		}
+		if schedule.end, err = time.Parse(time.RFC3339, window.End); err != nil {
+			return schedule, fmt.Errorf("end must be an RFC 3339 time such as 2026-11-02T04:00:00Z, got %q", window.End)
+		}
+		if !schedule.end.After(schedule.start) {
+			return schedule, fmt.Errorf("end %s is not after start %s", window.End, window.Start)
+		}
+	default:
+		return schedule, fmt.Errorf("set either cron and duration or start and end")
+	}
+	return schedule, nil
+}
+
+// active reports whether the window is open at a time. A recurring window is open if it started within its
+// duration before the time.
+func (s maintenanceSchedule) active(t time.Time) bool {
+	if s.cron == nil {
+		return !t.Before(s.start) && t.Before(s.end)
+	}
+	minute := t.In(s.location).Truncate(time.Minute)
+	for elapsed := time.Duration(0); elapsed < s.duration; elapsed += time.Minute {
+		if s.cron.matches(minute.Add(-elapsed)) {
+			return true
+		}
+	}
+	return false
+}
+
+// covers reports whether the window applies to an endpoint.
+func (s maintenanceSchedule) covers(server perfServer) bool {
+	if len(s.window.Endpoints) == 0 {
+		return true
+	}
+	return containsString(s.window.Endpoints, server.Address) || (server.Name != "" && containsString(s.window.Endpoints, server.Name))
+}
+
+// activeMaintenance returns the name of the maintenance window an endpoint is in, false if there is none.
+func activeMaintenance(server perfServer, now time.Time) (string, bool) {
+	for i, schedule := range maintenance {
+		if schedule.covers(server) && schedule.active(now) {
+			return maintenanceName(schedule.window, i), true
+		}
+	}
+	return "", false
+}
+
+// suppressTests records the suppressed marker of an endpoint skipped for maintenance in each direction, tagged
+// with the window's name.
+func suppressTests(config configuration, settings runSettings, eng engine, server perfServer, window string) {
+	log.Infof("Skipping the tests to %s [%s], it is in the maintenance window %s", server.Address, server.displayName(), window)
+	server.Tags = withTag(server.Tags, "maintenance", window)
+	server.runID = newRunID()
+	recordTestMetric(config, settings, eng, server, directionDownload, settings.downloadPrefix, "suppressed", 1)
+	if eng.upload {
+		recordTestMetric(config, settings, eng, server, directionUpload, settings.uploadPrefix, "suppressed", 1)
+	}
+}
+
+// validateMaintenance checks every maintenance window parses.
+func validateMaintenance(windows []maintenanceWindow) []error {
+	var errs []error
+	for i, window := range windows {
+		if _, err := parseMaintenanceWindow(window); err != nil {
+			errs = append(errs, fmt.Errorf("maintenance window %s: %v", maintenanceName(window, i), err))
+		}
+	}
+	return errs
+}
+
+// parseCron parses a five field cron expression. Each field is *, a value, a range a-b or a list of them, with
+// an optional /step. Sunday is 0 or 7 in the day of week field.
+func parseCron(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron %q must have five fields: minute hour day-of-month month day-of-week", expr)
+	}
+	var cron cronSchedule
+	var err error
+	if cron.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("cron %q minute: %v", expr, err)
+	}
+	if cron.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("cron %q hour: %v", expr, err)
+	}
+	if cron.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("cron %q day of month: %v", expr, err)
+	}
+	if cron.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("cron %q month: %v", expr, err)
+	}
+	if cron.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("cron %q day of week: %v", expr, err)
+	}
+	cron.dow[0] = cron.dow[0] || cron.dow[7]
+	cron.domAny, cron.dowAny = fields[2] == "*", fields[4] == "*"
+	return &cron, nil
+}
+
+// parseCronField returns the values from min to max a cron field matches, indexed by value.
+func parseCronField(field string, min int, max int) ([]bool, error) {
+	values := make([]bool, max+1)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return nil, fmt.Errorf("invalid step in %q", part)
+			}
+			part = part[:i]
+		}
+		low, high := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if low, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("invalid value %q", part)
+			}
+			high = low
+			if len(bounds) == 2 {
+				if high, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("invalid range %q", part)
+				}
+			} else if step > 1 {
+				// a/n runs from a to the end of the field
+				high = max
+			}
+		}
+		if low < min || high > max || low > high {
+			return nil, fmt.Errorf("%q is out of the range %d-%d", part, min, max)
+		}
+		for v := low; v <= high; v += step {
+			values[v] = true
+		}
+	}
+	return values, nil
+}
+
+// matches reports whether a minute matches the cron expression.
+func (c *cronSchedule) matches(t time.Time) bool {
+	if !c.minute[t.Minute()] || !c.hour[t.Hour()] || !c.month[int(t.Month())] {
+		return false
+	}
+	dom, dow := c.dom[t.Day()], c.dow[int(t.Weekday())]
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/template"
+	"time"
+)
+
+const (
+	directionDownload = "download"
+	directionUpload   = "upload"
+)
+
+// graphiteTemplate renders the graphite metric path when graphite-template is configured.
+var graphiteTemplate *template.Template
+
+// graphitePathData is the data available to the graphite-template, every value except the prefix
+// is sanitized to a single path segment.
+type graphitePathData struct {
+	Prefix    string
+	Source    string
+	Dest      string
+	Address   string
+	Direction string
+	Engine    string
+	Metric    string
+	Tags      map[string]string
+}
+
+// measurement is a single bandwidth result for one endpoint and direction. Companion metrics
+// such as path changes set Metric and Value instead of Bps.
+type measurement struct {
+	Timestamp   time.Time `json:"timestamp"`
+	Source      string    `json:"source"`
+	Destination string    `json:"destination"`
+	Address     string    `json:"address"`
+	Direction   string    `json:"direction"`
+	Prefix      string    `json:"prefix"`
+	Engine      string    `json:"engine"`
+	Bps         int64     `json:"bps"`
+	Metric      string    `json:"metric,omitempty"`
+	Value       float64   `json:"value,omitempty"`
+	// RunID identifies the test execution the measurement came from, a result and its companion
+	// metrics share it. Sinks use it to recognize a measurement written again by a retry.
+	RunID string `json:"run-id,omitempty"`
+	// RawID references the stored raw client output the result was read from.
+	RawID string            `json:"raw-id,omitempty"`
+	Tags  map[string]string `json:"tags,omitempty"`
+	// KeyID is the fingerprint of the public key of the agent that signed the measurement, Signature the
+	// base64 Ed25519 signature of the measurement without it.
+	KeyID     string `json:"key-id,omitempty"`
+	Signature string `json:"signature,omitempty"`
+}
+
+// newRunID returns a random ID for a test execution.
+func newRunID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(id)
+}
+
+// key identifies a measurement across retries, the metric is part of it since companion metrics share the run ID.
+func (m measurement) key() string {
+	return m.RunID + "|" + m.Prefix + "|" + m.Metric
+}
+
+// formattedValue returns the bandwidth for bandwidth results in the unit of the sink, or the companion metric value.
+func (m measurement) formattedValue(sink string) string {
+	if m.Metric == "" {
+		return unitOf(sink).format(m.Bps)
+	}
+	return strconv.FormatFloat(m.Value, 'f', -1, 64)
+}
+
+// recordMeasurement writes a measurement to the configured tsdb and any additional sinks.
+func recordMeasurement(config configuration, settings runSettings, m measurement) {
+	// results pushed by agents to a controller were tagged by the agent that measured them
+	if m.Source == config.Hostname {
+		m.Tags = withLabels(withCloudTags(m.Tags))
+	}
+	if m.RunID == "" {
+		m.RunID = newRunID()
+	}
+	if signer != nil {
+		m = signer.sign(m)
+	}
+	// a tenant's results stay out of the status API, /latest and the gRPC stream, the operator's views
+	tenant := config.tenant()
+	if tenant == nil {
+		recordStatus(m)
+	}
+	recordLatest(m)
+	if settings.dryRun {
+		if settings.tsdbType != "influx" {
+			log.Infof("[DRY RUN] Would send to graphite at %s -> %s", config.GraphiteHostPort, strings.TrimSpace(graphiteLine(config, m)))
+		} else {
+			log.Infof("[DRY RUN] Would send to influx at %s -> %s", config.InfluxURL, influxLine(config, m))
+		}
+		return
+	}
+	if streams != nil && tenant == nil {
+		streams.publish(m)
+	}
+	// agents of a controller push their results to it, the controller writes them to its sinks
+	if controller != nil {
+		controller.add(m)
+		return
+	}
+	// a tenant's results go to its own tsdb, the results of an endpoint group can be limited to some of the sinks
+	if tenant != nil && tenantSinks[tenant.Name] != nil {
+		tenantSinks[tenant.Name].add(config, m)
+	}
+	if config.sinkEnabled(sinkTSDB) {
+		if graphiteWriter != nil {
+			graphiteWriter.add(graphitePointOf(config, m))
+		} else if influxWriter != nil {
+			influxWriter.add(influxLine(config, m), m.RunID)
+		}
+	}
+	if kafkaWriter != nil && config.sinkEnabled(sinkKafka) {
+		sendKafka(m)
+	}
+	if elastic != nil && config.sinkEnabled(sinkElasticsearch) {
+		elastic.add(m)
+	}
+	if files != nil && config.sinkEnabled(sinkFile) {
+		files.add(m)
+	}
+	if pushgateway != nil && config.sinkEnabled(sinkPushgateway) {
+		pushgateway.add(m)
+	}
+	if broker != nil && config.sinkEnabled(sinkBroker) {
+		broker.publish(m)
+	}
+	if webhook != nil && config.sinkEnabled(sinkWebhook) {
+		webhook.add(m)
+	}
+	if zabbix != nil && config.sinkEnabled(sinkZabbix) {
+		zabbix.add(m)
+	}
+	if netdata != nil && config.sinkEnabled(sinkNetdata) {
+		netdata.add(config, m)
+	}
+	if textfile != nil && config.sinkEnabled(sinkTextfile) {
+		textfile.add(m)
+	}
+}
+
+// flushSinks writes out any measurements batched by the sinks, called at the end of every cycle.
+func flushSinks() {
+	if files != nil {
+		files.flush()
+	}
+	if graphiteWriter != nil {
+		graphiteWriter.flush()
+	}
+	if influxWriter != nil {
+		influxWriter.flush()
+	}
+	if elastic != nil {
+		elastic.flush()
+	}
+	if annotations != nil {
+		annotations.flush()
+	}
+	if controller != nil {
+		controller.flush()
+	}
+	if pushgateway != nil {
+		pushgateway.flush()
+	}
+	if broker != nil {
+		broker.flush()
+	}
+	if webhook != nil {
+		webhook.flush()
+	}
+	if zabbix != nil {
+		zabbix.flush()
+	}
+	if netdata != nil {
+		netdata.flush()
+	}
+	if textfile != nil {
+		textfile.flush()
+	}
+	for _, sink := range tenantSinks {
+		sink.flush()
+	}
+}
+
+// closeSinks flushes any batched measurements and closes the sinks holding open files or connections.
+func closeSinks() {
+	flushSinks()
+	if files != nil {
+		files.close()
+	}
+	if pushgateway != nil && pushgateway.config.DeleteOnShutdown {
+		pushgateway.deleteGroups()
+	}
+	if broker != nil {
+		broker.close()
+	}
+	if kafkaWriter != nil {
+		if err := kafkaWriter.Close(); err != nil {
+			log.Errorf("Error closing the kafka writer: %v", err)
+		}
+	}
+}
+
+// closeSinksOnSignal closes the sinks when the agent is stopped so no batched measurements are lost
+// and parquet files are left readable.
+func closeSinksOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Infof("Received %s, closing the sinks", sig)
+		closeSinks()
+		os.Exit(0)
+	}()
+}
+
+// graphiteLine formats a measurement in the graphite plaintext protocol.
+func graphiteLine(config configuration, m measurement) string {
+	return graphitePointOf(config, m).line()
+}
+
+// graphitePath renders the metric path of a measurement from the graphite-template if one is set, otherwise any
+// tags listed in graphite-tags are inserted as path segments between the prefix and the endpoint name. With the
+// tagged graphite-format it's a tagged series instead.
+func graphitePath(config configuration, m measurement) string {
+	if cliFlags.graphiteFormat == graphiteFormatTagged {
+		return graphiteSeries(m)
+	}
+	if graphiteTemplate != nil {
+		path, err := renderGraphitePath(graphiteTemplate, m)
+		if err != nil {
+			log.Errorf("Error rendering the graphite template, falling back to the default path: %v", err)
+		} else {
+			return path
+		}
+	}
+	path := m.Prefix
+	for _, key := range config.GraphiteTags {
+		if value, ok := m.Tags[key]; ok {
+			path += "." + graphiteSegment(value)
+		}
+	}
+	return path + "." + m.Destination
+}
+
+// parseGraphiteTemplate parses the graphite-template and verifies it renders against a sample measurement.
+func parseGraphiteTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("graphite").Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid graphite template: %v", err)
+	}
+	sample := measurement{Prefix: "bandwidth.download", Source: "agent", Destination: "endpoint", Direction: directionDownload}
+	if _, err := renderGraphitePath(tmpl, sample); err != nil {
+		return nil, fmt.Errorf("invalid graphite template: %v", err)
+	}
+	return tmpl, nil
+}
+
+// renderGraphitePath executes the graphite template for a measurement.
+func renderGraphitePath(tmpl *template.Template, m measurement) (string, error) {
+	data := graphitePathData{
+		Prefix:    m.Prefix,
+		Source:    graphiteSegment(m.Source),
+		Dest:      graphiteSegment(m.Destination),
+		Address:   graphiteSegment(m.Address),
+		Direction: m.Direction,
+		Engine:    m.Engine,
+		Metric:    m.Metric,
+		Tags:      make(map[string]string, len(m.Tags)),
+	}
+	for k, v := range m.Tags {
+		data.Tags[k] = graphiteSegment(v)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	path := strings.TrimSpace(buf.String())
+	if path == "" {
+		return "", fmt.Errorf("template rendered an empty metric path")
+	}
+	return path, nil
+}
+
+// graphiteSeries renders a measurement as a Graphite 1.1 tagged series, the prefix or the rendered graphite-template
+// tagged with the same dimensions written to influx: the source, destination, address, direction, engine, the unit of
+// a bandwidth result and the tags of the measurement. The built-in tags win over a measurement tag of the same name,
+// and name is left out as graphite reserves it for the series name.
+func graphiteSeries(m measurement) string {
+	name := m.Prefix
+	if graphiteTemplate != nil {
+		path, err := renderGraphitePath(graphiteTemplate, m)
+		if err != nil {
+			log.Errorf("Error rendering the graphite template, falling back to the prefix: %v", err)
+		} else {
+			name = path
+		}
+	}
+	tags := map[string]string{
+		"source":    m.Source,
+		"dest":      m.Destination,
+		"address":   m.Address,
+		"direction": m.Direction,
+		"engine":    m.Engine,
+	}
+	if m.Metric == "" {
+		tags["unit"] = unitOf("graphite").name
+	}
+	for key, value := range m.Tags {
+		if _, ok := tags[key]; !ok && key != "name" {
+			tags[key] = value
+		}
+	}
+	series := graphiteTagReplacer.Replace(name)
+	for _, key := range sortedTagKeys(tags) {
+		value := strings.TrimLeft(graphiteTagReplacer.Replace(tags[key]), "~")
+		// graphite rejects the empty tag values
+		if value == "" {
+			continue
+		}
+		series += ";" + strings.NewReplacer("!", "_", "^", "_", "=", "_").Replace(graphiteTagReplacer.Replace(key)) + "=" + value
+	}
+	return series
+}
+
+// graphiteTagReplacer replaces the characters that would split a tagged series or its line.
+var graphiteTagReplacer = strings.NewReplacer(";", "_", " ", "_", "\t", "_", "\n", "_")
+
+// graphiteSegment replaces characters that would split or break a graphite path segment.
+func graphiteSegment(value string) string {
+	return strings.NewReplacer(".", "_", " ", "_").Replace(value)
+}
+
+// influxLine formats a measurement in Influx line protocol. The measurement name, tag set and field name are
+// rendered from the influx-template, by default the legacy testType, iperfDestination, iperfSource and
+// agentVersion tags followed by the endpoint tags.
+func influxLine(config configuration, m measurement) string {
+	format := influxTemplate
+	if format == nil {
+		format, _ = parseInfluxTemplate(influxTemplateConfig{Measurement: config.MeasurementName})
+	}
+	line, err := format.line(m)
+	if err != nil {
+		log.Errorf("Error rendering the influx template, falling back to the default line: %v", err)
+		format, _ = parseInfluxTemplate(influxTemplateConfig{Measurement: config.MeasurementName})
+		line, _ = format.line(m)
+	}
+	// the run and raw output IDs are string fields rather than tags so they don't add a series per run
+	if m.RunID != "" {
+		line += fmt.Sprintf(",run_id=%q", m.RunID)
+	}
+	if m.RawID != "" {
+		line += fmt.Sprintf(",raw_id=%q", m.RawID)
+	}
+	// an explicit timestamp makes a retried write overwrite the point rather than add a second one
+	return line + " " + influxTimestamp(config.InfluxURL, m.Timestamp)
+}
+
+// influxEscape escapes the characters that are special in Influx tag keys and values.
+func influxEscape(value string) string {
+	return strings.NewReplacer(",", "\\,", "=", "\\=", " ", "\\ ").Replace(value)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultNetdataPort = "8125"
+	// netdataPacketSize keeps the statsd datagrams within the MTU of a path with tunnel overhead.
+	netdataPacketSize = 1400
+	netdataTimeout    = 10 * time.Second
+)
+
+// statsdNameInvalid matches the characters that would break a statsd line, the separators : and | among them.
+var statsdNameInvalid = regexp.MustCompile(`[^a-zA-Z0-9._-]`)
+
+// netdataConfig sends the measurements to the statsd server built into Netdata, which charts them as gauges. Statsd
+// is Netdata's only ingestion interface, its REST API is read-only.
+type netdataConfig struct {
+	// Statsd is the Netdata statsd listener as host[:port], 8125 by default.
+	Statsd string `yaml:"statsd"`
+	// Protocol is udp (default) or tcp, both are served by Netdata.
+	Protocol string `yaml:"protocol"`
+}
+
+// netdataSink batches the gauges of a cycle and sends them when the cycle ends.
+type netdataSink struct {
+	address  string
+	protocol string
+	mu       sync.Mutex
+	pending  []string
+}
+
+var netdata *netdataSink
+
+// mergeNetdataFlags fills any Netdata settings missing from the configuration file with the CLI values.
+func mergeNetdataFlags(nc *netdataConfig) {
+	if nc.Statsd == "" {
+		nc.Statsd = cliFlags.netdataStatsd
+	}
+}
+
+// validateNetdata checks the statsd address and protocol.
+func validateNetdata(nc netdataConfig) []error {
+	if nc.Statsd == "" {
+		return nil
+	}
+	var errs []error
+	if _, _, err := net.SplitHostPort(netdataAddress(nc.Statsd)); err != nil {
+		errs = append(errs, fmt.Errorf("netdata statsd must be a host with an optional port, got %q", nc.Statsd))
+	}
+	if nc.Protocol != "" && nc.Protocol != "udp" && nc.Protocol != "tcp" {
+		errs = append(errs, fmt.Errorf("netdata protocol must be udp or tcp, got %q", nc.Protocol))
+	}
+	return errs
+}
+
+// netdataAddress adds the default port to a statsd address without one.
+func netdataAddress(statsd string) string {
+	if _, _, err := net.SplitHostPort(statsd); err == nil {
+		return statsd
+	}
+	return net.JoinHostPort(strings.Trim(statsd, "[]"), defaultNetdataPort)
+}
+
+// initNetdata sets up the Netdata sink if a statsd address was configured.
+func initNetdata(nc netdataConfig) {
+	if nc.Statsd == "" {
+		return
+	}
+	protocol := nc.Protocol
+	if protocol == "" {
+		protocol = "udp"
+	}
+	netdata = &netdataSink{address: netdataAddress(nc.Statsd), protocol: protocol}
+	log.Debugf("[Config] Netdata Statsd = %s over %s", netdata.address, protocol)
+}
+
+// add buffers a measurement as a statsd gauge named like its graphite path, e.g. bandwidth.download.azure:250000|g.
+func (n *netdataSink) add(config configuration, m measurement) {
+	line := fmt.Sprintf("%s:%s|g", statsdNameInvalid.ReplaceAllString(graphitePath(config, m), "_"), m.formattedValue("netdata"))
+	n.mu.Lock()
+	n.pending = append(n.pending, line)
+	n.mu.Unlock()
+}
+
+// flush sends the buffered gauges, packed into as few datagrams as fit or as lines over one TCP connection.
+func (n *netdataSink) flush() {
+	n.mu.Lock()
+	batch := n.pending
+	n.pending = nil
+	n.mu.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+	start := time.Now()
+	size, err := n.send(batch)
+	auditWrite("netdata", n.address, size, start, err)
+	if err != nil {
+		log.Errorf("Error sending %d gauges to the netdata statsd at %s: %v", len(batch), n.address, err)
+		return
+	}
+	log.Debugf("Sent %d gauges to the netdata statsd at %s", len(batch), n.address)
+}
+
+// send writes the lines and returns the bytes written.
+func (n *netdataSink) send(lines []string) (int, error) {
+	conn, err := net.DialTimeout(n.protocol, n.address, netdataTimeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(netdataTimeout))
+	if n.protocol == "tcp" {
+		payload := strings.Join(lines, "\n") + "\n"
+		_, err := conn.Write([]byte(payload))
+		return len(payload), err
+	}
+	var packet strings.Builder
+	written := 0
+	for i, line := range lines {
+		if packet.Len() > 0 {
+			packet.WriteString("\n")
+		}
+		packet.WriteString(line)
+		if i+1 < len(lines) && packet.Len()+1+len(lines[i+1]) <= netdataPacketSize {
+			continue
+		}
+		if _, err := conn.Write([]byte(packet.String())); err != nil {
+			return written, err
+		}
+		written += packet.Len()
+		packet.Reset()
+	}
+	return written, nil
+}
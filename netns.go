@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+// netnsDir is where ip netns add creates the named network namespaces.
+const netnsDir = "/var/run/netns"
+
+// netnsName matches the name of a namespace created with ip netns add.
+var netnsName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// netnsPath is the namespace file of a netns setting, a name under /var/run/netns or the path of a namespace file
+// such as /proc/<pid>/ns/net of a container.
+func netnsPath(name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(netnsDir, name)
+}
+
+// validateNetns checks the network namespace and interface of an endpoint, a namespace needs Linux and the native
+// client since a container client runs in the namespace of its container.
+func validateNetns(config configuration, server perfServer) []error {
+	var errs []error
+	if server.Netns != "" {
+		if !filepath.IsAbs(server.Netns) && (!netnsName.MatchString(server.Netns) || server.Netns == "." || server.Netns == "..") {
+			errs = append(errs, fmt.Errorf("perf server %s netns must be the name of a namespace in %s or the path of a namespace file, got %q", server.Address, netnsDir, server.Netns))
+		}
+		if runtime.GOOS != "linux" {
+			errs = append(errs, fmt.Errorf("perf server %s: network namespaces are only supported on linux", server.Address))
+		}
+		if eng, err := selectEngine(config); err == nil && !cliFlags.noContainer && !endpointEngine(eng, server).local {
+			errs = append(errs, fmt.Errorf("perf server %s: a netns needs the native client, run with --nocontainer", server.Address))
+		}
+		if server.Tunnel != nil {
+			errs = append(errs, fmt.Errorf("perf server %s: set either netns or tunnel", server.Address))
+		}
+	}
+	if server.Interface != "" && strings.ContainsAny(server.Interface, "/ \t") {
+		errs = append(errs, fmt.Errorf("perf server %s interface must be an interface name such as eth0.100, got %q", server.Address, server.Interface))
+	}
+	return errs
+}
+
+// runCmdIn runs a command in the network namespace of an endpoint, in the agent's namespace without one, with the
+// environment of the endpoint's client.
+func runCmdIn(server perfServer, argv []string) (string, error) {
+	return runCmdInContext(context.Background(), server, argv, clientEnv(server))
+}
+
+// runCmdInContext runs a command like runCmdIn with the environment variables added to the agent's, the command is
+// killed when ctx is done.
+func runCmdInContext(ctx context.Context, server perfServer, argv []string, env []string) (string, error) {
+	var output string
+	var err error
+	if nsErr := inNetns(server.Netns, func() { output, err = runCmdContext(ctx, argv, env) }); nsErr != nil {
+		return "", nsErr
+	}
+	return output, err
+}
+
+// bindInterface resolves the address of the endpoint's interface, looked up in its namespace, that the tests bind
+// to so they leave through a VLAN subinterface or another tenant path. The address is of the family of the
+// endpoint's, link-local addresses are skipped.
+func bindInterface(server perfServer) (perfServer, error) {
+	if server.Interface == "" {
+		return server, nil
+	}
+	var addrs []net.Addr
+	var err error
+	if nsErr := inNetns(server.Netns, func() {
+		var iface *net.Interface
+		if iface, err = net.InterfaceByName(server.Interface); err == nil {
+			addrs, err = iface.Addrs()
+		}
+	}); nsErr != nil {
+		return server, nsErr
+	}
+	if err != nil {
+		return server, fmt.Errorf("interface %s: %v", server.Interface, err)
+	}
+	ip := net.ParseIP(server.dialAddress())
+	ipv6 := ip != nil && ip.To4() == nil
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLinkLocalUnicast() || (ipnet.IP.To4() == nil) != ipv6 {
+			continue
+		}
+		server.bindAddress = ipnet.IP.String()
+		return server, nil
+	}
+	family := "IPv4"
+	if ipv6 {
+		family = "IPv6"
+	}
+	return server, fmt.Errorf("interface %s has no %s address", server.Interface, family)
+}
+
+// tenantTags tags an endpoint's results with the namespace and interface it's tested over, so the paths of the
+// tenants of a box stay apart.
+func tenantTags(server perfServer) perfServer {
+	if server.Netns != "" {
+		server.Tags = withTag(server.Tags, "netns", server.Netns)
+	}
+	if server.Interface != "" {
+		server.Tags = withTag(server.Tags, "interface", server.Interface)
+	}
+	return server
+}
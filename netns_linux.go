@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// inNetns runs fn on a thread moved into a network namespace, so the commands it starts and the sockets it opens
+// belong to the namespace like under ip netns exec. fn must not hand its work to other goroutines, they run on
+// threads of the agent's namespace. The thread moves back when fn returns, an empty name runs fn as is.
+func inNetns(name string, fn func()) error {
+	if name == "" {
+		fn()
+		return nil
+	}
+	runtime.LockOSThread()
+	origin, err := os.Open("/proc/self/task/" + strconv.Itoa(syscall.Gettid()) + "/ns/net")
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("could not open the current network namespace: %v", err)
+	}
+	defer origin.Close()
+	target, err := os.Open(netnsPath(name))
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("could not open the network namespace %s: %v", name, err)
+	}
+	defer target.Close()
+	if err := setns(target.Fd()); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("could not enter the network namespace %s, the agent needs root or CAP_SYS_ADMIN: %v", name, err)
+	}
+	fn()
+	if err := setns(origin.Fd()); err != nil {
+		// the thread stays locked so no other goroutine is scheduled on it in the wrong namespace, the runtime
+		// discards it when this goroutine exits
+		return fmt.Errorf("could not leave the network namespace %s: %v", name, err)
+	}
+	runtime.UnlockOSThread()
+	return nil
+}
+
+// setns moves the calling thread into the network namespace of a namespace file.
+func setns(fd uintptr) error {
+	return unix.Setns(int(fd), unix.CLONE_NEWNET)
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// inNetns runs fn as is, network namespaces only exist on Linux.
+func inNetns(name string, fn func()) error {
+	if name == "" {
+		fn()
+		return nil
+	}
+	return fmt.Errorf("network namespaces are not supported on %s", runtime.GOOS)
+}
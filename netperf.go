@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// netperfTransactions is the result metric of the request/response tests, in transactions per second.
+const netperfTransactions = "transactions_per_sec"
+
+// netperfTestTypes splits a comma separated list of netperf test types, an empty list is the default TCP_STREAM
+// like an unset one rather than no test at all.
+func netperfTestTypes(list string) []string {
+	var types []string
+	for _, testType := range strings.Split(list, ",") {
+		if testType = strings.ToUpper(strings.TrimSpace(testType)); testType != "" {
+			types = append(types, testType)
+		}
+	}
+	if len(types) == 0 {
+		return []string{netperfTCP}
+	}
+	return types
+}
+
+// validateNetperfTests checks the netperf-tests setting.
+func validateNetperfTests() error {
+	for _, testType := range netperfTestTypes(cliFlags.netperfTests) {
+		switch testType {
+		case netperfTCP, netperfUDP, netperfRR, netperfCRR:
+		default:
+			return fmt.Errorf("netperf test %q must be one of TCP_STREAM, UDP_STREAM, TCP_RR or TCP_CRR", testType)
+		}
+	}
+	return nil
+}
+
+// engineTests returns the settings of every test run against an endpoint in a direction, one per netperf test
+// type with netperf and the settings as is with the other engines.
+func engineTests(settings runSettings, eng engine) []runSettings {
+	if eng.name != engineNetperf {
+		return []runSettings{settings}
+	}
+	tests := make([]runSettings, 0, len(settings.netperfTests))
+	for _, testType := range settings.netperfTests {
+		test := settings
+		test.netperfTest = testType
+		tests = append(tests, test)
+	}
+	return tests
+}
+
+// netperfTestPrefix is the tsdb prefix of a netperf test, TCP_STREAM keeps the prefix of the direction so
+// existing series carry on and the other tests are recorded under <prefix>.<test type> ex. bandwidth.download.tcp_rr.
+func netperfTestPrefix(prefix string, testType string) string {
+	if testType == "" || testType == netperfTCP {
+		return prefix
+	}
+	return prefix + "." + strings.ToLower(testType)
+}
+
+// netperfEngine returns the netperf engine reading the results of a test type and, if cpu is set, the CPU
+// utilization measured by netperf's -c and -C options. With -P 0 netperf prints only
+// its result lines, the columns differ between the stream and request/response tests:
+//
+//	TCP_STREAM  recv-socket send-socket send-size elapsed throughput [local-cpu remote-cpu local-sd remote-sd]
+//	UDP_STREAM  socket message-size elapsed messages errors throughput [local-cpu local-sd]
+//	            socket elapsed messages throughput [remote-cpu remote-sd]
+//	TCP_RR      send-socket recv-socket request-size response-size elapsed rate [local-cpu remote-cpu local-sd remote-sd]
+//	            send-socket recv-socket
+func netperfEngine(eng engine, testType string, cpu bool) engine {
+	switch testType {
+	case netperfUDP:
+		// the throughput of the receiving side, the sender also counts the datagrams dropped on the way
+		eng.parse = func(output string) (string, error) {
+			return netperfColumn(output, 1, 3, "throughput")
+		}
+	case netperfRR, netperfCRR:
+		eng.metric = netperfTransactions
+		eng.parse = func(output string) (string, error) {
+			return netperfColumn(output, 0, 5, "transaction rate")
+		}
+	}
+	if cpu {
+		eng.cpu = func(output string) (float64, float64, bool) {
+			localLine, localColumn, remoteLine, remoteColumn := 0, 5, 0, 6
+			switch testType {
+			case netperfUDP:
+				localLine, localColumn, remoteLine, remoteColumn = 0, 6, 1, 4
+			case netperfRR, netperfCRR:
+				localLine, localColumn, remoteLine, remoteColumn = 0, 6, 0, 7
+			}
+			local, err := netperfColumn(output, localLine, localColumn, "local CPU utilization")
+			if err != nil {
+				return 0, 0, false
+			}
+			remote, err := netperfColumn(output, remoteLine, remoteColumn, "remote CPU utilization")
+			if err != nil {
+				return 0, 0, false
+			}
+			localCPU, localErr := strconv.ParseFloat(local, 64)
+			remoteCPU, remoteErr := strconv.ParseFloat(remote, 64)
+			// netperf reports a negative utilization when it couldn't be measured
+			return localCPU, remoteCPU, localErr == nil && remoteErr == nil && localCPU >= 0 && remoteCPU >= 0
+		}
+	}
+	return eng
+}
+
+// netperfColumn returns a column of the nth result line of the netperf output, the lines starting with a number.
+func netperfColumn(output string, line int, column int, name string) (string, error) {
+	var lines [][]string
+	for _, text := range strings.Split(output, "\n") {
+		fields := strings.Fields(text)
+		if len(fields) > 0 && fields[0][0] >= '0' && fields[0][0] <= '9' {
+			lines = append(lines, fields)
+		}
+	}
+	if line >= len(lines) || column >= len(lines[line]) {
+		return "", fmt.Errorf("no %s found in the netperf output", name)
+	}
+	return lines[line][column], nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// networkChanges subscribes to the netlink link, address and route messages, a value is sent on every message.
+// Messages arriving while one is pending are merged into it.
+func networkChanges() (<-chan time.Time, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+	groups := uint32(unix.RTMGRP_LINK | unix.RTMGRP_IPV4_IFADDR | unix.RTMGRP_IPV4_ROUTE | unix.RTMGRP_IPV6_IFADDR | unix.RTMGRP_IPV6_ROUTE)
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: groups}); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	changes := make(chan time.Time, 1)
+	go func() {
+		buf := make([]byte, 1<<16)
+		for {
+			if _, _, err := unix.Recvfrom(fd, buf, 0); err != nil {
+				if err == unix.EINTR {
+					continue
+				}
+				// ENOBUFS means messages were dropped, which still means the network changed
+				if err != unix.ENOBUFS {
+					log.Errorf("Error watching the network with netlink, checking it every %s instead: %v", networkPoll, err)
+					unix.Close(fd)
+					for now := range time.Tick(networkPoll) {
+						changes <- now
+					}
+				}
+			}
+			select {
+			case changes <- time.Now():
+			default:
+			}
+		}
+	}()
+	return changes, nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"time"
+)
+
+// networkChanges fails as netlink only exists on Linux, the network is polled instead.
+func networkChanges() (<-chan time.Time, error) {
+	return nil, fmt.Errorf("netlink is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// nicCheck cross-checks the bytes an engine reports for a test against the byte counters of the interface the
+// test runs over. A large divergence points at the measurement rather than the network, such as offloads
+// miscounting, the route leaving through another interface or other traffic competing with the test.
+type nicCheck struct {
+	ifaces  []string
+	start   nicCounters
+	started time.Time
+}
+
+// startNICCheck reads the counters of the interface to an endpoint before its runs. It is only available on
+// Linux, nil elsewhere.
+func startNICCheck(server perfServer) *nicCheck {
+	ifaces := hostStatsInterfaces(server)
+	start, ok := readNICCounters(ifaces)
+	if !ok {
+		return nil
+	}
+	return &nicCheck{ifaces: ifaces, start: start, started: time.Now()}
+}
+
+// finish reads the counters after the runs and records the interface throughput in the direction of the test as
+// nic_observed in bps, and its divergence from the bytes the engine reported as nic_divergence_pct. The interface
+// bytes include the protocol headers, so they run a few percent above the engine's. A divergence beyond the
+// threshold is logged. Tests with a failed run are left out since the failed run's bytes aren't reported.
+func (c *nicCheck) finish(config configuration, settings runSettings, eng engine, server perfServer, direction string, prefix string, samples []sample, runs int, length string) {
+	end, ok := readNICCounters(c.ifaces)
+	elapsed := time.Since(c.started).Seconds()
+	if !ok || elapsed <= 0 || len(samples) != runs {
+		return
+	}
+	// the client sends in the download direction and receives in the reversed upload direction
+	observed := end.txBytes - c.start.txBytes
+	if direction == directionUpload {
+		observed = end.rxBytes - c.start.rxBytes
+	}
+	recordTestMetric(config, settings, eng, server, direction, prefix, "nic_observed", float64(observed)*8/elapsed)
+	reported := transferredBytes(samples, length)
+	if reported <= 0 {
+		return
+	}
+	divergence := (float64(observed) - float64(reported)) / float64(reported) * 100
+	recordTestMetric(config, settings, eng, server, direction, prefix, "nic_divergence_pct", divergence)
+	if settings.nicCheckThreshold > 0 && math.Abs(divergence) > settings.nicCheckThreshold {
+		log.Warnf("The %s interface counters of %s [%s] diverge %.1f%% from the %d bytes %s reported (run %s), check the interface, offloads and competing traffic",
+			direction, server.Address, server.displayName(), divergence, reported, eng.name, server.runID)
+	}
+}
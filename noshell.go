@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	// hostnamePattern matches a DNS name, an endpoint address is otherwise an IP address.
+	hostnamePattern = regexp.MustCompile(`^[A-Za-z0-9_]([A-Za-z0-9_.-]*[A-Za-z0-9_])?$`)
+	// imagePattern matches a container image reference ex. quay.io/networkstatic/iperf3:latest.
+	imagePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._/:@-]*$`)
+	// portPattern matches a TCP port.
+	portPattern = regexp.MustCompile(`^[0-9]{1,5}$`)
+)
+
+// shellBinaries are the interpreters --no-shell refuses to start, Windows also runs .bat and .cmd files through
+// cmd.exe.
+var shellBinaries = map[string]bool{
+	"sh": true, "bash": true, "dash": true, "zsh": true, "ksh": true, "csh": true, "tcsh": true, "fish": true,
+	"busybox": true, "cmd": true, "powershell": true, "pwsh": true,
+}
+
+// checkArgv refuses a command that would start a shell while --no-shell is set. Every child process is already
+// exec'ed directly with an argv array, this guards against a shell reaching it through a configured binary or
+// wrapper.
+func checkArgv(argv []string) error {
+	if !cliFlags.noShell {
+		return nil
+	}
+	for _, arg := range argv {
+		if isShell(arg) {
+			return fmt.Errorf("refusing to run %q, --no-shell doesn't allow starting %s", strings.Join(argv, " "), arg)
+		}
+	}
+	return nil
+}
+
+// isShell reports whether a command line argument names a shell, a script run by one or a Windows batch file. The
+// shebang line of a script is checked first and decides whatever the script's extension, a wrapper script runs its
+// shell whatever its name.
+func isShell(arg string) bool {
+	if interpreter := shebangInterpreter(arg); interpreter != "" {
+		return isShellName(interpreter)
+	}
+	return isShellName(arg)
+}
+
+// isShellName reports whether a command names a shell, a shell script or a Windows batch file by its name.
+func isShellName(arg string) bool {
+	base := strings.ToLower(filepath.Base(strings.Replace(arg, "\\", "/", -1)))
+	switch filepath.Ext(base) {
+	case ".bat", ".cmd", ".sh", ".ps1":
+		return true
+	}
+	return shellBinaries[strings.TrimSuffix(base, ".exe")]
+}
+
+// shebangInterpreter returns the interpreter named on the #! line of an executable script, the program after
+// /usr/bin/env included, or nothing if the argument isn't a script.
+func shebangInterpreter(arg string) string {
+	path, err := exec.LookPath(arg)
+	if err != nil {
+		return ""
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	line, _ := bufio.NewReader(io.LimitReader(f, 256)).ReadString('\n')
+	if !strings.HasPrefix(line, "#!") {
+		return ""
+	}
+	fields := strings.Fields(line[2:])
+	if len(fields) == 0 {
+		return ""
+	}
+	if filepath.Base(fields[0]) != "env" {
+		return fields[0]
+	}
+	for _, field := range fields[1:] {
+		if !strings.HasPrefix(field, "-") {
+			return field
+		}
+	}
+	return ""
+}
+
+// checkShellFreeServer verifies the settings of an endpoint that end up on a client's command line are plain
+// values, so an address or port from a semi-trusted configuration can't be read as an option of the client.
+func checkShellFreeServer(server perfServer, eng engine) error {
+	if eng.name == engineSSH {
+		return fmt.Errorf("the ssh engine starts the iperf3 server through the remote login shell and isn't allowed with --no-shell")
+	}
+	if net.ParseIP(server.Address) == nil && !hostnamePattern.MatchString(server.Address) {
+		return fmt.Errorf("address %q is not an IP address or a hostname", server.Address)
+	}
+	if server.UnderlayAddress != "" && net.ParseIP(server.UnderlayAddress) == nil && !hostnamePattern.MatchString(server.UnderlayAddress) {
+		return fmt.Errorf("underlay-address %q is not an IP address or a hostname", server.UnderlayAddress)
+	}
+	if server.Port != "" && !portPattern.MatchString(server.Port) {
+		return fmt.Errorf("port %q is not a number", server.Port)
+	}
+	if server.Ports != "" {
+		if _, err := parsePortRange(server.Ports); err != nil {
+			return err
+		}
+	}
+	if server.BandwidthCap != "" && !bandwidthPattern.MatchString(server.BandwidthCap) {
+		return fmt.Errorf("bandwidth-cap %q is not a number with an optional K, M or G suffix", server.BandwidthCap)
+	}
+	if server.profile != nil {
+		for _, value := range []string{server.profile.Length, server.profile.Parallel, server.profile.BandwidthCap, server.profile.Congestion} {
+			if strings.HasPrefix(value, "-") || strings.ContainsAny(value, " \t\n") {
+				return fmt.Errorf("test profile %q has the invalid setting %q", server.profile.Name, value)
+			}
+		}
+	}
+	return nil
+}
+
+// validateNoShell reports the settings --no-shell can't run with: the ssh engine, a shell as the perf binary
+// and endpoint, port or image values that aren't plain values.
+func validateNoShell(config configuration) []error {
+	if !cliFlags.noShell {
+		return nil
+	}
+	var errs []error
+	defaultEngine, err := selectEngine(config)
+	if err != nil {
+		return nil
+	}
+	for _, server := range allServers(config) {
+		if err := checkShellFreeServer(server, endpointEngine(defaultEngine, server)); err != nil {
+			errs = append(errs, fmt.Errorf("perf server %s: %v", server.Address, err))
+		}
+	}
+	for _, binary := range []struct{ name, path string }{
+		{"perf-binary", cliFlags.perfBinary},
+		{"iperf-path", cliFlags.iperfPath},
+		{"iperf2-path", cliFlags.iperf2Path},
+		{"netperf-path", cliFlags.netperfPath},
+	} {
+		if binary.path != "" && isShell(binary.path) {
+			errs = append(errs, fmt.Errorf("%s %q is a shell or batch file, which --no-shell doesn't allow", binary.name, binary.path))
+		}
+	}
+	if !imagePattern.MatchString(cliFlags.imageRepo) {
+		errs = append(errs, fmt.Errorf("image %q is not a container image reference", cliFlags.imageRepo))
+	}
+	if !portPattern.MatchString(cliFlags.perfServerPort) {
+		errs = append(errs, fmt.Errorf("perf-server-port %q is not a number", cliFlags.perfServerPort))
+	}
+	for _, setting := range []struct{ name, value string }{
+		{"test-length", cliFlags.testLength},
+		{"parallel", cliFlags.parallelConn},
+		{"omit", cliFlags.omit},
+		{"bandwidth-cap", cliFlags.bandwidthCap},
+		{"congestion", cliFlags.congestion},
+	} {
+		if strings.HasPrefix(setting.value, "-") || strings.ContainsAny(setting.value, " \t\n") {
+			errs = append(errs, fmt.Errorf("%s %q is not a plain value", setting.name, setting.value))
+		}
+	}
+	return errs
+}
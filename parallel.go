@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// parallelAuto tunes the number of parallel streams of every endpoint instead of using a fixed number.
+	parallelAuto = "auto"
+	// parallelTuneGain is the least improvement in throughput that makes doubling the streams worth it.
+	parallelTuneGain = 0.1
+)
+
+// tunedParallel is the number of streams tuned for an endpoint in one direction.
+type tunedParallel struct {
+	streams int
+	bps     int64
+	tuned   time.Time
+}
+
+// parallelTunings caches the tuned streams per endpoint, direction, engine and profile.
+var parallelTunings = struct {
+	sync.Mutex
+	tuned map[string]tunedParallel
+}{tuned: make(map[string]tunedParallel)}
+
+// validParallel reports whether a parallel setting is a positive number of streams or auto.
+func validParallel(value string) bool {
+	if value == parallelAuto {
+		return true
+	}
+	streams, err := strconv.Atoi(value)
+	return err == nil && streams > 0
+}
+
+// parallelStreams returns the streams to test an endpoint with in a direction with parallel auto. They're tuned
+// the first time and again once the tuning is older than parallel-retune, otherwise the cached tuning is used.
+func parallelStreams(settings runSettings, eng engine, server perfServer, direction string, clientCmd []string, opts testOptions, ports []string) int {
+	key := server.Address + "|" + opts.port + "|" + direction + "|" + eng.name + "|" + server.Netns + "|" + server.Interface
+	if server.profile != nil {
+		key += "|" + server.profile.Name
+	}
+	parallelTunings.Lock()
+	cached, ok := parallelTunings.tuned[key]
+	parallelTunings.Unlock()
+	if ok && (settings.parallelRetune <= 0 || time.Since(cached.tuned) < settings.parallelRetune) {
+		return cached.streams
+	}
+	tuned, ok := tuneParallel(settings, eng, server, direction, clientCmd, opts, ports)
+	if !ok {
+		return 1
+	}
+	parallelTunings.Lock()
+	parallelTunings.tuned[key] = tuned
+	parallelTunings.Unlock()
+	log.Infof("Tuned the %s tests to %s [%s] to %d parallel streams at %d bps", direction, server.Address, server.displayName(), tuned.streams, tuned.bps)
+	return tuned.streams
+}
+
+// tuneParallel ramps the streams of an endpoint's test up, 1, 2, 4, 8 and so on to parallel-max, with a run at
+// each step until doubling the streams improves the throughput less than parallelTuneGain. The streams before
+// that step are chosen. ok is false if not even the single stream run succeeded.
+func tuneParallel(settings runSettings, eng engine, server perfServer, direction string, clientCmd []string, opts testOptions, ports []string) (tunedParallel, bool) {
+	var best tunedParallel
+	for streams := 1; streams <= settings.parallelMax; streams *= 2 {
+		probe := opts
+		probe.parallel = strconv.Itoa(streams)
+		var result sample
+		var err error
+		if len(ports) > 0 {
+			var stripes [][]string
+			for _, port := range ports {
+				stripe := probe
+				stripe.port = port
+				stripes = append(stripes, clientArgv(eng, clientCmd, stripe))
+			}
+			result, err = runStripedSample(eng, server, stripes, ports, "")
+		} else {
+			result, err = engineClient{engine: eng, argv: clientCmd}.Run(context.Background(), server, probe)
+		}
+		if err != nil {
+			break
+		}
+		if budget != nil {
+			budget.use(server, transferredBytes([]sample{result}, probe.length))
+		}
+		log.Debugf("Tuning the %s tests to %s [%s]: %d parallel streams -> %d bps", direction, server.Address, server.displayName(), streams, result.bps)
+		if best.streams > 0 && float64(result.bps) < float64(best.bps)*(1+parallelTuneGain) {
+			break
+		}
+		best = tunedParallel{streams: streams, bps: result.bps, tuned: time.Now()}
+	}
+	return best, best.streams > 0
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// perfServer is a remote perf server getting polled along with the tags attached to its measurements.
+type perfServer struct {
+	Address string `yaml:"address" json:"address"`
+	Name    string `yaml:"name" json:"name,omitempty"`
+	// Port overrides the global --perf-server-port for this endpoint.
+	Port string `yaml:"port,omitempty" json:"port,omitempty"`
+	// Ports is a range or list of ports with a perf server on each, a test is striped across all of them.
+	Ports string `yaml:"ports,omitempty" json:"ports,omitempty"`
+	// Engine overrides the global engine for this endpoint.
+	Engine string `yaml:"engine,omitempty" json:"engine,omitempty"`
+	// BandwidthCap overrides the global --bandwidth-cap for this endpoint, "0" disables the cap.
+	BandwidthCap string            `yaml:"bandwidth-cap,omitempty" json:"bandwidth-cap,omitempty"`
+	Tags         map[string]string `yaml:"tags,omitempty" json:"tags,omitempty"`
+	// Tunnel reaches an endpoint on a private network through a SOCKS5 proxy or ssh jump host.
+	Tunnel *tunnelConfig `yaml:"tunnel,omitempty" json:"tunnel,omitempty"`
+	// Docker is the Docker API of the endpoint the perf server is started on for its tests.
+	Docker *remoteDockerConfig `yaml:"docker,omitempty" json:"docker,omitempty"`
+	// UnderlayAddress is the endpoint's address outside a VPN, tested after the address to measure the overhead
+	// of the overlay.
+	UnderlayAddress string `yaml:"underlay-address,omitempty" json:"underlay-address,omitempty"`
+	// Netns is the Linux network namespace the endpoint is tested from, by name or namespace file, so each tenant
+	// of a box can be measured over its own path.
+	Netns string `yaml:"netns,omitempty" json:"netns,omitempty"`
+	// Interface is the interface such as the VLAN subinterface eth0.100 the tests leave through, bound by its address.
+	Interface string `yaml:"interface,omitempty" json:"interface,omitempty"`
+	// Fallbacks are other addresses of the endpoint, such as the other nodes of an HA deployment, tested in order
+	// when the address fails its pre-check.
+	Fallbacks []string `yaml:"fallbacks,omitempty" json:"fallbacks,omitempty"`
+	// Auth authenticates the iperf3 client to a server that requires it.
+	Auth *iperfAuthConfig `yaml:"auth,omitempty" json:"auth,omitempty"`
+	// SLA overrides the shared sla settings for this endpoint.
+	SLA *slaTarget `yaml:"sla,omitempty" json:"sla,omitempty"`
+
+	// tunnelHost and tunnelPort are the local end of an open tunnel the perf client connects to.
+	tunnelHost string
+	tunnelPort string
+	// profile is the test profile the endpoint is being tested with, nil without profiles.
+	profile *testProfile
+	// runID identifies the test execution the endpoint is being tested in, empty outside of a test.
+	runID string
+	// resolvedIP is the address the endpoint's hostname is pinned to for the cycle with --dns-pin.
+	resolvedIP string
+	// bindAddress is the address of the endpoint's interface the clients bind to.
+	bindAddress string
+	// fallback is the fallback address the endpoint is tested at this cycle, empty for its address.
+	fallback string
+	// ipv6 is the IPv6 address a dual-stack endpoint is tested at after its IPv4 tests with --dual-stack.
+	ipv6 string
+}
+
+// UnmarshalYAML accepts both the original "address: name" pair and the expanded form with tags:
+//
+//	iperf-servers:
+//	  - 172.17.0.3: azure
+//	  - address: 172.17.0.4
+//	    name: aws
+//	    tags:
+//	      region: us-east
+func (p *perfServer) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type expanded perfServer
+	var entry expanded
+	if err := unmarshal(&entry); err == nil && entry.Address != "" {
+		*p = perfServer(entry)
+		return nil
+	}
+
+	var pair map[string]string
+	if err := unmarshal(&pair); err != nil {
+		return fmt.Errorf("perf server entries must be an \"address: name\" pair or contain an address: %v", err)
+	}
+	if len(pair) != 1 {
+		return fmt.Errorf("perf server entry %v must contain a single \"address: name\" pair", pair)
+	}
+	for address, name := range pair {
+		p.Address = address
+		p.Name = name
+	}
+	return nil
+}
+
+// displayName is the name recorded to the tsdb, the address is used if no name was given.
+func (p perfServer) displayName() string {
+	if p.Name == "" {
+		return p.Address
+	}
+	return p.Name
+}
+
+// serverPort is the port the endpoint's perf server listens on, the engine's port is used unless one was set
+// for the endpoint. The engine's port is set to --perf-server-port by resolveEngine. It's the first port of an
+// endpoint with several ports.
+func (p perfServer) serverPort(eng engine) string {
+	if p.Port != "" {
+		return p.Port
+	}
+	if p.Ports != "" {
+		if ports, err := parsePortRange(p.Ports); err == nil && len(ports) > 0 {
+			return ports[0]
+		}
+	}
+	return eng.port
+}
+
+// withTag returns a copy of the tags with one more tag set.
+func withTag(tags map[string]string, key string, value string) map[string]string {
+	tagged := make(map[string]string, len(tags)+1)
+	for k, v := range tags {
+		tagged[k] = v
+	}
+	tagged[key] = value
+	return tagged
+}
+
+// parsePerfServers parses a comma separated list of perf server targets in the form [name=]host[:port].
+// IPv6 addresses need brackets when a port is given, e.g. lab=[2001:db8::10]:5201.
+func parsePerfServers(list string) ([]perfServer, error) {
+	var servers []perfServer
+	for _, target := range strings.Split(list, ",") {
+		target = strings.TrimSpace(target)
+		if target == "" {
+			continue
+		}
+		server, err := parsePerfTarget(target)
+		if err != nil {
+			return nil, fmt.Errorf("invalid perf server %q: %v", target, err)
+		}
+		servers = append(servers, server)
+	}
+	return servers, nil
+}
+
+// parsePerfTarget parses a single perf server target.
+func parsePerfTarget(target string) (perfServer, error) {
+	var server perfServer
+	hostPort := target
+	if i := strings.Index(target, "="); i >= 0 {
+		server.Name = strings.TrimSpace(target[:i])
+		hostPort = strings.TrimSpace(target[i+1:])
+		if server.Name == "" {
+			return server, fmt.Errorf("empty name before \"=\"")
+		}
+	} else if host, name, ok := legacyPerfPair(target); ok {
+		// the original address:name form is still accepted
+		log.Warnf("the perf server form %q is deprecated, use %s=%s instead", target, name, host)
+		server.Address = host
+		server.Name = name
+		return server, nil
+	}
+
+	host, port, err := splitHostOptionalPort(hostPort)
+	if err != nil {
+		return server, err
+	}
+	server.Address = host
+	server.Port = port
+	return server, nil
+}
+
+// legacyPerfPair matches the original address:name form, a single colon followed by a non numeric name.
+func legacyPerfPair(target string) (string, string, bool) {
+	if strings.Count(target, ":") != 1 || strings.HasPrefix(target, "[") {
+		return "", "", false
+	}
+	parts := strings.SplitN(target, ":", 2)
+	if parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	if _, err := strconv.Atoi(parts[1]); err == nil {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// splitHostOptionalPort splits host[:port], [ipv6]:port or a bare IPv6 address and validates the port.
+func splitHostOptionalPort(hostPort string) (string, string, error) {
+	if hostPort == "" {
+		return "", "", fmt.Errorf("missing host")
+	}
+	// a bare IPv6 address has more than one colon and no brackets
+	if strings.Count(hostPort, ":") > 1 && !strings.HasPrefix(hostPort, "[") {
+		if net.ParseIP(hostPort) == nil {
+			return "", "", fmt.Errorf("%s is not a valid IPv6 address, use [address]:port to add a port", hostPort)
+		}
+		return hostPort, "", nil
+	}
+	if !strings.Contains(hostPort, ":") {
+		if strings.HasPrefix(hostPort, "[") {
+			return strings.Trim(hostPort, "[]"), "", nil
+		}
+		return hostPort, "", nil
+	}
+	if strings.HasPrefix(hostPort, "[") && strings.HasSuffix(hostPort, "]") {
+		host := strings.Trim(hostPort, "[]")
+		if net.ParseIP(host) == nil {
+			return "", "", fmt.Errorf("%s is not a valid IPv6 address", host)
+		}
+		return host, "", nil
+	}
+
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return "", "", err
+	}
+	if host == "" {
+		return "", "", fmt.Errorf("missing host")
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", "", fmt.Errorf("port %q must be a number between 1 and 65535", port)
+	}
+	return host, port, nil
+}
+
+// sortedTagKeys returns the tag keys in a stable order for building tsdb payloads.
+func sortedTagKeys(tags map[string]string) []string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
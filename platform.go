@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+// checkDockerDesktop verifies Docker Desktop is running Linux containers, the engine images are Linux only.
+func checkDockerDesktop() error {
+	if runtime.GOOS != "windows" && runtime.GOOS != "darwin" {
+		return nil
+	}
+	output, err := auditedOutput("docker", "info", "--format", "{{.OperatingSystem}}|{{.OSType}}")
+	if err != nil {
+		return fmt.Errorf("docker is installed but the daemon is not reachable, verify Docker Desktop is started: %s", strings.TrimSpace(string(output)))
+	}
+	info := strings.SplitN(strings.TrimSpace(string(output)), "|", 2)
+	if strings.Contains(info[0], "Docker Desktop") {
+		log.Debugf("[Config] Container Runtime = %s", info[0])
+	}
+	if len(info) == 2 && info[1] == "windows" {
+		return fmt.Errorf("Docker Desktop is running Windows containers, switch it to Linux containers or use the flag \"--nocontainer\"")
+	}
+	return nil
+}
+
+// tracerouteArgs returns the traceroute invocation of the platform, tracert on Windows.
+func tracerouteArgs(address string, source string) []string {
+	if runtime.GOOS == "windows" {
+		if source != "" {
+			return []string{"tracert", "-d", "-h", "30", "-w", "1000", "-S", source, address}
+		}
+		return []string{"tracert", "-d", "-h", "30", "-w", "1000", address}
+	}
+	if source != "" {
+		return []string{"traceroute", "-n", "-q", "1", "-w", "1", "-m", "30", "-s", source, address}
+	}
+	return []string{"traceroute", "-n", "-q", "1", "-w", "1", "-m", "30", address}
+}
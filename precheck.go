@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// precheck opens a TCP connection to the endpoint's perf server before it is tested so an unreachable endpoint
+// is skipped instead of running the client until it times out. The result is recorded as the reachable metric
+// of each direction, and a tunneled endpoint is checked through its tunnel. If the endpoint's address is
+// unreachable its fallbacks are checked in order, and the endpoint is returned set to test the first reachable one.
+func precheck(config configuration, settings runSettings, eng engine, server perfServer, tun *tunnel) (perfServer, bool) {
+	timeout := settings.precheckTimeout
+	// an engine without a listener such as exec is only checked if the endpoint has a port
+	if timeout <= 0 || server.serverPort(eng) == "" {
+		return server, true
+	}
+	start := time.Now()
+	target, err := dialPerfServer(server, eng, tun, timeout)
+	// a tunnel forwards to the endpoint's address, its fallbacks can't be reached through it
+	if err != nil && tun == nil {
+		for _, address := range server.Fallbacks {
+			log.Warnf("The %s server of %s [%s] at %s is unreachable, trying its fallback %s: %v", eng.server, server.Address, server.displayName(), target, address, err)
+			fallback := server
+			fallback.fallback = address
+			if target, err = dialPerfServer(fallback, eng, tun, timeout); err == nil {
+				server = fallback
+				break
+			}
+		}
+	}
+	if len(server.Fallbacks) > 0 {
+		server.Tags = withTag(server.Tags, "address_used", server.dialAddress())
+	}
+
+	reachable := 1.0
+	if err != nil {
+		reachable = 0
+		class := classifyError(err, "")
+		log.Errorf("Skipping the tests to %s [%s], the %s server at %s is unreachable (%s error): %v", server.Address, server.displayName(), eng.server, target, class, err)
+		if annotations != nil {
+			annotations.testFailed(server, directionDownload, start, fmt.Sprintf("unreachable: %v", err))
+		}
+		recordError(config, settings, eng, server, directionDownload, settings.downloadPrefix, class)
+		if eng.upload {
+			recordError(config, settings, eng, server, directionUpload, settings.uploadPrefix, class)
+		}
+	} else {
+		log.Debugf("Pre-check connected to %s in %s", target, time.Since(start))
+	}
+	recordTestMetric(config, settings, eng, server, directionDownload, settings.downloadPrefix, "reachable", reachable)
+	if eng.upload {
+		recordTestMetric(config, settings, eng, server, directionUpload, settings.uploadPrefix, "reachable", reachable)
+	}
+	return server, err == nil
+}
+
+// dialPerfServer connects to the endpoint's perf server port and closes the connection, it returns the address
+// dialed.
+func dialPerfServer(server perfServer, eng engine, tun *tunnel, timeout time.Duration) (string, error) {
+	target := net.JoinHostPort(server.dialAddress(), server.serverPort(eng))
+	var conn net.Conn
+	var err error
+	if tun != nil {
+		conn, err = dialTimeout(tun.dial, target, timeout)
+	} else {
+		// the connection is opened in the endpoint's namespace from its interface, without the fast fallback
+		// since its second dial would run on a goroutine outside the namespace
+		dialer := net.Dialer{Timeout: timeout, FallbackDelay: -1}
+		if server.bindAddress != "" {
+			dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(server.bindAddress)}
+		}
+		if nsErr := inNetns(server.Netns, func() { conn, err = dialer.Dial("tcp", target) }); nsErr != nil {
+			err = nsErr
+		}
+	}
+	if err != nil {
+		return target, err
+	}
+	conn.Close()
+	return target, nil
+}
+
+// dialTimeout bounds a dial function without its own timeout, such as a SOCKS5 or ssh tunnel.
+func dialTimeout(dial func(string, string) (net.Conn, error), target string, timeout time.Duration) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := dial("tcp", target)
+		done <- result{conn, err}
+	}()
+	select {
+	case r := <-done:
+		return r.conn, r.err
+	case <-time.After(timeout):
+		// close the connection if it is established after giving up on it
+		go func() {
+			if r := <-done; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, fmt.Errorf("dial tcp %s: i/o timeout", target)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+var (
+	// cpuListPattern matches a CPU list in the taskset and docker --cpuset-cpus format ex. 0,2-3.
+	cpuListPattern = regexp.MustCompile(`^[0-9]+(-[0-9]+)?(,[0-9]+(-[0-9]+)?)*$`)
+	// ionicePattern matches an ionice class with an optional best-effort level ex. best-effort:7.
+	ionicePattern = regexp.MustCompile(`^(idle|best-effort(:[0-7])?)$`)
+)
+
+// priorityArgv pins the perf client to the cpu-affinity CPUs and lowers its scheduling priority so a test on a
+// small box doesn't starve the workloads around it. The native client is wrapped with taskset, nice and ionice,
+// a container client gets the matching cgroup limits since the settings of the docker CLI don't carry over.
+func priorityArgv(argv []string, native bool) []string {
+	if native {
+		var prefix []string
+		if cliFlags.cpuAffinity != "" && runtime.GOOS == "linux" {
+			prefix = append(prefix, "taskset", "-c", cliFlags.cpuAffinity)
+		}
+		if cliFlags.nice != "" && runtime.GOOS != "windows" {
+			prefix = append(prefix, "nice", "-n", cliFlags.nice)
+		}
+		if cliFlags.ionice != "" && runtime.GOOS == "linux" {
+			prefix = append(prefix, ioniceArgs(cliFlags.ionice)...)
+		}
+		return append(prefix, argv...)
+	}
+	var args []string
+	if cliFlags.cpuAffinity != "" {
+		args = append(args, "--cpuset-cpus="+cliFlags.cpuAffinity)
+	}
+	if cliFlags.nice != "" {
+		nice, _ := strconv.Atoi(cliFlags.nice)
+		args = append(args, "--cpu-shares="+strconv.Itoa(niceShares(nice)))
+	}
+	if cliFlags.ionice != "" {
+		args = append(args, "--blkio-weight="+strconv.Itoa(ioniceWeight(cliFlags.ionice)))
+	}
+	return insertRunArgs(argv, args...)
+}
+
+// ioniceArgs returns the ionice invocation of an ionice setting.
+func ioniceArgs(setting string) []string {
+	if setting == "idle" {
+		return []string{"ionice", "-c", "3"}
+	}
+	args := []string{"ionice", "-c", "2"}
+	if i := strings.Index(setting, ":"); i >= 0 {
+		args = append(args, "-n", setting[i+1:])
+	}
+	return args
+}
+
+// niceShares converts a nice level to the equivalent CFS weight of docker --cpu-shares, every nice level is
+// about 25% less CPU time than the one below it.
+func niceShares(nice int) int {
+	shares := int(1024 / math.Pow(1.25, float64(nice)))
+	if shares < 2 {
+		return 2
+	}
+	return shares
+}
+
+// ioniceWeight converts an ionice setting to a docker --blkio-weight between 10 and 1000.
+func ioniceWeight(setting string) int {
+	if setting == "idle" {
+		return 10
+	}
+	level := 4
+	if i := strings.Index(setting, ":"); i >= 0 {
+		level, _ = strconv.Atoi(setting[i+1:])
+	}
+	return 1000 - level*130
+}
+
+// validatePriority checks the cpu-affinity, nice and ionice settings.
+func validatePriority() []error {
+	var errs []error
+	if cliFlags.cpuAffinity != "" && !cpuListPattern.MatchString(cliFlags.cpuAffinity) {
+		errs = append(errs, fmt.Errorf("cpu-affinity must be a list of CPUs and ranges ex. 0,2-3, got %q", cliFlags.cpuAffinity))
+	}
+	if cliFlags.nice != "" {
+		if nice, err := strconv.Atoi(cliFlags.nice); err != nil || nice < -20 || nice > 19 {
+			errs = append(errs, fmt.Errorf("nice must be a number between -20 and 19, got %q", cliFlags.nice))
+		}
+	}
+	if cliFlags.ionice != "" && !ionicePattern.MatchString(cliFlags.ionice) {
+		errs = append(errs, fmt.Errorf("ionice must be idle or best-effort with an optional level from 0 to 7 ex. best-effort:7, got %q", cliFlags.ionice))
+	}
+	return errs
+}
+
+// warnPriority reports the priority settings the native client can't apply on this platform.
+func warnPriority() {
+	if !cliFlags.noContainer || runtime.GOOS == "linux" {
+		return
+	}
+	if cliFlags.cpuAffinity != "" {
+		log.Warnf("cpu-affinity is not supported by the native client on %s and is ignored", runtime.GOOS)
+	}
+	if cliFlags.ionice != "" {
+		log.Warnf("ionice is not supported by the native client on %s and is ignored", runtime.GOOS)
+	}
+	if cliFlags.nice != "" && runtime.GOOS == "windows" {
+		log.Warn("nice is not supported by the native client on windows and is ignored")
+	}
+}
+
+// cpuList expands a CPU list such as 0,2-3 into the set of CPU numbers.
+func cpuList(list string) map[int]bool {
+	cpus := make(map[int]bool)
+	for _, part := range strings.Split(list, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			continue
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(bounds[1]); err != nil {
+				continue
+			}
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			cpus[cpu] = true
+		}
+	}
+	return cpus
+}
+
+// cpuTimes is a snapshot of the busy and total jiffies of the host's CPUs from /proc/stat.
+type cpuTimes struct {
+	busy  uint64
+	total uint64
+}
+
+// readCPUTimes sums the times of the cpu-affinity CPUs, or all CPUs without an affinity. It is only available
+// on Linux, ok is false elsewhere.
+func readCPUTimes() (cpuTimes, bool) {
+	var times cpuTimes
+	file, err := os.Open("/proc/stat")
+	if err != nil {
+		return times, false
+	}
+	defer file.Close()
+
+	var pinned map[int]bool
+	if cliFlags.cpuAffinity != "" {
+		pinned = cpuList(cliFlags.cpuAffinity)
+	}
+	found := false
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 || !strings.HasPrefix(fields[0], "cpu") {
+			continue
+		}
+		if pinned == nil {
+			if fields[0] != "cpu" {
+				continue
+			}
+		} else {
+			cpu, err := strconv.Atoi(strings.TrimPrefix(fields[0], "cpu"))
+			if err != nil || !pinned[cpu] {
+				continue
+			}
+		}
+		// user nice system idle iowait irq softirq steal, guest time is already counted in user
+		for i, field := range fields[1:] {
+			if i >= 8 {
+				break
+			}
+			value, _ := strconv.ParseUint(field, 10, 64)
+			times.total += value
+			if i != 3 && i != 4 {
+				times.busy += value
+			}
+		}
+		found = true
+	}
+	return times, found
+}
+
+// cpuUtilization is the percentage of CPU time spent busy between two snapshots.
+func cpuUtilization(start cpuTimes, end cpuTimes) (float64, bool) {
+	total := end.total - start.total
+	if end.total <= start.total {
+		return 0, false
+	}
+	return float64(end.busy-start.busy) / float64(total) * 100, true
+}
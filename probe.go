@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	defaultProbeLength     = "5"
+	defaultProbeMaxStreams = "16"
+	defaultProbePings      = "10"
+	// probeUDPLoss is the UDP loss in percent at the TCP rate above which the probe suggests capping the tests.
+	probeUDPLoss = 1.0
+)
+
+// probeStep is a TCP run of the parallel stream sweep.
+type probeStep struct {
+	streams int
+	bps     int64
+	ramp    time.Duration
+}
+
+// probeReport is everything the probe learned about an endpoint.
+type probeReport struct {
+	server   perfServer
+	engine   string
+	target   string
+	pathMTU  int
+	mss      int
+	mtuErr   error
+	rtts     []time.Duration
+	pings    int
+	pingErr  error
+	sweep    []probeStep
+	knee     int
+	upload   int64
+	upErr    error
+	udpBps   int64
+	udpLoss  float64
+	jitterMs float64
+	udpErr   error
+}
+
+// probeAction characterizes a new endpoint once, TCP in both directions, UDP loss at the TCP rate, latency, the
+// path MTU and a parallel stream sweep, and prints a summary with a suggested iperf-servers entry. Nothing is
+// written to the sinks.
+func probeAction(target string) error {
+	server, err := parsePerfTarget(target)
+	if err != nil {
+		return fmt.Errorf("invalid endpoint %q: %v", target, err)
+	}
+	config := loadConfig()
+	eng, err := selectEngine(config)
+	if err != nil {
+		return err
+	}
+	if eng.name == engineSSH || eng.name == engineExec {
+		return fmt.Errorf("probe runs the iperf3, iperf2, netperf or goperf engine, not %s", eng.name)
+	}
+	length, err := strconv.Atoi(cliFlags.probeLength)
+	if err != nil || length < 1 {
+		return fmt.Errorf("length must be a positive number of seconds, got %q", cliFlags.probeLength)
+	}
+	maxStreams, err := strconv.Atoi(cliFlags.probeMaxStreams)
+	if err != nil || maxStreams < 1 {
+		return fmt.Errorf("max-streams must be a positive number of streams, got %q", cliFlags.probeMaxStreams)
+	}
+	pings, err := strconv.Atoi(cliFlags.probePings)
+	if err != nil || pings < 1 {
+		return fmt.Errorf("pings must be a positive number of probes, got %q", cliFlags.probePings)
+	}
+	// the sweep is TCP, the UDP step asks for UDP itself
+	goperf := config.Goperf
+	goperf.Protocol = goperfTCP
+	configureGoperfEngine(goperf)
+	settings := resolveSettings()
+	settings.length = cliFlags.probeLength
+	client, err := setupEngine(eng, settings, true)
+	if err != nil {
+		return err
+	}
+	eng = client.engine
+	if !eng.parallel {
+		maxStreams = 1
+	}
+
+	report := probeReport{server: server, engine: eng.name, pings: pings}
+	report.target, err = dialPerfServer(server, eng, nil, settings.precheckTimeout)
+	if err != nil {
+		return fmt.Errorf("%s isn't reachable at %s: %v", eng.server, report.target, err)
+	}
+	log.Infof("Probing %s [%s] at %s with %s", server.Address, server.displayName(), report.target, eng.name)
+
+	report.pathMTU, report.mss, report.mtuErr = probeMTU(server.dialAddress(), server.serverPort(eng))
+	pingNetworks.Do(detectPingNetworks)
+	report.rtts, report.pingErr = ping(server.dialAddress(), "", pings)
+
+	// the sweep doubles the streams up to max-streams, the knee is where doubling them stops paying off
+	for streams := 1; streams <= maxStreams; streams *= 2 {
+		log.Infof("Running the %d stream download test", streams)
+		result, err := client.Run(context.Background(), server, probeOptions(eng, server, streams, false, ""))
+		if err != nil {
+			if streams == 1 {
+				return fmt.Errorf("the download test to %s failed: %v", report.target, err)
+			}
+			break
+		}
+		report.sweep = append(report.sweep, probeStep{streams: streams, bps: result.bps, ramp: rampTime(result.intervals)})
+	}
+	report.knee = report.sweep[0].streams
+	best := report.sweep[0].bps
+	for _, step := range report.sweep[1:] {
+		if float64(step.bps) < float64(best)*(1+parallelTuneGain) {
+			break
+		}
+		report.knee, best = step.streams, step.bps
+	}
+
+	if eng.upload {
+		log.Infof("Running the %d stream upload test", report.knee)
+		result, err := client.Run(context.Background(), server, probeOptions(eng, server, report.knee, true, ""))
+		report.upload, report.upErr = result.bps, err
+	}
+
+	// UDP is sent at the best TCP rate, the loss tells whether the path keeps up with it without congestion control
+	if eng.name == engineGoperf || eng.name == engineIperf3 {
+		log.Infof("Running the UDP download test at %s", formatRate(float64(best)))
+		opts := probeOptions(eng, server, 1, false, strconv.FormatInt(best, 10))
+		opts.udp = true
+		result, err := client.Run(context.Background(), server, opts)
+		if err == nil && !result.hasUDP {
+			err = fmt.Errorf("the %s client didn't report the loss and jitter", eng.name)
+		}
+		report.udpErr = err
+		if err == nil {
+			report.udpBps, report.udpLoss, report.jitterMs = result.bps, result.lossPct, result.jitterMs
+		}
+	}
+	report.print()
+	return nil
+}
+
+// probeOptions are the client options of a probe run.
+func probeOptions(eng engine, server perfServer, streams int, reverse bool, bandwidth string) testOptions {
+	opts := testOptions{
+		address:   server.dialAddress(),
+		port:      server.serverPort(eng),
+		length:    cliFlags.probeLength,
+		parallel:  strconv.Itoa(streams),
+		reverse:   reverse,
+		bandwidth: bandwidth,
+		json:      eng.rawJSON,
+	}
+	if eng.omit {
+		opts.omit = "0"
+	}
+	return opts
+}
+
+// rampTime is how long a run took to first reach 90% of its average bitrate, zero without interval bitrates.
+func rampTime(intervals []intervalSample) time.Duration {
+	if len(intervals) == 0 {
+		return 0
+	}
+	var total float64
+	for _, interval := range intervals {
+		total += interval.bps
+	}
+	average := total / float64(len(intervals))
+	for _, interval := range intervals {
+		if interval.bps >= average*0.9 {
+			return interval.end
+		}
+	}
+	return intervals[len(intervals)-1].end
+}
+
+// print writes the summary and the suggested configuration to stdout.
+func (r probeReport) print() {
+	fmt.Printf("Probe of %s [%s] at %s with %s\n\n", r.server.Address, r.server.displayName(), r.target, r.engine)
+	switch {
+	case r.mtuErr != nil:
+		fmt.Printf("  Path MTU       unknown: %v\n", r.mtuErr)
+	default:
+		fmt.Printf("  Path MTU       %d bytes, TCP MSS %d bytes\n", r.pathMTU, r.mss)
+	}
+	switch {
+	case r.pingErr != nil:
+		fmt.Printf("  Latency        unknown: %v\n", r.pingErr)
+	case len(r.rtts) == 0:
+		fmt.Printf("  Latency        no replies to %d pings\n", r.pings)
+	default:
+		var sum time.Duration
+		for _, rtt := range r.rtts {
+			sum += rtt
+		}
+		loss := float64(r.pings-len(r.rtts)) / float64(r.pings) * 100
+		fmt.Printf("  Latency        %.2f ms average, %.0f%% of %d pings lost\n", durationMillis(sum/time.Duration(len(r.rtts))), loss, r.pings)
+	}
+	fmt.Printf("  TCP download\n")
+	for _, step := range r.sweep {
+		knee := ""
+		if step.streams == r.knee {
+			knee = "  <- the streams stop paying off past here"
+		}
+		fmt.Printf("    %2d streams   %s%s\n", step.streams, formatRate(float64(step.bps)), knee)
+	}
+	switch {
+	case r.upErr != nil:
+		fmt.Printf("  TCP upload     failed: %v\n", r.upErr)
+	case r.upload > 0:
+		fmt.Printf("  TCP upload     %s with %d streams\n", formatRate(float64(r.upload)), r.knee)
+	}
+	switch {
+	case r.udpErr != nil:
+		fmt.Printf("  UDP download   failed: %v\n", r.udpErr)
+	case r.udpBps > 0:
+		fmt.Printf("  UDP download   %s, %.2f%% lost, %.2f ms jitter\n", formatRate(float64(r.udpBps)), r.udpLoss, r.jitterMs)
+	default:
+		fmt.Printf("  UDP download   skipped, UDP is measured with the goperf engine\n")
+	}
+
+	suggested := perfServer{Address: r.server.Address, Name: r.server.displayName(), Port: r.server.Port}
+	if r.engine != engineIperf3 {
+		suggested.Engine = r.engine
+	}
+	if r.mtuErr == nil {
+		suggested.Tags = map[string]string{"path-mtu": strconv.Itoa(r.pathMTU)}
+	}
+	block, err := yaml.Marshal(map[string][]perfServer{"iperf-servers": {suggested}})
+	if err != nil {
+		log.Errorf("Error rendering the suggested configuration: %v", err)
+		return
+	}
+	fmt.Printf("\nSuggested configuration:\n\n%s", block)
+	if r.knee > 1 {
+		fmt.Printf("# the throughput stopped improving past %d streams, test with parallel-connections %d or auto\n", r.knee, r.knee)
+	}
+	if ramp, length := r.suggestedLength(); length > 0 {
+		fmt.Printf("# the TCP ramp-up takes %s, a test-length of %d keeps it under a tenth of the test\n", roundDuration(ramp), length)
+	}
+	if r.udpErr == nil && r.udpLoss > probeUDPLoss {
+		fmt.Printf("# UDP lost %.2f%% at the TCP rate, cap the UDP tests below %s with bandwidth-cap\n", r.udpLoss, formatRate(float64(r.udpBps)))
+	}
+}
+
+// suggestedLength is the ramp-up of the knee's run and the test length in seconds that keeps it under a tenth of
+// the test, the length is zero when it fits the probe's length or the engine doesn't report interval bitrates.
+func (r probeReport) suggestedLength() (time.Duration, int) {
+	var ramp time.Duration
+	for _, step := range r.sweep {
+		if step.streams == r.knee {
+			ramp = step.ramp
+		}
+	}
+	length := int(math.Ceil(ramp.Seconds() * 10))
+	if current, _ := strconv.Atoi(strings.TrimSpace(cliFlags.probeLength)); length <= current {
+		return ramp, 0
+	}
+	return ramp, length
+}
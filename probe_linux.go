@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// probeMTU connects to the perf server and reads the path MTU the kernel learned for the route and the MSS of the
+// connection.
+func probeMTU(address string, port string) (int, int, error) {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(address, port), 5*time.Second)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		return 0, 0, err
+	}
+	level, option := unix.IPPROTO_IP, unix.IP_MTU
+	if ip := conn.RemoteAddr().(*net.TCPAddr).IP; ip.To4() == nil {
+		level, option = unix.IPPROTO_IPV6, unix.IPV6_MTU
+	}
+	var mtu, mss int
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		if mtu, sockErr = unix.GetsockoptInt(int(fd), level, option); sockErr != nil {
+			return
+		}
+		mss, sockErr = unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_MAXSEG)
+	}); err != nil {
+		return 0, 0, err
+	}
+	return mtu, mss, sockErr
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// probeMTU fails as the path MTU is read from the Linux socket options, the probe reports it as unknown.
+func probeMTU(address string, port string) (int, int, error) {
+	return 0, 0, fmt.Errorf("reading the path MTU is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// testProfile is a named measurement shape every endpoint is tested with, e.g. a short burst with many
+// streams and a long capped single stream. Unset settings fall back to the global flags.
+type testProfile struct {
+	Name string `yaml:"name"`
+	// Length is the test duration in seconds.
+	Length string `yaml:"length"`
+	// Parallel is the number of parallel streams.
+	Parallel string `yaml:"parallel"`
+	// BandwidthCap overrides the endpoint and global bandwidth cap for the profile.
+	BandwidthCap string `yaml:"bandwidth-cap"`
+	// Congestion is the TCP congestion control algorithm of the profile such as bbr or cubic.
+	Congestion string `yaml:"congestion"`
+}
+
+// profiledServers returns a copy of the endpoint for every profile tagged with the profile name, or the
+// endpoint as is when no profiles are configured.
+func profiledServers(profiles []testProfile, server perfServer) []perfServer {
+	if len(profiles) == 0 {
+		return []perfServer{server}
+	}
+	servers := make([]perfServer, 0, len(profiles))
+	for i := range profiles {
+		profiled := server
+		profiled.profile = &profiles[i]
+		profiled.Tags = withTag(server.Tags, "profile", profiles[i].Name)
+		if profiles[i].BandwidthCap != "" {
+			profiled.BandwidthCap = profiles[i].BandwidthCap
+		}
+		servers = append(servers, profiled)
+	}
+	return servers
+}
+
+// resultKey identifies the results of an endpoint in its tenant or group under its test profile for state kept
+// across cycles.
+func (p perfServer) resultKey() string {
+	key := p.Address
+	if p.profile != nil {
+		key += "|" + p.profile.Name
+	}
+	if scope := resultScope(p.Tags); scope != "" {
+		key = scope + "|" + key
+	}
+	return key
+}
+
+// profileOptions applies an endpoint's test profile to the options of a test.
+func profileOptions(server perfServer, opts testOptions) testOptions {
+	if server.profile == nil {
+		return opts
+	}
+	if server.profile.Length != "" {
+		opts.length = server.profile.Length
+	}
+	if server.profile.Parallel != "" {
+		opts.parallel = server.profile.Parallel
+	}
+	if server.profile.Congestion != "" {
+		opts.congestion = server.profile.Congestion
+	}
+	return opts
+}
+
+// validateProfiles checks the profile names are unique and their settings are valid.
+func validateProfiles(profiles []testProfile) []error {
+	var errs []error
+	seen := make(map[string]bool)
+	for i, profile := range profiles {
+		if profile.Name == "" {
+			errs = append(errs, fmt.Errorf("test profile %d has no name", i+1))
+		} else if seen[profile.Name] {
+			errs = append(errs, fmt.Errorf("test profile %q is defined more than once", profile.Name))
+		}
+		seen[profile.Name] = true
+		if profile.Length != "" {
+			length, err := strconv.Atoi(profile.Length)
+			if err != nil || length <= 0 {
+				errs = append(errs, fmt.Errorf("test profile %q length must be a positive number of seconds, got %q", profile.Name, profile.Length))
+			} else if omit, err := strconv.Atoi(cliFlags.omit); err == nil && omit >= length {
+				errs = append(errs, fmt.Errorf("omit must be shorter than the %ds length of test profile %q, got %ds", length, profile.Name, omit))
+			}
+		}
+		if profile.Parallel != "" && !validParallel(profile.Parallel) {
+			errs = append(errs, fmt.Errorf("test profile %q parallel must be a positive number of streams or auto, got %q", profile.Name, profile.Parallel))
+		}
+		if profile.BandwidthCap != "" && !bandwidthPattern.MatchString(profile.BandwidthCap) {
+			errs = append(errs, fmt.Errorf("test profile %q bandwidth-cap must be a number with an optional K, M or G suffix, got %q", profile.Name, profile.BandwidthCap))
+		}
+		if profile.Congestion != "" && !congestionPattern.MatchString(profile.Congestion) {
+			errs = append(errs, fmt.Errorf("test profile %q congestion must be the name of a congestion control algorithm such as bbr or cubic, got %q", profile.Name, profile.Congestion))
+		}
+	}
+	return errs
+}
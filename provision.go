@@ -0,0 +1,472 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	providerAWS           = "aws"
+	defaultFleetName      = "cloud-bandwidth"
+	defaultInstanceType   = "t3.micro"
+	fleetTagKey           = "cloud-bandwidth-fleet"
+	amazonLinuxParameter  = "/aws/service/ami-amazon-linux-latest/al2023-ami-kernel-default-x86_64"
+	fleetStartTimeout     = 5 * time.Minute
+	fleetPollInterval     = 5 * time.Second
+	fleetServerStartDelay = 3 * time.Minute
+)
+
+// fleetUserData installs docker on Amazon Linux and starts the iperf3 server container on boot.
+const fleetUserData = `#!/bin/bash
+dnf install -y docker
+systemctl enable --now docker
+docker run -d --restart always -p %[1]s:%[1]s %[2]s -s -p %[1]s
+`
+
+// ec2Client calls the EC2 and SSM APIs of a region.
+type ec2Client struct {
+	region string
+	ec2    *ec2.EC2
+	ssm    *ssm.SSM
+}
+
+// ec2Instance is an instance in a DescribeInstances response.
+type ec2Instance struct {
+	InstanceID string
+	IPAddress  string
+	State      string
+}
+
+// provisionFleetAction starts a small VM running the iperf3 server in every region and adds them to the
+// configuration file as perf servers.
+func provisionFleetAction() error {
+	loadConfig()
+	// the perf server port is opened to this range only, there is no default so a fleet is never opened to everyone
+	if cliFlags.fleetAllowCIDR == "" {
+		return fmt.Errorf("--allow-cidr is required, the source range allowed to reach the perf servers ex. --allow-cidr=203.0.113.0/24")
+	}
+	if _, _, err := net.ParseCIDR(cliFlags.fleetAllowCIDR); err != nil {
+		return fmt.Errorf("invalid --allow-cidr %q: %v", cliFlags.fleetAllowCIDR, err)
+	}
+	regions, sess, err := fleetSetup()
+	if err != nil {
+		return err
+	}
+	port := cliFlags.perfServerPort
+	image := cliFlags.imageRepo
+	// the port and image are written into the user data script of the instances
+	if cliFlags.noShell && (!portPattern.MatchString(port) || !imagePattern.MatchString(image)) {
+		return fmt.Errorf("--no-shell requires a numeric perf-server-port and a plain image reference, got %q and %q", port, image)
+	}
+
+	var servers []perfServer
+	for _, region := range regions {
+		ec2 := newEC2Client(sess, region)
+		server, err := ec2.provision(port, image)
+		if err != nil {
+			log.Errorf("Error provisioning the perf server in %s: %v", region, err)
+			continue
+		}
+		servers = append(servers, server)
+	}
+	if len(servers) == 0 {
+		return fmt.Errorf("no perf servers were provisioned")
+	}
+
+	if cliFlags.fleetWriteConfig {
+		if err := updateConfigServers(cliFlags.configPath, servers, nil); err != nil {
+			return fmt.Errorf("the perf servers were provisioned but the configuration file could not be updated: %v", err)
+		}
+		log.Infof("Added %d perf servers to %s", len(servers), cliFlags.configPath)
+	}
+	for _, server := range servers {
+		waitForPerfServer(server)
+	}
+	return nil
+}
+
+// deprovisionFleetAction terminates the fleet's VMs and security groups and removes them from the configuration file.
+func deprovisionFleetAction() error {
+	loadConfig()
+	regions, sess, err := fleetSetup()
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, region := range regions {
+		ec2 := newEC2Client(sess, region)
+		if err := ec2.deprovision(); err != nil {
+			log.Errorf("Error deprovisioning the perf servers in %s: %v", region, err)
+			continue
+		}
+		names = append(names, fleetServerName(cliFlags.fleetName, region))
+	}
+	if cliFlags.fleetWriteConfig && len(names) > 0 {
+		if err := updateConfigServers(cliFlags.configPath, nil, names); err != nil {
+			return fmt.Errorf("the perf servers were deprovisioned but the configuration file could not be updated: %v", err)
+		}
+		log.Infof("Removed %d perf servers from %s", len(names), cliFlags.configPath)
+	}
+	return nil
+}
+
+// fleetSetup checks the provisioning flags and loads the AWS credentials with the SDK's default chain, the
+// AWS_* environment variables, the AWS_PROFILE of the shared credentials file or the instance role.
+func fleetSetup() ([]string, *session.Session, error) {
+	if cliFlags.fleetProvider != providerAWS {
+		return nil, nil, fmt.Errorf("unsupported provider %q, only aws is supported", cliFlags.fleetProvider)
+	}
+	var regions []string
+	for _, region := range strings.Split(cliFlags.fleetRegions, ",") {
+		if region = strings.TrimSpace(region); region != "" {
+			regions = append(regions, region)
+		}
+	}
+	if len(regions) == 0 {
+		return nil, nil, fmt.Errorf("at least one region is required ex. --regions=us-east-1,eu-west-1")
+	}
+	if format := configFormat(cliFlags.configPath); cliFlags.fleetWriteConfig && format != configYAML {
+		return nil, nil, fmt.Errorf("only a YAML configuration file can be updated with the perf servers, %s is %s, pass --write-config=false", cliFlags.configPath, strings.ToUpper(format))
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+		Config: aws.Config{
+			HTTPClient: &http.Client{
+				Timeout:   30 * time.Second,
+				Transport: auditedTransport{sink: providerAWS, base: &http.Transport{Proxy: http.ProxyFromEnvironment}},
+			},
+		},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := sess.Config.Credentials.Get(); err != nil {
+		return nil, nil, fmt.Errorf("no AWS credentials found: %v", err)
+	}
+	return regions, sess, nil
+}
+
+// fleetServerName is the perf server name of a fleet's VM in a region.
+func fleetServerName(fleet string, region string) string {
+	return providerAWS + "-" + fleet + "-" + region
+}
+
+func newEC2Client(sess *session.Session, region string) *ec2Client {
+	config := aws.NewConfig().WithRegion(region)
+	return &ec2Client{
+		region: region,
+		ec2:    ec2.New(sess, config),
+		ssm:    ssm.New(sess, config),
+	}
+}
+
+// provision starts a VM running the iperf3 server in the client's region and waits for its public address.
+func (c *ec2Client) provision(port string, image string) (perfServer, error) {
+	imageID, err := c.latestAmazonLinux()
+	if err != nil {
+		return perfServer{}, fmt.Errorf("could not look up the Amazon Linux image: %v", err)
+	}
+	groupID, created, err := c.securityGroup(port)
+	if err != nil {
+		return perfServer{}, err
+	}
+
+	run, err := c.ec2.RunInstances(&ec2.RunInstancesInput{
+		ImageId:                           aws.String(imageID),
+		InstanceType:                      aws.String(cliFlags.fleetInstanceType),
+		MinCount:                          aws.Int64(1),
+		MaxCount:                          aws.Int64(1),
+		UserData:                          aws.String(base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf(fleetUserData, port, image)))),
+		InstanceInitiatedShutdownBehavior: aws.String(ec2.ShutdownBehaviorTerminate),
+		MetadataOptions:                   &ec2.InstanceMetadataOptionsRequest{HttpTokens: aws.String(ec2.HttpTokensStateRequired)},
+		// the security group is set on the network interface that gets the public address
+		NetworkInterfaces: []*ec2.InstanceNetworkInterfaceSpecification{{
+			DeviceIndex:              aws.Int64(0),
+			Groups:                   aws.StringSlice([]string{groupID}),
+			AssociatePublicIpAddress: aws.Bool(true),
+		}},
+		TagSpecifications: []*ec2.TagSpecification{{
+			ResourceType: aws.String(ec2.ResourceTypeInstance),
+			Tags: []*ec2.Tag{
+				{Key: aws.String("Name"), Value: aws.String(cliFlags.fleetName + "-" + c.region)},
+				{Key: aws.String(fleetTagKey), Value: aws.String(cliFlags.fleetName)},
+			},
+		}},
+	})
+	if err == nil && len(run.Instances) == 0 {
+		err = fmt.Errorf("no instance was started")
+	}
+	if err != nil {
+		// a security group created for the instance would be left behind, deprovision only finds it with an instance
+		if created {
+			if err := c.deleteSecurityGroup(groupID); err != nil {
+				log.Errorf("Error deleting the security group %s in %s: %v", groupID, c.region, err)
+			}
+		}
+		return perfServer{}, fmt.Errorf("RunInstances: %v", err)
+	}
+	instanceID := aws.StringValue(run.Instances[0].InstanceId)
+	log.Infof("Started instance %s in %s, waiting for it to run", instanceID, c.region)
+
+	described := &ec2.DescribeInstancesInput{InstanceIds: aws.StringSlice([]string{instanceID})}
+	if err := c.waitFor(c.ec2.WaitUntilInstanceRunningWithContext, described); err != nil {
+		return perfServer{}, fmt.Errorf("instance %s did not start within %s: %v", instanceID, fleetStartTimeout, err)
+	}
+	instances, err := c.describeInstances(described)
+	if err != nil {
+		return perfServer{}, err
+	}
+	if len(instances) != 1 || instances[0].IPAddress == "" {
+		return perfServer{}, fmt.Errorf("instance %s is running without a public address", instanceID)
+	}
+	log.Infof("Instance %s in %s is running at %s", instanceID, c.region, instances[0].IPAddress)
+	return perfServer{
+		Address: instances[0].IPAddress,
+		Name:    fleetServerName(cliFlags.fleetName, c.region),
+		Tags: map[string]string{
+			"provider":    providerAWS,
+			"region":      c.region,
+			"fleet":       cliFlags.fleetName,
+			"instance-id": instanceID,
+		},
+	}, nil
+}
+
+// deprovision terminates the fleet's instances in the region and then deletes its security group.
+func (c *ec2Client) deprovision() error {
+	instances, err := c.describeInstances(&ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("tag:" + fleetTagKey), Values: aws.StringSlice([]string{cliFlags.fleetName})},
+			{Name: aws.String("instance-state-name"), Values: aws.StringSlice([]string{"pending", "running", "stopping", "stopped"})},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if len(instances) > 0 {
+		var ids []string
+		for _, instance := range instances {
+			ids = append(ids, instance.InstanceID)
+			log.Infof("Terminating instance %s (%s) in %s", instance.InstanceID, instance.IPAddress, c.region)
+		}
+		if _, err := c.ec2.TerminateInstances(&ec2.TerminateInstancesInput{InstanceIds: aws.StringSlice(ids)}); err != nil {
+			return fmt.Errorf("TerminateInstances: %v", err)
+		}
+		// the security group can only be deleted once no instance uses it
+		terminated := &ec2.DescribeInstancesInput{InstanceIds: aws.StringSlice(ids)}
+		if err := c.waitFor(c.ec2.WaitUntilInstanceTerminatedWithContext, terminated); err != nil {
+			log.Warnf("The instances in %s were not terminated within %s: %v", c.region, fleetStartTimeout, err)
+		}
+	} else {
+		log.Infof("No %s instances found in %s", cliFlags.fleetName, c.region)
+	}
+
+	groupID, err := c.findSecurityGroup()
+	if err != nil || groupID == "" {
+		return err
+	}
+	if err := c.deleteSecurityGroup(groupID); err != nil {
+		return fmt.Errorf("could not delete the security group %s: %v", groupID, err)
+	}
+	return nil
+}
+
+// waitFor polls the instances with an SDK waiter every fleetPollInterval until fleetStartTimeout.
+func (c *ec2Client) waitFor(waiter func(aws.Context, *ec2.DescribeInstancesInput, ...request.WaiterOption) error, input *ec2.DescribeInstancesInput) error {
+	return waiter(aws.BackgroundContext(), input,
+		request.WithWaiterDelay(request.ConstantWaiterDelay(fleetPollInterval)),
+		request.WithWaiterMaxAttempts(int(fleetStartTimeout/fleetPollInterval)))
+}
+
+// securityGroup returns the fleet's security group in the default VPC, creating it with the perf server port open
+// to --allow-cidr. created reports whether the group was created by this call.
+func (c *ec2Client) securityGroup(port string) (groupID string, created bool, err error) {
+	groupID, err = c.findSecurityGroup()
+	if err != nil || groupID != "" {
+		return groupID, false, err
+	}
+	portNumber, err := strconv.ParseInt(port, 10, 64)
+	if err != nil {
+		return "", false, fmt.Errorf("invalid perf server port %q: %v", port, err)
+	}
+	group, err := c.ec2.CreateSecurityGroup(&ec2.CreateSecurityGroupInput{
+		GroupName:   aws.String(cliFlags.fleetName),
+		Description: aws.String("cloud-bandwidth perf servers"),
+	})
+	if err != nil {
+		return "", false, fmt.Errorf("could not create the security group: %v", err)
+	}
+	groupID = aws.StringValue(group.GroupId)
+	_, err = c.ec2.AuthorizeSecurityGroupIngress(&ec2.AuthorizeSecurityGroupIngressInput{
+		GroupId: aws.String(groupID),
+		IpPermissions: []*ec2.IpPermission{{
+			IpProtocol: aws.String("tcp"),
+			FromPort:   aws.Int64(portNumber),
+			ToPort:     aws.Int64(portNumber),
+			IpRanges:   []*ec2.IpRange{{CidrIp: aws.String(cliFlags.fleetAllowCIDR)}},
+		}},
+	})
+	if err != nil {
+		if err := c.deleteSecurityGroup(groupID); err != nil {
+			log.Errorf("Error deleting the security group %s in %s: %v", groupID, c.region, err)
+		}
+		return "", false, fmt.Errorf("could not open port %s in the security group %s: %v", port, groupID, err)
+	}
+	log.Infof("Created the security group %s in %s allowing %s to port %s", groupID, c.region, cliFlags.fleetAllowCIDR, port)
+	return groupID, true, nil
+}
+
+// deleteSecurityGroup deletes the fleet's security group, no instance may use it anymore.
+func (c *ec2Client) deleteSecurityGroup(groupID string) error {
+	if _, err := c.ec2.DeleteSecurityGroup(&ec2.DeleteSecurityGroupInput{GroupId: aws.String(groupID)}); err != nil {
+		return err
+	}
+	log.Infof("Deleted the security group %s in %s", groupID, c.region)
+	return nil
+}
+
+// findSecurityGroup returns the ID of the fleet's security group, empty if it doesn't exist.
+func (c *ec2Client) findSecurityGroup() (string, error) {
+	groups, err := c.ec2.DescribeSecurityGroups(&ec2.DescribeSecurityGroupsInput{
+		Filters: []*ec2.Filter{{Name: aws.String("group-name"), Values: aws.StringSlice([]string{cliFlags.fleetName})}},
+	})
+	if err != nil {
+		return "", fmt.Errorf("DescribeSecurityGroups: %v", err)
+	}
+	if len(groups.SecurityGroups) == 0 {
+		return "", nil
+	}
+	return aws.StringValue(groups.SecurityGroups[0].GroupId), nil
+}
+
+// describeInstances returns the instances matching the filters or instance IDs.
+func (c *ec2Client) describeInstances(input *ec2.DescribeInstancesInput) ([]ec2Instance, error) {
+	var instances []ec2Instance
+	err := c.ec2.DescribeInstancesPages(input, func(page *ec2.DescribeInstancesOutput, last bool) bool {
+		for _, reservation := range page.Reservations {
+			for _, instance := range reservation.Instances {
+				instances = append(instances, ec2Instance{
+					InstanceID: aws.StringValue(instance.InstanceId),
+					IPAddress:  aws.StringValue(instance.PublicIpAddress),
+					State:      aws.StringValue(instance.State.Name),
+				})
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("DescribeInstances: %v", err)
+	}
+	return instances, nil
+}
+
+// latestAmazonLinux looks up the current Amazon Linux 2023 image of the region in the public SSM parameters.
+func (c *ec2Client) latestAmazonLinux() (string, error) {
+	result, err := c.ssm.GetParameter(&ssm.GetParameterInput{Name: aws.String(amazonLinuxParameter)})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(result.Parameter.Value), nil
+}
+
+// waitForPerfServer waits for the iperf3 server of a new VM to accept connections, installing docker and
+// pulling the image takes a couple of minutes after the VM is running.
+func waitForPerfServer(server perfServer) {
+	target := net.JoinHostPort(server.Address, cliFlags.perfServerPort)
+	log.Infof("Waiting for the perf server at %s [%s] to start", target, server.Name)
+	deadline := time.Now().Add(fleetServerStartDelay)
+	for time.Now().Before(deadline) {
+		if conn, err := net.DialTimeout("tcp", target, 3*time.Second); err == nil {
+			conn.Close()
+			log.Infof("The perf server at %s [%s] is up", target, server.Name)
+			return
+		}
+		time.Sleep(fleetPollInterval)
+	}
+	log.Warnf("The perf server at %s [%s] is not reachable yet, it may still be starting", target, server.Name)
+}
+
+// updateConfigServers adds perf servers to the iperf-servers of the configuration file and removes the named ones.
+// Servers with the name of an added server are replaced. The file is rewritten so a copy is kept as a .bak file,
+// comments are not preserved.
+func updateConfigServers(path string, add []perfServer, remove []string) error {
+	var doc yaml.MapSlice
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path+".bak", data, 0644); err != nil {
+			return err
+		}
+	}
+
+	drop := make(map[string]bool)
+	for _, name := range remove {
+		drop[name] = true
+	}
+	for _, server := range add {
+		drop[server.Name] = true
+	}
+
+	index := -1
+	for i, item := range doc {
+		if item.Key == "iperf-servers" {
+			index = i
+		}
+	}
+	if index < 0 {
+		doc = append(doc, yaml.MapItem{Key: "iperf-servers"})
+		index = len(doc) - 1
+	}
+	existing, _ := doc[index].Value.([]interface{})
+	var servers []interface{}
+	for _, entry := range existing {
+		if !drop[configServerName(entry)] {
+			servers = append(servers, entry)
+		}
+	}
+	for _, server := range add {
+		servers = append(servers, server)
+	}
+	doc[index].Value = servers
+
+	out, err := yaml.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, out, 0644)
+}
+
+// configServerName returns the name of an iperf-servers entry in either the address: name or the expanded form.
+func configServerName(entry interface{}) string {
+	fields, ok := entry.(yaml.MapSlice)
+	if !ok {
+		return ""
+	}
+	for _, field := range fields {
+		if field.Key == "name" {
+			return fmt.Sprint(field.Value)
+		}
+	}
+	if len(fields) == 1 && fields[0].Key != "address" {
+		return fmt.Sprint(fields[0].Value)
+	}
+	return ""
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultPushgatewayJob = "cloud-bandwidth"
+
+// promNameInvalid matches the characters not allowed in prometheus metric and label names.
+var promNameInvalid = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// promLabelEscaper escapes a label value for the text format, which only escapes the backslash, the double quote
+// and the newline. Go's %q would also escape tabs and non-ASCII characters the parsers don't unescape.
+var promLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+type pushgatewayConfig struct {
+	URL      string `yaml:"url"`
+	Job      string `yaml:"job"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// DeleteOnShutdown removes the pushed groups when the agent stops so stale results don't linger.
+	DeleteOnShutdown bool `yaml:"delete-on-shutdown"`
+}
+
+// pushgatewayGroup is the grouping key of the results of one endpoint tested from one host.
+type pushgatewayGroup struct {
+	instance string
+	endpoint string
+}
+
+// pushgatewaySink keeps the latest value of every series per endpoint and pushes each endpoint as its own
+// group, job/<job>/instance/<hostname>/endpoint/<name>, at the end of every cycle.
+type pushgatewaySink struct {
+	config pushgatewayConfig
+	client *http.Client
+	mu     sync.Mutex
+	groups map[pushgatewayGroup]map[string]string
+	pushed map[pushgatewayGroup]bool
+}
+
+var pushgateway *pushgatewaySink
+
+// mergePushgatewayFlags fills any pushgateway settings missing from the configuration file with the CLI values.
+func mergePushgatewayFlags(pc *pushgatewayConfig) {
+	if pc.URL == "" {
+		pc.URL = cliFlags.pushgatewayURL
+	}
+	if pc.Job == "" {
+		pc.Job = cliFlags.pushgatewayJob
+	}
+	if cliFlags.pushgatewayDelete {
+		pc.DeleteOnShutdown = true
+	}
+}
+
+// initPushgateway sets up the pushgateway sink if a URL was configured.
+func initPushgateway(pc pushgatewayConfig) {
+	if pc.URL == "" {
+		return
+	}
+	if pc.Job == "" {
+		pc.Job = defaultPushgatewayJob
+	}
+	pushgateway = &pushgatewaySink{
+		config: pc,
+		client: &http.Client{Timeout: 30 * time.Second},
+		groups: make(map[pushgatewayGroup]map[string]string),
+		pushed: make(map[pushgatewayGroup]bool),
+	}
+	log.Debugf("[Config] Pushgateway = %s job %s", pc.URL, pc.Job)
+}
+
+// add stores the measurement as the latest value of its series in the endpoint's group, the instance is
+// the host that ran the test so results pushed to a controller keep their agent's grouping.
+func (p *pushgatewaySink) add(m measurement) {
+	series := promSeries(m, unitOf("pushgateway"), nil)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := pushgatewayGroup{instance: m.Source, endpoint: m.Destination}
+	group, ok := p.groups[key]
+	if !ok {
+		group = make(map[string]string)
+		p.groups[key] = group
+	}
+	group[series] = m.formattedValue("pushgateway")
+}
+
+// promSeries names the prometheus series of a measurement with its labels sorted, extra labels are added to the
+// ones of the measurement. The bandwidth series is named after its unit such as cbandwidth_bandwidth_mbps.
+func promSeries(m measurement, unit bandwidthUnit, extra map[string]string) string {
+	name := "cbandwidth_bandwidth_" + strings.ToLower(unit.name)
+	if m.Metric != "" {
+		name = "cbandwidth_" + promNameInvalid.ReplaceAllString(m.Metric, "_")
+	}
+	labels := map[string]string{"source": m.Source}
+	if m.Direction != "" {
+		labels["direction"] = m.Direction
+	}
+	if m.Address != "" {
+		labels["address"] = m.Address
+	}
+	if m.Engine != "" {
+		labels["engine"] = m.Engine
+	}
+	for k, v := range m.Tags {
+		labels[promNameInvalid.ReplaceAllString(k, "_")] = v
+	}
+	for k, v := range extra {
+		labels[k] = v
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, k, promLabelEscaper.Replace(labels[k])))
+	}
+	return fmt.Sprintf("%s{%s}", name, strings.Join(pairs, ","))
+}
+
+// promExposition renders series and their values in the prometheus text format, sorted and typed as gauges.
+func promExposition(values map[string]string) []byte {
+	series := make([]string, 0, len(values))
+	for s := range values {
+		series = append(series, s)
+	}
+	sort.Strings(series)
+	var body bytes.Buffer
+	typed := make(map[string]bool)
+	for _, s := range series {
+		name := s[:strings.Index(s, "{")]
+		if !typed[name] {
+			fmt.Fprintf(&body, "# TYPE %s gauge\n", name)
+			typed[name] = true
+		}
+		fmt.Fprintf(&body, "%s %s\n", s, values[s])
+	}
+	return body.Bytes()
+}
+
+// flush replaces every endpoint group updated this cycle on the pushgateway.
+func (p *pushgatewaySink) flush() {
+	p.mu.Lock()
+	groups := p.groups
+	p.groups = make(map[pushgatewayGroup]map[string]string)
+	p.mu.Unlock()
+
+	for key, group := range groups {
+		if err := p.request("PUT", key, promExposition(group)); err != nil {
+			log.Errorf("Error pushing the results of %s to the pushgateway: %v", key.endpoint, err)
+			continue
+		}
+		p.mu.Lock()
+		p.pushed[key] = true
+		p.mu.Unlock()
+	}
+}
+
+// deleteGroups removes every group pushed by this agent.
+func (p *pushgatewaySink) deleteGroups() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key := range p.pushed {
+		if err := p.request("DELETE", key, nil); err != nil {
+			log.Errorf("Error deleting the pushgateway group of %s: %v", key.endpoint, err)
+		}
+	}
+	p.pushed = make(map[pushgatewayGroup]bool)
+}
+
+// request sends a request for a group, empty label values are base64 encoded as the pushgateway requires.
+func (p *pushgatewaySink) request(method string, key pushgatewayGroup, body []byte) error {
+	path := fmt.Sprintf("%s/metrics/job/%s/%s/%s",
+		strings.TrimRight(p.config.URL, "/"),
+		url.PathEscape(p.config.Job),
+		pushgatewayLabel("instance", key.instance),
+		pushgatewayLabel("endpoint", key.endpoint),
+	)
+	req, err := http.NewRequest(method, path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	if p.config.Username != "" {
+		req.SetBasicAuth(p.config.Username, p.config.Password)
+	}
+	resp, err := auditedDo(p.client, "pushgateway", req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBody, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(respBody))
+	}
+	return nil
+}
+
+// pushgatewayLabel encodes a grouping label for the URL path, the pushgateway rejects empty values unless
+// they're passed base64 encoded.
+func pushgatewayLabel(name string, value string) string {
+	if value == "" {
+		return name + "@base64/="
+	}
+	return name + "/" + url.PathEscape(value)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// rawKeyInvalid matches the characters replaced in the path segments of a raw output key.
+var rawKeyInvalid = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+type rawOutputConfig struct {
+	// Dir stores the raw output under a local directory.
+	Dir string `yaml:"dir"`
+	// S3 stores the raw output in an S3 or S3 compatible bucket instead.
+	S3 s3Config `yaml:"s3"`
+}
+
+type s3Config struct {
+	Bucket string `yaml:"bucket"`
+	Region string `yaml:"region"`
+	// Endpoint is the URL of an S3 compatible store such as MinIO, requests use path style addressing.
+	// AWS is used if it isn't set.
+	Endpoint     string `yaml:"endpoint"`
+	Prefix       string `yaml:"prefix"`
+	AccessKey    string `yaml:"access-key"`
+	SecretKey    string `yaml:"secret-key"`
+	SessionToken string `yaml:"session-token"`
+}
+
+// rawStore keeps the complete client output of every test run so a surprising result can be checked against
+// the evidence, iperf3 runs are stored as their JSON report.
+type rawStore struct {
+	config rawOutputConfig
+	client *http.Client
+}
+
+var raws *rawStore
+
+// mergeRawOutputFlags fills any raw output settings missing from the configuration file with the CLI values.
+func mergeRawOutputFlags(rc *rawOutputConfig) {
+	if rc.Dir == "" {
+		rc.Dir = cliFlags.rawOutputDir
+	}
+	if rc.S3.Bucket == "" {
+		rc.S3.Bucket = cliFlags.rawOutputBucket
+	}
+	if rc.S3.AccessKey == "" {
+		rc.S3.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if rc.S3.SecretKey == "" {
+		rc.S3.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if rc.S3.SessionToken == "" {
+		rc.S3.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if rc.S3.Region == "" {
+		rc.S3.Region = os.Getenv("AWS_REGION")
+	}
+}
+
+// initRawOutput sets up the raw output store if a directory or bucket was configured.
+func initRawOutput(rc rawOutputConfig) error {
+	if rc.Dir == "" && rc.S3.Bucket == "" {
+		return nil
+	}
+	if rc.Dir != "" && rc.S3.Bucket != "" {
+		return fmt.Errorf("raw output can be stored in a directory or an S3 bucket, not both")
+	}
+	if rc.Dir != "" {
+		if err := os.MkdirAll(rc.Dir, 0755); err != nil {
+			return fmt.Errorf("could not create the raw output directory: %v", err)
+		}
+		log.Debugf("[Config] Raw Output = %s", rc.Dir)
+	} else {
+		if rc.S3.AccessKey == "" || rc.S3.SecretKey == "" {
+			return fmt.Errorf("the raw output bucket requires an access-key and secret-key or the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY variables")
+		}
+		if rc.S3.Region == "" {
+			rc.S3.Region = "us-east-1"
+		}
+		log.Debugf("[Config] Raw Output = s3://%s/%s", rc.S3.Bucket, rc.S3.Prefix)
+	}
+	raws = &rawStore{
+		config: rc,
+		client: &http.Client{
+			Timeout:   60 * time.Second,
+			Transport: &http.Transport{Proxy: http.ProxyFromEnvironment},
+		},
+	}
+	return nil
+}
+
+// rawKey is the blob ID of a test run, keyed by the host, endpoint and start time.
+func rawKey(source string, server perfServer, direction string, start time.Time, run int, ext string) string {
+	name := start.UTC().Format("20060102T150405.000Z") + "-" + direction
+	if server.profile != nil {
+		name += "-" + server.profile.Name
+	}
+	name = fmt.Sprintf("%s-%d.%s", name, run, ext)
+	return strings.Join([]string{
+		rawKeyInvalid.ReplaceAllString(source, "_"),
+		rawKeyInvalid.ReplaceAllString(server.displayName(), "_"),
+		rawKeyInvalid.ReplaceAllString(name, "_"),
+	}, "/")
+}
+
+// put stores the output of a run under its key.
+func (r *rawStore) put(key string, data []byte) error {
+	if r.config.Dir != "" {
+		path := filepath.Join(r.config.Dir, filepath.FromSlash(key))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		return os.WriteFile(path, data, 0644)
+	}
+	return r.putS3(key, data)
+}
+
+// putS3 uploads an object signed with AWS signature version 4.
+func (r *rawStore) putS3(key string, data []byte) error {
+	s3 := r.config.S3
+	if s3.Prefix != "" {
+		key = strings.Trim(s3.Prefix, "/") + "/" + key
+	}
+	var host, path, scheme string
+	if s3.Endpoint == "" {
+		scheme, host, path = "https", fmt.Sprintf("%s.s3.%s.amazonaws.com", s3.Bucket, s3.Region), "/"+key
+	} else {
+		endpoint := strings.TrimRight(s3.Endpoint, "/")
+		scheme = "https"
+		if i := strings.Index(endpoint, "://"); i >= 0 {
+			scheme, endpoint = endpoint[:i], endpoint[i+3:]
+		}
+		host, path = endpoint, "/"+s3.Bucket+"/"+key
+	}
+	req, err := http.NewRequest("PUT", scheme+"://"+host+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	// the key's extension follows the output format, JSON from iperf3 --json and plain text otherwise
+	contentType := mime.TypeByExtension(filepath.Ext(key))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	req.Header.Set("Content-Type", contentType)
+	signAWSRequest(req, data, s3.Region, "s3", awsCredentials{
+		AccessKey:    s3.AccessKey,
+		SecretKey:    s3.SecretKey,
+		SessionToken: s3.SessionToken,
+	})
+
+	resp, err := auditedDo(r.client, "s3", req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRedisPort = "6379"
+	redisTimeout     = 10 * time.Second
+)
+
+// redisAcquireScript reserves a slot for a holder or renews the slot it already holds, it returns an empty string
+// if the slot was granted and the current holder if it wasn't.
+const redisAcquireScript = `local current = redis.call('get', KEYS[1])
+if current == false or current == ARGV[1] then
+	redis.call('set', KEYS[1], ARGV[1], 'px', ARGV[2])
+	return ''
+end
+return current`
+
+// redisReleaseScript frees a slot only if it's still the holder's, a slot that expired and was reserved by another
+// agent is left alone.
+const redisReleaseScript = `if redis.call('get', KEYS[1]) == ARGV[1] then
+	return redis.call('del', KEYS[1])
+end
+return 0`
+
+// redisSlots reserves the slots as keys in a Redis shared by the agents, with a client of just the commands it
+// needs. Every command is sent on a new connection as the slots are reserved a few times per test.
+type redisSlots struct {
+	address  string
+	username string
+	password string
+	db       string
+	tls      bool
+}
+
+// parseRedisURL reads a redis://[[user]:password@]host[:port][/db] URL, rediss:// connects with TLS.
+func parseRedisURL(rawURL string) (*redisSlots, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" || (u.Scheme != "redis" && u.Scheme != "rediss") {
+		return nil, fmt.Errorf("slots redis must be a URL such as redis://:password@host:6379/0, got %q", rawURL)
+	}
+	r := &redisSlots{address: u.Host, tls: u.Scheme == "rediss"}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		r.address = net.JoinHostPort(u.Hostname(), defaultRedisPort)
+	}
+	if u.User != nil {
+		r.username = u.User.Username()
+		r.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if _, err := strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("slots redis database must be a number, got %q", db)
+		}
+		r.db = db
+	}
+	return r, nil
+}
+
+func (r *redisSlots) acquire(key string, holder string, ttl time.Duration) (bool, string, error) {
+	reply, err := r.command("EVAL", redisAcquireScript, "1", key, holder, strconv.FormatInt(ttl.Milliseconds(), 10))
+	if err != nil {
+		return false, "", err
+	}
+	current, _ := reply.(string)
+	return current == "", current, nil
+}
+
+func (r *redisSlots) release(key string, holder string) error {
+	_, err := r.command("EVAL", redisReleaseScript, "1", key, holder)
+	return err
+}
+
+// command authenticates, selects the database and runs a command, returning its reply.
+func (r *redisSlots) command(args ...string) (interface{}, error) {
+	conn, err := net.DialTimeout("tcp", r.address, redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if r.tls {
+		host, _, _ := net.SplitHostPort(r.address)
+		conn = tls.Client(conn, &tls.Config{ServerName: host})
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(redisTimeout))
+
+	var commands [][]string
+	if r.password != "" {
+		if r.username != "" {
+			commands = append(commands, []string{"AUTH", r.username, r.password})
+		} else {
+			commands = append(commands, []string{"AUTH", r.password})
+		}
+	}
+	if r.db != "" {
+		commands = append(commands, []string{"SELECT", r.db})
+	}
+	commands = append(commands, args)
+	var request strings.Builder
+	for _, command := range commands {
+		fmt.Fprintf(&request, "*%d\r\n", len(command))
+		for _, arg := range command {
+			fmt.Fprintf(&request, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	if _, err := io.WriteString(conn, request.String()); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	var reply interface{}
+	for i := range commands {
+		if reply, err = readRedisReply(reader); err != nil {
+			return nil, fmt.Errorf("%s: %v", commands[i][0], err)
+		}
+	}
+	return reply, nil
+}
+
+// readRedisReply reads a simple string, error, integer or bulk string reply, a nil bulk string is read as nil.
+func readRedisReply(reader *bufio.Reader) (interface{}, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, fmt.Errorf("%s", line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid bulk length %q", line[1:])
+		}
+		if length < 0 {
+			return nil, nil
+		}
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:length]), nil
+	default:
+		return nil, fmt.Errorf("unsupported reply %q", line)
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// remoteDockerTimeout bounds every call to a remote Docker API, pulling a missing image included.
+	remoteDockerTimeout = 2 * time.Minute
+	// remoteServerReady is how long a just started server container has to start listening.
+	remoteServerReady = 15 * time.Second
+	// remoteContainerLabel marks the server containers started by the agent.
+	remoteContainerLabel = "cloud-bandwidth.server"
+)
+
+// remoteDockerConfig is the Docker or Podman API of an endpoint, the agent starts the perf server there in a
+// container just before the endpoint's tests and removes it afterwards so no perf port stays open.
+type remoteDockerConfig struct {
+	// Host is the API address, tcp://host:2376 over TLS or unix:///var/run/docker.sock.
+	Host string `yaml:"host" json:"host"`
+	// TLSCA, TLSCert and TLSKey are the CA of the daemon and the client certificate it requires.
+	TLSCA   string `yaml:"tls-ca,omitempty" json:"tls-ca,omitempty"`
+	TLSCert string `yaml:"tls-cert,omitempty" json:"tls-cert,omitempty"`
+	TLSKey  string `yaml:"tls-key,omitempty" json:"tls-key,omitempty"`
+	// Image overrides the engine's server image.
+	Image string `yaml:"image,omitempty" json:"image,omitempty"`
+}
+
+// remoteDockerClient calls the Docker Engine API of an endpoint.
+type remoteDockerClient struct {
+	base   string
+	client *http.Client
+}
+
+// newRemoteDockerClient connects to a Docker API over TLS with a client certificate, or over a unix socket. A
+// Docker API reachable over plain TCP gives root on its host to anyone who can reach it, it's refused.
+func newRemoteDockerClient(dc *remoteDockerConfig) (*remoteDockerClient, error) {
+	u, err := url.Parse(dc.Host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid docker host %q: %v", dc.Host, err)
+	}
+	transport := &http.Transport{}
+	c := &remoteDockerClient{client: &http.Client{Transport: transport, Timeout: remoteDockerTimeout}}
+	switch u.Scheme {
+	case "unix":
+		socket := u.Path
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+		c.base = "http://docker"
+	case "tcp", "https":
+		if dc.TLSCert == "" || dc.TLSKey == "" {
+			return nil, fmt.Errorf("docker host %s needs TLS, set the tls-cert and tls-key of a client certificate the daemon trusts", dc.Host)
+		}
+		tlsConfig, err := tlsClientConfig(dc.TLSCA, dc.TLSCert, dc.TLSKey, false)
+		if err != nil {
+			return nil, fmt.Errorf("docker host %s: %v", dc.Host, err)
+		}
+		transport.TLSClientConfig = tlsConfig
+		c.base = "https://" + u.Host
+	default:
+		return nil, fmt.Errorf("docker host must be tcp://host:port over TLS or unix:///path, got %q", dc.Host)
+	}
+	return c, nil
+}
+
+// validateRemoteDocker checks the docker settings of an endpoint.
+func validateRemoteDocker(dc *remoteDockerConfig) error {
+	if dc == nil {
+		return nil
+	}
+	if dc.Host == "" {
+		return fmt.Errorf("docker needs the host of the Docker API")
+	}
+	if (dc.TLSCert == "") != (dc.TLSKey == "") {
+		return fmt.Errorf("docker tls-cert and tls-key must be set together")
+	}
+	if dc.Image != "" && !imagePattern.MatchString(dc.Image) {
+		return fmt.Errorf("docker image %q is not a plain image reference", dc.Image)
+	}
+	_, err := newRemoteDockerClient(dc)
+	return err
+}
+
+// startRemoteContainers starts the perf server of an endpoint in a container on its Docker host, one per port of
+// a striped endpoint, and returns a function removing them. The containers use the host network so every port
+// the engine opens is reachable, netperf's data connections included.
+func startRemoteContainers(eng engine, server perfServer) (func(), error) {
+	dc := server.Docker
+	if eng.serverArgs == nil {
+		return nil, fmt.Errorf("the %s engine has no server to start in a container", eng.name)
+	}
+	image := dc.Image
+	if image == "" {
+		image = eng.serverImage
+	}
+	if image == "" {
+		return nil, fmt.Errorf("there is no default container image for the %s server, set the docker image of the endpoint", eng.name)
+	}
+	client, err := newRemoteDockerClient(dc)
+	if err != nil {
+		return nil, err
+	}
+	ports := stripePorts(eng, server)
+	if len(ports) == 0 {
+		ports = []string{server.serverPort(eng)}
+	}
+
+	var ids []string
+	cleanup := func() {
+		for _, id := range ids {
+			if err := client.remove(id); err != nil {
+				log.Errorf("Error removing the %s server container %s on %s: %v", eng.name, shortID(id), dc.Host, err)
+			} else {
+				log.Debugf("[Docker] Removed the %s server container %s on %s", eng.name, shortID(id), dc.Host)
+			}
+		}
+	}
+	for _, port := range ports {
+		id, err := client.run(image, strings.Fields(eng.serverArgs(port)))
+		if err != nil {
+			cleanup()
+			return nil, fmt.Errorf("could not start the %s server container on %s: %v", eng.name, dc.Host, err)
+		}
+		ids = append(ids, id)
+		log.Debugf("[Docker] Started the %s server container %s on %s listening on port %s", eng.name, shortID(id), dc.Host, port)
+	}
+	for _, port := range ports {
+		if err := waitListening(net.JoinHostPort(server.Address, port), remoteServerReady); err != nil {
+			cleanup()
+			return nil, fmt.Errorf("the %s server container on %s isn't listening on port %s: %v", eng.name, dc.Host, port, err)
+		}
+	}
+	return cleanup, nil
+}
+
+// run creates and starts a container, pulling the image as the --image-pull-policy says: first with always, if the
+// host doesn't have it with ifnotpresent, and never with never.
+func (c *remoteDockerClient) run(image string, cmd []string) (string, error) {
+	body := map[string]interface{}{
+		"Image":  image,
+		"Cmd":    cmd,
+		"Labels": map[string]string{remoteContainerLabel: "true"},
+		"HostConfig": map[string]interface{}{
+			"NetworkMode": "host",
+			"AutoRemove":  true,
+		},
+	}
+	var created struct {
+		ID string `json:"Id"`
+	}
+	if cliFlags.imagePullPolicy == imagePullAlways {
+		log.Infof("[Docker] Pulling %s", image)
+		if err := c.pull(image); err != nil {
+			return "", err
+		}
+	}
+	status, err := c.do("POST", "/containers/create", body, &created)
+	if status == http.StatusNotFound && cliFlags.imagePullPolicy == imagePullNever {
+		return "", fmt.Errorf("image %s isn't on the docker host and image-pull-policy is never", image)
+	}
+	if status == http.StatusNotFound {
+		log.Infof("[Docker] Pulling %s", image)
+		if err := c.pull(image); err != nil {
+			return "", err
+		}
+		status, err = c.do("POST", "/containers/create", body, &created)
+	}
+	if err != nil {
+		return "", err
+	}
+	if _, err := c.do("POST", "/containers/"+created.ID+"/start", nil, nil); err != nil {
+		c.remove(created.ID)
+		return "", err
+	}
+	return created.ID, nil
+}
+
+// pull pulls an image, the API streams the progress and reports a failure in it rather than in the status. An image
+// pinned by digest is pulled by the full reference, the daemon verifies its content against the digest.
+func (c *remoteDockerClient) pull(image string) error {
+	query := url.Values{"fromImage": {image}}
+	if !imagePinned(image) {
+		name, tag := image, "latest"
+		if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+			name, tag = image[:i], image[i+1:]
+		}
+		query = url.Values{"fromImage": {name}, "tag": {tag}}
+	}
+	req, err := http.NewRequest("POST", c.base+"/images/create?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := auditedDo(c.client, "docker", req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	progress, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("pulling %s: unexpected status %s: %s", image, resp.Status, bytes.TrimSpace(progress))
+	}
+	if i := bytes.Index(progress, []byte(`"error"`)); i >= 0 {
+		return fmt.Errorf("pulling %s: %s", image, bytes.TrimSpace(progress[i:]))
+	}
+	return nil
+}
+
+// remove force removes a container, one that already exited was removed by the daemon.
+func (c *remoteDockerClient) remove(id string) error {
+	status, err := c.do("DELETE", "/containers/"+id+"?force=true", nil, nil)
+	if status == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+// do sends a JSON request to the Docker API and decodes the JSON response, it returns the status code with any
+// error.
+func (c *remoteDockerClient) do(method string, path string, body interface{}, result interface{}) (int, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, c.base+path, reader)
+	if err != nil {
+		return 0, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := auditedDo(c.client, "docker", req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var apiErr struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(respBody, &apiErr) == nil && apiErr.Message != "" {
+			return resp.StatusCode, fmt.Errorf("%s", apiErr.Message)
+		}
+		return resp.StatusCode, fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(respBody))
+	}
+	if result == nil || len(respBody) == 0 {
+		return resp.StatusCode, nil
+	}
+	return resp.StatusCode, json.Unmarshal(respBody, result)
+}
+
+// waitListening waits for a TCP port to accept connections.
+func waitListening(address string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		conn, err := net.DialTimeout("tcp", address, time.Second)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+// shortID shortens a container ID the way the docker CLI shows it.
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
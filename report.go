@@ -0,0 +1,367 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xitongsys/parquet-go/source"
+)
+
+const (
+	reportFormatMarkdown = "markdown"
+	reportFormatHTML     = "html"
+	reportDayLayout      = "2006-01-02"
+)
+
+// reportPoint is a bandwidth result read back from the file output.
+type reportPoint struct {
+	timestamp   time.Time
+	destination string
+	prefix      string
+	bps         float64
+}
+
+// reportRow summarizes the results of an endpoint in one series over the report period. Previous is the
+// average over the period before it, zero if there were no results then. Compliance is the percent of the results
+// that reached the SLATarget bandwidth, SLATarget is zero for a series without an SLA.
+type reportRow struct {
+	Endpoint    string
+	Series      string
+	Tests       int
+	Average     float64
+	P95         float64
+	WorstDay    string
+	WorstDayAvg float64
+	Previous    float64
+	SLATarget   float64
+	SLAPercent  float64
+	Compliance  float64
+}
+
+// reportAction prints a summary of the results stored by the file output over the last --period with the
+// averages, p95s, worst days and the change from the period before, as Markdown or HTML.
+func reportAction() error {
+	config := loadConfig()
+	period, err := parsePeriod(cliFlags.reportPeriod)
+	if err != nil {
+		return err
+	}
+	if cliFlags.reportFormat != reportFormatMarkdown && cliFlags.reportFormat != reportFormatHTML {
+		return fmt.Errorf("report format must be markdown or html, got %q", cliFlags.reportFormat)
+	}
+	dir := cliFlags.reportDir
+	if dir == "" {
+		dir = config.FileOutput.Dir
+	}
+	if dir == "" {
+		return fmt.Errorf("report reads the results stored by the file output, pass --dir or set file-output.dir")
+	}
+	now := time.Now()
+	points, err := readHistory(dir, now.Add(-2*period))
+	if err != nil {
+		return err
+	}
+	rows := buildReport(points, now, period)
+	months := reportSLA(config, rows, points, now, period)
+
+	var out io.Writer = os.Stdout
+	if cliFlags.reportOutput != "" {
+		file, err := os.Create(cliFlags.reportOutput)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+	title := fmt.Sprintf("Bandwidth report for the %s to %s", cliFlags.reportPeriod, now.Format(reportDayLayout))
+	if cliFlags.reportFormat == reportFormatHTML {
+		return writeHTMLReport(out, title, rows, months)
+	}
+	return writeMarkdownReport(out, title, rows, months)
+}
+
+// parsePeriod parses a report period in days such as 7d or 30d, weeks such as 2w, or a Go duration such as 12h.
+func parsePeriod(text string) (time.Duration, error) {
+	var period time.Duration
+	var err error
+	switch {
+	case strings.HasSuffix(text, "d"):
+		var days int
+		days, err = strconv.Atoi(strings.TrimSuffix(text, "d"))
+		period = time.Duration(days) * 24 * time.Hour
+	case strings.HasSuffix(text, "w"):
+		var weeks int
+		weeks, err = strconv.Atoi(strings.TrimSuffix(text, "w"))
+		period = time.Duration(weeks) * 7 * 24 * time.Hour
+	default:
+		period, err = time.ParseDuration(text)
+	}
+	if err != nil || period <= 0 {
+		return 0, fmt.Errorf("period must be a number of days such as 30d, weeks such as 2w or a duration such as 12h, got %q", text)
+	}
+	return period, nil
+}
+
+// readHistory reads the bandwidth results since a time from the csv and parquet files of the file output. A
+// parquet file still being written has no footer yet and is skipped.
+func readHistory(dir string, since time.Time) ([]reportPoint, error) {
+	var points []reportPoint
+	for _, format := range []string{fileFormatCSV, fileFormatParquet} {
+		names, err := filepath.Glob(filepath.Join(dir, filePrefix+"*."+format))
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			var read []reportPoint
+			if format == fileFormatCSV {
+				read, err = readCSVHistory(name)
+			} else {
+				read, err = readParquetHistory(name)
+			}
+			if err != nil {
+				log.Warnf("Skipping %s: %v", name, err)
+				continue
+			}
+			for _, point := range read {
+				if !point.timestamp.Before(since) {
+					points = append(points, point)
+				}
+			}
+		}
+	}
+	return points, nil
+}
+
+// readCSVHistory reads the bandwidth results of a csv output file, companion metrics are left out.
+func readCSVHistory(name string) ([]reportPoint, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	var points []reportPoint
+	for i, record := range records {
+		if i == 0 || len(record) != len(csvHeader) || record[8] != "" {
+			continue
+		}
+		timestamp, err := time.Parse(time.RFC3339, record[0])
+		if err != nil {
+			continue
+		}
+		bps, err := strconv.ParseFloat(record[7], 64)
+		if err != nil {
+			continue
+		}
+		points = append(points, reportPoint{timestamp: timestamp, destination: record[2], prefix: record[5], bps: bps})
+	}
+	return points, nil
+}
+
+// parquetFile reads a local parquet file for the parquet reader, which opens it again for every column. An empty
+// name is the same file.
+type parquetFile struct {
+	*os.File
+	name string
+}
+
+func (f parquetFile) Open(name string) (source.ParquetFile, error) {
+	if name == "" {
+		name = f.name
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return parquetFile{file, name}, nil
+}
+
+func (f parquetFile) Create(name string) (source.ParquetFile, error) {
+	return nil, fmt.Errorf("the report only reads parquet files")
+}
+
+// readParquetHistory reads the bandwidth results of a parquet output file, companion metrics are left out.
+func readParquetHistory(name string) ([]reportPoint, error) {
+	rows, err := readParquetRows(name)
+	if err != nil {
+		return nil, err
+	}
+	var points []reportPoint
+	for _, row := range rows {
+		if row.Metric != "" {
+			continue
+		}
+		points = append(points, reportPoint{
+			timestamp:   time.Unix(0, row.Timestamp*int64(time.Millisecond)),
+			destination: row.Destination,
+			prefix:      row.Prefix,
+			bps:         float64(row.Bps),
+		})
+	}
+	return points, nil
+}
+
+// buildReport summarizes the results of every endpoint and series over the period ending now and compares them
+// to the period before. The rows are sorted by endpoint and series.
+func buildReport(points []reportPoint, now time.Time, period time.Duration) []reportRow {
+	start, previousStart := now.Add(-period), now.Add(-2*period)
+	current := make(map[string][]reportPoint)
+	previous := make(map[string][]float64)
+	for _, point := range points {
+		key := point.destination + "|" + point.prefix
+		switch {
+		case !point.timestamp.Before(start):
+			current[key] = append(current[key], point)
+		case !point.timestamp.Before(previousStart):
+			previous[key] = append(previous[key], point.bps)
+		}
+	}
+
+	rows := make([]reportRow, 0, len(current))
+	for key, series := range current {
+		values := make([]float64, 0, len(series))
+		days := make(map[string][]float64)
+		for _, point := range series {
+			values = append(values, point.bps)
+			day := point.timestamp.Local().Format(reportDayLayout)
+			days[day] = append(days[day], point.bps)
+		}
+		parts := strings.SplitN(key, "|", 2)
+		row := reportRow{
+			Endpoint: parts[0],
+			Series:   parts[1],
+			Tests:    len(values),
+			Average:  mean(values),
+			P95:      percentile(values, 95),
+		}
+		for day, dayValues := range days {
+			dayAvg := mean(dayValues)
+			if row.WorstDay == "" || dayAvg < row.WorstDayAvg || (dayAvg == row.WorstDayAvg && day < row.WorstDay) {
+				row.WorstDay, row.WorstDayAvg = day, dayAvg
+			}
+		}
+		if before := previous[key]; len(before) > 0 {
+			row.Previous = mean(before)
+		}
+		rows = append(rows, row)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Endpoint != rows[j].Endpoint {
+			return rows[i].Endpoint < rows[j].Endpoint
+		}
+		return rows[i].Series < rows[j].Series
+	})
+	return rows
+}
+
+// Change formats the change of the average from the previous period in percent, n/a without previous results.
+func (r reportRow) Change() string {
+	if r.Previous <= 0 {
+		return "n/a"
+	}
+	return fmt.Sprintf("%+.1f%%", (r.Average-r.Previous)/r.Previous*100)
+}
+
+// SLA formats the compliance with the SLA over the period, n/a for a series without an SLA.
+func (r reportRow) SLA() string {
+	if r.SLATarget <= 0 {
+		return "n/a"
+	}
+	met := "met"
+	if r.Compliance < r.SLAPercent {
+		met = "missed"
+	}
+	return fmt.Sprintf("%.2f%% at %s, %s %.4g%%", r.Compliance, formatRate(r.SLATarget), met, r.SLAPercent)
+}
+
+// formatRate formats a bitrate with the largest unit keeping it above 1.
+func formatRate(bps float64) string {
+	switch {
+	case bps >= 1e9:
+		return fmt.Sprintf("%.2f Gbps", bps/1e9)
+	case bps >= 1e6:
+		return fmt.Sprintf("%.1f Mbps", bps/1e6)
+	case bps >= 1e3:
+		return fmt.Sprintf("%.1f Kbps", bps/1e3)
+	}
+	return fmt.Sprintf("%.0f bps", bps)
+}
+
+// writeMarkdownReport writes the report as a Markdown table, followed by the monthly SLA compliance if any endpoint
+// has an SLA.
+func writeMarkdownReport(w io.Writer, title string, rows []reportRow, months []slaMonthRow) error {
+	fmt.Fprintf(w, "# %s\n\n", title)
+	if len(rows) == 0 {
+		_, err := fmt.Fprintln(w, "No results were stored in the period.")
+		return err
+	}
+	fmt.Fprintln(w, "Endpoint | Series | Tests | Average | p95 | Worst Day | Change | SLA")
+	fmt.Fprintln(w, "-------- | ------ | ----- | ------- | --- | --------- | ------ | ---")
+	for _, row := range rows {
+		fmt.Fprintf(w, "%s | %s | %d | %s | %s | %s (%s) | %s | %s\n", row.Endpoint, row.Series, row.Tests,
+			formatRate(row.Average), formatRate(row.P95), row.WorstDay, formatRate(row.WorstDayAvg), row.Change(), row.SLA())
+	}
+	fmt.Fprintln(w, "\nChange is the average compared to the period before, SLA the percent of the tests at the SLA bandwidth.")
+	if len(months) == 0 {
+		return nil
+	}
+	fmt.Fprint(w, "\n## Monthly SLA Compliance\n\n")
+	fmt.Fprintln(w, "Endpoint | Series | Month | Tests | Compliance | Target | Met")
+	fmt.Fprintln(w, "-------- | ------ | ----- | ----- | ---------- | ------ | ---")
+	for _, month := range months {
+		fmt.Fprintf(w, "%s | %s | %s | %d | %.2f%% | %.4g%% at %s | %s\n", month.Endpoint, month.Series, month.Month,
+			month.Tests, month.Compliance, month.Percent, formatRate(month.Target), month.Met())
+	}
+	_, err := fmt.Fprintln(w, "\nThe first and last months are partial when the period doesn't start and end with them.")
+	return err
+}
+
+// reportHTML is the HTML report, the values are escaped by html/template.
+var reportHTML = template.Must(template.New("report").Funcs(template.FuncMap{"rate": formatRate}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: right; }
+th:first-child, td:first-child, th:nth-child(2), td:nth-child(2) { text-align: left; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+{{if .Rows}}<table>
+<tr><th>Endpoint</th><th>Series</th><th>Tests</th><th>Average</th><th>p95</th><th>Worst Day</th><th>Change</th><th>SLA</th></tr>
+{{range .Rows}}<tr><td>{{.Endpoint}}</td><td>{{.Series}}</td><td>{{.Tests}}</td><td>{{rate .Average}}</td><td>{{rate .P95}}</td><td>{{.WorstDay}} ({{rate .WorstDayAvg}})</td><td>{{.Change}}</td><td>{{.SLA}}</td></tr>
+{{end}}</table>
+<p>Change is the average compared to the period before, SLA the percent of the tests at the SLA bandwidth.</p>{{if .Months}}
+<h2>Monthly SLA Compliance</h2>
+<table>
+<tr><th>Endpoint</th><th>Series</th><th>Month</th><th>Tests</th><th>Compliance</th><th>Target</th><th>Met</th></tr>
+{{range .Months}}<tr><td>{{.Endpoint}}</td><td>{{.Series}}</td><td>{{.Month}}</td><td>{{.Tests}}</td><td>{{printf "%.2f" .Compliance}}%</td><td>{{printf "%.4g" .Percent}}% at {{rate .Target}}</td><td>{{.Met}}</td></tr>
+{{end}}</table>
+<p>The first and last months are partial when the period doesn't start and end with them.</p>{{end}}{{else}}<p>No results were stored in the period.</p>{{end}}
+</body>
+</html>
+`))
+
+// writeHTMLReport writes the report as a standalone HTML page.
+func writeHTMLReport(w io.Writer, title string, rows []reportRow, months []slaMonthRow) error {
+	return reportHTML.Execute(w, struct {
+		Title  string
+		Rows   []reportRow
+		Months []slaMonthRow
+	}{title, rows, months})
+}
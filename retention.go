@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+const (
+	// rollupPrefix names the files of hourly averages compacted from the raw output files.
+	rollupPrefix = filePrefix + "rollup-"
+	// fileTimeLayout is the UTC start time in the name of an output file.
+	fileTimeLayout = "20060102T150405Z"
+)
+
+// rollupKey identifies a series within an hour of a rollup.
+type rollupKey struct {
+	hour                                                            int64
+	source, destination, address, direction, prefix, engine, metric string
+	tags                                                            string
+}
+
+// rollupSum accumulates the rows of a series within an hour.
+type rollupSum struct {
+	bps   float64
+	value float64
+	count int
+}
+
+// compact rolls the raw output files that ended more than raw-retention ago up into hourly averages, and removes
+// the rollups whose last hour is older than rollup-retention. The files are the agent's only local store, there is
+// no database to downsample. It runs whenever a file is opened, on start and at every rotation, so the file being
+// written is never touched.
+func (f *fileSink) compact(now time.Time) {
+	if f.rawRetention > 0 {
+		// a raw file ends where the next one starts, the newest one is still being written
+		raws := f.rawFiles()
+		for i := 0; i+1 < len(raws); i++ {
+			end, ok := fileTime(raws[i+1])
+			if !ok || end.After(now.Add(-f.rawRetention)) {
+				break
+			}
+			if err := f.compactFile(raws[i]); err != nil {
+				log.Errorf("Error compacting the output file %s: %v", raws[i], err)
+			}
+		}
+	}
+	if f.rollupRetention <= 0 {
+		return
+	}
+	rollups, err := filepath.Glob(filepath.Join(f.config.Dir, rollupPrefix+"*."+f.config.Format))
+	if err != nil {
+		return
+	}
+	for _, name := range rollups {
+		// the modification time of a rollup is the end of its last hour
+		if info, err := os.Stat(name); err == nil && info.ModTime().Before(now.Add(-f.rollupRetention)) {
+			if err := os.Remove(name); err != nil {
+				log.Errorf("Error removing the expired rollup file %s: %v", name, err)
+			} else {
+				log.Debugf("Removed the expired rollup file %s", name)
+			}
+		}
+	}
+}
+
+// rawFiles returns the raw output files oldest first, the rollups left out.
+func (f *fileSink) rawFiles() []string {
+	matches, err := filepath.Glob(filepath.Join(f.config.Dir, filePrefix+"*."+f.config.Format))
+	if err != nil {
+		return nil
+	}
+	var raws []string
+	for _, name := range matches {
+		if !strings.HasPrefix(filepath.Base(name), rollupPrefix) {
+			raws = append(raws, name)
+		}
+	}
+	// the timestamped names sort oldest first
+	sort.Strings(raws)
+	return raws
+}
+
+// fileTime parses the start time in the name of a raw output file.
+func fileTime(name string) (time.Time, bool) {
+	stamp := strings.TrimPrefix(filepath.Base(name), filePrefix)
+	stamp = strings.TrimSuffix(stamp, filepath.Ext(stamp))
+	t, err := time.Parse(fileTimeLayout, stamp)
+	return t, err == nil
+}
+
+// compactFile replaces a raw output file with a rollup file of the same format holding the hourly average of
+// every series, tagged rollup=1h.
+func (f *fileSink) compactFile(name string) error {
+	rows, err := readOutputRows(name, f.config.Format)
+	if err != nil {
+		return err
+	}
+	rollup, last := rollupRows(rows)
+	start, _ := fileTime(name)
+	out := filepath.Join(f.config.Dir, fmt.Sprintf("%s%s.%s", rollupPrefix, start.UTC().Format(fileTimeLayout), f.config.Format))
+	if len(rollup) > 0 {
+		if err := writeOutputRows(out, f.config.Format, rollup); err != nil {
+			os.Remove(out)
+			return err
+		}
+		if err := os.Chtimes(out, last, last); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(name); err != nil {
+		return err
+	}
+	log.Debugf("Compacted %s with %d rows into %d hourly rows", name, len(rows), len(rollup))
+	return nil
+}
+
+// rollupRows averages the rows of every series per hour, it returns the averages in the order the series first
+// appeared with the end of the last hour.
+func rollupRows(rows []parquetRow) ([]parquetRow, time.Time) {
+	hourMS := int64(time.Hour / time.Millisecond)
+	sums := make(map[rollupKey]*rollupSum)
+	var keys []rollupKey
+	var last int64
+	for _, row := range rows {
+		key := rollupKey{
+			hour:        row.Timestamp - row.Timestamp%hourMS,
+			source:      row.Source,
+			destination: row.Destination,
+			address:     row.Address,
+			direction:   row.Direction,
+			prefix:      row.Prefix,
+			engine:      row.Engine,
+			metric:      row.Metric,
+			tags:        row.Tags,
+		}
+		sum, ok := sums[key]
+		if !ok {
+			sum = &rollupSum{}
+			sums[key] = sum
+			keys = append(keys, key)
+		}
+		sum.bps += float64(row.Bps)
+		sum.value += row.Value
+		sum.count++
+		if key.hour+hourMS > last {
+			last = key.hour + hourMS
+		}
+	}
+	rollup := make([]parquetRow, 0, len(keys))
+	for _, key := range keys {
+		sum := sums[key]
+		rollup = append(rollup, parquetRow{
+			Timestamp:   key.hour,
+			Source:      key.source,
+			Destination: key.destination,
+			Address:     key.address,
+			Direction:   key.direction,
+			Prefix:      key.prefix,
+			Engine:      key.engine,
+			Bps:         int64(math.Round(sum.bps / float64(sum.count))),
+			Metric:      key.metric,
+			Value:       sum.value / float64(sum.count),
+			Tags:        addFlatTag(key.tags, "rollup=1h"),
+		})
+	}
+	return rollup, time.Unix(0, last*int64(time.Millisecond))
+}
+
+// addFlatTag adds a k=v pair to tags flattened by flattenTags, keeping them sorted.
+func addFlatTag(tags string, pair string) string {
+	if tags == "" {
+		return pair
+	}
+	pairs := append(strings.Split(tags, ";"), pair)
+	sort.Strings(pairs)
+	return strings.Join(pairs, ";")
+}
+
+// readOutputRows reads every row of a csv or parquet output file.
+func readOutputRows(name string, format string) ([]parquetRow, error) {
+	if format == fileFormatParquet {
+		return readParquetRows(name)
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	var rows []parquetRow
+	for i, record := range records {
+		if i == 0 || len(record) != len(csvHeader) {
+			continue
+		}
+		timestamp, err := time.Parse(time.RFC3339, record[0])
+		if err != nil {
+			continue
+		}
+		bps, _ := strconv.ParseInt(record[7], 10, 64)
+		value, _ := strconv.ParseFloat(record[9], 64)
+		rows = append(rows, parquetRow{
+			Timestamp:   timestamp.UnixNano() / 1e6,
+			Source:      record[1],
+			Destination: record[2],
+			Address:     record[3],
+			Direction:   record[4],
+			Prefix:      record[5],
+			Engine:      record[6],
+			Bps:         bps,
+			Metric:      record[8],
+			Value:       value,
+			Tags:        record[10],
+		})
+	}
+	return rows, nil
+}
+
+// readParquetRows reads every row of a parquet output file.
+func readParquetRows(name string) ([]parquetRow, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	pr, err := reader.NewParquetReader(parquetFile{file, name}, new(parquetRow), 1)
+	if err != nil {
+		return nil, err
+	}
+	defer pr.ReadStop()
+	rows := make([]parquetRow, pr.GetNumRows())
+	if err := pr.Read(&rows); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// writeOutputRows writes rows to a new csv or parquet file.
+func writeOutputRows(name string, format string, rows []parquetRow) error {
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if format == fileFormatParquet {
+		pw, err := writer.NewParquetWriterFromWriter(file, new(parquetRow), 1)
+		if err != nil {
+			return err
+		}
+		pw.CompressionType = parquet.CompressionCodec_SNAPPY
+		for _, row := range rows {
+			if err := pw.Write(row); err != nil {
+				return err
+			}
+		}
+		if err := pw.WriteStop(); err != nil {
+			return err
+		}
+		return file.Close()
+	}
+	w := csv.NewWriter(file)
+	if err := w.Write(csvHeader); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		w.Write([]string{
+			time.Unix(0, row.Timestamp*int64(time.Millisecond)).UTC().Format(time.RFC3339),
+			row.Source,
+			row.Destination,
+			row.Address,
+			row.Direction,
+			row.Prefix,
+			row.Engine,
+			strconv.FormatInt(row.Bps, 10),
+			row.Metric,
+			strconv.FormatFloat(row.Value, 'f', -1, 64),
+			row.Tags,
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return file.Close()
+}
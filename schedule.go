@@ -0,0 +1,97 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// cycleRand is seeded explicitly as the global source is deterministic for this module's go version, a
+// rand.Rand isn't safe for concurrent use so it is locked.
+var cycleRand = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// cycleOrder returns the perf servers in the order they are tested this cycle, shuffled if
+// --shuffle-endpoints is set so endpoints late in the list are not always tested last.
+func cycleOrder(settings runSettings, servers []perfServer) []perfServer {
+	ordered := make([]perfServer, len(servers))
+	copy(ordered, servers)
+	if settings.shuffle {
+		cycleRand.Lock()
+		cycleRand.Shuffle(len(ordered), func(i, j int) {
+			ordered[i], ordered[j] = ordered[j], ordered[i]
+		})
+		cycleRand.Unlock()
+	}
+	return ordered
+}
+
+// testGap returns the pause before the next endpoint is tested, the --test-gap plus a random
+// amount up to --test-gap-jitter.
+func testGap(settings runSettings) time.Duration {
+	gap := settings.testGap
+	if settings.testGapJitter > 0 {
+		cycleRand.Lock()
+		gap += time.Duration(cycleRand.Int63n(int64(settings.testGapJitter)))
+		cycleRand.Unlock()
+	}
+	return gap
+}
+
+// lastFullRate records when each capped endpoint last ran a full rate test.
+var lastFullRate = struct {
+	sync.Mutex
+	times map[string]time.Time
+}{times: make(map[string]time.Time)}
+
+// endpointCap returns the bandwidth cap of an endpoint, the per endpoint setting wins over --bandwidth-cap.
+func endpointCap(settings runSettings, server perfServer) string {
+	bandwidthCap := settings.bandwidthCap
+	if server.BandwidthCap != "" {
+		bandwidthCap = server.BandwidthCap
+	}
+	if bandwidthCap == "0" {
+		return ""
+	}
+	return bandwidthCap
+}
+
+// cycleBandwidth returns the bandwidth target of an endpoint for this cycle, empty for a full rate test.
+// Capped endpoints run a full rate test instead once every --full-rate-interval.
+func cycleBandwidth(settings runSettings, eng engine, server perfServer) string {
+	bandwidthCap := endpointCap(settings, server)
+	if bandwidthCap == "" || !eng.bandwidthCap {
+		return ""
+	}
+	if settings.fullRateInterval > 0 {
+		lastFullRate.Lock()
+		defer lastFullRate.Unlock()
+		last, seen := lastFullRate.times[server.resultKey()]
+		if !seen {
+			// start the clock so a full rate test doesn't run as soon as the agent starts
+			lastFullRate.times[server.resultKey()] = time.Now()
+		} else if time.Since(last) >= settings.fullRateInterval {
+			lastFullRate.times[server.resultKey()] = time.Now()
+			return ""
+		}
+	}
+	return bandwidthCap
+}
+
+// rateTags adds a rate tag marking capped and uncapped runs to the tags of endpoints that have a cap.
+func rateTags(settings runSettings, server perfServer, bandwidth string) map[string]string {
+	if endpointCap(settings, server) == "" {
+		return server.Tags
+	}
+	tags := make(map[string]string, len(server.Tags)+1)
+	for k, v := range server.Tags {
+		tags[k] = v
+	}
+	tags["rate"] = "uncapped"
+	if bandwidth != "" {
+		tags["rate"] = "capped"
+	}
+	return tags
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// envVarPattern only matches the ${VAR} form so secrets containing a bare $ are left untouched.
+var envVarPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces ${VAR} references with the value of the environment variable.
+func expandEnv(value string) string {
+	return envVarPattern.ReplaceAllStringFunc(value, func(ref string) string {
+		name := envVarPattern.FindStringSubmatch(ref)[1]
+		envValue, ok := os.LookupEnv(name)
+		if !ok {
+			log.Warnf("environment variable %s referenced in the configuration file is not set", name)
+		}
+		return envValue
+	})
+}
+
+// readSecretFile reads a secret such as an API token from a file, trimming any trailing newline.
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("could not read secret file: %v", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// resolveServerSecrets expands environment references in the tunnel and authentication passwords of endpoints.
+func resolveServerSecrets(servers []perfServer) {
+	for _, server := range servers {
+		if server.Tunnel != nil {
+			server.Tunnel.Password = expandEnv(server.Tunnel.Password)
+		}
+		if server.Auth != nil {
+			server.Auth.Password = expandEnv(server.Auth.Password)
+		}
+	}
+}
+
+// resolveSecrets expands environment references in the secret-ish configuration fields and merges the
+// Kentik credentials from the configuration file, token files and CLI, preferring the configuration file.
+func resolveSecrets(config *configuration) error {
+	for _, field := range []*string{
+		&config.InfluxURL,
+		&config.HTTPSProxy,
+		&config.KentikEmail,
+		&config.KentikToken,
+		&config.KentikTokenFile,
+		&config.Kafka.Username,
+		&config.Kafka.Password,
+		&config.Kafka.SchemaRegistry,
+		&config.Elasticsearch.Password,
+		&config.Elasticsearch.APIKey,
+		&config.Grafana.Token,
+		&config.Agent.Key,
+		&config.ConfigSource.URL,
+		&config.ConfigSource.Token,
+		&config.Discovery.Kubernetes.Token,
+		&config.Pushgateway.Password,
+		&config.Broker.Password,
+		&config.Webhook.Secret,
+		&config.RawOutput.S3.AccessKey,
+		&config.RawOutput.S3.SecretKey,
+		&config.RawOutput.S3.SessionToken,
+		&config.GRPCToken,
+		&config.Alerts.SNMP.Community,
+		&config.Alerts.SNMP.AuthPassword,
+		&config.Alerts.SNMP.PrivPassword,
+		&config.Hooks.PreTest.URL,
+		&config.Hooks.PostTest.URL,
+		&config.Goperf.Secret,
+		&config.Slots.Redis,
+	} {
+		*field = expandEnv(*field)
+	}
+	for name, value := range config.Webhook.Headers {
+		config.Webhook.Headers[name] = expandEnv(value)
+	}
+	if err := resolveTenantSecrets(config.Tenants); err != nil {
+		return err
+	}
+	resolveServerSecrets(allServers(*config))
+
+	if config.KentikToken == "" && config.KentikTokenFile != "" {
+		token, err := readSecretFile(config.KentikTokenFile)
+		if err != nil {
+			return err
+		}
+		config.KentikToken = token
+	}
+	if cliFlags.kentikTokenFile != "" {
+		token, err := readSecretFile(cliFlags.kentikTokenFile)
+		if err != nil {
+			return err
+		}
+		cliFlags.kentikToken = token
+	}
+
+	if config.KentikEmail != "" {
+		cliFlags.kentikEmail = config.KentikEmail
+	}
+	if config.KentikToken != "" {
+		cliFlags.kentikToken = config.KentikToken
+	}
+
+	return nil
+}
+
+// redact hides a secret value for logging while still showing whether it was set.
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "<redacted>"
+}
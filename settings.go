@@ -0,0 +1,177 @@
+package main
+
+import (
+	"strconv"
+	"time"
+)
+
+// runSettings are the test settings resolved once from the CLI and the configuration file after they're merged.
+// They're passed by value through a cycle instead of the test code reading the global flags, so nothing a test
+// does can change the settings of another one running alongside it.
+type runSettings struct {
+	dryRun bool
+	// tsdbType is the tsdb the results are written to, graphite or influx.
+	tsdbType string
+	// interval is the pause between cycles.
+	interval time.Duration
+	// length, parallel, omit and warmup are the client settings of every test, in seconds and streams.
+	length   string
+	parallel string
+	omit     string
+	warmup   string
+	samples  int
+	// busyRetries is how many times a run is retried after the perf server was busy, busyRetryWait the first wait.
+	busyRetries   int
+	busyRetryWait time.Duration
+	// keepSamples records every run of a test, not only the statistics of the runs.
+	keepSamples    bool
+	fullRunAverage bool
+	// intervalStats records the spread of the interval bitrates of a test, intervalSeries every interval.
+	intervalStats  bool
+	intervalSeries bool
+	// serverPort is the --perf-server-port, the engines fall back to their own default if it wasn't changed.
+	serverPort       string
+	downloadPrefix   string
+	uploadPrefix     string
+	bandwidthCap     string
+	fullRateInterval time.Duration
+	precheckTimeout  time.Duration
+	testGap          time.Duration
+	testGapJitter    time.Duration
+	shuffle          bool
+	traceroute       bool
+	latency          bool
+	// dnsTiming resolves and times the endpoint hostnames before their tests, dnsPin tests the resolved address.
+	dnsTiming bool
+	dnsPin    bool
+	// vpnDetect tags the endpoints whose route goes through a VPN interface.
+	vpnDetect bool
+	// dualStack tests the endpoints with both IPv4 and IPv6 addresses over each.
+	dualStack bool
+	// hostStats samples the host during every test.
+	hostStats bool
+	// nicCheck cross-checks the bytes of every test against the interface counters, a divergence beyond
+	// nicCheckThreshold percent is logged.
+	nicCheck          bool
+	nicCheckThreshold float64
+	// callSim simulates a video call to every endpoint after its pre-check.
+	callSim bool
+	// anomalyDrop is the percent below the baseline of the last anomalyWindow results that flags an anomaly, no
+	// results are checked if zero. anomalyMethod is the median or ewma baseline and anomalyWebhook receives the anomalies.
+	anomalyDrop    float64
+	anomalyWindow  int
+	anomalyMethod  string
+	anomalyWebhook string
+	// failureRate records the failed metric of the successful tests too, so its average is the failure rate.
+	failureRate bool
+	heartbeat   bool
+	// noShell checks the endpoints of every cycle, they can come from a controller or a config source.
+	noShell bool
+	// noContainer runs the native clients, with --nocontainer or in the pod of the cronjob command.
+	noContainer bool
+	// netperfTests are the netperf test types run against every endpoint, netperfTest is the one of a test.
+	netperfTests []string
+	netperfTest  string
+	netperfCPU   bool
+	// parallelMax is the most streams parallel auto tunes up to, parallelRetune the age a tuning is redone at.
+	parallelMax    int
+	parallelRetune time.Duration
+	// congestion is the TCP congestion control algorithm of every test, the host default if empty.
+	congestion string
+	// compareEngine is the candidate engine and compareProfiles the baseline and candidate profiles compared.
+	compareEngine   string
+	compareProfiles []string
+	// compareCongestion is the candidate TCP congestion control algorithm compared to the tests' own.
+	compareCongestion string
+}
+
+// engineClient is an engine resolved for this run with the command its client is invoked with.
+type engineClient struct {
+	engine
+	argv []string
+	// native is true if the client runs directly on the host rather than in a container.
+	native bool
+	// version is the detected version of the client, empty if it has none or couldn't be read.
+	version string
+}
+
+// resolveSettings snapshots the merged test settings, it runs after loadConfig.
+func resolveSettings() runSettings {
+	samples, err := strconv.Atoi(cliFlags.samples)
+	if err != nil || samples < 1 {
+		samples = 1
+	}
+	nicCheckThreshold, _ := strconv.ParseFloat(cliFlags.nicCheckThreshold, 64)
+	parallelMax, _ := strconv.Atoi(cliFlags.parallelMax)
+	busyRetries, _ := strconv.Atoi(cliFlags.busyRetries)
+	anomalyDrop, _ := strconv.ParseFloat(cliFlags.anomalyDrop, 64)
+	anomalyWindow, err := strconv.Atoi(cliFlags.anomalyWindow)
+	if err != nil || anomalyWindow < anomalyMinHistory {
+		anomalyWindow = anomalyMinHistory
+	}
+	return runSettings{
+		dryRun:            cliFlags.dryRun,
+		tsdbType:          cliFlags.tsdbType,
+		interval:          seconds(cliFlags.testInterval),
+		length:            cliFlags.testLength,
+		parallel:          cliFlags.parallelConn,
+		parallelMax:       parallelMax,
+		parallelRetune:    seconds(cliFlags.parallelRetune),
+		omit:              cliFlags.omit,
+		warmup:            cliFlags.warmup,
+		samples:           samples,
+		busyRetries:       busyRetries,
+		busyRetryWait:     seconds(cliFlags.busyRetryWait),
+		keepSamples:       cliFlags.keepSamples,
+		fullRunAverage:    cliFlags.fullRunAverage,
+		intervalStats:     cliFlags.intervalStats,
+		intervalSeries:    cliFlags.intervalSeries,
+		serverPort:        cliFlags.perfServerPort,
+		downloadPrefix:    cliFlags.downloadPrefix,
+		uploadPrefix:      cliFlags.uploadPrefix,
+		bandwidthCap:      cliFlags.bandwidthCap,
+		fullRateInterval:  seconds(cliFlags.fullRateInterval),
+		precheckTimeout:   seconds(cliFlags.precheckTimeout),
+		testGap:           seconds(cliFlags.testGap),
+		testGapJitter:     seconds(cliFlags.testGapJitter),
+		shuffle:           cliFlags.shuffleEndpoints,
+		traceroute:        cliFlags.traceroute,
+		latency:           cliFlags.latency,
+		dnsTiming:         cliFlags.dnsTiming,
+		dnsPin:            cliFlags.dnsPin,
+		vpnDetect:         cliFlags.vpnDetect,
+		dualStack:         cliFlags.dualStack,
+		hostStats:         cliFlags.hostStats,
+		nicCheck:          cliFlags.nicCheck,
+		nicCheckThreshold: nicCheckThreshold,
+		callSim:           cliFlags.callSim,
+		anomalyDrop:       anomalyDrop,
+		anomalyWindow:     anomalyWindow,
+		anomalyMethod:     cliFlags.anomalyMethod,
+		anomalyWebhook:    cliFlags.anomalyWebhook,
+		failureRate:       cliFlags.failureRate,
+		heartbeat:         cliFlags.heartbeat,
+		noShell:           cliFlags.noShell,
+		noContainer:       cliFlags.noContainer,
+		netperfTests:      netperfTestTypes(cliFlags.netperfTests),
+		netperfCPU:        cliFlags.netperfCPU,
+		congestion:        cliFlags.congestion,
+		compareEngine:     cliFlags.compareEngine,
+		compareProfiles:   compareProfileNames(cliFlags.compareProfiles),
+		compareCongestion: cliFlags.compareCongestion,
+	}
+}
+
+// seconds parses a setting in seconds, invalid values are rejected by validateConfig and read as zero.
+func seconds(value string) time.Duration {
+	d, _ := time.ParseDuration(value + "s")
+	return d
+}
+
+// resolveEngine sets the engine's default port to --perf-server-port unless it was left at the iperf3 default.
+func resolveEngine(eng engine, settings runSettings) engine {
+	if settings.serverPort != defaultIperfPort {
+		eng.port = settings.serverPort
+	}
+	return eng
+}
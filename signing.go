@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// signingConfig signs every measurement with the agent's Ed25519 key, so results can be shown not to have been
+// altered after they were measured.
+type signingConfig struct {
+	// Key is the PEM file of the agent's private key, created with its public key next to it as <key>.pub if it
+	// doesn't exist.
+	Key string `yaml:"key"`
+}
+
+// measurementSigner signs measurements with the agent's key.
+type measurementSigner struct {
+	key   ed25519.PrivateKey
+	keyID string
+}
+
+var signer *measurementSigner
+
+// mergeSigningFlags fills any signing settings missing from the configuration file with the CLI values.
+func mergeSigningFlags(sc *signingConfig) {
+	if sc.Key == "" {
+		sc.Key = cliFlags.signingKey
+	}
+}
+
+// initSigning loads the agent's signing key, or creates one on the first start.
+func initSigning(sc signingConfig) error {
+	if sc.Key == "" {
+		return nil
+	}
+	key, err := loadSigningKey(sc.Key)
+	if os.IsNotExist(err) {
+		key, err = createSigningKey(sc.Key)
+	}
+	if err != nil {
+		return err
+	}
+	signer = &measurementSigner{key: key, keyID: keyFingerprint(key.Public().(ed25519.PublicKey))}
+	log.Debugf("[Config] Signing Key = %s (%s)", sc.Key, signer.keyID)
+	return nil
+}
+
+// loadSigningKey reads an Ed25519 private key from a PKCS #8 PEM file.
+func loadSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("no PEM private key found in %s", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse the signing key %s: %v", path, err)
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("the signing key %s is not an Ed25519 key", path)
+	}
+	return key, nil
+}
+
+// createSigningKey generates a key and writes it to path, and its public key to path.pub for verifying.
+func createSigningKey(path string) (ed25519.PrivateKey, error) {
+	public, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return nil, fmt.Errorf("could not write the signing key: %v", err)
+	}
+	der, err = x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path+".pub", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		return nil, fmt.Errorf("could not write the public key: %v", err)
+	}
+	log.Infof("Created the signing key %s (%s), its public key %s.pub verifies the results", path, keyFingerprint(public), path)
+	return key, nil
+}
+
+// loadPublicKey reads an Ed25519 public key from a PKIX PEM file.
+func loadPublicKey(path string) (ed25519.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("no PEM public key found in %s", path)
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse the public key %s: %v", path, err)
+	}
+	key, ok := parsed.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("the public key %s is not an Ed25519 key", path)
+	}
+	return key, nil
+}
+
+// keyFingerprint identifies a public key in the measurements, in the SHA256:base64 form of ssh-keygen -l.
+func keyFingerprint(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// signedPayload is the JSON of a measurement without its signature, the bytes that are signed. The key ID is
+// part of it so a signature can't be moved to another key.
+func signedPayload(m measurement) ([]byte, error) {
+	m.Signature = ""
+	return json.Marshal(m)
+}
+
+// sign sets the key ID and signature of a measurement. A measurement signed by the agent that measured it, such
+// as one pushed to a controller, keeps its signature.
+func (s *measurementSigner) sign(m measurement) measurement {
+	if m.Signature != "" {
+		return m
+	}
+	m.KeyID = s.keyID
+	payload, err := signedPayload(m)
+	if err != nil {
+		log.Errorf("Error signing the measurement of %s: %v", m.Destination, err)
+		return m
+	}
+	m.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(s.key, payload))
+	return m
+}
+
+// verifyMeasurement checks the signature of a measurement against the public key with its key ID.
+func verifyMeasurement(m measurement, keys map[string]ed25519.PublicKey) error {
+	if m.Signature == "" {
+		return errors.New("not signed")
+	}
+	key, ok := keys[m.KeyID]
+	if !ok {
+		return fmt.Errorf("signed with the unknown key %s", m.KeyID)
+	}
+	signature, err := base64.StdEncoding.DecodeString(m.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature: %v", err)
+	}
+	payload, err := signedPayload(m)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(key, payload, signature) {
+		return errors.New("the signature doesn't match, the measurement was altered")
+	}
+	return nil
+}
+
+// verifyAction checks the signatures of the measurements in the files given, or stdin, against the public keys.
+// The measurements are JSON objects one per line or JSON arrays, as written by the webhook, kafka, broker and
+// elasticsearch sinks. It fails if any measurement isn't signed by one of the keys or was altered.
+func verifyAction(paths []string) error {
+	if len(cliFlags.verifyKeys.Value()) == 0 {
+		return fmt.Errorf("verify needs the public key of the agents with --public-key")
+	}
+	keys := make(map[string]ed25519.PublicKey)
+	for _, path := range cliFlags.verifyKeys.Value() {
+		key, err := loadPublicKey(path)
+		if err != nil {
+			return err
+		}
+		keys[keyFingerprint(key)] = key
+	}
+	if len(paths) == 0 {
+		paths = []string{"-"}
+	}
+	var verified, failed int
+	for _, path := range paths {
+		in := io.Reader(os.Stdin)
+		if path != "-" {
+			file, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			in = file
+		}
+		scanner := bufio.NewScanner(in)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for line := 1; scanner.Scan(); line++ {
+			text := bytes.TrimSpace(scanner.Bytes())
+			if len(text) == 0 {
+				continue
+			}
+			var batch []measurement
+			if text[0] == '[' {
+				if err := json.Unmarshal(text, &batch); err != nil {
+					return fmt.Errorf("%s:%d: %v", path, line, err)
+				}
+			} else {
+				var m measurement
+				if err := json.Unmarshal(text, &m); err != nil {
+					return fmt.Errorf("%s:%d: %v", path, line, err)
+				}
+				batch = []measurement{m}
+			}
+			for _, m := range batch {
+				if err := verifyMeasurement(m, keys); err != nil {
+					failed++
+					fmt.Printf("FAILED %s:%d %s %s %s run %s: %v\n", path, line, m.Timestamp.Format("2006-01-02T15:04:05Z07:00"), m.Destination, measurementName(m), m.RunID, err)
+					continue
+				}
+				verified++
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	fmt.Printf("%d measurements verified, %d failed\n", verified, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d measurements failed verification", failed)
+	}
+	return nil
+}
+
+// measurementName names a measurement in messages, its direction and metric.
+func measurementName(m measurement) string {
+	if m.Metric == "" {
+		return m.Direction
+	}
+	return strings.Join([]string{m.Direction, m.Metric}, " ")
+}
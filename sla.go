@@ -0,0 +1,444 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSLAPercent = "95"
+	defaultSLAWindow  = "30d"
+	// slaHourLayout keys the hourly counts the rolling compliance is summed from, in UTC.
+	slaHourLayout = "2006-01-02T15"
+	// slaMonthLayout keys the monthly summaries, in the agent's time zone like the budget months.
+	slaMonthLayout = "2006-01"
+	// slaMonthsKept is how many monthly summaries are kept per endpoint, a year and the month before it.
+	slaMonthsKept = 13
+)
+
+// slaTarget is the bandwidth an endpoint's results should reach and the percent of them that should, such as 95% of
+// the downloads at 400M or more. A direction without a bandwidth has no SLA.
+type slaTarget struct {
+	// Download and Upload are bandwidths with an optional K/M/G suffix.
+	Download string `yaml:"download,omitempty" json:"download,omitempty"`
+	Upload   string `yaml:"upload,omitempty" json:"upload,omitempty"`
+	// Percent is the share of the results that should reach the bandwidth, 95 by default.
+	Percent string `yaml:"percent,omitempty" json:"percent,omitempty"`
+}
+
+// slaConfig is the SLA of every endpoint, an endpoint's own sla settings override it.
+type slaConfig struct {
+	slaTarget `yaml:",inline"`
+	// Window is the period the rolling compliance is computed over, such as 30d or 7d.
+	Window string `yaml:"window"`
+	// StateFile keeps the compliance counts across restarts, they are only kept in memory without one.
+	StateFile string `yaml:"state-file"`
+}
+
+// slaCounts are the results tested against an SLA and the ones that met it.
+type slaCounts struct {
+	Tests int `json:"tests"`
+	Met   int `json:"met"`
+}
+
+// percent is the compliance in percent, 100 without results.
+func (c slaCounts) percent() float64 {
+	if c.Tests == 0 {
+		return 100
+	}
+	return float64(c.Met) / float64(c.Tests) * 100
+}
+
+// slaHistory are the counts of an endpoint and direction by hour for the rolling window and by month.
+type slaHistory struct {
+	Hours  map[string]*slaCounts `json:"hours"`
+	Months map[string]*slaCounts `json:"months"`
+}
+
+// slaTracker computes the compliance of every endpoint with an SLA.
+type slaTracker struct {
+	config   slaConfig
+	window   time.Duration
+	mu       sync.Mutex
+	history  map[string]*slaHistory
+	breached map[string]bool
+}
+
+var slas *slaTracker
+
+// mergeSLAFlags fills any SLA settings missing from the configuration file with the CLI values.
+func mergeSLAFlags(sc *slaConfig) {
+	if sc.Download == "" {
+		sc.Download = cliFlags.slaDownload
+	}
+	if sc.Upload == "" {
+		sc.Upload = cliFlags.slaUpload
+	}
+	if sc.Percent == "" {
+		sc.Percent = cliFlags.slaPercent
+	}
+	if sc.Window == "" {
+		sc.Window = cliFlags.slaWindow
+	}
+	if sc.StateFile == "" {
+		sc.StateFile = cliFlags.slaStateFile
+	}
+	if sc.Percent == "" {
+		sc.Percent = defaultSLAPercent
+	}
+	if sc.Window == "" {
+		sc.Window = defaultSLAWindow
+	}
+}
+
+// validateSLATarget checks the bandwidths and percent of an SLA.
+func validateSLATarget(name string, target slaTarget) []error {
+	var errs []error
+	for _, setting := range []struct{ name, value string }{
+		{"download", target.Download},
+		{"upload", target.Upload},
+	} {
+		if setting.value == "" {
+			continue
+		}
+		if bps, err := parseBandwidth(setting.value); err != nil || bps <= 0 {
+			errs = append(errs, fmt.Errorf("%s %s must be a bandwidth such as 400M or 1G, got %q", name, setting.name, setting.value))
+		}
+	}
+	if target.Percent != "" {
+		if percent, err := strconv.ParseFloat(target.Percent, 64); err != nil || percent <= 0 || percent > 100 {
+			errs = append(errs, fmt.Errorf("%s percent must be a percent of the results above 0 and up to 100, got %q", name, target.Percent))
+		}
+	}
+	return errs
+}
+
+// validateSLA checks the SLA of every endpoint and the window.
+func validateSLA(config configuration) []error {
+	errs := validateSLATarget("sla", config.SLA.slaTarget)
+	if _, err := parsePeriod(config.SLA.Window); err != nil {
+		errs = append(errs, fmt.Errorf("sla window: %v", err))
+	}
+	for _, server := range allServers(config) {
+		if server.SLA != nil {
+			errs = append(errs, validateSLATarget("perf server "+server.Address+" sla", *server.SLA)...)
+		}
+	}
+	return errs
+}
+
+// slaTargetOf resolves the bandwidth and percent of an endpoint's SLA in a direction, from its own sla settings and
+// then the shared ones. ok is false if the direction has no SLA.
+func slaTargetOf(sc slaConfig, server perfServer, direction string) (bps float64, percent float64, ok bool) {
+	target := sc.slaTarget
+	if server.SLA != nil {
+		if server.SLA.Download != "" {
+			target.Download = server.SLA.Download
+		}
+		if server.SLA.Upload != "" {
+			target.Upload = server.SLA.Upload
+		}
+		if server.SLA.Percent != "" {
+			target.Percent = server.SLA.Percent
+		}
+	}
+	bandwidth := target.Download
+	if direction == directionUpload {
+		bandwidth = target.Upload
+	}
+	if bandwidth == "" {
+		return 0, 0, false
+	}
+	bps, err := parseBandwidth(bandwidth)
+	if err != nil {
+		return 0, 0, false
+	}
+	percent, err = strconv.ParseFloat(target.Percent, 64)
+	if err != nil {
+		percent, _ = strconv.ParseFloat(defaultSLAPercent, 64)
+	}
+	return bps, percent, true
+}
+
+// hasSLA reports whether the shared settings or any endpoint define an SLA.
+func hasSLA(config configuration) bool {
+	if config.SLA.Download != "" || config.SLA.Upload != "" {
+		return true
+	}
+	for _, server := range allServers(config) {
+		if server.SLA != nil && (server.SLA.Download != "" || server.SLA.Upload != "") {
+			return true
+		}
+	}
+	return false
+}
+
+// initSLA sets up the SLA tracking if any endpoint has an SLA and loads the counts kept in the state file. The
+// endpoints of a config source or discovery are tracked against the shared SLA, so it's set up when one is set even
+// without endpoints yet.
+func initSLA(config configuration) error {
+	if !hasSLA(config) {
+		return nil
+	}
+	if errs := validateSLA(config); len(errs) > 0 {
+		return errs[0]
+	}
+	window, _ := parsePeriod(config.SLA.Window)
+	t := &slaTracker{config: config.SLA, window: window, history: make(map[string]*slaHistory), breached: make(map[string]bool)}
+	if config.SLA.StateFile != "" {
+		data, err := os.ReadFile(config.SLA.StateFile)
+		if err == nil {
+			if err := json.Unmarshal(data, &t.history); err != nil {
+				return fmt.Errorf("could not read the SLA state %s: %v", config.SLA.StateFile, err)
+			}
+		} else if !os.IsNotExist(err) {
+			return fmt.Errorf("could not read the SLA state %s: %v", config.SLA.StateFile, err)
+		}
+	}
+	log.Debugf("[Config] SLA = %s%% of the results at download %s, upload %s over %s", config.SLA.Percent, config.SLA.Download, config.SLA.Upload, config.SLA.Window)
+	slas = t
+	return nil
+}
+
+// testResult counts a full rate result against the endpoint's SLA and records the rolling compliance over the window
+// as sla_compliance_pct and the compliance of the month so far as sla_month_compliance_pct. An alert fires when the
+// rolling compliance falls below the target, once until it recovers.
+func (t *slaTracker) testResult(config configuration, settings runSettings, eng engine, server perfServer, direction string, prefix string, bps int64) {
+	target, percent, ok := slaTargetOf(t.config, server, direction)
+	if !ok {
+		return
+	}
+	key := server.resultKey() + "|" + direction
+	now := measurementTime()
+	hour, month := now.UTC().Format(slaHourLayout), now.Format(slaMonthLayout)
+
+	t.mu.Lock()
+	history, ok := t.history[key]
+	if !ok {
+		history = &slaHistory{Hours: make(map[string]*slaCounts), Months: make(map[string]*slaCounts)}
+		t.history[key] = history
+	}
+	if _, ok := history.Months[month]; !ok {
+		// the first result of a month closes the month before it
+		if previous := latestSLAMonth(history.Months); previous != "" {
+			counts := *history.Months[previous]
+			log.Infof("SLA %s: %s to %s [%s] met %.0f bps in %.2f%% of %d results, the target is %.2f%%", previous, direction,
+				server.Address, server.displayName(), target, counts.percent(), counts.Tests, percent)
+		}
+		history.Months[month] = &slaCounts{}
+	}
+	for _, counts := range []*slaCounts{t.hourCounts(history, hour), history.Months[month]} {
+		counts.Tests++
+		if float64(bps) >= target {
+			counts.Met++
+		}
+	}
+	t.prune(history, now)
+	var rolling slaCounts
+	for _, counts := range history.Hours {
+		rolling.Tests += counts.Tests
+		rolling.Met += counts.Met
+	}
+	monthly := *history.Months[month]
+	wasBreached := t.breached[key]
+	t.breached[key] = rolling.percent() < percent
+	t.save()
+	t.mu.Unlock()
+
+	recordTestMetric(config, settings, eng, server, direction, prefix, "sla_compliance_pct", rolling.percent())
+	recordTestMetric(config, settings, eng, server, direction, prefix, "sla_month_compliance_pct", monthly.percent())
+	switch {
+	case rolling.percent() < percent && !wasBreached:
+		message := fmt.Sprintf("%s throughput to %s [%s] met %.0f bps in %.2f%% of the %d results over the last %s, below the SLA of %.2f%%",
+			direction, server.Address, server.displayName(), target, rolling.percent(), rolling.Tests, t.config.Window, percent)
+		log.Warnf("SLA breached: %s", message)
+		if alerts != nil {
+			alerts.fire(alertEvent{
+				Name:        alertSLA,
+				Timestamp:   now,
+				Source:      config.Hostname,
+				Destination: server.displayName(),
+				Address:     server.Address,
+				Direction:   direction,
+				Engine:      eng.name,
+				Value:       bps,
+				Limit:       target,
+				Message:     message,
+			})
+		}
+	case rolling.percent() >= percent && wasBreached:
+		log.Infof("SLA recovered: %s throughput to %s [%s] met %.0f bps in %.2f%% of the results over the last %s",
+			direction, server.Address, server.displayName(), target, rolling.percent(), t.config.Window)
+	}
+}
+
+// hourCounts returns the counts of an hour. The caller holds the lock.
+func (t *slaTracker) hourCounts(history *slaHistory, hour string) *slaCounts {
+	counts, ok := history.Hours[hour]
+	if !ok {
+		counts = &slaCounts{}
+		history.Hours[hour] = counts
+	}
+	return counts
+}
+
+// prune drops the hours that left the window and the oldest months past slaMonthsKept. The caller holds the lock.
+func (t *slaTracker) prune(history *slaHistory, now time.Time) {
+	start := now.Add(-t.window).UTC().Truncate(time.Hour)
+	for hour := range history.Hours {
+		if at, err := time.Parse(slaHourLayout, hour); err != nil || at.Before(start) {
+			delete(history.Hours, hour)
+		}
+	}
+	months := make([]string, 0, len(history.Months))
+	for month := range history.Months {
+		months = append(months, month)
+	}
+	sort.Strings(months)
+	for len(months) > slaMonthsKept {
+		delete(history.Months, months[0])
+		months = months[1:]
+	}
+}
+
+// save writes the counts to the state file. The caller holds the lock.
+func (t *slaTracker) save() {
+	if t.config.StateFile == "" {
+		return
+	}
+	data, _ := json.MarshalIndent(t.history, "", "  ")
+	tmp := t.config.StateFile + ".tmp"
+	if err := os.MkdirAll(filepath.Dir(t.config.StateFile), 0755); err != nil {
+		log.Errorf("Error saving the SLA state %s: %v", t.config.StateFile, err)
+		return
+	}
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		log.Errorf("Error saving the SLA state %s: %v", t.config.StateFile, err)
+		return
+	}
+	if err := os.Rename(tmp, t.config.StateFile); err != nil {
+		log.Errorf("Error saving the SLA state %s: %v", t.config.StateFile, err)
+	}
+}
+
+// latestSLAMonth is the latest month with counts, empty if there are none.
+func latestSLAMonth(months map[string]*slaCounts) string {
+	latest := ""
+	for month := range months {
+		if month > latest {
+			latest = month
+		}
+	}
+	return latest
+}
+
+// slaMonthRow is the compliance of an endpoint's series with its SLA over a calendar month of the report.
+type slaMonthRow struct {
+	Endpoint   string
+	Series     string
+	Month      string
+	Tests      int
+	Compliance float64
+	Target     float64
+	Percent    float64
+}
+
+// Met is yes if the month met the SLA.
+func (r slaMonthRow) Met() string {
+	if r.Compliance >= r.Percent {
+		return "yes"
+	}
+	return "no"
+}
+
+// slaDirections maps the bandwidth prefixes of the configuration and of every endpoint group and tenant to their
+// direction, a series of another prefix has no SLA.
+func slaDirections(config configuration) map[string]string {
+	settings := runSettings{downloadPrefix: cliFlags.downloadPrefix, uploadPrefix: cliFlags.uploadPrefix}
+	directions := map[string]string{settings.downloadPrefix: directionDownload, settings.uploadPrefix: directionUpload}
+	for i := range config.Groups {
+		_, groupSettings := groupCycle(config, settings, &config.Groups[i])
+		directions[groupSettings.downloadPrefix] = directionDownload
+		directions[groupSettings.uploadPrefix] = directionUpload
+	}
+	return directions
+}
+
+// reportSLA adds the compliance over the period to the report rows of the endpoints with an SLA and summarizes it
+// per calendar month. The endpoints that aren't in the configuration, such as discovered ones, are held to the
+// shared SLA.
+func reportSLA(config configuration, rows []reportRow, points []reportPoint, now time.Time, period time.Duration) []slaMonthRow {
+	servers := make(map[string]perfServer)
+	for _, server := range allServers(config) {
+		servers[server.displayName()] = server
+	}
+	directions := slaDirections(config)
+	type key struct{ endpoint, series string }
+	periodCounts := make(map[key]*slaCounts)
+	monthCounts := make(map[key]map[string]*slaCounts)
+	start := now.Add(-period)
+	for _, point := range points {
+		if point.timestamp.Before(start) {
+			continue
+		}
+		target, _, ok := slaTargetOf(config.SLA, servers[point.destination], directions[point.prefix])
+		if !ok {
+			continue
+		}
+		k := key{point.destination, point.prefix}
+		if periodCounts[k] == nil {
+			periodCounts[k] = &slaCounts{}
+			monthCounts[k] = make(map[string]*slaCounts)
+		}
+		month := point.timestamp.Local().Format(slaMonthLayout)
+		if monthCounts[k][month] == nil {
+			monthCounts[k][month] = &slaCounts{}
+		}
+		for _, counts := range []*slaCounts{periodCounts[k], monthCounts[k][month]} {
+			counts.Tests++
+			if point.bps >= target {
+				counts.Met++
+			}
+		}
+	}
+
+	for i, row := range rows {
+		counts, ok := periodCounts[key{row.Endpoint, row.Series}]
+		if !ok {
+			continue
+		}
+		rows[i].SLATarget, rows[i].SLAPercent, _ = slaTargetOf(config.SLA, servers[row.Endpoint], directions[row.Series])
+		rows[i].Compliance = counts.percent()
+	}
+	var months []slaMonthRow
+	for k, byMonth := range monthCounts {
+		target, percent, _ := slaTargetOf(config.SLA, servers[k.endpoint], directions[k.series])
+		for month, counts := range byMonth {
+			months = append(months, slaMonthRow{
+				Endpoint:   k.endpoint,
+				Series:     k.series,
+				Month:      month,
+				Tests:      counts.Tests,
+				Compliance: counts.percent(),
+				Target:     target,
+				Percent:    percent,
+			})
+		}
+	}
+	sort.Slice(months, func(i, j int) bool {
+		if months[i].Endpoint != months[j].Endpoint {
+			return months[i].Endpoint < months[j].Endpoint
+		}
+		if months[i].Series != months[j].Series {
+			return months[i].Series < months[j].Series
+		}
+		return months[i].Month < months[j].Month
+	})
+	return months
+}
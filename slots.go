@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	slotBackendController = "controller"
+	slotBackendRedis      = "redis"
+	defaultSlotWait       = "600"
+	// slotTTL is how long a reservation outlives an agent that stopped renewing it, it's renewed every third of it.
+	slotTTL = 60 * time.Second
+	// slotPoll is how often a test waiting for a slot tries again, plus up to as much jitter so the waiting agents
+	// don't retry in lockstep.
+	slotPoll = 5 * time.Second
+)
+
+// slotsConfig reserves the test slot of a perf server before testing it, so the agents sharing a server queue
+// their tests instead of colliding with the server is busy error or splitting its bandwidth.
+type slotsConfig struct {
+	// Backend is controller to reserve the slots with the agent's controller or redis, empty disables the slots.
+	Backend string `yaml:"backend"`
+	// Redis is the redis://[[user]:password@]host[:port][/db] URL of the redis backend, rediss:// for TLS.
+	Redis string `yaml:"redis"`
+	// Wait is how long a test waits for a slot in seconds before it fails with the busy class.
+	Wait string `yaml:"wait"`
+}
+
+// slotBackend reserves the slots of the perf servers. Acquiring a slot the holder already has renews it, the
+// current holder is returned if the slot wasn't granted.
+type slotBackend interface {
+	acquire(key string, holder string, ttl time.Duration) (bool, string, error)
+	release(key string, holder string) error
+}
+
+// slotReserver waits for the slot of a perf server and holds it for the duration of a test.
+type slotReserver struct {
+	backend slotBackend
+	name    string
+	agent   string
+	wait    time.Duration
+}
+
+var slots *slotReserver
+
+// mergeSlotsFlags fills any slot settings missing from the configuration file with the CLI values.
+func mergeSlotsFlags(sc *slotsConfig) {
+	if sc.Backend == "" {
+		sc.Backend = cliFlags.slotBackend
+	}
+	if sc.Redis == "" {
+		sc.Redis = cliFlags.slotRedis
+	}
+	if sc.Wait == "" {
+		sc.Wait = cliFlags.slotWait
+	}
+}
+
+// validateSlots checks the backend has what it needs to reserve the slots.
+func validateSlots(config configuration) []error {
+	sc := config.Slots
+	var errs []error
+	switch sc.Backend {
+	case "":
+		return nil
+	case slotBackendController:
+		if config.Agent.ControllerURL == "" {
+			errs = append(errs, fmt.Errorf("the controller slots backend requires a controller in agent.controller-url or --controller-url"))
+		}
+	case slotBackendRedis:
+		if sc.Redis == "" {
+			errs = append(errs, fmt.Errorf("the redis slots backend requires a URL in slots.redis or --slot-redis"))
+		} else if _, err := parseRedisURL(sc.Redis); err != nil {
+			errs = append(errs, err)
+		}
+	default:
+		errs = append(errs, fmt.Errorf("slots backend must be controller or redis, got %q", sc.Backend))
+	}
+	if wait, err := strconv.Atoi(sc.Wait); err != nil || wait <= 0 {
+		errs = append(errs, fmt.Errorf("slots wait must be a positive number of seconds, got %q", sc.Wait))
+	}
+	return errs
+}
+
+// initSlots sets up the slot reservations if a backend was configured, the slots are held as the agent ID with a
+// controller and as the hostname otherwise.
+func initSlots(sc slotsConfig, hostname string) error {
+	if sc.Backend == "" || cliFlags.dryRun {
+		return nil
+	}
+	reserver := &slotReserver{name: sc.Backend, agent: hostname, wait: seconds(sc.Wait)}
+	if controller != nil {
+		reserver.agent = controller.config.ID
+	}
+	switch sc.Backend {
+	case slotBackendController:
+		if controller == nil {
+			return fmt.Errorf("the controller slots backend requires a controller in agent.controller-url or --controller-url")
+		}
+		reserver.backend = controllerSlots{controller}
+	case slotBackendRedis:
+		backend, err := parseRedisURL(sc.Redis)
+		if err != nil {
+			return err
+		}
+		reserver.backend = backend
+	}
+	slots = reserver
+	log.Debugf("[Config] Slots = %s as %s waiting up to %ssec", sc.Backend, reserver.agent, sc.Wait)
+	return nil
+}
+
+// slotKey is the slot of a perf server port, shared by the agents reaching it at the same address.
+func slotKey(address string, port string) string {
+	return "cbandwidth:slot:" + net.JoinHostPort(address, port)
+}
+
+// reserve waits for the slot of a perf server and renews it in the background until the returned function
+// releases it. The slot is held by the test's run ID so two tests of the same agent don't share it. A test is
+// run without a slot if the backend can't be reached, since an outage of the backend shouldn't stop the testing,
+// and fails with the busy class if the slot wasn't granted within the wait.
+func (s *slotReserver) reserve(server perfServer, address string, port string) (func(), error) {
+	key := slotKey(address, port)
+	holder := s.agent + "/" + server.runID
+	deadline := time.Now().Add(s.wait)
+	for {
+		granted, current, err := s.backend.acquire(key, holder, slotTTL)
+		if err != nil {
+			log.Warnf("Error reserving the slot of %s [%s] with the %s backend, testing without one: %v", key, server.displayName(), s.name, err)
+			return func() {}, nil
+		}
+		if granted {
+			break
+		}
+		if time.Now().After(deadline) {
+			return nil, &testError{class: errorBusy, reason: fmt.Sprintf("the slot of %s is held by %s after waiting %s", key, current, s.wait)}
+		}
+		log.Infof("The slot of %s [%s] is held by %s, waiting for it", key, server.displayName(), current)
+		cycleRand.Lock()
+		poll := slotPoll + time.Duration(cycleRand.Int63n(int64(slotPoll)))
+		cycleRand.Unlock()
+		time.Sleep(poll)
+	}
+	log.Debugf("Reserved the slot of %s [%s] as %s", key, server.displayName(), holder)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(slotTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if granted, current, err := s.backend.acquire(key, holder, slotTTL); err != nil {
+					log.Warnf("Error renewing the slot of %s: %v", key, err)
+				} else if !granted {
+					log.Warnf("The slot of %s expired and was reserved by %s", key, current)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+		if err := s.backend.release(key, holder); err != nil {
+			log.Warnf("Error releasing the slot of %s, it expires in %s: %v", key, slotTTL, err)
+		}
+	}, nil
+}
+
+// slotRequest reserves, renews or releases a slot with the controller, TTL is in seconds.
+type slotRequest struct {
+	Key    string `json:"key"`
+	Holder string `json:"holder"`
+	TTL    int    `json:"ttl,omitempty"`
+}
+
+// slotResponse is whether a slot was granted and its current holder.
+type slotResponse struct {
+	Granted bool   `json:"granted"`
+	Holder  string `json:"holder,omitempty"`
+}
+
+// controllerSlots reserves the slots with the controller the agent pulls its assignments from.
+type controllerSlots struct {
+	client *controllerClient
+}
+
+func (c controllerSlots) acquire(key string, holder string, ttl time.Duration) (bool, string, error) {
+	var resp slotResponse
+	err := c.client.do("POST", "/v1/slots", slotRequest{Key: key, Holder: holder, TTL: int(ttl.Seconds())}, &resp)
+	return resp.Granted, resp.Holder, err
+}
+
+func (c controllerSlots) release(key string, holder string) error {
+	return c.client.do("DELETE", "/v1/slots", slotRequest{Key: key, Holder: holder}, nil)
+}
+
+// slotLease is a slot reserved with the controller.
+type slotLease struct {
+	holder  string
+	expires time.Time
+}
+
+// slotLeases are the slots reserved with the controller by key, an expired lease is free.
+var slotLeases = struct {
+	sync.Mutex
+	leases map[string]slotLease
+}{leases: make(map[string]slotLease)}
+
+// handleSlots serves the slot reservations of the agents on the controller.
+func handleSlots(w http.ResponseWriter, r *http.Request) {
+	var req slotRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Key == "" || req.Holder == "" {
+		http.Error(w, "a slot key and holder are required", http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	slotLeases.Lock()
+	defer slotLeases.Unlock()
+	lease, held := slotLeases.leases[req.Key]
+	held = held && now.Before(lease.expires)
+	switch r.Method {
+	case http.MethodPost:
+		if held && lease.holder != req.Holder {
+			writeJSON(w, slotResponse{Holder: lease.holder})
+			return
+		}
+		ttl := time.Duration(req.TTL) * time.Second
+		if ttl <= 0 || ttl > 10*slotTTL {
+			ttl = slotTTL
+		}
+		slotLeases.leases[req.Key] = slotLease{holder: req.Holder, expires: now.Add(ttl)}
+		writeJSON(w, slotResponse{Granted: true, Holder: req.Holder})
+	case http.MethodDelete:
+		if !held || lease.holder == req.Holder {
+			delete(slotLeases.leases, req.Key)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// busyBackoff returns the wait before a retry of a run the perf server was busy for, the --busy-retry-wait
+// doubled every retry plus up to half of it as jitter so the agents turned away together don't return together.
+func busyBackoff(settings runSettings, retry int) time.Duration {
+	wait := settings.busyRetryWait << uint(retry)
+	if wait <= 0 {
+		return 0
+	}
+	cycleRand.Lock()
+	wait += time.Duration(cycleRand.Int63n(int64(wait)/2 + 1))
+	cycleRand.Unlock()
+	return wait
+}
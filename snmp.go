@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+const (
+	defaultSNMPPort      = "162"
+	defaultSNMPCommunity = "public"
+	snmpVersion2c        = "2c"
+	snmpVersion3         = "3"
+	// defaultSNMPOID is the net-snmp playpen subtree, replace it with an OID under your own enterprise number.
+	defaultSNMPOID = "1.3.6.1.4.1.8072.9999.9999.1"
+	snmpAuthMD5    = "md5"
+	snmpAuthSHA    = "sha"
+	snmpPrivDES    = "des"
+	snmpPrivAES    = "aes"
+	snmpTimeout    = 5 * time.Second
+)
+
+// The OIDs every SNMPv2 trap starts with, the agent uptime and the OID of the notification.
+var (
+	oidSysUpTime   = ".1.3.6.1.2.1.1.3.0"
+	oidSnmpTrapOID = ".1.3.6.1.6.3.1.1.4.1.0"
+)
+
+// snmpConfig sends the alerts as SNMPv2c or SNMPv3 traps. The notifications are <oid>.0.1 for a threshold alert
+// and <oid>.0.2 for an anomaly, their objects are under <oid>.1.
+type snmpConfig struct {
+	// Target is the trap receiver as host[:port], 162 by default.
+	Target string `yaml:"target"`
+	// Version is 2c (default) or 3.
+	Version   string `yaml:"version"`
+	Community string `yaml:"community"`
+	OID       string `yaml:"oid"`
+	// User, the auth and the priv settings are the SNMPv3 USM user the traps are sent as. Auth is md5 or sha (the
+	// default), priv is des or aes (the default), the security level follows the passwords that are set.
+	User         string `yaml:"user"`
+	AuthProtocol string `yaml:"auth-protocol"`
+	AuthPassword string `yaml:"auth-password"`
+	PrivProtocol string `yaml:"priv-protocol"`
+	PrivPassword string `yaml:"priv-password"`
+	// EngineID is the hex SNMPv3 engine ID of the agent, the receiver localizes the user's keys with it. It's
+	// derived from the hostname if empty.
+	EngineID string `yaml:"engine-id"`
+}
+
+// snmpSender sends the traps with gosnmp. The agent is the authoritative engine of its SNMPv3 traps so no engine
+// discovery is needed, gosnmp localizes the user's keys for the agent's engine ID.
+type snmpSender struct {
+	config  snmpConfig
+	address string
+	oid     string
+	started time.Time
+	mu      sync.Mutex
+	client  *gosnmp.GoSNMP
+}
+
+// snmpOIDPattern matches a dotted object identifier such as 1.3.6.1.4.1.8072.9999.9999.1.
+var snmpOIDPattern = regexp.MustCompile(`^\.?[0-2](\.[0-9]+)+$`)
+
+// validateSNMP checks the trap receiver, the OID and the SNMPv3 user.
+func validateSNMP(sc snmpConfig) []error {
+	if sc.Target == "" {
+		return nil
+	}
+	var errs []error
+	if _, _, err := net.SplitHostPort(snmpAddress(sc.Target)); err != nil {
+		errs = append(errs, fmt.Errorf("alerts snmp target must be a host with an optional port, got %q", sc.Target))
+	}
+	if !snmpOIDPattern.MatchString(sc.OID) {
+		errs = append(errs, fmt.Errorf("alerts snmp oid: %q is not a dotted object identifier", sc.OID))
+	}
+	switch sc.Version {
+	case snmpVersion2c:
+	case snmpVersion3:
+		if sc.User == "" {
+			errs = append(errs, fmt.Errorf("alerts snmp version 3 needs a user"))
+		}
+		if sc.AuthProtocol != snmpAuthMD5 && sc.AuthProtocol != snmpAuthSHA {
+			errs = append(errs, fmt.Errorf("alerts snmp auth-protocol must be md5 or sha, got %q", sc.AuthProtocol))
+		}
+		if sc.PrivProtocol != snmpPrivDES && sc.PrivProtocol != snmpPrivAES {
+			errs = append(errs, fmt.Errorf("alerts snmp priv-protocol must be des or aes, got %q", sc.PrivProtocol))
+		}
+		if sc.AuthPassword != "" && len(sc.AuthPassword) < 8 {
+			errs = append(errs, fmt.Errorf("alerts snmp auth-password must be at least 8 characters"))
+		}
+		if sc.PrivPassword != "" && len(sc.PrivPassword) < 8 {
+			errs = append(errs, fmt.Errorf("alerts snmp priv-password must be at least 8 characters"))
+		}
+		if sc.PrivPassword != "" && sc.AuthPassword == "" {
+			errs = append(errs, fmt.Errorf("alerts snmp priv-password needs an auth-password, there is no privacy without authentication"))
+		}
+		if sc.EngineID != "" {
+			if id, err := hex.DecodeString(sc.EngineID); err != nil || len(id) < 5 || len(id) > 32 {
+				errs = append(errs, fmt.Errorf("alerts snmp engine-id must be 5 to 32 bytes in hex, got %q", sc.EngineID))
+			}
+		}
+	default:
+		errs = append(errs, fmt.Errorf("alerts snmp version must be 2c or 3, got %q", sc.Version))
+	}
+	return errs
+}
+
+// snmpAddress adds the default trap port to a target without one.
+func snmpAddress(target string) string {
+	if _, _, err := net.SplitHostPort(target); err == nil {
+		return target
+	}
+	return net.JoinHostPort(strings.Trim(target, "[]"), defaultSNMPPort)
+}
+
+// newSNMPSender sets up the gosnmp client of the trap receiver, with the SNMPv3 user for the agent's engine ID.
+func newSNMPSender(sc snmpConfig, hostname string) (*snmpSender, error) {
+	s := &snmpSender{config: sc, address: snmpAddress(sc.Target), oid: strings.TrimPrefix(sc.OID, "."), started: time.Now()}
+	host, port, err := net.SplitHostPort(s.address)
+	if err != nil {
+		return nil, err
+	}
+	portNumber, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid snmp port %q", port)
+	}
+	s.client = &gosnmp.GoSNMP{
+		Target:    host,
+		Port:      uint16(portNumber),
+		Transport: "udp",
+		Community: sc.Community,
+		Version:   gosnmp.Version2c,
+		Timeout:   snmpTimeout,
+	}
+	if sc.Version != snmpVersion3 {
+		log.Debugf("[Config] Alert Traps = SNMPv2c to %s under %s", s.address, s.oid)
+		return s, nil
+	}
+	var engineID []byte
+	if sc.EngineID != "" {
+		engineID, _ = hex.DecodeString(sc.EngineID)
+	} else {
+		// an engine ID of the text format, enterprise 0, with the hostname
+		name := "cbandwidth-" + hostname
+		if len(name) > 27 {
+			name = name[:27]
+		}
+		engineID = append([]byte{0x80, 0x00, 0x00, 0x00, 0x04}, name...)
+	}
+	usm := &gosnmp.UsmSecurityParameters{
+		UserName:                 sc.User,
+		AuthoritativeEngineID:    string(engineID),
+		AuthoritativeEngineBoots: 1,
+	}
+	s.client.Version = gosnmp.Version3
+	s.client.SecurityModel = gosnmp.UserSecurityModel
+	s.client.MsgFlags = gosnmp.NoAuthNoPriv
+	if sc.AuthPassword != "" {
+		s.client.MsgFlags = gosnmp.AuthNoPriv
+		usm.AuthenticationProtocol = gosnmp.SHA
+		if sc.AuthProtocol == snmpAuthMD5 {
+			usm.AuthenticationProtocol = gosnmp.MD5
+		}
+		usm.AuthenticationPassphrase = sc.AuthPassword
+	}
+	if sc.PrivPassword != "" {
+		s.client.MsgFlags = gosnmp.AuthPriv
+		usm.PrivacyProtocol = gosnmp.AES
+		if sc.PrivProtocol == snmpPrivDES {
+			usm.PrivacyProtocol = gosnmp.DES
+		}
+		usm.PrivacyPassphrase = sc.PrivPassword
+	}
+	s.client.SecurityParameters = usm
+	log.Debugf("[Config] Alert Traps = SNMPv3 to %s under %s as %s, engine ID %x", s.address, s.oid, sc.User, engineID)
+	return s, nil
+}
+
+// send sends the trap of an alert, traps aren't acknowledged so it only fails if it couldn't be sent.
+func (s *snmpSender) send(event alertEvent) error {
+	notification := s.oid + ".0.1"
+	switch event.Name {
+	case alertAnomaly:
+		notification = s.oid + ".0.2"
+	case alertSLA:
+		notification = s.oid + ".0.3"
+	}
+	uptime := uint32(time.Since(s.started) / (10 * time.Millisecond))
+	trap := gosnmp.SnmpTrap{Variables: []gosnmp.SnmpPDU{
+		{Name: oidSysUpTime, Type: gosnmp.TimeTicks, Value: uptime},
+		{Name: oidSnmpTrapOID, Type: gosnmp.ObjectIdentifier, Value: notification},
+		{Name: s.oid + ".1.1.0", Type: gosnmp.OctetString, Value: event.Source},
+		{Name: s.oid + ".1.2.0", Type: gosnmp.OctetString, Value: event.Destination},
+		{Name: s.oid + ".1.3.0", Type: gosnmp.OctetString, Value: event.Address},
+		{Name: s.oid + ".1.4.0", Type: gosnmp.OctetString, Value: event.Direction},
+		{Name: s.oid + ".1.5.0", Type: gosnmp.OctetString, Value: event.Engine},
+		{Name: s.oid + ".1.6.0", Type: gosnmp.Counter64, Value: uint64(event.Value)},
+		{Name: s.oid + ".1.7.0", Type: gosnmp.Counter64, Value: uint64(event.Limit)},
+		{Name: s.oid + ".1.8.0", Type: gosnmp.OctetString, Value: event.Message},
+	}}
+
+	// the client isn't safe for concurrent use, and the engine time of the SNMPv3 traps moves with every trap
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if usm, ok := s.client.SecurityParameters.(*gosnmp.UsmSecurityParameters); ok {
+		usm.AuthoritativeEngineTime = uint32(time.Since(s.started).Seconds())
+	}
+	start := time.Now()
+	err := s.client.Connect()
+	if err == nil {
+		_, err = s.client.SendTrap(trap)
+		s.client.Conn.Close()
+	}
+	auditWrite("snmp", s.address, 0, start, err)
+	if err == nil {
+		log.Debugf("Sent the %s trap of %s to %s", event.Name, event.Destination, s.address)
+	}
+	return err
+}
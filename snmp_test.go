@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
+	"hash"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+// The password and engine ID the keys of RFC 3414 A.3 are localized from.
+const (
+	rfc3414Password = "maplesyrup"
+	rfc3414EngineID = "000000000000000000000002"
+)
+
+var testAlert = alertEvent{
+	Name:        alertThreshold,
+	Source:      "agent-1",
+	Destination: "azure",
+	Address:     "10.0.0.5",
+	Direction:   directionDownload,
+	Engine:      engineIperf3,
+	Value:       52000000,
+	Limit:       100000000,
+	Message:     "download below the threshold",
+}
+
+// TestSNMPv3KeyLocalization checks that the traps are authenticated with the keys of RFC 3414 A.3, the HMAC of a
+// sent trap is recomputed with the published localized key.
+func TestSNMPv3KeyLocalization(t *testing.T) {
+	for _, tc := range []struct {
+		protocol string
+		hash     func() hash.Hash
+		key      string
+	}{
+		{snmpAuthMD5, md5.New, "526f5eed9fcce26f8964c2930787d82b"},
+		{snmpAuthSHA, sha1.New, "6695febc9288e36282235fc7151f128497b38f3f"},
+	} {
+		t.Run(tc.protocol, func(t *testing.T) {
+			conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			sender, err := newSNMPSender(snmpConfig{
+				Target:       conn.LocalAddr().String(),
+				Version:      snmpVersion3,
+				OID:          defaultSNMPOID,
+				User:         "cbandwidth",
+				AuthProtocol: tc.protocol,
+				AuthPassword: rfc3414Password,
+				EngineID:     rfc3414EngineID,
+			}, "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := sender.send(testAlert); err != nil {
+				t.Fatal(err)
+			}
+			message := make([]byte, 65535)
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			n, _, err := conn.ReadFrom(message)
+			if err != nil {
+				t.Fatal(err)
+			}
+			message = message[:n]
+
+			// the authentication parameters are the 12 byte octet string following the user name
+			user := append([]byte{0x04, byte(len("cbandwidth"))}, "cbandwidth"...)
+			at := bytes.Index(message, user)
+			if at < 0 || message[at+len(user)] != 0x04 || message[at+len(user)+1] != 12 {
+				t.Fatalf("no authentication parameters in the trap %x", message)
+			}
+			at += len(user) + 2
+			sent := append([]byte(nil), message[at:at+12]...)
+			copy(message[at:at+12], make([]byte, 12))
+			key, _ := hex.DecodeString(tc.key)
+			mac := hmac.New(tc.hash, key)
+			mac.Write(message)
+			if want := mac.Sum(nil)[:12]; !bytes.Equal(sent, want) {
+				t.Errorf("the trap is authenticated with %x, want %x from the RFC 3414 key %s", sent, want, tc.key)
+			}
+		})
+	}
+}
+
+// TestSNMPTrapRoundTrip sends the traps to a gosnmp receiver and checks the decoded objects.
+func TestSNMPTrapRoundTrip(t *testing.T) {
+	engineID, _ := hex.DecodeString(rfc3414EngineID)
+	for _, tc := range []struct {
+		name     string
+		config   snmpConfig
+		receiver *gosnmp.GoSNMP
+	}{
+		{
+			name:   "v2c",
+			config: snmpConfig{Version: snmpVersion2c, Community: "public"},
+			receiver: &gosnmp.GoSNMP{
+				Version:   gosnmp.Version2c,
+				Community: "public",
+			},
+		},
+		{
+			name: "v3 sha aes",
+			config: snmpConfig{
+				Version:      snmpVersion3,
+				User:         "cbandwidth",
+				AuthProtocol: snmpAuthSHA,
+				AuthPassword: rfc3414Password,
+				PrivProtocol: snmpPrivAES,
+				PrivPassword: "pancakes-and-syrup",
+				EngineID:     rfc3414EngineID,
+			},
+			receiver: &gosnmp.GoSNMP{
+				Version:       gosnmp.Version3,
+				SecurityModel: gosnmp.UserSecurityModel,
+				MsgFlags:      gosnmp.AuthPriv,
+				SecurityParameters: &gosnmp.UsmSecurityParameters{
+					UserName:                 "cbandwidth",
+					AuthoritativeEngineID:    string(engineID),
+					AuthenticationProtocol:   gosnmp.SHA,
+					AuthenticationPassphrase: rfc3414Password,
+					PrivacyProtocol:          gosnmp.AES,
+					PrivacyPassphrase:        "pancakes-and-syrup",
+				},
+			},
+		},
+		{
+			name: "v3 md5 des",
+			config: snmpConfig{
+				Version:      snmpVersion3,
+				User:         "cbandwidth",
+				AuthProtocol: snmpAuthMD5,
+				AuthPassword: rfc3414Password,
+				PrivProtocol: snmpPrivDES,
+				PrivPassword: "pancakes-and-syrup",
+				EngineID:     rfc3414EngineID,
+			},
+			receiver: &gosnmp.GoSNMP{
+				Version:       gosnmp.Version3,
+				SecurityModel: gosnmp.UserSecurityModel,
+				MsgFlags:      gosnmp.AuthPriv,
+				SecurityParameters: &gosnmp.UsmSecurityParameters{
+					UserName:                 "cbandwidth",
+					AuthoritativeEngineID:    string(engineID),
+					AuthenticationProtocol:   gosnmp.MD5,
+					AuthenticationPassphrase: rfc3414Password,
+					PrivacyProtocol:          gosnmp.DES,
+					PrivacyPassphrase:        "pancakes-and-syrup",
+				},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			received := make(chan []gosnmp.SnmpPDU, 1)
+			listener := gosnmp.NewTrapListener()
+			defer listener.Close()
+			listener.Params = tc.receiver
+			listener.OnNewTrap = func(packet *gosnmp.SnmpPacket, _ *net.UDPAddr) {
+				received <- packet.Variables
+			}
+			address := freeUDPAddress(t)
+			errs := make(chan error, 1)
+			go func() { errs <- listener.Listen(address) }()
+			select {
+			case <-listener.Listening():
+			case err := <-errs:
+				t.Fatal(err)
+			}
+
+			tc.config.Target = address
+			tc.config.OID = defaultSNMPOID
+			if errs := validateSNMP(tc.config); len(errs) > 0 {
+				t.Fatal(errs)
+			}
+			sender, err := newSNMPSender(tc.config, "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := sender.send(testAlert); err != nil {
+				t.Fatal(err)
+			}
+			var variables []gosnmp.SnmpPDU
+			select {
+			case variables = <-received:
+			case <-time.After(2 * time.Second):
+				t.Fatal("no trap was received")
+			}
+
+			values := make(map[string]interface{})
+			for _, variable := range variables {
+				if value, ok := variable.Value.([]byte); ok {
+					values[variable.Name] = string(value)
+				} else {
+					values[variable.Name] = variable.Value
+				}
+			}
+			for oid, want := range map[string]interface{}{
+				oidSnmpTrapOID:                  "." + defaultSNMPOID + ".0.1",
+				"." + defaultSNMPOID + ".1.1.0": testAlert.Source,
+				"." + defaultSNMPOID + ".1.2.0": testAlert.Destination,
+				"." + defaultSNMPOID + ".1.3.0": testAlert.Address,
+				"." + defaultSNMPOID + ".1.6.0": uint64(testAlert.Value),
+				"." + defaultSNMPOID + ".1.7.0": uint64(testAlert.Limit),
+				"." + defaultSNMPOID + ".1.8.0": testAlert.Message,
+			} {
+				if values[oid] != want {
+					t.Errorf("%s = %v, want %v", oid, values[oid], want)
+				}
+			}
+		})
+	}
+}
+
+// freeUDPAddress returns a loopback address with a UDP port that was free a moment ago.
+func freeUDPAddress(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().String()
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	engineSSH      = "ssh"
+	defaultSSHPort = "22"
+	// sshServerStartDelay gives the remote iperf3 server time to bind before the client connects.
+	sshServerStartDelay = time.Second
+)
+
+type sshConfig struct {
+	User                  string `yaml:"user"`
+	Port                  string `yaml:"port"`
+	KeyFile               string `yaml:"key-file"`
+	KnownHosts            string `yaml:"known-hosts"`
+	InsecureIgnoreHostKey bool   `yaml:"insecure-ignore-host-key"`
+	IperfCommand          string `yaml:"iperf-command"`
+}
+
+// sshSettings is the merged ssh configuration used by the ssh engine.
+var sshSettings sshConfig
+
+// the ssh engine runs the iperf3 client locally against a server started over ssh for each endpoint.
+func init() {
+	sshEngine := engines[engineIperf3]
+	sshEngine.name = engineSSH
+	sshEngine.prepare = startRemoteServer
+	engines[engineSSH] = sshEngine
+}
+
+// mergeSSHFlags fills any ssh settings missing from the configuration file with the CLI values and defaults.
+func mergeSSHFlags(sc *sshConfig) {
+	if sc.User == "" {
+		sc.User = cliFlags.sshUser
+	}
+	if sc.KeyFile == "" {
+		sc.KeyFile = cliFlags.sshKeyFile
+	}
+	if sc.Port == "" {
+		sc.Port = defaultSSHPort
+	}
+	if sc.IperfCommand == "" {
+		sc.IperfCommand = "iperf3"
+	}
+	if sc.KnownHosts == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			sc.KnownHosts = filepath.Join(home, ".ssh", "known_hosts")
+		}
+	}
+}
+
+// startRemoteServer starts an iperf3 server on the endpoint over ssh and returns a function stopping it.
+func startRemoteServer(eng engine, server perfServer) (func(), error) {
+	client, err := dialSSH(server.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := runSSH(client, fmt.Sprintf("nohup %s -s -p %s >/dev/null 2>&1 & echo $!",
+		sshSettings.IperfCommand,
+		server.serverPort(eng),
+	))
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("could not start the iperf3 server on %s: %v %s", server.Address, err, output)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(output))
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("could not read the pid of the iperf3 server started on %s: %s", server.Address, output)
+	}
+	log.Debugf("[SSH] Started iperf3 server on %s with pid %d", server.Address, pid)
+	time.Sleep(sshServerStartDelay)
+
+	return func() {
+		if output, err := runSSH(client, fmt.Sprintf("kill %d", pid)); err != nil {
+			log.Errorf("Error stopping the iperf3 server with pid %d on %s: %v %s", pid, server.Address, err, output)
+		} else {
+			log.Debugf("[SSH] Stopped iperf3 server on %s with pid %d", server.Address, pid)
+		}
+		client.Close()
+	}, nil
+}
+
+// dialSSH connects to a host authenticating with the configured key file or the running ssh-agent.
+func dialSSH(host string) (*ssh.Client, error) {
+	return dialSSHAs(sshSettings.User, net.JoinHostPort(host, sshSettings.Port))
+}
+
+// dialSSHAs connects to host:port as a user with the configured ssh credentials.
+func dialSSHAs(user string, hostPort string) (*ssh.Client, error) {
+	var auth []ssh.AuthMethod
+	if sshSettings.KeyFile != "" {
+		key, err := os.ReadFile(sshSettings.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the ssh key: %v", err)
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse the ssh key %s: %v", sshSettings.KeyFile, err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			log.Warnf("Could not connect to the ssh-agent at %s: %v", socket, err)
+		} else {
+			auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("no ssh key file was passed and no ssh-agent is running")
+	}
+
+	hostKeyCallback := ssh.InsecureIgnoreHostKey()
+	if !sshSettings.InsecureIgnoreHostKey {
+		callback, err := knownhosts.New(sshSettings.KnownHosts)
+		if err != nil {
+			return nil, fmt.Errorf("could not load the ssh known hosts %s: %v", sshSettings.KnownHosts, err)
+		}
+		hostKeyCallback = callback
+	}
+
+	return ssh.Dial("tcp", hostPort, &ssh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         10 * time.Second,
+	})
+}
+
+// runSSH runs a command in a new session and returns its combined output.
+func runSSH(client *ssh.Client, command string) (string, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+
+	log.Debugf("[SSH] Running Command -> %s", command)
+	output, err := session.CombinedOutput(command)
+	return strings.TrimSpace(string(output)), err
+}
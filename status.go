@@ -0,0 +1,180 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// agentStatus is the live state of the agent served at /status for the top command.
+type agentStatus struct {
+	Hostname string    `json:"hostname"`
+	Version  string    `json:"version"`
+	Started  time.Time `json:"started"`
+	Now      time.Time `json:"now"`
+	Cycles   int       `json:"cycles"`
+	// Testing is the test running right now, nil between tests.
+	Testing *runningTest `json:"testing,omitempty"`
+	// NextRuns is when the test cycle of each endpoint group is next due, "default" for the ungrouped endpoints.
+	NextRuns  map[string]time.Time `json:"next-runs"`
+	Endpoints []endpointStatus     `json:"endpoints"`
+}
+
+// runningTest is a test in progress.
+type runningTest struct {
+	Endpoint  string    `json:"endpoint"`
+	Address   string    `json:"address"`
+	Direction string    `json:"direction"`
+	RunID     string    `json:"run-id"`
+	Started   time.Time `json:"started"`
+	// Length is the expected duration of every run of the test in seconds, Runs the number of runs.
+	Length int `json:"length"`
+	Runs   int `json:"runs"`
+	// ServerPorts are the ports of the endpoint the test connects to, ClientPorts the source port range of its
+	// streams when the client ports are pinned.
+	ServerPorts []string `json:"server-ports,omitempty"`
+	ClientPorts string   `json:"client-ports,omitempty"`
+}
+
+// endpointStatus is the latest results and the error count of an endpoint.
+type endpointStatus struct {
+	Name     string        `json:"name"`
+	Address  string        `json:"address"`
+	Download *statusResult `json:"download,omitempty"`
+	Upload   *statusResult `json:"upload,omitempty"`
+	// Errors counts the failed tests and pre-checks since the agent started, LastError is the time of the last one
+	// and LastErrorClass its class such as timeout or refused.
+	Errors         int        `json:"errors"`
+	LastError      *time.Time `json:"last-error,omitempty"`
+	LastErrorClass string     `json:"last-error-class,omitempty"`
+}
+
+// statusResult is the latest bitrate measured in a direction.
+type statusResult struct {
+	Bps       int64     `json:"bps"`
+	Timestamp time.Time `json:"timestamp"`
+	RunID     string    `json:"run-id"`
+}
+
+// agentState tracks the agent state from the measurements and the test loop.
+var agentState = struct {
+	sync.RWMutex
+	started   time.Time
+	cycles    int
+	testing   *runningTest
+	nextRuns  map[string]time.Time
+	endpoints map[string]*endpointStatus
+}{started: time.Now(), nextRuns: make(map[string]time.Time), endpoints: make(map[string]*endpointStatus)}
+
+// statusEndpoint returns the status of a measurement's endpoint, created on its first measurement. The lock must
+// be held.
+func statusEndpoint(name string, address string) *endpointStatus {
+	key := address + "|" + name
+	endpoint, ok := agentState.endpoints[key]
+	if !ok {
+		endpoint = &endpointStatus{Name: name, Address: address}
+		agentState.endpoints[key] = endpoint
+	}
+	return endpoint
+}
+
+// recordStatus updates the latest result, the error count or the class of the last error of an endpoint from a
+// measurement.
+func recordStatus(m measurement) {
+	failed := (m.Metric == "test_failed" && m.Value > 0) || (m.Metric == "reachable" && m.Value == 0)
+	result := m.Metric == "" && (m.Direction == directionDownload || m.Direction == directionUpload)
+	if !failed && !result && m.Metric != "test_errors" {
+		return
+	}
+	agentState.Lock()
+	defer agentState.Unlock()
+	endpoint := statusEndpoint(m.Destination, m.Address)
+	if m.Metric == "test_errors" {
+		endpoint.LastErrorClass = m.Tags["class"]
+		return
+	}
+	if failed {
+		endpoint.Errors++
+		at := m.Timestamp
+		endpoint.LastError = &at
+		return
+	}
+	latest := &statusResult{Bps: m.Bps, Timestamp: m.Timestamp, RunID: m.RunID}
+	if m.Direction == directionUpload {
+		endpoint.Upload = latest
+	} else {
+		endpoint.Download = latest
+	}
+}
+
+// statusTesting marks a test as running, the returned function marks it finished.
+func statusTesting(eng engine, server perfServer, direction string, length string, runs int, ports []string) func() {
+	seconds, _ := strconv.Atoi(length)
+	test := &runningTest{
+		Endpoint:    server.displayName(),
+		Address:     server.Address,
+		Direction:   direction,
+		RunID:       server.runID,
+		Started:     time.Now(),
+		Length:      seconds,
+		Runs:        runs,
+		ServerPorts: ports,
+	}
+	if clientPorts != nil && eng.cport {
+		test.ClientPorts = clientPorts.String()
+	}
+	agentState.Lock()
+	agentState.testing = test
+	agentState.Unlock()
+	return func() {
+		agentState.Lock()
+		if agentState.testing == test {
+			agentState.testing = nil
+		}
+		agentState.Unlock()
+	}
+}
+
+// statusScheduled records when the cycle of an endpoint group is next due, after a cycle of it ran.
+func statusScheduled(group string, next time.Time) {
+	if group == "" {
+		group = "default"
+	}
+	agentState.Lock()
+	agentState.cycles++
+	agentState.nextRuns[group] = next
+	agentState.Unlock()
+}
+
+// currentStatus returns a copy of the agent state for the API, the endpoints sorted by name.
+func currentStatus(hostname string) agentStatus {
+	agentState.RLock()
+	defer agentState.RUnlock()
+	current := agentStatus{
+		Hostname:  hostname,
+		Version:   version,
+		Started:   agentState.started,
+		Now:       time.Now(),
+		Cycles:    agentState.cycles,
+		NextRuns:  make(map[string]time.Time, len(agentState.nextRuns)),
+		Endpoints: make([]endpointStatus, 0, len(agentState.endpoints)),
+	}
+	if agentState.testing != nil {
+		testing := *agentState.testing
+		current.Testing = &testing
+	}
+	for group, next := range agentState.nextRuns {
+		current.NextRuns[group] = next
+	}
+	for _, endpoint := range agentState.endpoints {
+		current.Endpoints = append(current.Endpoints, *endpoint)
+	}
+	sort.Slice(current.Endpoints, func(i, j int) bool {
+		if current.Endpoints[i].Name != current.Endpoints[j].Name {
+			return current.Endpoints[i].Name < current.Endpoints[j].Name
+		}
+		return current.Endpoints[i].Address < current.Endpoints[j].Address
+	})
+	return current
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxStripePorts bounds the clients a test starts at once to an endpoint.
+const maxStripePorts = 64
+
+// parsePortRange parses the ports of an endpoint, a range such as 5201-5208, a list such as 5201,5203 or both.
+func parsePortRange(text string) ([]string, error) {
+	var ports []string
+	seen := make(map[int]bool)
+	for _, part := range strings.Split(text, ",") {
+		part = strings.TrimSpace(part)
+		bounds := strings.SplitN(part, "-", 2)
+		first, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+		if err != nil {
+			return nil, fmt.Errorf("ports must be a range such as 5201-5208 or a list of ports, got %q", text)
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(strings.TrimSpace(bounds[1])); err != nil {
+				return nil, fmt.Errorf("ports must be a range such as 5201-5208 or a list of ports, got %q", text)
+			}
+		}
+		if first < 1 || last > 65535 || first > last {
+			return nil, fmt.Errorf("ports %q must be between 1 and 65535 with the lower port of a range first", part)
+		}
+		for port := first; port <= last; port++ {
+			if !seen[port] {
+				seen[port] = true
+				ports = append(ports, strconv.Itoa(port))
+			}
+		}
+		if len(ports) > maxStripePorts {
+			return nil, fmt.Errorf("ports %q has more than %d ports", text, maxStripePorts)
+		}
+	}
+	return ports, nil
+}
+
+// stripePorts returns the ports a test to an endpoint is striped across, nil unless it has several ports and the
+// engine runs a server per port.
+func stripePorts(eng engine, server perfServer) []string {
+	if server.Ports == "" || server.tunnelHost != "" {
+		return nil
+	}
+	if eng.name != engineIperf3 && eng.name != engineIperf2 {
+		log.Warnf("The %s engine can't stripe a test across the ports of %s [%s], testing port %s only", eng.name, server.Address, server.displayName(), server.serverPort(eng))
+		return nil
+	}
+	ports, err := parsePortRange(server.Ports)
+	if err != nil || len(ports) < 2 {
+		return nil
+	}
+	return ports
+}
+
+// runStripedSample runs a client to each port of an endpoint at once and sums their results, so the flows hash
+// onto several ECMP paths. The run fails if any client fails since the sum would understate the path. The output
+// of each client is stored under the raw ID with its port.
+func runStripedSample(eng engine, server perfServer, argvs [][]string, ports []string, rawID string) (sample, error) {
+	results := make([]sample, len(argvs))
+	errs := make([]error, len(argvs))
+	var wg sync.WaitGroup
+	for i := range argvs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			stripe := server
+			stripe.Port = ports[i]
+			stripeID := ""
+			if rawID != "" {
+				stripeID = stripeRawID(rawID, ports[i])
+			}
+			results[i], errs[i] = runSample(context.Background(), eng, stripe, argvs[i], stripeID)
+		}(i)
+	}
+	wg.Wait()
+
+	var total sample
+	total.hasFullRun = true
+	total.started = results[0].started
+	var rawIDs []string
+	var intervals [][]intervalSample
+	for i, result := range results {
+		if errs[i] != nil {
+			return total, &testError{class: classifyError(errs[i], ""), reason: fmt.Sprintf("port %s: %v", ports[i], errs[i])}
+		}
+		total.bps += result.bps
+		total.fullRunBps += result.fullRunBps
+		total.hasFullRun = total.hasFullRun && result.hasFullRun
+		total.retransmits += result.retransmits
+		total.hasRetransmits = total.hasRetransmits || result.hasRetransmits
+		total.bytes += result.bytes
+		if result.congestion != "" {
+			total.congestion = result.congestion
+		}
+		if result.rawID != "" {
+			rawIDs = append(rawIDs, result.rawID)
+		}
+		intervals = append(intervals, result.intervals)
+	}
+	total.rawID = strings.Join(rawIDs, ",")
+	total.intervals = sumIntervals(intervals)
+	return total, nil
+}
+
+// stripeRawID adds the port of a striped client to the raw ID of its run.
+func stripeRawID(rawID string, port string) string {
+	if i := strings.LastIndex(rawID, "."); i >= 0 {
+		return rawID[:i] + "-p" + port + rawID[i:]
+	}
+	return rawID + "-p" + port
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSyslogPort    = "514"
+	defaultSyslogTLSPort = "6514"
+	defaultSyslogApp     = "cloud-bandwidth"
+	syslogUDP            = "udp"
+	syslogTCP            = "tcp"
+	syslogTLS            = "tls"
+	// syslogWarning is the severity of the alerts.
+	syslogWarning = 4
+	// syslogSDID is the structured data element of an alert, under the RFC 5612 example enterprise number.
+	syslogSDID    = "cbandwidth@32473"
+	syslogTimeout = 5 * time.Second
+)
+
+// syslogFacilities are the facility codes by name.
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "daemon": 3, "auth": 4, "syslog": 5,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// syslogConfig sends the alerts as RFC 5424 syslog events.
+type syslogConfig struct {
+	// Address is the syslog server as host[:port], 514 by default or 6514 with TLS.
+	Address string `yaml:"address"`
+	// Protocol is udp (default), tcp or tls, the stream protocols frame the events with their length.
+	Protocol string `yaml:"protocol"`
+	Facility string `yaml:"facility"`
+	AppName  string `yaml:"app-name"`
+}
+
+// syslogSender formats and sends the alerts, a connection is opened per event as alerts are rare.
+type syslogSender struct {
+	config   syslogConfig
+	address  string
+	hostname string
+	priority int
+}
+
+// validateSyslog checks the server, the protocol and the facility.
+func validateSyslog(sc syslogConfig) []error {
+	if sc.Address == "" {
+		return nil
+	}
+	var errs []error
+	if sc.Protocol != syslogUDP && sc.Protocol != syslogTCP && sc.Protocol != syslogTLS {
+		errs = append(errs, fmt.Errorf("alerts syslog protocol must be udp, tcp or tls, got %q", sc.Protocol))
+	}
+	if _, _, err := net.SplitHostPort(syslogAddress(sc)); err != nil {
+		errs = append(errs, fmt.Errorf("alerts syslog address must be a host with an optional port, got %q", sc.Address))
+	}
+	if _, ok := syslogFacilities[sc.Facility]; !ok {
+		errs = append(errs, fmt.Errorf("alerts syslog facility must be one of kern, user, daemon, auth, syslog or local0 to local7, got %q", sc.Facility))
+	}
+	return errs
+}
+
+// syslogAddress adds the default port of the protocol to a server without one.
+func syslogAddress(sc syslogConfig) string {
+	if _, _, err := net.SplitHostPort(sc.Address); err == nil {
+		return sc.Address
+	}
+	port := defaultSyslogPort
+	if sc.Protocol == syslogTLS {
+		port = defaultSyslogTLSPort
+	}
+	return net.JoinHostPort(strings.Trim(sc.Address, "[]"), port)
+}
+
+func newSyslogSender(sc syslogConfig, hostname string) *syslogSender {
+	return &syslogSender{
+		config:   sc,
+		address:  syslogAddress(sc),
+		hostname: hostname,
+		priority: syslogFacilities[sc.Facility]*8 + syslogWarning,
+	}
+}
+
+// format renders an alert as an RFC 5424 message, the alert name is the MSGID and its fields are structured data.
+func (s *syslogSender) format(event alertEvent) string {
+	params := [][2]string{
+		{"endpoint", event.Destination},
+		{"address", event.Address},
+		{"direction", event.Direction},
+		{"engine", event.Engine},
+		{"bps", strconv.FormatInt(event.Value, 10)},
+		{"limit", strconv.FormatFloat(event.Limit, 'f', 0, 64)},
+	}
+	var sd strings.Builder
+	sd.WriteString("[" + syslogSDID)
+	for _, param := range params {
+		fmt.Fprintf(&sd, " %s=\"%s\"", param[0], syslogEscape(param[1]))
+	}
+	sd.WriteString("]")
+	return fmt.Sprintf("<%d>1 %s %s %s %d %s %s %s", s.priority, event.Timestamp.UTC().Format(time.RFC3339Nano),
+		syslogHeader(s.hostname), syslogHeader(s.config.AppName), os.Getpid(), event.Name, sd.String(), event.Message)
+}
+
+// send sends an alert, over TCP and TLS with the octet counting framing of RFC 6587.
+func (s *syslogSender) send(event alertEvent) error {
+	message := s.format(event)
+	start := time.Now()
+	err := s.write(message)
+	auditWrite("syslog", s.address, len(message), start, err)
+	if err == nil {
+		log.Debugf("Sent the %s syslog event of %s to %s", event.Name, event.Destination, s.address)
+	}
+	return err
+}
+
+func (s *syslogSender) write(message string) error {
+	var conn net.Conn
+	var err error
+	switch s.config.Protocol {
+	case syslogTLS:
+		host, _, _ := net.SplitHostPort(s.address)
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: syslogTimeout}, "tcp", s.address, &tls.Config{ServerName: host})
+	case syslogTCP:
+		conn, err = net.DialTimeout("tcp", s.address, syslogTimeout)
+	default:
+		conn, err = net.DialTimeout("udp", s.address, syslogTimeout)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(syslogTimeout))
+	if s.config.Protocol != syslogUDP {
+		message = strconv.Itoa(len(message)) + " " + message
+	}
+	_, err = conn.Write([]byte(message))
+	return err
+}
+
+// syslogHeader makes a header field printable ASCII without spaces, - if it's empty.
+func syslogHeader(value string) string {
+	value = strings.Map(func(r rune) rune {
+		if r <= 32 || r >= 127 {
+			return -1
+		}
+		return r
+	}, value)
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// syslogEscape escapes the characters with a meaning in a structured data parameter value.
+func syslogEscape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(value)
+}
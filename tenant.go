@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+)
+
+// tenantNamePattern keeps a tenant name usable as a metric path segment and a tag value.
+var tenantNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// tenantConfig is a customer served by the agent, with its own endpoints, metric prefixes and tsdb credentials.
+// Its results are only written to its own tsdb and to the shared sinks it lists, never to another tenant's.
+type tenantConfig struct {
+	Name string `yaml:"name"`
+	// Interval is the pause between the tenant's cycles in seconds.
+	Interval string `yaml:"interval"`
+	// Profiles are the names of the test profiles the tenant's endpoints are tested with.
+	Profiles []string `yaml:"profiles"`
+	// DownloadPrefix and UploadPrefix default to the global prefixes under the tenant name.
+	DownloadPrefix string `yaml:"download-prefix"`
+	UploadPrefix   string `yaml:"upload-prefix"`
+	// GraphiteAddress is the host:port of the tenant's carbon server with the graphite tsdb.
+	GraphiteAddress string `yaml:"graphite-address"`
+	// InfluxURL, KentikEmail and KentikToken are the tenant's influx endpoint and credentials with the influx tsdb.
+	InfluxURL       string `yaml:"influx-url"`
+	KentikEmail     string `yaml:"kentik-email"`
+	KentikToken     string `yaml:"kentik-token"`
+	KentikTokenFile string `yaml:"kentik-token-file"`
+	// Sinks are the shared sinks the tenant's results are also written to, none by default. tsdb writes them to
+	// the global tsdb in place of a tenant tsdb. The shared sinks are the operator's, with the operator's
+	// addresses and credentials, only the tsdb can be the tenant's own.
+	Sinks       []string     `yaml:"sinks"`
+	PerfServers []perfServer `yaml:"iperf-servers"`
+}
+
+// tenantSink is the tsdb writer of a tenant.
+type tenantSink struct {
+	graphite *graphiteBatcher
+	influx   *influxBatcher
+}
+
+// tenantSinks are the tsdb writers of the tenants by name.
+var tenantSinks map[string]*tenantSink
+
+// tenantGroups returns an endpoint group per tenant, so the tenants are scheduled and tested like the groups.
+func tenantGroups(tenants []tenantConfig) []endpointGroup {
+	groups := make([]endpointGroup, 0, len(tenants))
+	for i := range tenants {
+		tenant := &tenants[i]
+		groups = append(groups, endpointGroup{
+			Name:           tenant.Name,
+			Interval:       tenant.Interval,
+			Profiles:       tenant.Profiles,
+			DownloadPrefix: tenant.DownloadPrefix,
+			UploadPrefix:   tenant.UploadPrefix,
+			Sinks:          tenant.Sinks,
+			PerfServers:    tenant.PerfServers,
+			tenant:         tenant,
+		})
+	}
+	return groups
+}
+
+// tenant returns the tenant of the cycle, nil outside of a tenant.
+func (c configuration) tenant() *tenantConfig {
+	if c.group == nil {
+		return nil
+	}
+	return c.group.tenant
+}
+
+// ownTSDB reports whether the tenant's results are written to a tsdb of its own rather than the global one.
+func (t *tenantConfig) ownTSDB() bool {
+	return !containsString(t.Sinks, sinkTSDB)
+}
+
+// resolveTenantSecrets expands the environment references in the tenants' credentials and reads their token files.
+func resolveTenantSecrets(tenants []tenantConfig) error {
+	for i := range tenants {
+		tenant := &tenants[i]
+		for _, field := range []*string{&tenant.InfluxURL, &tenant.KentikEmail, &tenant.KentikToken, &tenant.KentikTokenFile} {
+			*field = expandEnv(*field)
+		}
+		if tenant.KentikToken == "" && tenant.KentikTokenFile != "" {
+			token, err := readSecretFile(tenant.KentikTokenFile)
+			if err != nil {
+				return fmt.Errorf("tenant %s: %v", tenant.Name, err)
+			}
+			tenant.KentikToken = token
+		}
+	}
+	return nil
+}
+
+// validateTenants checks every tenant has a name and a tsdb of its own, and that no two tenants write under the
+// same prefix. The endpoints, interval, profiles and sinks are checked with the groups.
+func validateTenants(config configuration) []error {
+	var errs []error
+	if len(config.Tenants) > 0 && config.Agent.ControllerURL != "" {
+		errs = append(errs, fmt.Errorf("tenants can't be used with a controller, the controller writes every agent's results to its own sinks"))
+	}
+	prefixes := make(map[string]string)
+	for i, tenant := range config.Tenants {
+		if !tenantNamePattern.MatchString(tenant.Name) {
+			errs = append(errs, fmt.Errorf("tenant %d name must only contain letters, digits, - and _, got %q", i+1, tenant.Name))
+			continue
+		}
+		if tenant.ownTSDB() {
+			if cliFlags.tsdbType == "influx" {
+				if tenant.InfluxURL == "" {
+					errs = append(errs, fmt.Errorf("tenant %s needs an influx-url, or tsdb in its sinks to share the global one", tenant.Name))
+				}
+			} else if _, _, err := net.SplitHostPort(tenant.GraphiteAddress); err != nil {
+				errs = append(errs, fmt.Errorf("tenant %s needs a graphite-address as host:port, or tsdb in its sinks to share the global one, got %q", tenant.Name, tenant.GraphiteAddress))
+			}
+		}
+		for _, prefix := range []string{tenant.DownloadPrefix, tenant.UploadPrefix} {
+			if prefix == "" {
+				continue
+			}
+			if other, ok := prefixes[prefix]; ok && other != tenant.Name {
+				errs = append(errs, fmt.Errorf("tenants %s and %s both write under the prefix %q", other, tenant.Name, prefix))
+			}
+			prefixes[prefix] = tenant.Name
+		}
+	}
+	return errs
+}
+
+// initTenants sets up the tsdb writer of every tenant with a tsdb of its own.
+func initTenants(config configuration) error {
+	tenantSinks = make(map[string]*tenantSink)
+	for _, tenant := range config.Tenants {
+		if !tenant.ownTSDB() {
+			continue
+		}
+		sink := &tenantSink{}
+		if cliFlags.tsdbType == "influx" {
+			writer, err := newInfluxBatcher(tenant.InfluxURL, tenant.KentikEmail, tenant.KentikToken)
+			if err != nil {
+				return err
+			}
+			sink.influx = writer
+			log.Debugf("[Config] Tenant %s = influx at %s", tenant.Name, tenant.InfluxURL)
+		} else {
+			sink.graphite = newGraphiteBatcher(tenant.GraphiteAddress)
+			log.Debugf("[Config] Tenant %s = graphite at %s", tenant.Name, sink.graphite.address)
+		}
+		tenantSinks[tenant.Name] = sink
+	}
+	return nil
+}
+
+// add buffers a measurement of the tenant until the sinks are flushed.
+func (s *tenantSink) add(config configuration, m measurement) {
+	if s.graphite != nil {
+		s.graphite.add(graphitePointOf(config, m))
+	} else {
+		s.influx.add(influxLine(config, m), m.RunID)
+	}
+}
+
+// flush writes out the tenant's batched measurements.
+func (s *tenantSink) flush() {
+	if s.graphite != nil {
+		s.graphite.flush()
+	} else {
+		s.influx.flush()
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestTenantStateSeparation checks that two tenants testing the same address keep their own state across cycles.
+func TestTenantStateSeparation(t *testing.T) {
+	tenants := []tenantConfig{
+		{Name: "acme", PerfServers: []perfServer{{Address: "10.99.0.1", Name: "dc"}}},
+		{Name: "globex", PerfServers: []perfServer{{Address: "10.99.0.1", Name: "dc"}}},
+	}
+	cycles := scheduledCycles(configuration{Groups: tenantGroups(tenants)}, runSettings{})
+	if len(cycles) != 2 {
+		t.Fatalf("got %d cycles, want one per tenant", len(cycles))
+	}
+	acme, globex := cycles[0].config.PerfServers[0], cycles[1].config.PerfServers[0]
+	if acme.resultKey() == globex.resultKey() {
+		t.Errorf("both tenants share the result key %q", acme.resultKey())
+	}
+
+	// the change from the previous result is the tenant's own
+	for _, m := range []measurement{
+		{Address: acme.Address, Direction: directionDownload, Engine: engineIperf3, Bps: 100, RunID: "a1", Tags: acme.Tags},
+		{Address: acme.Address, Direction: directionDownload, Engine: engineIperf3, Bps: 200, RunID: "a2", Tags: acme.Tags},
+		{Address: globex.Address, Direction: directionDownload, Engine: engineIperf3, Bps: 1000, RunID: "g1", Tags: globex.Tags},
+	} {
+		recordLatest(m)
+	}
+	if delta, ok := latestDelta(acme, directionDownload, engineIperf3); !ok || delta != 100 {
+		t.Errorf("acme delta = %v, %v, want 100%% from its own previous result", delta, ok)
+	}
+	if delta, ok := latestDelta(globex, directionDownload, engineIperf3); ok {
+		t.Errorf("globex delta = %v, want none on its first result", delta)
+	}
+
+	// a full rate test due for one tenant isn't due for the other
+	settings := runSettings{bandwidthCap: "100M", fullRateInterval: time.Hour}
+	eng := engines[engineIperf3]
+	for _, server := range []perfServer{acme, globex} {
+		if bandwidth := cycleBandwidth(settings, eng, server); bandwidth != "100M" {
+			t.Fatalf("%s ran at %q on its first cycle, want the 100M cap", server.Tags["tenant"], bandwidth)
+		}
+	}
+	lastFullRate.Lock()
+	lastFullRate.times[acme.resultKey()] = time.Now().Add(-2 * time.Hour)
+	lastFullRate.Unlock()
+	if bandwidth := cycleBandwidth(settings, eng, globex); bandwidth != "100M" {
+		t.Errorf("globex ran at %q on the full rate schedule of acme, want the 100M cap", bandwidth)
+	}
+	if bandwidth := cycleBandwidth(settings, eng, acme); bandwidth != "" {
+		t.Errorf("acme ran at %q, want its due full rate test", bandwidth)
+	}
+}
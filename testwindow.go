@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// testWindow changes the shape of the tests during a time of day, e.g. short capped tests during business hours
+// and long full rate tests at night. It is scheduled like a maintenance window, a cron expression with a duration
+// or a start and end time, and applies to every endpoint unless endpoints are listed. Unset settings keep the
+// global and endpoint values.
+type testWindow struct {
+	maintenanceWindow `yaml:",inline"`
+	// Length is the test duration in seconds.
+	Length string `yaml:"length"`
+	// Parallel is the number of parallel streams.
+	Parallel string `yaml:"parallel"`
+	// BandwidthCap overrides the endpoint and global bandwidth cap during the window, "0" runs at full rate.
+	BandwidthCap string `yaml:"bandwidth-cap"`
+}
+
+// testWindowSchedule is a parsed test window.
+type testWindowSchedule struct {
+	window   testWindow
+	schedule maintenanceSchedule
+}
+
+// testWindows are the parsed test windows, set up when the agent starts.
+var testWindows []testWindowSchedule
+
+// initTestWindows parses the test windows.
+func initTestWindows(windows []testWindow) error {
+	testWindows = nil
+	for i, window := range windows {
+		schedule, err := parseMaintenanceWindow(window.maintenanceWindow)
+		if err != nil {
+			return fmt.Errorf("test window %s: %v", maintenanceName(window.maintenanceWindow, i), err)
+		}
+		testWindows = append(testWindows, testWindowSchedule{window: window, schedule: schedule})
+		log.Debugf("[Config] Test Window = %s length=%s parallel=%s bandwidth-cap=%s", maintenanceName(window.maintenanceWindow, i), window.Length, window.Parallel, window.BandwidthCap)
+	}
+	return nil
+}
+
+// applyTestWindow applies the first test window an endpoint is in to the settings of its tests and tags the
+// endpoint with the window's name. A capped window skips the periodic full rate test so it can't land in the
+// hours the cap protects.
+func applyTestWindow(settings runSettings, server perfServer, now time.Time) (runSettings, perfServer) {
+	for i, tw := range testWindows {
+		if !tw.schedule.covers(server) || !tw.schedule.active(now) {
+			continue
+		}
+		name := maintenanceName(tw.window.maintenanceWindow, i)
+		log.Debugf("Testing %s [%s] with the settings of the test window %s", server.Address, server.displayName(), name)
+		if tw.window.Length != "" {
+			settings.length = tw.window.Length
+		}
+		if tw.window.Parallel != "" {
+			settings.parallel = tw.window.Parallel
+		}
+		if tw.window.BandwidthCap != "" {
+			server.BandwidthCap = tw.window.BandwidthCap
+			settings.fullRateInterval = 0
+		}
+		server.Tags = withTag(server.Tags, "window", name)
+		return settings, server
+	}
+	return settings, server
+}
+
+// validateTestWindows checks every test window parses and its settings are valid.
+func validateTestWindows(windows []testWindow) []error {
+	var errs []error
+	for i, window := range windows {
+		name := maintenanceName(window.maintenanceWindow, i)
+		if _, err := parseMaintenanceWindow(window.maintenanceWindow); err != nil {
+			errs = append(errs, fmt.Errorf("test window %s: %v", name, err))
+		}
+		if window.Length != "" {
+			length, err := strconv.Atoi(window.Length)
+			if err != nil || length <= 0 {
+				errs = append(errs, fmt.Errorf("test window %s length must be a positive number of seconds, got %q", name, window.Length))
+			} else if omit, err := strconv.Atoi(cliFlags.omit); err == nil && omit >= length {
+				errs = append(errs, fmt.Errorf("omit must be shorter than the %ds length of test window %s, got %ds", length, name, omit))
+			}
+		}
+		if window.Parallel != "" && !validParallel(window.Parallel) {
+			errs = append(errs, fmt.Errorf("test window %s parallel must be a positive number of streams or auto, got %q", name, window.Parallel))
+		}
+		if window.BandwidthCap != "" && window.BandwidthCap != "0" && !bandwidthPattern.MatchString(window.BandwidthCap) {
+			errs = append(errs, fmt.Errorf("test window %s bandwidth-cap must be a number with an optional K, M or G suffix or 0, got %q", name, window.BandwidthCap))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// textfileConfig writes the latest results to a .prom file in the Prometheus text format, for the textfile
+// collector of a node_exporter already running on the host.
+type textfileConfig struct {
+	// Path is the file written after every cycle, in the directory passed to --collector.textfile.directory.
+	Path string `yaml:"path"`
+}
+
+// textfileSink keeps the latest value of every series and rewrites the whole file at the end of every cycle, so
+// the file always has the last result of every endpoint.
+type textfileSink struct {
+	path   string
+	mu     sync.Mutex
+	series map[string]string
+}
+
+var textfile *textfileSink
+
+// mergeTextfileFlags fills any textfile settings missing from the configuration file with the CLI values.
+func mergeTextfileFlags(tc *textfileConfig) {
+	if tc.Path == "" {
+		tc.Path = cliFlags.textfilePath
+	}
+}
+
+// validateTextfile checks the path has the extension the collector reads and its directory exists.
+func validateTextfile(tc textfileConfig) []error {
+	if tc.Path == "" {
+		return nil
+	}
+	var errs []error
+	if filepath.Ext(tc.Path) != ".prom" {
+		errs = append(errs, fmt.Errorf("textfile path must end in .prom for the node_exporter to read it, got %q", tc.Path))
+	}
+	if info, err := os.Stat(filepath.Dir(tc.Path)); err != nil || !info.IsDir() {
+		errs = append(errs, fmt.Errorf("textfile directory %s doesn't exist", filepath.Dir(tc.Path)))
+	}
+	return errs
+}
+
+// initTextfile sets up the textfile sink if a path was configured.
+func initTextfile(tc textfileConfig) {
+	if tc.Path == "" {
+		return
+	}
+	textfile = &textfileSink{path: tc.Path, series: make(map[string]string)}
+	log.Debugf("[Config] Textfile = %s", tc.Path)
+}
+
+// add stores the measurement as the latest value of its series, labeled with its endpoint.
+func (t *textfileSink) add(m measurement) {
+	series := promSeries(m, unitOf("textfile"), map[string]string{"endpoint": m.Destination})
+	t.mu.Lock()
+	t.series[series] = m.formattedValue("textfile")
+	t.mu.Unlock()
+}
+
+// flush writes the series to a temporary file next to the .prom file and renames it over it, so the collector
+// never reads a half written file.
+func (t *textfileSink) flush() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.series) == 0 {
+		return
+	}
+	body := promExposition(t.series)
+	start := time.Now()
+	err := t.write(body)
+	auditWrite("textfile", t.path, len(body), start, err)
+	if err != nil {
+		log.Errorf("Error writing %d series to the textfile %s: %v", len(t.series), t.path, err)
+		return
+	}
+	log.Debugf("Wrote %d series to the textfile %s", len(t.series), t.path)
+}
+
+func (t *textfileSink) write(body []byte) error {
+	// the collector only reads .prom files so the temporary file is skipped
+	tmp, err := os.CreateTemp(filepath.Dir(t.path), "."+strings.TrimSuffix(filepath.Base(t.path), ".prom")+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), t.path)
+}
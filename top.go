@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// the ANSI sequences of the full screen view: the alternate screen, the cursor and clearing
+	ansiAltScreen   = "\x1b[?1049h"
+	ansiMainScreen  = "\x1b[?1049l"
+	ansiHideCursor  = "\x1b[?25l"
+	ansiShowCursor  = "\x1b[?25h"
+	ansiHome        = "\x1b[H\x1b[2J"
+	ansiBold        = "\x1b[1m"
+	ansiRed         = "\x1b[31m"
+	ansiReset       = "\x1b[0m"
+	defaultTopAgent = "http://127.0.0.1:8080"
+)
+
+// topAction shows the live state of an agent from its API until interrupted, redrawing it every refresh.
+func topAction() error {
+	agent := strings.TrimSuffix(cliFlags.topAgent, "/")
+	if !strings.Contains(agent, "://") {
+		agent = "http://" + agent
+	}
+	refresh := seconds(cliFlags.topRefresh)
+	if refresh <= 0 {
+		return fmt.Errorf("refresh must be a positive number of seconds, got %q", cliFlags.topRefresh)
+	}
+	client := &http.Client{Timeout: 5 * time.Second}
+	// the first read fails fast on a wrong address instead of drawing an empty screen
+	current, err := fetchStatus(client, agent)
+	fetched := time.Now()
+	if err != nil {
+		return fmt.Errorf("could not read the agent status at %s, is it running with --api-listen? %v", agent, err)
+	}
+
+	fmt.Print(ansiAltScreen + ansiHideCursor)
+	defer fmt.Print(ansiShowCursor + ansiMainScreen)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	ticker := time.NewTicker(refresh)
+	defer ticker.Stop()
+	for {
+		fmt.Print(ansiHome + renderTop(agent, current, err, time.Since(fetched)))
+		select {
+		case <-signals:
+			return nil
+		case <-ticker.C:
+		}
+		var next agentStatus
+		if next, err = fetchStatus(client, agent); err == nil {
+			current, fetched = next, time.Now()
+		}
+	}
+}
+
+// fetchStatus reads the agent status from its API.
+func fetchStatus(client *http.Client, agent string) (agentStatus, error) {
+	var current agentStatus
+	resp, err := client.Get(agent + "/status")
+	if err != nil {
+		return current, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return current, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&current)
+	return current, err
+}
+
+// renderTop draws the status screen, since is the time since the status was read. A failed refresh keeps the last
+// status on screen under the error.
+func renderTop(agent string, current agentStatus, fetchErr error, since time.Duration) string {
+	var b strings.Builder
+	// the countdowns are on the agent's clock, which can be off from the local one
+	agentNow := current.Now.Add(since)
+	fmt.Fprintf(&b, "%scloud-bandwidth %s%s on %s (%s)  up %s  %d cycles\r\n", ansiBold, current.Version, ansiReset,
+		current.Hostname, agent, roundDuration(agentNow.Sub(current.Started)), current.Cycles)
+	if fetchErr != nil {
+		fmt.Fprintf(&b, "%sError refreshing the status: %v%s\r\n", ansiRed, fetchErr, ansiReset)
+	}
+	b.WriteString("\r\n")
+
+	if test := current.Testing; test != nil {
+		elapsed := agentNow.Sub(test.Started)
+		total := time.Duration(test.Length*test.Runs) * time.Second
+		fmt.Fprintf(&b, "Testing %s %s [%s]  %s\r\n", test.Direction, test.Address, test.Endpoint, progressBar(elapsed, total, 30))
+	} else {
+		b.WriteString("Idle\r\n")
+	}
+	groups := make([]string, 0, len(current.NextRuns))
+	for group := range current.NextRuns {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	for _, group := range groups {
+		wait := current.NextRuns[group].Sub(agentNow)
+		next := "due"
+		if wait > 0 {
+			next = "in " + roundDuration(wait)
+		}
+		fmt.Fprintf(&b, "Next %s cycle %s\r\n", group, next)
+	}
+	b.WriteString("\r\n")
+
+	fmt.Fprintf(&b, "%s%-24s %-22s %14s %14s %12s %7s %-11s%s\r\n", ansiBold, "ENDPOINT", "ADDRESS", "DOWNLOAD", "UPLOAD", "LAST RESULT", "ERRORS", "LAST ERROR", ansiReset)
+	for _, endpoint := range current.Endpoints {
+		var last time.Time
+		for _, result := range []*statusResult{endpoint.Download, endpoint.Upload} {
+			if result != nil && result.Timestamp.After(last) {
+				last = result.Timestamp
+			}
+		}
+		age := "-"
+		if !last.IsZero() {
+			age = roundDuration(agentNow.Sub(last)) + " ago"
+		}
+		lastError := endpoint.LastErrorClass
+		if lastError == "" {
+			lastError = "-"
+		}
+		line := fmt.Sprintf("%-24s %-22s %14s %14s %12s %7d %-11s", truncate(endpoint.Name, 24), truncate(endpoint.Address, 22),
+			formatStatusBps(endpoint.Download), formatStatusBps(endpoint.Upload), age, endpoint.Errors, lastError)
+		// an endpoint whose last error is newer than its last result is failing now
+		if endpoint.LastError != nil && endpoint.LastError.After(last) {
+			line = ansiRed + line + ansiReset
+		}
+		b.WriteString(line + "\r\n")
+	}
+	if len(current.Endpoints) == 0 {
+		b.WriteString("No results yet\r\n")
+	}
+	b.WriteString("\r\nCtrl-C to quit\r\n")
+	return b.String()
+}
+
+// formatStatusBps formats the bitrate of a result with a unit, - without one.
+func formatStatusBps(result *statusResult) string {
+	if result == nil {
+		return "-"
+	}
+	return formatRate(float64(result.Bps))
+}
+
+// progressBar draws the share of a test's expected duration that has elapsed.
+func progressBar(elapsed time.Duration, total time.Duration, width int) string {
+	if total <= 0 {
+		return roundDuration(elapsed)
+	}
+	filled := int(float64(width) * elapsed.Seconds() / total.Seconds())
+	if filled > width {
+		filled = width
+	}
+	if filled < 0 {
+		filled = 0
+	}
+	return fmt.Sprintf("[%s%s] %s / %s", strings.Repeat("#", filled), strings.Repeat(".", width-filled), roundDuration(elapsed), roundDuration(total))
+}
+
+// roundDuration formats a duration to the second.
+func roundDuration(d time.Duration) string {
+	if d < 0 {
+		d = 0
+	}
+	return d.Round(time.Second).String()
+}
+
+// truncate shortens a string to a column width.
+func truncate(s string, width int) string {
+	if len(s) <= width {
+		return s
+	}
+	return s[:width-1] + "~"
+}
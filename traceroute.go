@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultPathPrefix = "bandwidth.path_changed"
+
+// pathRecord is the last traced path to an endpoint.
+type pathRecord struct {
+	Address string    `json:"address"`
+	Name    string    `json:"name"`
+	Hops    []string  `json:"hops"`
+	Hash    string    `json:"hash"`
+	Changed bool      `json:"changed"`
+	Updated time.Time `json:"updated"`
+}
+
+// pathStore holds the last traced path per endpoint address, it is read concurrently by the API.
+var pathStore = struct {
+	sync.RWMutex
+	paths map[string]pathRecord
+}{paths: make(map[string]pathRecord)}
+
+// checkPath traces the route to an endpoint, records the hop list and emits a path_changed metric
+// that is 1 if the hops differ from the previous cycle.
+func checkPath(config configuration, settings runSettings, server perfServer) {
+	if settings.dryRun {
+		log.Infof("[DRY RUN] Would trace the path to %s -> %s", server.Address, strings.Join(tracerouteArgs(server.Address, ""), " "))
+		return
+	}
+	output, err := runCmdIn(server, tracerouteArgs(server.dialAddress(), server.bindAddress))
+	if err != nil {
+		log.Errorf("Error tracing the path to %s, verify traceroute is installed: %v", server.Address, err)
+		log.Debug(output)
+		return
+	}
+	hops := parseTraceroute(output)
+	hash := hashHops(hops)
+
+	pathStore.Lock()
+	previous, seen := pathStore.paths[server.Address]
+	changed := seen && previous.Hash != hash
+	pathStore.paths[server.Address] = pathRecord{
+		Address: server.Address,
+		Name:    server.displayName(),
+		Hops:    hops,
+		Hash:    hash,
+		Changed: changed,
+		Updated: time.Now(),
+	}
+	pathStore.Unlock()
+
+	value := 0.0
+	if changed {
+		value = 1
+		log.Warnf("Path to endpoint %s [%s] changed: %s -> %s", server.Address, server.displayName(),
+			strings.Join(previous.Hops, ","), strings.Join(hops, ","))
+	}
+	log.Debugf("Path to endpoint %s [%s] -> %s (%s)", server.Address, server.displayName(), strings.Join(hops, ","), hash)
+
+	recordMeasurement(config, settings, measurement{
+		Timestamp:   measurementTime(),
+		Source:      config.Hostname,
+		Destination: server.displayName(),
+		Address:     server.Address,
+		Prefix:      cliFlags.pathPrefix,
+		Metric:      "path_changed",
+		Value:       value,
+		Tags:        server.Tags,
+	})
+}
+
+// parseTraceroute extracts the responding address of each hop, "*" for hops that did not answer.
+// Both the traceroute and the Windows tracert output number each hop line.
+func parseTraceroute(output string) []string {
+	var hops []string
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] == "traceroute" {
+			continue
+		}
+		if _, err := fmt.Sscanf(fields[0], "%d", new(int)); err != nil {
+			continue
+		}
+		hop := "*"
+		for _, field := range fields[1:] {
+			if net.ParseIP(field) != nil {
+				hop = field
+				break
+			}
+		}
+		hops = append(hops, hop)
+	}
+	return hops
+}
+
+// hashHops returns a short stable hash of the responding hops. The hops that didn't answer are left out, a router
+// rate limiting its ICMP replies answers in one cycle and not the next without the path changing.
+func hashHops(hops []string) string {
+	var responding []string
+	for _, hop := range hops {
+		if hop != "*" {
+			responding = append(responding, hop)
+		}
+	}
+	sum := sha256.Sum256([]byte(strings.Join(responding, ",")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// currentPaths returns a copy of the traced paths for the API.
+func currentPaths() []pathRecord {
+	pathStore.RLock()
+	defer pathStore.RUnlock()
+	paths := make([]pathRecord, 0, len(pathStore.paths))
+	for _, record := range pathStore.paths {
+		paths = append(paths, record)
+	}
+	return paths
+}
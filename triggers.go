@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// the reasons of an event-driven test cycle, recorded as the trigger tag of its results
+	triggerAPI     = "api"
+	triggerConfig  = "config"
+	triggerNetwork = "network"
+	// networkSettle is how long the network has to be quiet after a change before it's compared, so a flapping
+	// link or a route table being rewritten triggers one cycle rather than one per message
+	networkSettle = 5 * time.Second
+	// networkPoll is how often the network is compared where there's no netlink to watch
+	networkPoll = 10 * time.Second
+)
+
+// networkProbes are the addresses the default routes are looked up to, no packets are sent to them.
+var networkProbes = []string{"192.0.2.1", "2001:db8::1"}
+
+// testTrigger is an out-of-band test cycle of all or some of the endpoints, run between the scheduled cycles.
+type testTrigger struct {
+	reason    string
+	endpoints []string
+}
+
+// testTriggers carries the triggered test cycles to the test loop, it is nil when the agent isn't running in a loop.
+var testTriggers chan testTrigger
+
+// eventTriggers are the events enabled with --event-triggers.
+var eventTriggers = map[string]bool{}
+
+// parseEventTriggers reads a comma separated list of the events that trigger a test cycle.
+func parseEventTriggers(value string) (map[string]bool, error) {
+	events := map[string]bool{}
+	for _, event := range strings.Split(value, ",") {
+		event = strings.TrimSpace(event)
+		switch event {
+		case "":
+		case triggerAPI, triggerConfig, triggerNetwork:
+			events[event] = true
+		default:
+			return nil, fmt.Errorf("event-triggers must be a list of api, config and network, got %q", event)
+		}
+	}
+	return events, nil
+}
+
+// validateEventTriggers checks the events and that the config trigger has a configuration file or config source to
+// watch.
+func validateEventTriggers(config configuration) []error {
+	events, err := parseEventTriggers(cliFlags.eventTriggers)
+	if err != nil {
+		return []error{err}
+	}
+	var errs []error
+	if events[triggerConfig] && config.ConfigSource.URL == "" && !configFilePresent {
+		errs = append(errs, fmt.Errorf("the config event trigger needs a configuration file or a config-source to watch"))
+	}
+	if events[triggerAPI] && cliFlags.apiListen == "" {
+		errs = append(errs, fmt.Errorf("the api event trigger needs the agent API, pass an --api-listen address"))
+	}
+	return errs
+}
+
+// initTriggers lets tests be triggered when the agent runs in a loop, and starts watching the network if enabled.
+func initTriggers(loop bool) {
+	eventTriggers, _ = parseEventTriggers(cliFlags.eventTriggers)
+	if !loop {
+		if len(eventTriggers) > 0 {
+			log.Warnf("Event triggered test cycles only run when the agent tests in a loop, ignoring --event-triggers")
+		}
+		eventTriggers = map[string]bool{}
+		return
+	}
+	testTriggers = make(chan testTrigger, 1)
+	if len(eventTriggers) == 0 {
+		return
+	}
+	var events []string
+	for event := range eventTriggers {
+		events = append(events, event)
+	}
+	sort.Strings(events)
+	log.Infof("Running a test cycle on the %s events", strings.Join(events, ", "))
+	if eventTriggers[triggerNetwork] {
+		go watchNetwork()
+	}
+}
+
+// queueTrigger queues a triggered test cycle to run once the current one completes. One triggered cycle can be
+// pending at a time, a trigger arriving while one is pending is dropped as the pending cycle covers it.
+func queueTrigger(trigger testTrigger) bool {
+	if testTriggers == nil {
+		return false
+	}
+	select {
+	case testTriggers <- trigger:
+		log.Infof("Test cycle triggered by %s for %s", triggerLabel(trigger.reason), endpointsLabel(trigger.endpoints))
+		return true
+	default:
+		log.Debugf("Dropped the test cycle triggered by %s, a triggered cycle is already pending", triggerLabel(trigger.reason))
+		return false
+	}
+}
+
+// triggerEvent queues a test cycle of every endpoint if the event was enabled with --event-triggers.
+func triggerEvent(reason string) {
+	if eventTriggers[reason] {
+		queueTrigger(testTrigger{reason: reason})
+	}
+}
+
+// triggerLabel describes the reason of a triggered cycle in the logs.
+func triggerLabel(reason string) string {
+	switch reason {
+	case triggerConfig:
+		return "a config change"
+	case triggerNetwork:
+		return "a network change"
+	}
+	return "the API"
+}
+
+// triggerHandler serves POST /trigger on the agent API, the endpoint names or addresses to test are passed as
+// endpoint query parameters, every endpoint is tested if there are none.
+func triggerHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "a test cycle is triggered with a POST", http.StatusMethodNotAllowed)
+		return
+	}
+	endpoints := r.URL.Query()["endpoint"]
+	if testTriggers == nil {
+		http.Error(w, "the agent isn't running tests in a loop", http.StatusConflict)
+		return
+	}
+	if !queueTrigger(testTrigger{reason: triggerAPI, endpoints: endpoints}) {
+		http.Error(w, "a triggered test cycle is already pending", http.StatusTooManyRequests)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	writeJSON(w, map[string]string{"message": "the test cycle starts once the current one completes"})
+}
+
+// networkState describes the interfaces of the default routes, their state and addresses. The cycle is triggered
+// when it changes rather than on every link or route message, so the veth interfaces the container runtime adds
+// for every test don't trigger one.
+func networkState() string {
+	var state []string
+	for _, probe := range networkProbes {
+		iface, err := routeInterface(probe)
+		if err != nil || iface == nil {
+			state = append(state, "no route to "+probe)
+			continue
+		}
+		var addrs []string
+		if ifaceAddrs, err := iface.Addrs(); err == nil {
+			for _, addr := range ifaceAddrs {
+				addrs = append(addrs, addr.String())
+			}
+		}
+		sort.Strings(addrs)
+		if described := fmt.Sprintf("%s up=%t %s", iface.Name, iface.Flags&net.FlagUp != 0, strings.Join(addrs, ",")); !containsString(state, described) {
+			state = append(state, described)
+		}
+	}
+	return strings.Join(state, "; ")
+}
+
+// watchNetwork triggers a test cycle when the default route or the state of its interface changes.
+func watchNetwork() {
+	changes, err := networkChanges()
+	if err != nil {
+		log.Warnf("Could not watch the network with netlink, checking it every %s instead: %v", networkPoll, err)
+		ticker := time.NewTicker(networkPoll)
+		changes = ticker.C
+	}
+	state := networkState()
+	log.Debugf("[Config] Network = %s", state)
+	for range changes {
+		// wait for the network to settle
+		settle := time.NewTimer(networkSettle)
+		for settling := true; settling; {
+			select {
+			case <-changes:
+				if !settle.Stop() {
+					<-settle.C
+				}
+				settle.Reset(networkSettle)
+			case <-settle.C:
+				settling = false
+			}
+		}
+		current := networkState()
+		if current == state {
+			continue
+		}
+		log.Infof("The network changed from %s to %s", state, current)
+		state = current
+		triggerEvent(triggerNetwork)
+	}
+}
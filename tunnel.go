@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/proxy"
+)
+
+// tunnelConfig reaches an endpoint on a private network through a SOCKS5 proxy or an ssh jump host.
+type tunnelConfig struct {
+	// SOCKS5 is the host:port of a SOCKS5 proxy, Username and Password are used if it requires auth.
+	SOCKS5   string `yaml:"socks5" json:"socks5,omitempty"`
+	Username string `yaml:"username" json:"username,omitempty"`
+	Password string `yaml:"password" json:"password,omitempty"`
+	// JumpHost is an ssh bastion in the form [user@]host[:port], it uses the ssh key and known hosts settings.
+	JumpHost string `yaml:"jump-host" json:"jump-host,omitempty"`
+}
+
+// tunnel forwards the connections of the perf client from a local port to the endpoint.
+type tunnel struct {
+	listener net.Listener
+	dial     func(network string, address string) (net.Conn, error)
+	closer   io.Closer
+	target   string
+	wg       sync.WaitGroup
+}
+
+// validateTunnel checks a tunnel has exactly one way of reaching the endpoint.
+func validateTunnel(tc *tunnelConfig) error {
+	if tc == nil {
+		return nil
+	}
+	if (tc.SOCKS5 == "") == (tc.JumpHost == "") {
+		return fmt.Errorf("a tunnel needs either a socks5 proxy or a jump-host")
+	}
+	if tc.SOCKS5 != "" {
+		if _, _, err := net.SplitHostPort(tc.SOCKS5); err != nil {
+			return fmt.Errorf("the socks5 proxy must be host:port, got %q", tc.SOCKS5)
+		}
+	}
+	return nil
+}
+
+// openTunnel starts forwarding a local port to the endpoint's perf server and returns the local address.
+// Only engines whose client opens every connection to the server port can be tunneled, which excludes netperf.
+func openTunnel(server perfServer, eng engine) (*tunnel, error) {
+	tc := server.Tunnel
+	t := &tunnel{target: net.JoinHostPort(server.Address, server.serverPort(eng))}
+	if tc.SOCKS5 != "" {
+		var auth *proxy.Auth
+		if tc.Username != "" {
+			auth = &proxy.Auth{User: tc.Username, Password: tc.Password}
+		}
+		dialer, err := proxy.SOCKS5("tcp", tc.SOCKS5, auth, proxy.Direct)
+		if err != nil {
+			return nil, fmt.Errorf("could not set up the socks5 proxy %s: %v", tc.SOCKS5, err)
+		}
+		t.dial = dialer.Dial
+	} else {
+		user, hostPort := splitJumpHost(tc.JumpHost)
+		client, err := dialSSHAs(user, hostPort)
+		if err != nil {
+			return nil, fmt.Errorf("could not connect to the jump host %s: %v", tc.JumpHost, err)
+		}
+		t.dial = client.Dial
+		t.closer = client
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		if t.closer != nil {
+			t.closer.Close()
+		}
+		return nil, err
+	}
+	t.listener = listener
+	t.wg.Add(1)
+	go t.serve()
+	log.Debugf("[Tunnel] Forwarding %s to %s via %s", listener.Addr(), t.target, tunnelVia(tc))
+	return t, nil
+}
+
+// localAddress is the host and port the perf client connects to instead of the endpoint.
+func (t *tunnel) localAddress() (string, string) {
+	host, port, _ := net.SplitHostPort(t.listener.Addr().String())
+	return host, port
+}
+
+// serve accepts the perf client connections until the tunnel is closed.
+func (t *tunnel) serve() {
+	defer t.wg.Done()
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			return
+		}
+		t.wg.Add(1)
+		go func() {
+			defer t.wg.Done()
+			t.forward(conn)
+		}()
+	}
+}
+
+// forward copies a client connection to and from the endpoint until either side closes.
+func (t *tunnel) forward(local net.Conn) {
+	defer local.Close()
+	remote, err := t.dial("tcp", t.target)
+	if err != nil {
+		log.Errorf("Error connecting to %s through the tunnel: %v", t.target, err)
+		return
+	}
+	defer remote.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(remote, local)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(local, remote)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// close stops accepting connections, waits for the open ones and disconnects from the jump host.
+func (t *tunnel) close() {
+	t.listener.Close()
+	if t.closer != nil {
+		// closing the ssh client also ends any forwarded connections still open
+		t.closer.Close()
+	}
+	t.wg.Wait()
+	log.Debugf("[Tunnel] Closed the tunnel to %s", t.target)
+}
+
+// splitJumpHost splits [user@]host[:port], the ssh user and port settings are the defaults.
+func splitJumpHost(jumpHost string) (string, string) {
+	user := sshSettings.User
+	if i := strings.LastIndex(jumpHost, "@"); i >= 0 {
+		user = jumpHost[:i]
+		jumpHost = jumpHost[i+1:]
+	}
+	if host, port, err := splitHostOptionalPort(jumpHost); err == nil && port != "" {
+		return user, net.JoinHostPort(host, port)
+	} else if err == nil {
+		return user, net.JoinHostPort(host, sshSettings.Port)
+	}
+	return user, net.JoinHostPort(jumpHost, sshSettings.Port)
+}
+
+// tunnelVia describes how a tunnel reaches the endpoint for the logs.
+func tunnelVia(tc *tunnelConfig) string {
+	if tc.SOCKS5 != "" {
+		return "socks5 proxy " + tc.SOCKS5
+	}
+	return "jump host " + tc.JumpHost
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	unitBps  = "bps"
+	unitKbps = "Kbps"
+	unitMbps = "Mbps"
+	unitGbps = "Gbps"
+	// maxUnitPrecision is the most decimals a bandwidth is written with, a bit is the ninth decimal of a Gbps
+	maxUnitPrecision = 9
+)
+
+// bandwidthUnits are the divisors of the bandwidth units from bits per second, decimal as iperf reports them.
+var bandwidthUnits = map[string]float64{
+	unitBps:  1,
+	unitKbps: 1e3,
+	unitMbps: 1e6,
+	unitGbps: 1e9,
+}
+
+// unitSinks are the sinks the bandwidth is written to as a bare value, so the unit and precision can be chosen per
+// sink. The structured sinks such as the file output, Kafka and the gRPC API always carry the bps.
+var unitSinks = []string{"graphite", "influx", "netdata", "pushgateway", "textfile", "zabbix"}
+
+// unitsConfig chooses the unit and precision of the bandwidth results, for every sink or per sink.
+type unitsConfig struct {
+	// Unit is bps, Kbps, Mbps or Gbps, bps by default.
+	Unit string `yaml:"unit"`
+	// Precision is the number of decimals written, the full precision of the unit by default.
+	Precision string                     `yaml:"precision"`
+	Sinks     map[string]sinkUnitsConfig `yaml:"sinks"`
+}
+
+// sinkUnitsConfig overrides the unit and precision for a sink, the settings it leaves out are the shared ones.
+type sinkUnitsConfig struct {
+	Unit      string `yaml:"unit"`
+	Precision string `yaml:"precision"`
+}
+
+// bandwidthUnit is the unit and precision a sink writes the bandwidth results with.
+type bandwidthUnit struct {
+	name      string
+	divisor   float64
+	precision int
+}
+
+// defaultUnit writes the bandwidth as an integer bps.
+var defaultUnit = bandwidthUnit{name: unitBps, divisor: 1, precision: -1}
+
+// sinkUnits are the units of the sinks, by sink name. Sinks not in it write bps.
+var sinkUnits = map[string]bandwidthUnit{}
+
+// mergeUnitsFlags fills the shared unit and precision missing from the configuration file with the CLI values.
+func mergeUnitsFlags(uc *unitsConfig) {
+	if uc.Unit == "" {
+		uc.Unit = cliFlags.units
+	}
+	if uc.Precision == "" {
+		uc.Precision = cliFlags.unitPrecision
+	}
+}
+
+// parseUnit reads a unit name in any case and a precision, an empty precision is the full precision.
+func parseUnit(name string, precision string) (bandwidthUnit, error) {
+	unit := defaultUnit
+	if name != "" {
+		found := false
+		for canonical, divisor := range bandwidthUnits {
+			if strings.EqualFold(name, canonical) {
+				unit.name, unit.divisor, found = canonical, divisor, true
+			}
+		}
+		if !found {
+			return unit, fmt.Errorf("unit must be bps, Kbps, Mbps or Gbps, got %q", name)
+		}
+	}
+	if precision != "" {
+		p, err := strconv.Atoi(precision)
+		if err != nil || p < 0 || p > maxUnitPrecision {
+			return unit, fmt.Errorf("unit precision must be a number of decimals from 0 to %d, got %q", maxUnitPrecision, precision)
+		}
+		unit.precision = p
+	}
+	return unit, nil
+}
+
+// parseUnits resolves the unit of every sink from the shared and per sink settings.
+func parseUnits(uc unitsConfig) (map[string]bandwidthUnit, error) {
+	units := make(map[string]bandwidthUnit, len(unitSinks))
+	for sink := range uc.Sinks {
+		if !containsString(unitSinks, sink) {
+			return nil, fmt.Errorf("units can be set for the %s sinks, got %q", strings.Join(unitSinks, ", "), sink)
+		}
+	}
+	for _, sink := range unitSinks {
+		name, precision := uc.Unit, uc.Precision
+		if override, ok := uc.Sinks[sink]; ok {
+			if override.Unit != "" {
+				name = override.Unit
+			}
+			if override.Precision != "" {
+				precision = override.Precision
+			}
+		}
+		unit, err := parseUnit(name, precision)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", sink, err)
+		}
+		units[sink] = unit
+	}
+	return units, nil
+}
+
+// validateUnits checks the units and precisions.
+func validateUnits(uc unitsConfig) []error {
+	if _, err := parseUnits(uc); err != nil {
+		return []error{err}
+	}
+	return nil
+}
+
+// initUnits sets up the units of the sinks.
+func initUnits(uc unitsConfig) error {
+	units, err := parseUnits(uc)
+	if err != nil {
+		return err
+	}
+	sinkUnits = units
+	var names []string
+	for sink, unit := range units {
+		if unit != defaultUnit {
+			names = append(names, sink+"="+unit.String())
+		}
+	}
+	sort.Strings(names)
+	if len(names) > 0 {
+		log.Debugf("[Config] Units = %s", strings.Join(names, ", "))
+	}
+	return nil
+}
+
+// unitOf returns the unit a sink writes the bandwidth results with.
+func unitOf(sink string) bandwidthUnit {
+	if unit, ok := sinkUnits[sink]; ok {
+		return unit
+	}
+	return defaultUnit
+}
+
+// format writes a bandwidth in bps in the unit, an integer bps is written as is.
+func (u bandwidthUnit) format(bps int64) string {
+	if u.divisor == 1 && u.precision <= 0 {
+		return strconv.FormatInt(bps, 10)
+	}
+	return strconv.FormatFloat(float64(bps)/u.divisor, 'f', u.precision, 64)
+}
+
+// grafanaUnit is the Grafana data rate unit of the panels showing the bandwidth.
+func (u bandwidthUnit) grafanaUnit() string {
+	if u.name == unitBps {
+		return "bps"
+	}
+	return strings.TrimSuffix(u.name, "ps") + "its"
+}
+
+// String is the unit with its precision as it's shown in the debug logs.
+func (u bandwidthUnit) String() string {
+	if u.precision < 0 {
+		return u.name
+	}
+	return fmt.Sprintf("%s/%d", u.name, u.precision)
+}
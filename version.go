@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// build metadata injected with ldflags, for example:
+//
+//	go build -ldflags "-X main.version=v1.2.0 -X main.commit=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// buildCommit returns the injected git commit, falling back to the revision embedded by the go toolchain.
+func buildCommit() string {
+	if commit != "" {
+		return commit
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" && len(setting.Value) >= 7 {
+				return setting.Value[:7]
+			}
+		}
+	}
+	return "unknown"
+}
+
+// printVersion prints the version and build metadata.
+func printVersion(name string) {
+	date := buildDate
+	if date == "" {
+		date = "unknown"
+	}
+	fmt.Printf("%s version %s\n", name, version)
+	fmt.Printf("  commit:     %s\n", buildCommit())
+	fmt.Printf("  build date: %s\n", date)
+	fmt.Printf("  go version: %s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	vpnWireGuard = "wireguard"
+	vpnOpenVPN   = "openvpn"
+	vpnIPsec     = "ipsec"
+	// vpnTun is any other TUN/TAP interface, OpenVPN on Linux among others.
+	vpnTun = "tun"
+
+	// underlayPrefix is appended to the prefixes of the results to an endpoint's underlay-address.
+	underlayPrefix = ".underlay"
+)
+
+// sysClassNet is where Linux describes the network interfaces.
+var sysClassNet = "/sys/class/net"
+
+// routeInterface returns the interface the route to an address leaves through. Connecting a UDP socket picks the
+// route without sending anything.
+func routeInterface(address string) (*net.Interface, error) {
+	conn, err := net.Dial("udp", net.JoinHostPort(address, "9"))
+	if err != nil {
+		return nil, err
+	}
+	local := conn.LocalAddr().(*net.UDPAddr).IP
+	conn.Close()
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for i := range ifaces {
+		addrs, err := ifaces[i].Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(local) {
+				return &ifaces[i], nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// vpnType classifies an interface as a WireGuard, OpenVPN, IPsec or other TUN/TAP tunnel, empty if it isn't one.
+// Linux reports WireGuard and TUN devices in sysfs, other platforms are recognized by the interface name. Policy
+// based IPsec without a VTI or XFRM interface routes through the physical interface and isn't detected.
+func vpnType(iface *net.Interface) string {
+	name := strings.ToLower(iface.Name)
+	if uevent, err := os.ReadFile(filepath.Join(sysClassNet, iface.Name, "uevent")); err == nil {
+		switch {
+		case strings.Contains(string(uevent), "DEVTYPE=wireguard"):
+			return vpnWireGuard
+		case strings.Contains(string(uevent), "DEVTYPE=xfrm"), strings.Contains(string(uevent), "DEVTYPE=vti"):
+			return vpnIPsec
+		}
+	}
+	switch {
+	case strings.HasPrefix(name, "wg"), strings.Contains(name, "wireguard"):
+		return vpnWireGuard
+	case strings.Contains(name, "openvpn"), strings.Contains(name, "tap-windows"):
+		return vpnOpenVPN
+	case strings.HasPrefix(name, "ipsec"), strings.HasPrefix(name, "vti"), strings.HasPrefix(name, "xfrm"):
+		return vpnIPsec
+	case strings.HasPrefix(name, "tun"), strings.HasPrefix(name, "tap"), strings.HasPrefix(name, "utun"):
+		return vpnTun
+	}
+	if _, err := os.Stat(filepath.Join(sysClassNet, iface.Name, "tun_flags")); err == nil {
+		return vpnTun
+	}
+	return ""
+}
+
+// tagVPN tags an endpoint tested through a VPN interface with the interface name as vpn and its kind as vpn_type.
+func tagVPN(server perfServer) perfServer {
+	if server.Tunnel != nil {
+		// the route leads to the bastion rather than the endpoint
+		return server
+	}
+	iface, err := routeInterface(server.dialAddress())
+	if err != nil {
+		log.Debugf("Could not look up the route to %s [%s]: %v", server.Address, server.displayName(), err)
+		return server
+	}
+	if iface == nil {
+		return server
+	}
+	kind := vpnType(iface)
+	if kind == "" {
+		return server
+	}
+	log.Debugf("The route to %s [%s] goes through the %s interface %s", server.Address, server.displayName(), kind, iface.Name)
+	server.Tags = withTag(withTag(server.Tags, "vpn", iface.Name), "vpn_type", kind)
+	return server
+}
+
+// measureOverlayOverhead tests an endpoint again at its underlay-address, the same endpoint reached outside the
+// VPN, and records how much slower the overlay is under <prefix>.overlay_overhead in bps and
+// <prefix>.overlay_overhead_pct in percent of the underlay. The underlay runs at the bandwidth of the overlay test.
+func measureOverlayOverhead(config configuration, settings runSettings, client engineClient, server perfServer, results cycleResults) {
+	eng := client.engine
+	if server.Tunnel != nil {
+		log.Debugf("Skipping the underlay test to %s [%s], it is only run against endpoints reached directly", server.UnderlayAddress, server.displayName())
+		return
+	}
+	underlay := server
+	underlay.Address, underlay.resolvedIP = server.UnderlayAddress, ""
+	underlay.Tags = make(map[string]string, len(server.Tags))
+	for k, v := range server.Tags {
+		if k != "vpn" && k != "vpn_type" {
+			underlay.Tags[k] = v
+		}
+	}
+	if settings.vpnDetect {
+		if underlay = tagVPN(underlay); underlay.Tags["vpn"] != "" {
+			log.Warnf("The underlay-address %s of %s also goes through the VPN interface %s", underlay.Address, server.displayName(), underlay.Tags["vpn"])
+		}
+	}
+
+	if eng.prepare != nil && settings.dryRun {
+		log.Infof("[DRY RUN] Would prepare the %s test to %s", eng.name, underlay.Address)
+	} else if eng.prepare != nil {
+		cleanup, err := eng.prepare(eng, underlay)
+		if err != nil {
+			log.Errorf("Error preparing the %s underlay test to %s: %v", eng.name, underlay.Address, err)
+			return
+		}
+		defer cleanup()
+	}
+
+	// the underlay results are kept apart and out of the anomaly baselines
+	test := settings
+	test.downloadPrefix += underlayPrefix
+	test.uploadPrefix += underlayPrefix
+	test.anomalyDrop = 0
+	for _, direction := range []string{directionDownload, directionUpload} {
+		overlay, ok := results.get(profileName(server), direction)
+		if !ok {
+			continue
+		}
+		bps, ok := runPerfTest(config, test, client, underlay, direction, overlay.bandwidth)
+		if !ok {
+			continue
+		}
+		prefix := settings.downloadPrefix
+		if direction == directionUpload {
+			prefix = settings.uploadPrefix
+		}
+		overhead := bps - overlay.bps
+		server.runID = newRunID()
+		log.Infof("%s overlay overhead for endpoint %s [%s] -> %d bps through the VPN vs %d bps at %s (run %s)", strings.Title(direction), server.Address, server.displayName(), overlay.bps, bps, underlay.Address, server.runID)
+		recordTestMetric(config, settings, eng, server, direction, prefix, "overlay_overhead", float64(overhead))
+		if bps > 0 {
+			recordTestMetric(config, settings, eng, server, direction, prefix, "overlay_overhead_pct", float64(overhead)/float64(bps)*100)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	defaultWebhookRetries = 3
+	// webhookSignatureHeader carries the HMAC-SHA256 of the timestamp and body, webhookTimestampHeader the
+	// timestamp so a receiver can reject replayed requests.
+	webhookSignatureHeader = "X-Cbandwidth-Signature"
+	webhookTimestampHeader = "X-Cbandwidth-Timestamp"
+)
+
+// webhookConfig posts the measurements as JSON to HTTP consumers that have no dedicated sink.
+type webhookConfig struct {
+	URLs []string `yaml:"urls"`
+	// Batch posts the measurements of a cycle as one JSON array instead of one request per measurement.
+	Batch bool `yaml:"batch"`
+	// Headers are added to every request, their values are templates of the request such as {{.Source}}.
+	Headers map[string]string `yaml:"headers"`
+	// Secret signs every request body with HMAC-SHA256.
+	Secret string `yaml:"secret"`
+	// Retries is how often a request that failed on the consumer's side or in transit is sent again.
+	Retries *int `yaml:"retries"`
+}
+
+// webhookRequest is the data the header templates are rendered with.
+type webhookRequest struct {
+	Source       string
+	Count        int
+	Timestamp    time.Time
+	Measurements []measurement
+}
+
+// webhookStatusError is a response other than 2xx from a webhook consumer.
+type webhookStatusError struct {
+	code       int
+	status     string
+	retryAfter time.Duration
+}
+
+func (e webhookStatusError) Error() string {
+	return fmt.Sprintf("unexpected status %s", e.status)
+}
+
+// webhookSink buffers the measurements of a cycle and posts them to every URL when the cycle ends.
+type webhookSink struct {
+	config  webhookConfig
+	headers map[string]*template.Template
+	retries int
+	client  *http.Client
+	mu      sync.Mutex
+	pending []measurement
+}
+
+var webhook *webhookSink
+
+// mergeWebhookFlags fills any webhook settings missing from the configuration file with the CLI values.
+func mergeWebhookFlags(wc *webhookConfig) {
+	if len(wc.URLs) == 0 && cliFlags.webhookURL != "" {
+		wc.URLs = strings.Split(cliFlags.webhookURL, ",")
+	}
+	if wc.Secret == "" {
+		wc.Secret = cliFlags.webhookSecret
+	}
+	if cliFlags.webhookBatch {
+		wc.Batch = true
+	}
+}
+
+// parseWebhookHeaders parses the header templates.
+func parseWebhookHeaders(headers map[string]string) (map[string]*template.Template, error) {
+	parsed := make(map[string]*template.Template, len(headers))
+	for name, value := range headers {
+		tmpl, err := template.New(name).Option("missingkey=error").Parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("webhook header %s: %v", name, err)
+		}
+		parsed[name] = tmpl
+	}
+	return parsed, nil
+}
+
+// validateWebhook checks the webhook URLs, header templates and retries.
+func validateWebhook(wc webhookConfig) []error {
+	var errs []error
+	for _, rawURL := range wc.URLs {
+		if u, err := url.Parse(strings.TrimSpace(rawURL)); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("webhook URL must be an http or https URL, got %q", rawURL))
+		}
+	}
+	if _, err := parseWebhookHeaders(wc.Headers); err != nil {
+		errs = append(errs, err)
+	}
+	if wc.Retries != nil && *wc.Retries < 0 {
+		errs = append(errs, fmt.Errorf("webhook retries must be zero or a positive number, got %d", *wc.Retries))
+	}
+	return errs
+}
+
+// initWebhook sets up the webhook sink if any URLs were configured.
+func initWebhook(wc webhookConfig) error {
+	if len(wc.URLs) == 0 {
+		return nil
+	}
+	headers, err := parseWebhookHeaders(wc.Headers)
+	if err != nil {
+		return err
+	}
+	for i := range wc.URLs {
+		wc.URLs[i] = strings.TrimSpace(wc.URLs[i])
+	}
+	retries := defaultWebhookRetries
+	if wc.Retries != nil {
+		retries = *wc.Retries
+	}
+	webhook = &webhookSink{
+		config:  wc,
+		headers: headers,
+		retries: retries,
+		client:  &http.Client{Timeout: 30 * time.Second, Transport: &http.Transport{Proxy: http.ProxyFromEnvironment}},
+	}
+	for _, u := range wc.URLs {
+		log.Debugf("[Config] Webhook URL = %s", redactRawURL(u))
+	}
+	log.Debugf("[Config] Webhook Batch = %t, Signed = %t, Retries = %d", wc.Batch, wc.Secret != "", retries)
+	return nil
+}
+
+// redactRawURL redacts a URL for the log, its query can carry tokens.
+func redactRawURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return redactURL(u)
+}
+
+// add buffers a measurement until the end of the cycle.
+func (w *webhookSink) add(m measurement) {
+	w.mu.Lock()
+	w.pending = append(w.pending, m)
+	w.mu.Unlock()
+}
+
+// flush posts the buffered measurements to every URL, as one array in batch mode or one object per measurement.
+func (w *webhookSink) flush() {
+	w.mu.Lock()
+	batch := w.pending
+	w.pending = nil
+	w.mu.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+	if w.config.Batch {
+		body, err := json.Marshal(batch)
+		if err != nil {
+			log.Errorf("Error encoding the measurements for the webhook: %v", err)
+			return
+		}
+		w.post(batch, body)
+		return
+	}
+	for _, m := range batch {
+		body, err := json.Marshal(m)
+		if err != nil {
+			log.Errorf("Error encoding the measurement for the webhook: %v", err)
+			continue
+		}
+		w.post([]measurement{m}, body)
+	}
+}
+
+// post sends a body to every URL, each consumer gets every request.
+func (w *webhookSink) post(batch []measurement, body []byte) {
+	data := webhookRequest{Source: batch[0].Source, Count: len(batch), Timestamp: time.Now(), Measurements: batch}
+	headers := make(http.Header)
+	for name, tmpl := range w.headers {
+		var value bytes.Buffer
+		if err := tmpl.Execute(&value, data); err != nil {
+			log.Errorf("Error rendering the webhook header %s: %v", name, err)
+			continue
+		}
+		headers.Set(name, value.String())
+	}
+	if w.config.Secret != "" {
+		timestamp := strconv.FormatInt(data.Timestamp.Unix(), 10)
+		headers.Set(webhookTimestampHeader, timestamp)
+		headers.Set(webhookSignatureHeader, "sha256="+webhookSignature(w.config.Secret, timestamp, body))
+	}
+	for _, u := range w.config.URLs {
+		w.send(u, headers, body, len(batch))
+	}
+}
+
+// send posts a body to a URL and retries it when the consumer couldn't be reached or failed on its side, after
+// the pause of a Retry-After header if it sent one.
+func (w *webhookSink) send(rawURL string, headers http.Header, body []byte, count int) {
+	target := redactRawURL(rawURL)
+	backoff := influxRetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := w.request(rawURL, headers, body)
+		if err == nil {
+			log.Debugf("Posted %d measurements to the webhook at %s", count, target)
+			return
+		}
+		status, isStatus := err.(webhookStatusError)
+		retryable := !isStatus || status.code == http.StatusTooManyRequests || status.code >= 500
+		if attempt >= w.retries || !retryable {
+			log.Errorf("Error posting %d measurements to the webhook at %s: %v", count, target, err)
+			return
+		}
+		pause := backoff
+		if isStatus && status.retryAfter > 0 {
+			pause = status.retryAfter
+		}
+		log.Warnf("Retrying the post to the webhook at %s in %s: %v", target, pause, err)
+		time.Sleep(pause)
+		backoff *= 2
+	}
+}
+
+// request sends a single webhook request.
+func (w *webhookSink) request(rawURL string, headers http.Header, body []byte) error {
+	req, err := http.NewRequest("POST", rawURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, values := range headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := auditedDo(w.client, "webhook", req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return webhookStatusError{code: resp.StatusCode, status: resp.Status, retryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+	}
+	return nil
+}
+
+// webhookSignature is the hex HMAC-SHA256 of the timestamp, a dot and the body, keyed with the secret.
+func webhookSignature(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	defaultZabbixPort = "10051"
+	// defaultZabbixKey is the trapper item key of a measurement, e.g. cbandwidth.bps[azure,download].
+	defaultZabbixKey = "cbandwidth.{{.Metric}}[{{param .Destination}},{{.Direction}}]"
+	// defaultZabbixHost is the host in Zabbix the items belong to, the agent that measured them.
+	defaultZabbixHost = "{{.Source}}"
+	zabbixTimeout     = 30 * time.Second
+)
+
+// zabbixProcessed matches the counts in the info of a sender response, processed: 3; failed: 0; total: 3.
+var zabbixProcessed = regexp.MustCompile(`processed: (\d+); failed: (\d+)`)
+
+// zabbixConfig sends the measurements to trapper items with the Zabbix sender protocol.
+type zabbixConfig struct {
+	// Server is the Zabbix server or proxy as host[:port], 10051 by default.
+	Server string `yaml:"server"`
+	// Host and Key are templates of the host and item key of a measurement, with the fields of the measurement
+	// and param quoting an item key parameter.
+	Host string `yaml:"host"`
+	Key  string `yaml:"key"`
+	// DiscoveryKey optionally sends the endpoints and directions to a low-level discovery rule, so the items can
+	// be created from item prototypes with the {#ENDPOINT}, {#ADDRESS}, {#DIRECTION} and {#METRIC} macros.
+	DiscoveryKey string `yaml:"discovery-key"`
+}
+
+// zabbixItem is the data the host and key templates are rendered with, Metric is bps for bandwidth results.
+type zabbixItem struct {
+	Source      string
+	Destination string
+	Address     string
+	Direction   string
+	Engine      string
+	Metric      string
+	Tags        map[string]string
+}
+
+// zabbixValue is a value in a sender request.
+type zabbixValue struct {
+	Host  string `json:"host"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Clock int64  `json:"clock"`
+	NS    int    `json:"ns"`
+}
+
+// zabbixSink batches the values of a cycle and sends them in one sender request when the cycle ends.
+type zabbixSink struct {
+	config     zabbixConfig
+	address    string
+	host       *template.Template
+	key        *template.Template
+	mu         sync.Mutex
+	pending    []zabbixValue
+	discovered map[string]map[string]map[string]string
+}
+
+var zabbix *zabbixSink
+
+// mergeZabbixFlags fills any Zabbix settings missing from the configuration file with the CLI values.
+func mergeZabbixFlags(zc *zabbixConfig) {
+	if zc.Server == "" {
+		zc.Server = cliFlags.zabbixServer
+	}
+	if zc.Host == "" {
+		zc.Host = cliFlags.zabbixHost
+	}
+}
+
+// parseZabbixTemplates parses the host and item key templates, the defaults are used for empty ones.
+func parseZabbixTemplates(zc zabbixConfig) (*template.Template, *template.Template, error) {
+	funcs := template.FuncMap{"param": zabbixParam}
+	hostText, keyText := zc.Host, zc.Key
+	if hostText == "" {
+		hostText = defaultZabbixHost
+	}
+	if keyText == "" {
+		keyText = defaultZabbixKey
+	}
+	host, err := template.New("host").Funcs(funcs).Option("missingkey=zero").Parse(hostText)
+	if err != nil {
+		return nil, nil, fmt.Errorf("zabbix host template: %v", err)
+	}
+	key, err := template.New("key").Funcs(funcs).Option("missingkey=zero").Parse(keyText)
+	if err != nil {
+		return nil, nil, fmt.Errorf("zabbix key template: %v", err)
+	}
+	return host, key, nil
+}
+
+// zabbixParam quotes an item key parameter if it has a character with a meaning in keys.
+func zabbixParam(value string) string {
+	if !strings.ContainsAny(value, ",[]\" ") && !strings.HasPrefix(value, "\"") {
+		return value
+	}
+	return "\"" + strings.ReplaceAll(value, "\"", "\\\"") + "\""
+}
+
+// validateZabbix checks the server address and the templates.
+func validateZabbix(zc zabbixConfig) []error {
+	if zc.Server == "" {
+		return nil
+	}
+	var errs []error
+	if _, _, err := net.SplitHostPort(zabbixAddress(zc.Server)); err != nil {
+		errs = append(errs, fmt.Errorf("zabbix server must be a host with an optional port, got %q", zc.Server))
+	}
+	if _, _, err := parseZabbixTemplates(zc); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// zabbixAddress adds the default port to a server without one.
+func zabbixAddress(server string) string {
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server
+	}
+	return net.JoinHostPort(strings.Trim(server, "[]"), defaultZabbixPort)
+}
+
+// initZabbix sets up the Zabbix sink if a server was configured.
+func initZabbix(zc zabbixConfig) error {
+	if zc.Server == "" {
+		return nil
+	}
+	host, key, err := parseZabbixTemplates(zc)
+	if err != nil {
+		return err
+	}
+	zabbix = &zabbixSink{
+		config:     zc,
+		address:    zabbixAddress(zc.Server),
+		host:       host,
+		key:        key,
+		discovered: make(map[string]map[string]map[string]string),
+	}
+	log.Debugf("[Config] Zabbix = %s", zabbix.address)
+	return nil
+}
+
+// add renders the host and item key of a measurement and buffers its value until the end of the cycle.
+func (z *zabbixSink) add(m measurement) {
+	item := zabbixItem{
+		Source:      m.Source,
+		Destination: m.Destination,
+		Address:     m.Address,
+		Direction:   m.Direction,
+		Engine:      m.Engine,
+		Metric:      m.Metric,
+		Tags:        m.Tags,
+	}
+	if item.Metric == "" {
+		item.Metric = strings.ToLower(unitOf("zabbix").name)
+	}
+	var host, key bytes.Buffer
+	if err := z.host.Execute(&host, item); err != nil {
+		log.Errorf("Error rendering the zabbix host of %s: %v", m.Destination, err)
+		return
+	}
+	if err := z.key.Execute(&key, item); err != nil {
+		log.Errorf("Error rendering the zabbix item key of %s: %v", m.Destination, err)
+		return
+	}
+	value := zabbixValue{
+		Host:  host.String(),
+		Key:   key.String(),
+		Value: m.formattedValue("zabbix"),
+		Clock: m.Timestamp.Unix(),
+		NS:    m.Timestamp.Nanosecond(),
+	}
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.pending = append(z.pending, value)
+	if z.config.DiscoveryKey != "" {
+		hosts, ok := z.discovered[value.Host]
+		if !ok {
+			hosts = make(map[string]map[string]string)
+			z.discovered[value.Host] = hosts
+		}
+		hosts[value.Key] = map[string]string{
+			"{#ENDPOINT}":  m.Destination,
+			"{#ADDRESS}":   m.Address,
+			"{#DIRECTION}": m.Direction,
+			"{#METRIC}":    item.Metric,
+		}
+	}
+}
+
+// flush sends the buffered values, preceded by the discovery data of every host if a discovery key is set. The
+// discovery is sent every cycle since Zabbix removes the items that stop being discovered.
+func (z *zabbixSink) flush() {
+	z.mu.Lock()
+	batch := z.pending
+	z.pending = nil
+	var discovery []zabbixValue
+	now := time.Now()
+	for host, items := range z.discovered {
+		keys := make([]string, 0, len(items))
+		for key := range items {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		rows := make([]map[string]string, 0, len(keys))
+		for _, key := range keys {
+			rows = append(rows, items[key])
+		}
+		data, _ := json.Marshal(rows)
+		discovery = append(discovery, zabbixValue{Host: host, Key: z.config.DiscoveryKey, Value: string(data), Clock: now.Unix(), NS: now.Nanosecond()})
+	}
+	z.mu.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+	if len(discovery) > 0 {
+		if err := z.send(discovery); err != nil {
+			log.Errorf("Error sending the discovery data to the zabbix server at %s: %v", z.address, err)
+		}
+	}
+	if err := z.send(batch); err != nil {
+		log.Errorf("Error sending %d values to the zabbix server at %s: %v", len(batch), z.address, err)
+		return
+	}
+	log.Debugf("Sent %d values to the zabbix server at %s", len(batch), z.address)
+}
+
+// send makes a sender request and checks every value was processed, values of items that don't exist or aren't
+// trapper items are counted as failed by the server.
+func (z *zabbixSink) send(values []zabbixValue) error {
+	body, err := json.Marshal(map[string]interface{}{"request": "sender data", "data": values})
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = z.exchange(body)
+	auditWrite("zabbix", z.address, len(body), start, err)
+	return err
+}
+
+// exchange sends a request framed with the ZBXD header and reads the response.
+func (z *zabbixSink) exchange(body []byte) error {
+	conn, err := net.DialTimeout("tcp", z.address, zabbixTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(zabbixTimeout))
+
+	header := make([]byte, 13)
+	copy(header, "ZBXD\x01")
+	binary.LittleEndian.PutUint64(header[5:], uint64(len(body)))
+	if _, err := conn.Write(append(header, body...)); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return fmt.Errorf("no response: %v", err)
+	}
+	if string(header[:4]) != "ZBXD" {
+		return fmt.Errorf("invalid response header %q", header[:5])
+	}
+	length := binary.LittleEndian.Uint64(header[5:])
+	if length > 1<<20 {
+		return fmt.Errorf("response of %d bytes is too long", length)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(conn, data); err != nil {
+		return fmt.Errorf("incomplete response: %v", err)
+	}
+	var resp struct {
+		Response string `json:"response"`
+		Info     string `json:"info"`
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return fmt.Errorf("invalid response: %v", err)
+	}
+	if resp.Response != "success" {
+		return fmt.Errorf("the server responded %s: %s", resp.Response, resp.Info)
+	}
+	if match := zabbixProcessed.FindStringSubmatch(resp.Info); match != nil && match[2] != "0" {
+		return fmt.Errorf("%s values failed, check the items exist as trapper items on the hosts: %s", match[2], resp.Info)
+	}
+	return nil
+}